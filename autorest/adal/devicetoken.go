@@ -24,11 +24,13 @@ package adal
 */
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -56,6 +58,10 @@ var (
 	// ErrDeviceCodeEmpty represents an empty device code from the device endpoint while using device flow
 	ErrDeviceCodeEmpty = fmt.Errorf("%s Error while retrieving device code: Device Code Empty", logPrefix)
 
+	// ErrDeviceRefreshTokenMissing represents a token without a refresh token from the token endpoint
+	// while using device flow, returned when the DeviceCode requires a refresh token
+	ErrDeviceRefreshTokenMissing = fmt.Errorf("%s Error while retrieving OAuth token: Refresh Token Missing", logPrefix)
+
 	// ErrOAuthTokenEmpty represents an empty OAuth token from the token endpoint when using device flow
 	ErrOAuthTokenEmpty = fmt.Errorf("%s Error while retrieving OAuth token: Token Empty", logPrefix)
 
@@ -66,6 +72,23 @@ var (
 	errStatusNotOK        = "Error HTTP status != 200"
 )
 
+const (
+	// defaultDeviceInterval is the polling interval, in seconds, used when the device endpoint
+	// does not specify one (see RFC 8628 section 3.2).
+	defaultDeviceInterval = 5
+
+	// maxDeviceInterval is the longest polling interval, in seconds, accepted from the device endpoint.
+	maxDeviceInterval = 60
+
+	// deviceSlowDownIncrement is the number of seconds added to the polling interval each time the
+	// token endpoint responds with slow_down (see RFC 8628 section 3.5).
+	deviceSlowDownIncrement = 5
+
+	// maxDeviceExpiresIn is the longest lifetime, in seconds, of a device code accepted from the
+	// device endpoint.
+	maxDeviceExpiresIn = 60 * 60
+)
+
 // DeviceCode is the object returned by the device auth endpoint
 // It contains information to instruct the user to complete the auth flow
 type DeviceCode struct {
@@ -79,6 +102,38 @@ type DeviceCode struct {
 	Resource    string  // store the following, stored when initiating, used when exchanging
 	OAuthConfig OAuthConfig
 	ClientID    string
+
+	// RequireRefreshToken, when true, causes the completion of the device flow to fail with
+	// ErrDeviceRefreshTokenMissing if the token endpoint does not return a refresh token. Otherwise
+	// such tokens are returned and Token.IsRefreshable reports false for them.
+	RequireRefreshToken bool `json:"-"`
+}
+
+// devicePollUnit is the unit of DeviceCode.Interval; it is shortened by tests.
+var devicePollUnit = time.Second
+
+// UnmarshalJSON implements the json.Unmarshaler interface for DeviceCode. An empty interval is
+// treated as absent, and the interval is accepted either as a string or as a number.
+func (dc *DeviceCode) UnmarshalJSON(data []byte) error {
+	type deviceCode DeviceCode
+	aux := struct {
+		*deviceCode
+		Interval json.RawMessage `json:"interval,omitempty"`
+	}{deviceCode: (*deviceCode)(dc)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	dc.Interval = nil
+	raw := strings.Trim(string(aux.Interval), `"`)
+	if raw == "" || raw == "null" {
+		return nil
+	}
+	interval, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return fmt.Errorf("interval %s is not an integer", aux.Interval)
+	}
+	dc.Interval = &interval
+	return nil
 }
 
 // TokenError is the object returned by the token exchange endpoint
@@ -99,6 +154,15 @@ type deviceToken struct {
 	TokenError
 }
 
+// UnmarshalJSON implements the json.Unmarshaler interface. It is required as the method promoted
+// from the embedded Token would otherwise leave TokenError unpopulated.
+func (dt *deviceToken) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &dt.Token); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &dt.TokenError)
+}
+
 // InitiateDeviceAuth initiates a device auth flow. It returns a DeviceCode
 // that can be used with CheckForUserCompletion or WaitForUserCompletion.
 func InitiateDeviceAuth(sender Sender, oauthConfig OAuthConfig, clientID, resource string) (*DeviceCode, error) {
@@ -142,6 +206,10 @@ func InitiateDeviceAuth(sender Sender, oauthConfig OAuthConfig, clientID, resour
 		return nil, fmt.Errorf("%s %s: %s", logPrefix, errCodeHandlingFails, err.Error())
 	}
 
+	if err = validateDeviceCode(&code); err != nil {
+		return nil, fmt.Errorf("%s %s: %s", logPrefix, errCodeHandlingFails, err.Error())
+	}
+
 	code.ClientID = clientID
 	code.Resource = resource
 	code.OAuthConfig = oauthConfig
@@ -149,9 +217,37 @@ func InitiateDeviceAuth(sender Sender, oauthConfig OAuthConfig, clientID, resour
 	return &code, nil
 }
 
+// validateDeviceCode checks that the expires_in and interval returned by the device endpoint are
+// positive and within sane bounds, defaulting the interval if it was not returned or is zero.
+func validateDeviceCode(code *DeviceCode) error {
+	if code.ExpiresIn == nil {
+		return fmt.Errorf("expires_in is missing")
+	}
+	if *code.ExpiresIn <= 0 || *code.ExpiresIn > maxDeviceExpiresIn {
+		return fmt.Errorf("expires_in %d is not between 1 and %d seconds", *code.ExpiresIn, maxDeviceExpiresIn)
+	}
+	if code.Interval == nil || *code.Interval == 0 {
+		interval := int64(defaultDeviceInterval)
+		code.Interval = &interval
+	}
+	if *code.Interval < 0 || *code.Interval > maxDeviceInterval {
+		return fmt.Errorf("interval %d is not between 1 and %d seconds", *code.Interval, maxDeviceInterval)
+	}
+	if *code.Interval > *code.ExpiresIn {
+		return fmt.Errorf("interval %d exceeds expires_in %d", *code.Interval, *code.ExpiresIn)
+	}
+	return nil
+}
+
 // CheckForUserCompletion takes a DeviceCode and checks with the Azure AD OAuth endpoint
 // to see if the device flow has: been completed, timed out, or otherwise failed
 func CheckForUserCompletion(sender Sender, code *DeviceCode) (*Token, error) {
+	return CheckForUserCompletionWithContext(context.Background(), sender, code)
+}
+
+// CheckForUserCompletionWithContext is the same as CheckForUserCompletion, but sends the token
+// request with the passed context.
+func CheckForUserCompletionWithContext(ctx context.Context, sender Sender, code *DeviceCode) (*Token, error) {
 	v := url.Values{
 		"client_id":  []string{code.ClientID},
 		"code":       []string{*code.DeviceCode},
@@ -169,8 +265,11 @@ func CheckForUserCompletion(sender Sender, code *DeviceCode) (*Token, error) {
 
 	req.ContentLength = int64(len(s))
 	req.Header.Set(contentType, mimeTypeFormPost)
-	resp, err := sender.Do(req)
+	resp, err := sender.Do(req.WithContext(ctx))
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, fmt.Errorf("%s %s: %s", logPrefix, errTokenSendingFails, err.Error())
 	}
 	defer resp.Body.Close()
@@ -194,6 +293,11 @@ func CheckForUserCompletion(sender Sender, code *DeviceCode) (*Token, error) {
 	}
 
 	if token.Error == nil {
+		// some tenants issue no refresh token; the user must then complete another device flow
+		// rather than the token being refreshed once it expires
+		if code.RequireRefreshToken && !token.Token.IsRefreshable() {
+			return nil, ErrDeviceRefreshTokenMissing
+		}
 		return &token.Token, nil
 	}
 
@@ -213,12 +317,38 @@ func CheckForUserCompletion(sender Sender, code *DeviceCode) (*Token, error) {
 
 // WaitForUserCompletion calls CheckForUserCompletion repeatedly until a token is granted or an error state occurs.
 // This prevents the user from looping and checking against 'ErrDeviceAuthorizationPending'.
+// If the DeviceCode specifies when it expires, ErrDeviceCodeExpired is returned once it has.
+// Callers should check Token.IsRefreshable, or set DeviceCode.RequireRefreshToken, since some
+// tenants grant tokens that cannot be refreshed.
+// Polls are spaced by the DeviceCode's interval (5 seconds if it is absent or zero), and the
+// interval grows by 5 seconds each time the server responds with slow_down.
 func WaitForUserCompletion(sender Sender, code *DeviceCode) (*Token, error) {
-	intervalDuration := time.Duration(*code.Interval) * time.Second
-	waitDuration := intervalDuration
+	return WaitForUserCompletionWithContext(context.Background(), sender, code)
+}
+
+// WaitForUserCompletionWithContext is the same as WaitForUserCompletion, but stops polling and
+// returns ctx.Err() as soon as the passed context is cancelled or its deadline passes.
+func WaitForUserCompletionWithContext(ctx context.Context, sender Sender, code *DeviceCode) (*Token, error) {
+	if code.Interval != nil && *code.Interval < 0 {
+		return nil, fmt.Errorf("%s Error waiting for user to complete device flow. The device code has no valid interval", logPrefix)
+	}
+	interval := int64(defaultDeviceInterval)
+	if code.Interval != nil && *code.Interval > 0 {
+		interval = *code.Interval
+	}
+	var deadline time.Time
+	if code.ExpiresIn != nil {
+		deadline = time.Now().Add(time.Duration(*code.ExpiresIn) * time.Second)
+	}
 
 	for {
-		token, err := CheckForUserCompletion(sender, code)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, ErrDeviceCodeExpired
+		}
+		token, err := CheckForUserCompletionWithContext(ctx, sender, code)
 
 		if err == nil {
 			return token, nil
@@ -226,17 +356,21 @@ func WaitForUserCompletion(sender Sender, code *DeviceCode) (*Token, error) {
 
 		switch err {
 		case ErrDeviceSlowDown:
-			waitDuration += waitDuration
+			interval += deviceSlowDownIncrement
 		case ErrDeviceAuthorizationPending:
 			// noop
 		default: // everything else is "fatal" to us
 			return nil, err
 		}
 
-		if waitDuration > (intervalDuration * 3) {
+		if interval > maxDeviceInterval {
 			return nil, fmt.Errorf("%s Error waiting for user to complete device flow. Server told us to slow_down too much", logPrefix)
 		}
 
-		time.Sleep(waitDuration)
+		select {
+		case <-time.After(time.Duration(interval) * devicePollUnit):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 }
@@ -15,11 +15,13 @@ package adal
 //  limitations under the License.
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/noahhai/go-autorest/autorest/mocks"
 )
@@ -42,7 +44,7 @@ const MockDeviceCodeResponse = `
 	"user_code": "ABCDEF",
 	"verification_url": "http://aka.ms/deviceauth",
 	"expires_in": "900",
-	"interval": "0"
+	"interval": "5"
 }
 `
 
@@ -112,6 +114,53 @@ func TestDeviceCodeReturnsErrorIfCannotDeserializeDeviceCode(t *testing.T) {
 	}
 }
 
+func TestDeviceCodeReturnsErrorIfIntervalOrExpiresInInvalid(t *testing.T) {
+	for _, fields := range []string{
+		`"expires_in": "900", "interval": "-5"`,
+		`"expires_in": "900", "interval": "3600"`,
+		`"expires_in": "0", "interval": "5"`,
+		`"expires_in": "86400", "interval": "5"`,
+		`"expires_in": "3", "interval": "5"`,
+		`"interval": "5"`,
+	} {
+		sender := mocks.NewSender()
+		sender.AppendResponse(mocks.NewResponseWithContent(`{"device_code": "10000-40-1234567890", ` + fields + `}`))
+
+		_, err := InitiateDeviceAuth(sender, TestOAuthConfig, TestClientID, TestResource)
+		if err == nil || !strings.Contains(err.Error(), errCodeHandlingFails) {
+			t.Fatalf("adal: InitiateDeviceAuth failed to return an error for %s", fields)
+		}
+	}
+}
+
+func TestDeviceCodeDefaultsInterval(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendResponse(mocks.NewResponseWithContent(`{"device_code": "10000-40-1234567890", "expires_in": "900"}`))
+
+	code, err := InitiateDeviceAuth(sender, TestOAuthConfig, TestClientID, TestResource)
+	if err != nil {
+		t.Fatalf("adal: InitiateDeviceAuth returned an error (%v)", err)
+	}
+	if code.Interval == nil || *code.Interval != defaultDeviceInterval {
+		t.Fatalf("adal: InitiateDeviceAuth failed to default the interval to %d", defaultDeviceInterval)
+	}
+}
+
+func TestDeviceCodeDefaultsZeroOrEmptyInterval(t *testing.T) {
+	for _, interval := range []string{`"0"`, `""`} {
+		sender := mocks.NewSender()
+		sender.AppendResponse(mocks.NewResponseWithContent(`{"device_code": "10000-40-1234567890", "expires_in": "900", "interval": ` + interval + `}`))
+
+		code, err := InitiateDeviceAuth(sender, TestOAuthConfig, TestClientID, TestResource)
+		if err != nil {
+			t.Fatalf("adal: InitiateDeviceAuth returned an error for interval %s (%v)", interval, err)
+		}
+		if code.Interval == nil || *code.Interval != defaultDeviceInterval {
+			t.Fatalf("adal: InitiateDeviceAuth failed to default interval %s to %d", interval, defaultDeviceInterval)
+		}
+	}
+}
+
 func TestDeviceCodeReturnsErrorIfEmptyDeviceCode(t *testing.T) {
 	sender := mocks.NewSender()
 	body := mocks.NewBody("")
@@ -127,9 +176,16 @@ func TestDeviceCodeReturnsErrorIfEmptyDeviceCode(t *testing.T) {
 	}
 }
 
+func init() {
+	// poll without real delays
+	devicePollUnit = time.Millisecond
+}
+
 func deviceCode() *DeviceCode {
 	var deviceCode DeviceCode
 	_ = json.Unmarshal([]byte(MockDeviceCodeResponse), &deviceCode)
+	interval := int64(1)
+	deviceCode.Interval = &interval
 	deviceCode.Resource = TestResource
 	deviceCode.ClientID = TestClientID
 	return &deviceCode
@@ -150,6 +206,58 @@ func TestDeviceTokenReturns(t *testing.T) {
 	}
 }
 
+const mockDeviceTokenResponseWithoutRefreshToken = `{
+	"access_token": "accessToken",
+	"expires_in": "1000",
+	"expires_on": "2000",
+	"not_before": "3000",
+	"resource": "resource",
+	"token_type": "type"
+}
+`
+
+func TestDeviceTokenReportsRefreshable(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendResponse(mocks.NewResponseWithContent(MockDeviceTokenResponse))
+
+	token, err := WaitForUserCompletion(sender, deviceCode())
+	if err != nil {
+		t.Fatalf("adal: got error unexpectedly (%v)", err)
+	}
+	if !token.IsRefreshable() {
+		t.Fatal("adal: Token#IsRefreshable returned false for a token with a refresh token")
+	}
+}
+
+func TestDeviceTokenWithoutRefreshToken(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendResponse(mocks.NewResponseWithContent(mockDeviceTokenResponseWithoutRefreshToken))
+
+	token, err := WaitForUserCompletion(sender, deviceCode())
+	if err != nil {
+		t.Fatalf("adal: got error unexpectedly (%v)", err)
+	}
+	if token.AccessToken != "accessToken" || token.IsRefreshable() {
+		t.Fatalf("adal: expected a token that is not refreshable, got %+v", token)
+	}
+}
+
+func TestDeviceTokenReturnsErrorIfRefreshTokenRequired(t *testing.T) {
+	sender := mocks.NewSender()
+	body := mocks.NewBody(mockDeviceTokenResponseWithoutRefreshToken)
+	sender.AppendResponse(mocks.NewResponseWithBodyAndStatus(body, http.StatusOK, "OK"))
+
+	code := deviceCode()
+	code.RequireRefreshToken = true
+	_, err := WaitForUserCompletion(sender, code)
+	if err != ErrDeviceRefreshTokenMissing {
+		t.Fatalf("adal: got wrong error expected(%s) actual(%v)", ErrDeviceRefreshTokenMissing, err)
+	}
+	if body.IsOpen() {
+		t.Fatalf("response body was left open!")
+	}
+}
+
 func TestDeviceTokenReturnsErrorIfSendingFails(t *testing.T) {
 	sender := mocks.NewSender()
 	sender.SetError(fmt.Errorf("this is an error"))
@@ -266,6 +374,80 @@ func TestDeviceTokenSucceedsWithIntermediateSlowDown(t *testing.T) {
 	}
 }
 
+type timedDeviceTokenSender struct {
+	errors   []string
+	attempts []time.Time
+}
+
+func (s *timedDeviceTokenSender) Do(req *http.Request) (*http.Response, error) {
+	s.attempts = append(s.attempts, time.Now())
+	if len(s.attempts) <= len(s.errors) {
+		return mocks.NewResponseWithContent(errorDeviceTokenResponse(s.errors[len(s.attempts)-1])), nil
+	}
+	return mocks.NewResponseWithContent(MockDeviceTokenResponse), nil
+}
+
+func TestWaitForUserCompletionRespectsInterval(t *testing.T) {
+	defer func(unit time.Duration) { devicePollUnit = unit }(devicePollUnit)
+	devicePollUnit = 10 * time.Millisecond
+
+	sender := &timedDeviceTokenSender{errors: []string{"authorization_pending", "slow_down", "authorization_pending"}}
+	code := deviceCode()
+	interval := int64(2)
+	code.Interval = &interval
+
+	if _, err := WaitForUserCompletion(sender, code); err != nil {
+		t.Fatalf("adal: WaitForUserCompletion returned an error (%v)", err)
+	}
+	if len(sender.attempts) != 4 {
+		t.Fatalf("adal: WaitForUserCompletion made %d attempts, expected 4", len(sender.attempts))
+	}
+	// 2 units between polls, growing by 5 units after slow_down
+	for i, units := range []time.Duration{2, 7, 7} {
+		gap := sender.attempts[i+1].Sub(sender.attempts[i])
+		if gap < units*devicePollUnit {
+			t.Fatalf("adal: WaitForUserCompletion waited %v before attempt %d, expected at least %v", gap, i+2, units*devicePollUnit)
+		}
+	}
+}
+
+func TestWaitForUserCompletionDefaultsZeroInterval(t *testing.T) {
+	defer func(unit time.Duration) { devicePollUnit = unit }(devicePollUnit)
+	devicePollUnit = time.Millisecond
+
+	sender := &timedDeviceTokenSender{errors: []string{"authorization_pending"}}
+	code := deviceCode()
+	interval := int64(0)
+	code.Interval = &interval
+
+	if _, err := WaitForUserCompletion(sender, code); err != nil {
+		t.Fatalf("adal: WaitForUserCompletion returned an error (%v)", err)
+	}
+	if gap := sender.attempts[1].Sub(sender.attempts[0]); gap < defaultDeviceInterval*devicePollUnit {
+		t.Fatalf("adal: WaitForUserCompletion waited %v, expected at least %v", gap, defaultDeviceInterval*devicePollUnit)
+	}
+}
+
+func TestWaitForUserCompletionWithContextCancels(t *testing.T) {
+	defer func(unit time.Duration) { devicePollUnit = unit }(devicePollUnit)
+	devicePollUnit = time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sender := SenderFunc(func(r *http.Request) (*http.Response, error) {
+		cancel()
+		return mocks.NewResponseWithContent(errorDeviceTokenResponse("authorization_pending")), nil
+	})
+
+	start := time.Now()
+	_, err := WaitForUserCompletionWithContext(ctx, sender, deviceCode())
+	if err != context.Canceled {
+		t.Fatalf("adal: WaitForUserCompletionWithContext returned %v, expected %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed >= devicePollUnit {
+		t.Fatalf("adal: WaitForUserCompletionWithContext took %v to return after cancellation", elapsed)
+	}
+}
+
 func TestDeviceTokenReturnsErrorIfAccessDenied(t *testing.T) {
 	sender := mocks.NewSender()
 	body := mocks.NewBody(errorDeviceTokenResponse("access_denied"))
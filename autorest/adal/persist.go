@@ -15,11 +15,29 @@ package adal
 //  limitations under the License.
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
+)
+
+const (
+	// tokenFileLockTimeout is how long to wait to acquire the lock on a token file.
+	tokenFileLockTimeout = 30 * time.Second
+
+	// tokenFileLockStaleAge is how long a lock file may go unmodified before it is considered
+	// abandoned (e.g. its owner was killed) and is broken. The owner of a lock refreshes its
+	// modification time every tokenFileLockHeartbeat for as long as it holds the lock.
+	tokenFileLockStaleAge = 2 * time.Minute
+
+	tokenFileLockHeartbeat = 10 * time.Second
+
+	tokenFileLockRetryDelay = 50 * time.Millisecond
 )
 
 // LoadToken restores a Token object from a file located at 'path'.
@@ -71,3 +89,151 @@ func SaveToken(path string, mode os.FileMode, token Token) error {
 	}
 	return nil
 }
+
+// SaveTokenWithLock persists an oauth token at the given location on disk like SaveToken, while
+// holding the lock used by RefreshTokenFile. It is suitable for use in a TokenRefreshCallback
+// when the token file is shared by concurrent processes.
+func SaveTokenWithLock(path string, mode os.FileMode, token Token) error {
+	unlock, err := lockTokenFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return SaveToken(path, mode, token)
+}
+
+// RefreshTokenFile loads the token stored at path and, if it expires within the default refresh
+// window, invokes refresh to obtain a new token which is then saved back to path. The load,
+// refresh and save happen while holding a lock on the token file so that concurrent processes
+// sharing the file don't each refresh the token and overwrite one another's results; a process
+// that waited for the lock will find the token already refreshed and return it as is.
+func RefreshTokenFile(path string, mode os.FileMode, refresh func(Token) (Token, error)) (*Token, error) {
+	unlock, err := lockTokenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	token, err := LoadToken(path)
+	if err != nil {
+		return nil, err
+	}
+	if !token.WillExpireIn(defaultRefresh) {
+		return token, nil
+	}
+	refreshed, err := refresh(*token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh token stored in file (%s): %v", path, err)
+	}
+	if err := SaveToken(path, mode, refreshed); err != nil {
+		return nil, err
+	}
+	return &refreshed, nil
+}
+
+// lockTokenFile acquires an exclusive lock on the token file at path by creating a companion
+// lock file holding a token unique to this owner, returning a function that releases the lock.
+func lockTokenFile(path string) (func(), error) {
+	lockPath := path + ".lock"
+	if err := os.MkdirAll(filepath.Dir(lockPath), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create directory (%s) to lock token in: %v", filepath.Dir(lockPath), err)
+	}
+	owner, err := newLockOwner()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate owner for lock file (%s) for token: %v", lockPath, err)
+	}
+	deadline := time.Now().Add(tokenFileLockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = f.Write(owner)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(lockPath)
+				return nil, fmt.Errorf("failed to write lock file (%s) for token: %v", lockPath, err)
+			}
+			return holdTokenFileLock(lockPath, owner), nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create lock file (%s) for token: %v", lockPath, err)
+		}
+		if breakStaleTokenFileLock(lockPath, owner) {
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for lock file (%s) for token", lockPath)
+		}
+		time.Sleep(tokenFileLockRetryDelay)
+	}
+}
+
+// holdTokenFileLock keeps the lock file at lockPath fresh while it is held by owner, returning a
+// function that releases the lock. The lock file is only removed if it still belongs to owner.
+func holdTokenFileLock(lockPath string, owner []byte) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(tokenFileLockHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if ownsTokenFileLock(lockPath, owner) {
+					now := time.Now()
+					os.Chtimes(lockPath, now, now)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		if ownsTokenFileLock(lockPath, owner) {
+			os.Remove(lockPath)
+		}
+	}
+}
+
+// breakStaleTokenFileLock removes the lock file at lockPath if it has not been refreshed within
+// tokenFileLockStaleAge, returning true if it did. The lock file is first renamed to a name unique
+// to owner so that only one of several waiters can break it; should the renamed file turn out to
+// be a lock that was taken in the meantime, it is put back.
+func breakStaleTokenFileLock(lockPath string, owner []byte) bool {
+	fi, err := os.Stat(lockPath)
+	if err != nil || time.Since(fi.ModTime()) <= tokenFileLockStaleAge {
+		return false
+	}
+	stalePath := fmt.Sprintf("%s.%s.stale", lockPath, owner)
+	if err := os.Rename(lockPath, stalePath); err != nil {
+		return false
+	}
+	defer os.Remove(stalePath)
+	if fi, err = os.Stat(stalePath); err == nil && time.Since(fi.ModTime()) <= tokenFileLockStaleAge {
+		// another waiter broke the stale lock and took it before we renamed it, restore it
+		os.Link(stalePath, lockPath)
+		return false
+	}
+	return true
+}
+
+// ownsTokenFileLock returns true if the lock file at lockPath holds owner.
+func ownsTokenFileLock(lockPath string, owner []byte) bool {
+	b, err := ioutil.ReadFile(lockPath)
+	return err == nil && bytes.Equal(b, owner)
+}
+
+// newLockOwner returns a random token identifying the owner of a lock file.
+func newLockOwner() ([]byte, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	owner := make([]byte, hex.EncodedLen(len(b)))
+	hex.Encode(owner, b)
+	return owner, nil
+}
@@ -19,10 +19,13 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const MockTokenJSON string = `{
@@ -169,3 +172,116 @@ func TestSaveTokenFailsCantCreate(t *testing.T) {
 		t.Fatalf("azure: failed to get correct error expected(%s) actual(%v)", expectedSubstring, err)
 	}
 }
+
+func TestRefreshTokenFileRefreshesOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testrefreshtokenfile")
+	if err != nil {
+		t.Fatalf("azure: unexpected error when creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tokenPath := filepath.Join(dir, "token.json")
+	if err := SaveToken(tokenPath, 0600, *newTokenExpiresIn(time.Second)); err != nil {
+		t.Fatalf("azure: unexpected error saving token to file: %v", err)
+	}
+
+	var mu sync.Mutex
+	refreshes := 0
+	refresh := func(tk Token) (Token, error) {
+		mu.Lock()
+		refreshes++
+		mu.Unlock()
+		tk.AccessToken = "refreshed"
+		return *setTokenToExpireIn(&tk, time.Hour), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tk, err := RefreshTokenFile(tokenPath, 0600, refresh)
+			if err != nil {
+				t.Errorf("azure: RefreshTokenFile returned an error: %v", err)
+				return
+			}
+			if tk.AccessToken != "refreshed" {
+				t.Errorf("azure: RefreshTokenFile returned a stale token")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if refreshes != 1 {
+		t.Fatalf("azure: RefreshTokenFile refreshed the token %d times, expected once", refreshes)
+	}
+	if _, err := os.Stat(tokenPath + ".lock"); !os.IsNotExist(err) {
+		t.Fatalf("azure: RefreshTokenFile did not release the lock file")
+	}
+}
+
+func TestRefreshTokenFileBreaksAbandonedLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testrefreshtokenfile")
+	if err != nil {
+		t.Fatalf("azure: unexpected error when creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tokenPath := filepath.Join(dir, "token.json")
+	if err := SaveToken(tokenPath, 0600, *newTokenExpiresIn(time.Hour)); err != nil {
+		t.Fatalf("azure: unexpected error saving token to file: %v", err)
+	}
+	if err := ioutil.WriteFile(tokenPath+".lock", nil, 0600); err != nil {
+		t.Fatalf("azure: unexpected error creating lock file: %v", err)
+	}
+	abandoned := time.Now().Add(-2 * tokenFileLockStaleAge)
+	if err := os.Chtimes(tokenPath+".lock", abandoned, abandoned); err != nil {
+		t.Fatalf("azure: unexpected error aging lock file: %v", err)
+	}
+
+	_, err = RefreshTokenFile(tokenPath, 0600, func(tk Token) (Token, error) {
+		t.Fatal("azure: RefreshTokenFile refreshed a fresh token")
+		return tk, nil
+	})
+	if err != nil {
+		t.Fatalf("azure: RefreshTokenFile returned an error: %v", err)
+	}
+}
+
+func TestLockTokenFileReleaseKeepsLockOfAnotherOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testlocktokenfile")
+	if err != nil {
+		t.Fatalf("azure: unexpected error when creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tokenPath := filepath.Join(dir, "token.json")
+
+	unlock, err := lockTokenFile(tokenPath)
+	if err != nil {
+		t.Fatalf("azure: lockTokenFile returned an error: %v", err)
+	}
+	// simulate another process breaking the lock and taking it over
+	if err := ioutil.WriteFile(tokenPath+".lock", []byte("another owner"), 0600); err != nil {
+		t.Fatalf("azure: unexpected error overwriting lock file: %v", err)
+	}
+	unlock()
+	if _, err := os.Stat(tokenPath + ".lock"); err != nil {
+		t.Fatalf("azure: releasing the lock removed the lock file of another owner: %v", err)
+	}
+}
+
+func TestLockTokenFileDoesNotBreakFreshLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testlocktokenfile")
+	if err != nil {
+		t.Fatalf("azure: unexpected error when creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	lockPath := filepath.Join(dir, "token.json.lock")
+	if err := ioutil.WriteFile(lockPath, []byte("another owner"), 0600); err != nil {
+		t.Fatalf("azure: unexpected error creating lock file: %v", err)
+	}
+	if breakStaleTokenFileLock(lockPath, []byte("owner")) {
+		t.Fatal("azure: breakStaleTokenFileLock broke a lock that is still held")
+	}
+	if b, err := ioutil.ReadFile(lockPath); err != nil || string(b) != "another owner" {
+		t.Fatalf("azure: breakStaleTokenFileLock modified a lock that is still held: %q %v", b, err)
+	}
+}
@@ -31,6 +31,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -41,6 +42,12 @@ import (
 const (
 	defaultRefresh = 5 * time.Minute
 
+	// defaultAssertionLifetime is the default validity period of signed client assertions
+	defaultAssertionLifetime = 24 * time.Hour
+
+	// refreshDaemonRetry is the minimum interval between refresh attempts made by the refresh daemon
+	refreshDaemonRetry = 30 * time.Second
+
 	// OAuthGrantTypeDeviceCode is the "grant_type" identifier used in device flow
 	OAuthGrantTypeDeviceCode = "device_code"
 
@@ -91,6 +98,12 @@ type RefresherWithContext interface {
 	EnsureFreshWithContext(ctx context.Context) error
 }
 
+// ClaimsRefresher is an interface for acquiring a token satisfying additional claims, such as
+// those demanded by a resource's claims challenge (e.g., for multi-factor authentication).
+type ClaimsRefresher interface {
+	RefreshWithClaims(ctx context.Context, claims string) error
+}
+
 // TokenRefreshCallback is the type representing callbacks that will be called after
 // a successful token refresh
 type TokenRefreshCallback func(Token) error
@@ -117,11 +130,69 @@ func newToken() Token {
 	}
 }
 
+// UnmarshalJSON implements the json.Unmarshaler interface. Endpoints return expires_in, expires_on
+// and not_before either as JSON numbers or as quoted strings; both are normalized to json.Number.
+func (t *Token) UnmarshalJSON(data []byte) error {
+	type token Token
+	var raw struct {
+		token
+		ExpiresIn json.RawMessage `json:"expires_in"`
+		ExpiresOn json.RawMessage `json:"expires_on"`
+		NotBefore json.RawMessage `json:"not_before"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	tok := Token(raw.token)
+	var err error
+	if tok.ExpiresIn, err = parseTokenNumber("expires_in", raw.ExpiresIn); err != nil {
+		return err
+	}
+	if tok.ExpiresOn, err = parseTokenNumber("expires_on", raw.ExpiresOn); err != nil {
+		return err
+	}
+	if tok.NotBefore, err = parseTokenNumber("not_before", raw.NotBefore); err != nil {
+		return err
+	}
+	*t = tok
+	return nil
+}
+
+// parseTokenNumber converts a JSON number or quoted number into a json.Number. Missing, null and
+// empty string values yield the empty json.Number.
+func parseTokenNumber(name string, data json.RawMessage) (json.Number, error) {
+	s := strings.TrimSpace(string(data))
+	if s == "" || s == "null" {
+		return "", nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return "", err
+		}
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return "", nil
+		}
+	}
+	var n json.Number
+	if err := json.Unmarshal([]byte(s), &n); err != nil {
+		return "", fmt.Errorf("adal: %s value %s is not a number", name, data)
+	}
+	return n, nil
+}
+
 // IsZero returns true if the token object is zero-initialized.
 func (t Token) IsZero() bool {
 	return t == Token{}
 }
 
+// IsRefreshable returns true if the Token carries a refresh token with which it can be refreshed.
+// Tokens without one, such as those some tenants issue through the device flow, can only be
+// replaced by authenticating again.
+func (t Token) IsRefreshable() bool {
+	return t.RefreshToken != ""
+}
+
 // Expires returns the time.Time when the Token expires.
 func (t Token) Expires() time.Time {
 	s, err := t.ExpiresOn.Float64()
@@ -134,6 +205,16 @@ func (t Token) Expires() time.Time {
 	return time.Time(expiration).UTC()
 }
 
+// ValidFrom returns the time.Time before which the Token must not be used, as specified by its
+// not_before value. It returns the zero time.Time if the Token has no valid not_before value.
+func (t Token) ValidFrom() time.Time {
+	s, err := t.NotBefore.Float64()
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Time(date.NewUnixTimeFromSeconds(s)).UTC()
+}
+
 // IsExpired returns true if the Token is expired, false otherwise.
 func (t Token) IsExpired() bool {
 	return t.WillExpireIn(0)
@@ -145,11 +226,94 @@ func (t Token) WillExpireIn(d time.Duration) bool {
 	return !t.Expires().After(time.Now().Add(d))
 }
 
+// LifetimeRemaining returns the fraction, from 1 when issued to 0 once expired, of the Token's
+// lifetime that remains. The lifetime runs from the issued-at (iat) claim of the access token to
+// the Token's expiry. If the access token has no iat claim, or the Token has no expiry, ok is false.
+func (t Token) LifetimeRemaining() (fraction float64, ok bool) {
+	var c struct {
+		IssuedAt json.Number `json:"iat"`
+	}
+	if err := decodeClaims(t.AccessToken, &c); err != nil || c.IssuedAt == "" {
+		return 0, false
+	}
+	iat, err := c.IssuedAt.Float64()
+	if err != nil {
+		return 0, false
+	}
+	issued := date.UnixEpoch().Add(time.Duration(iat * float64(time.Second)))
+	lifetime := t.Expires().Sub(issued)
+	if lifetime <= 0 {
+		return 0, false
+	}
+	fraction = float64(time.Until(t.Expires())) / float64(lifetime)
+	return math.Max(0, math.Min(1, fraction)), true
+}
+
 //OAuthToken return the current access token
 func (t *Token) OAuthToken() string {
 	return t.AccessToken
 }
 
+// identityClaims are the claims of an access token that identify the principal it was issued to.
+type identityClaims struct {
+	ObjectID string `json:"oid"`
+	TenantID string `json:"tid"`
+	Subject  string `json:"sub"`
+}
+
+// decodeClaims unmarshals the claims of the passed JWT access token into v without verifying its
+// signature.
+func decodeClaims(accessToken string, v interface{}) error {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("adal: access token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return fmt.Errorf("adal: failed to decode access token claims: %v", err)
+	}
+	if err = json.Unmarshal(payload, v); err != nil {
+		return fmt.Errorf("adal: failed to unmarshal access token claims: %v", err)
+	}
+	return nil
+}
+
+// parseIdentityClaims returns the identity claims of the passed JWT access token without
+// verifying its signature.
+func parseIdentityClaims(accessToken string) (identityClaims, error) {
+	var c identityClaims
+	if err := decodeClaims(accessToken, &c); err != nil {
+		return c, err
+	}
+	if c.ObjectID == "" && c.Subject == "" {
+		return c, fmt.Errorf("adal: access token does not identify a principal")
+	}
+	return c, nil
+}
+
+// SameIdentity returns true if the access tokens of t1 and t2 were issued to the same principal,
+// as identified by their tenant (tid) and object (oid) claims or, if either lacks an object ID,
+// their subject (sub) claims. It allows, for example, a refresh token cached for one resource to
+// be checked before it is used for another. The signatures of the tokens are not verified. An
+// error is returned if either access token cannot be parsed.
+func SameIdentity(t1, t2 Token) (bool, error) {
+	c1, err := parseIdentityClaims(t1.AccessToken)
+	if err != nil {
+		return false, err
+	}
+	c2, err := parseIdentityClaims(t2.AccessToken)
+	if err != nil {
+		return false, err
+	}
+	if c1.TenantID != c2.TenantID {
+		return false, nil
+	}
+	if c1.ObjectID != "" && c2.ObjectID != "" {
+		return c1.ObjectID == c2.ObjectID, nil
+	}
+	return c1.Subject != "" && c1.Subject == c2.Subject, nil
+}
+
 // ServicePrincipalSecret is an interface that allows various secret mechanism to fill the form
 // that is submitted when acquiring an oAuth token.
 type ServicePrincipalSecret interface {
@@ -205,27 +369,37 @@ func (tokenSecret ServicePrincipalTokenSecret) MarshalJSON() ([]byte, error) {
 type ServicePrincipalCertificateSecret struct {
 	Certificate *x509.Certificate
 	PrivateKey  *rsa.PrivateKey
+
+	// AssertionLifetime is the validity period of the signed client assertion. Defaults to 24 hours
+	// when zero.
+	AssertionLifetime time.Duration
 }
 
-// SignJwt returns the JWT signed with the certificate's private key.
-func (secret *ServicePrincipalCertificateSecret) SignJwt(spt *ServicePrincipalToken) (string, error) {
-	hasher := sha1.New()
-	_, err := hasher.Write(secret.Certificate.Raw)
-	if err != nil {
-		return "", err
+func (secret *ServicePrincipalCertificateSecret) assertionLifetime() time.Duration {
+	if secret.AssertionLifetime <= 0 {
+		return defaultAssertionLifetime
 	}
+	return secret.AssertionLifetime
+}
 
-	thumbprint := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+// thumbprint returns the base64url encoded SHA-1 hash of the certificate.
+func (secret *ServicePrincipalCertificateSecret) thumbprint() string {
+	hash := sha1.Sum(secret.Certificate.Raw)
+	return base64.URLEncoding.EncodeToString(hash[:])
+}
 
+// SignJwt returns the JWT signed with the certificate's private key.
+func (secret *ServicePrincipalCertificateSecret) SignJwt(spt *ServicePrincipalToken) (string, error) {
 	// The jti (JWT ID) claim provides a unique identifier for the JWT.
 	jti := make([]byte, 20)
-	_, err = rand.Read(jti)
+	_, err := rand.Read(jti)
 	if err != nil {
 		return "", err
 	}
 
+	now := time.Now()
 	token := jwt.New(jwt.SigningMethodRS256)
-	token.Header["x5t"] = thumbprint
+	token.Header["x5t"] = secret.thumbprint()
 	x5c := []string{base64.StdEncoding.EncodeToString(secret.Certificate.Raw)}
 	token.Header["x5c"] = x5c
 	token.Claims = jwt.MapClaims{
@@ -233,16 +407,16 @@ func (secret *ServicePrincipalCertificateSecret) SignJwt(spt *ServicePrincipalTo
 		"iss": spt.inner.ClientID,
 		"sub": spt.inner.ClientID,
 		"jti": base64.URLEncoding.EncodeToString(jti),
-		"nbf": time.Now().Unix(),
-		"exp": time.Now().Add(time.Hour * 24).Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(secret.assertionLifetime()).Unix(),
 	}
 
-	signedString, err := token.SignedString(secret.PrivateKey)
-	return signedString, err
+	return token.SignedString(secret.PrivateKey)
 }
 
 // SetAuthenticationValues is a method of the interface ServicePrincipalSecret.
 // It will populate the form submitted during oAuth Token Acquisition using a JWT signed with a certificate.
+// A new JWT, with its own jti, is signed for every token request so that assertions are never replayed.
 func (secret *ServicePrincipalCertificateSecret) SetAuthenticationValues(spt *ServicePrincipalToken, v *url.Values) error {
 	jwt, err := secret.SignJwt(spt)
 	if err != nil {
@@ -337,20 +511,88 @@ type ServicePrincipalToken struct {
 	refreshLock      *sync.RWMutex
 	sender           Sender
 	refreshCallbacks []TokenRefreshCallback
+	daemon           *refreshDaemon
+	broker           TokenBroker
+	// claims is the claims request parameter included in token requests, if not empty.
+	claims string
+	// refreshed counts, atomically, the successful refreshes of the token for its own resource,
+	// allowing a Refresh that waited on another to reuse its token.
+	refreshed uint32
+	// authorities caches, by authority host and resource, the tokens acquired through ForAuthority.
+	// It is guarded by refreshLock.
+	authorities map[string]*ServicePrincipalToken
 	// MaxMSIRefreshAttempts is the maximum number of attempts to refresh an MSI token.
 	MaxMSIRefreshAttempts int
 }
 
 // MarshalTokenJSON returns the marshalled inner token.
+// Note that the token contains the access token and, if issued, the refresh token; both should be
+// stored with the same care as any other credential.
 func (spt ServicePrincipalToken) MarshalTokenJSON() ([]byte, error) {
 	return json.Marshal(spt.inner.Token)
 }
 
+// UnmarshalTokenJSON replaces the inner token with the token marshalled by MarshalTokenJSON.
+func (spt *ServicePrincipalToken) UnmarshalTokenJSON(data []byte) error {
+	var token Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return err
+	}
+	spt.refreshLock.Lock()
+	defer spt.refreshLock.Unlock()
+	spt.inner.Token = token
+	return nil
+}
+
+// ServicePrincipalTokenConfig is a snapshot of the configuration of a ServicePrincipalToken. It
+// contains no secrets: the client secret, certificate, password, authorization code and MSI
+// secret are never included. Together with the token returned by MarshalTokenJSON it allows a
+// ServicePrincipalToken to be reconstructed, see NewServicePrincipalTokenFromConfig.
+type ServicePrincipalTokenConfig struct {
+	OAuthConfig   OAuthConfig   `json:"oauth"`
+	ClientID      string        `json:"clientID"`
+	Resource      string        `json:"resource"`
+	AutoRefresh   bool          `json:"autoRefresh"`
+	RefreshWithin time.Duration `json:"refreshWithin"`
+}
+
+// Config returns a snapshot of the configuration of the ServicePrincipalToken.
+func (spt *ServicePrincipalToken) Config() ServicePrincipalTokenConfig {
+	spt.refreshLock.RLock()
+	defer spt.refreshLock.RUnlock()
+	return ServicePrincipalTokenConfig{
+		OAuthConfig:   spt.inner.OauthConfig,
+		ClientID:      spt.inner.ClientID,
+		Resource:      spt.inner.Resource,
+		AutoRefresh:   spt.inner.AutoRefresh,
+		RefreshWithin: spt.inner.RefreshWithin,
+	}
+}
+
 // SetRefreshCallbacks replaces any existing refresh callbacks with the specified callbacks.
 func (spt *ServicePrincipalToken) SetRefreshCallbacks(callbacks []TokenRefreshCallback) {
 	spt.refreshCallbacks = callbacks
 }
 
+// SetClaims sets the claims request parameter (a JSON object) included in subsequent token
+// requests, asking for a token satisfying additional claims. Passing an empty string clears it.
+// The current token is kept until it is next refreshed (see RefreshWithClaims).
+func (spt *ServicePrincipalToken) SetClaims(claims string) {
+	spt.refreshLock.Lock()
+	defer spt.refreshLock.Unlock()
+	spt.claims = claims
+}
+
+// RefreshWithClaims sets the claims request parameter, as SetClaims does, and immediately obtains a
+// fresh token satisfying them. It is typically called in response to a claims challenge returned
+// by a resource (see autorest.ClaimsFromChallenge).
+func (spt *ServicePrincipalToken) RefreshWithClaims(ctx context.Context, claims string) error {
+	spt.refreshLock.Lock()
+	defer spt.refreshLock.Unlock()
+	spt.claims = claims
+	return spt.refreshOwnResource(ctx)
+}
+
 // MarshalJSON implements the json.Marshaler interface.
 func (spt ServicePrincipalToken) MarshalJSON() ([]byte, error) {
 	return json.Marshal(spt.inner)
@@ -475,6 +717,54 @@ func NewServicePrincipalTokenFromManualToken(oauthConfig OAuthConfig, clientID s
 	return spt, nil
 }
 
+// NewServicePrincipalTokenFromConfig creates a ServicePrincipalToken from a configuration snapshot
+// returned by Config and a previously acquired token. Since no secret is available, the token is
+// refreshed using its refresh token; once that is no longer valid a ServicePrincipalToken must be
+// created from the original secret.
+func NewServicePrincipalTokenFromConfig(config ServicePrincipalTokenConfig, token Token, callbacks ...TokenRefreshCallback) (*ServicePrincipalToken, error) {
+	spt, err := NewServicePrincipalTokenFromManualToken(config.OAuthConfig, config.ClientID, config.Resource, token, callbacks...)
+	if err != nil {
+		return nil, err
+	}
+	spt.inner.AutoRefresh = config.AutoRefresh
+	spt.inner.RefreshWithin = config.RefreshWithin
+	return spt, nil
+}
+
+// TokenBroker acquires a token for the passed resource from an external source (e.g., a token
+// broker running on the local machine).
+type TokenBroker func(ctx context.Context, resource string) (Token, error)
+
+// NewServicePrincipalTokenFromBroker creates a ServicePrincipalToken that acquires its tokens from
+// the passed TokenBroker rather than from Azure Active Directory. The token is acquired, and is
+// cached and refreshed, as for any other ServicePrincipalToken.
+func NewServicePrincipalTokenFromBroker(clientID string, resource string, broker TokenBroker, callbacks ...TokenRefreshCallback) (*ServicePrincipalToken, error) {
+	if err := validateStringParam(clientID, "clientID"); err != nil {
+		return nil, err
+	}
+	if err := validateStringParam(resource, "resource"); err != nil {
+		return nil, err
+	}
+	if broker == nil {
+		return nil, fmt.Errorf("parameter 'broker' cannot be nil")
+	}
+	spt := &ServicePrincipalToken{
+		inner: servicePrincipalToken{
+			Token:         newToken(),
+			Secret:        &ServicePrincipalNoSecret{},
+			ClientID:      clientID,
+			Resource:      resource,
+			AutoRefresh:   true,
+			RefreshWithin: defaultRefresh,
+		},
+		refreshLock:      &sync.RWMutex{},
+		sender:           &http.Client{Transport: tracing.Transport},
+		refreshCallbacks: callbacks,
+		broker:           broker,
+	}
+	return spt, nil
+}
+
 // NewServicePrincipalTokenFromManualTokenSecret creates a ServicePrincipalToken using the supplied token and secret
 func NewServicePrincipalTokenFromManualTokenSecret(oauthConfig OAuthConfig, clientID string, resource string, token Token, secret ServicePrincipalSecret, callbacks ...TokenRefreshCallback) (*ServicePrincipalToken, error) {
 	if err := validateOAuthConfig(oauthConfig); err != nil {
@@ -633,17 +923,39 @@ func GetMSIVMEndpoint() (string, error) {
 
 // NewServicePrincipalTokenFromMSI creates a ServicePrincipalToken via the MSI VM Extension.
 // It will use the system assigned identity when creating the token.
-func NewServicePrincipalTokenFromMSI(msiEndpoint, resource, msiSecret string, callbacks ...TokenRefreshCallback) (*ServicePrincipalToken, error) {
-	return newServicePrincipalTokenFromMSI(msiEndpoint, resource, msiSecret, nil, callbacks...)
+func NewServicePrincipalTokenFromMSI(msiEndpoint, resource string, callbacks ...TokenRefreshCallback) (*ServicePrincipalToken, error) {
+	return newServicePrincipalTokenFromMSI(msiEndpoint, resource, nil, callbacks...)
 }
 
 // NewServicePrincipalTokenFromMSIWithUserAssignedID creates a ServicePrincipalToken via the MSI VM Extension.
 // It will use the specified user assigned identity when creating the token.
-func NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint, resource, msiSecret string, userAssignedID string, callbacks ...TokenRefreshCallback) (*ServicePrincipalToken, error) {
-	return newServicePrincipalTokenFromMSI(msiEndpoint, resource, msiSecret, &userAssignedID, callbacks...)
+func NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint, resource string, userAssignedID string, callbacks ...TokenRefreshCallback) (*ServicePrincipalToken, error) {
+	return newServicePrincipalTokenFromMSI(msiEndpoint, resource, &userAssignedID, callbacks...)
 }
 
-func newServicePrincipalTokenFromMSI(msiEndpoint, resource, msiSecret string, userAssignedID *string, callbacks ...TokenRefreshCallback) (*ServicePrincipalToken, error) {
+// NewServicePrincipalTokenFromMSIWithSecret creates a ServicePrincipalToken via an MSI endpoint that
+// requires a secret (e.g., the MSI_SECRET of Azure App Service), using the system assigned identity.
+func NewServicePrincipalTokenFromMSIWithSecret(msiEndpoint, resource, msiSecret string, callbacks ...TokenRefreshCallback) (*ServicePrincipalToken, error) {
+	spt, err := newServicePrincipalTokenFromMSI(msiEndpoint, resource, nil, callbacks...)
+	if err != nil {
+		return nil, err
+	}
+	spt.inner.MsiSecret = msiSecret
+	return spt, nil
+}
+
+// NewServicePrincipalTokenFromMSIWithUserAssignedIDAndSecret creates a ServicePrincipalToken via an
+// MSI endpoint that requires a secret, using the specified user assigned identity.
+func NewServicePrincipalTokenFromMSIWithUserAssignedIDAndSecret(msiEndpoint, resource, msiSecret string, userAssignedID string, callbacks ...TokenRefreshCallback) (*ServicePrincipalToken, error) {
+	spt, err := newServicePrincipalTokenFromMSI(msiEndpoint, resource, &userAssignedID, callbacks...)
+	if err != nil {
+		return nil, err
+	}
+	spt.inner.MsiSecret = msiSecret
+	return spt, nil
+}
+
+func newServicePrincipalTokenFromMSI(msiEndpoint, resource string, userAssignedID *string, callbacks ...TokenRefreshCallback) (*ServicePrincipalToken, error) {
 	if err := validateStringParam(msiEndpoint, "msiEndpoint"); err != nil {
 		return nil, err
 	}
@@ -686,7 +998,6 @@ func newServicePrincipalTokenFromMSI(msiEndpoint, resource, msiSecret string, us
 			Resource:      resource,
 			AutoRefresh:   true,
 			RefreshWithin: defaultRefresh,
-			MsiSecret:     msiSecret,
 			MsiEndpoint:   msiEndpoint,
 		},
 		refreshLock:           &sync.RWMutex{},
@@ -731,22 +1042,90 @@ func (spt *ServicePrincipalToken) EnsureFresh() error {
 // EnsureFreshWithContext will refresh the token if it will expire within the refresh window (as set by
 // RefreshWithin) and autoRefresh flag is on.  This method is safe for concurrent use.
 func (spt *ServicePrincipalToken) EnsureFreshWithContext(ctx context.Context) error {
-	if spt.inner.AutoRefresh && spt.inner.Token.WillExpireIn(spt.inner.RefreshWithin) {
+	spt.refreshLock.RLock()
+	stale := spt.inner.AutoRefresh && spt.inner.Token.WillExpireIn(spt.inner.RefreshWithin)
+	spt.refreshLock.RUnlock()
+	if stale {
 		// take the write lock then check to see if the token was already refreshed
 		spt.refreshLock.Lock()
 		defer spt.refreshLock.Unlock()
 		if spt.inner.Token.WillExpireIn(spt.inner.RefreshWithin) {
-			return spt.refreshInternal(ctx, spt.inner.Resource)
+			return spt.refreshOwnResource(ctx)
+		}
+	}
+	return nil
+}
+
+// refreshDaemon tracks the goroutine started by StartRefreshDaemon.
+type refreshDaemon struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartRefreshDaemon starts a goroutine that refreshes the token as it enters the refresh window
+// (as set by RefreshWithin), so requests do not incur the latency of refreshing it. Failed
+// refreshes are retried, at most every 30 seconds, until the token is refreshed; requests continue
+// to refresh the token as usual if it becomes stale in the meantime. The goroutine exits when ctx
+// is canceled or StopRefreshDaemon is called. An error is returned if the daemon is already running.
+func (spt *ServicePrincipalToken) StartRefreshDaemon(ctx context.Context) error {
+	spt.refreshLock.Lock()
+	defer spt.refreshLock.Unlock()
+	if spt.daemon != nil {
+		select {
+		case <-spt.daemon.done:
+		default:
+			return fmt.Errorf("adal: refresh daemon is already running")
 		}
 	}
+	ctx, cancel := context.WithCancel(ctx)
+	d := &refreshDaemon{cancel: cancel, done: make(chan struct{})}
+	spt.daemon = d
+	go spt.runRefreshDaemon(ctx, d.done)
 	return nil
 }
 
+// StopRefreshDaemon stops the goroutine started by StartRefreshDaemon, waiting for it to exit.
+// It does nothing if the daemon is not running.
+func (spt *ServicePrincipalToken) StopRefreshDaemon() {
+	spt.refreshLock.Lock()
+	d := spt.daemon
+	spt.daemon = nil
+	spt.refreshLock.Unlock()
+	if d != nil {
+		d.cancel()
+		<-d.done
+	}
+}
+
+func (spt *ServicePrincipalToken) runRefreshDaemon(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	var retry time.Duration
+	for {
+		spt.refreshLock.RLock()
+		wait := time.Until(spt.inner.Token.Expires().Add(-spt.inner.RefreshWithin))
+		spt.refreshLock.RUnlock()
+		if wait < retry {
+			wait = retry
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		// errors are ignored; the refresh is retried and requests still refresh stale tokens
+		spt.RefreshWithContext(ctx)
+		retry = refreshDaemonRetry
+	}
+}
+
 // InvokeRefreshCallbacks calls any TokenRefreshCallbacks that were added to the SPT during initialization
+// or through SetRefreshCallbacks, passing each the freshly obtained token.
 func (spt *ServicePrincipalToken) InvokeRefreshCallbacks(token Token) error {
 	if spt.refreshCallbacks != nil {
 		for _, callback := range spt.refreshCallbacks {
-			err := callback(spt.inner.Token)
+			err := callback(token)
 			if err != nil {
 				return fmt.Errorf("adal: TokenRefreshCallback handler failed. Error = '%v'", err)
 			}
@@ -756,17 +1135,36 @@ func (spt *ServicePrincipalToken) InvokeRefreshCallbacks(token Token) error {
 }
 
 // Refresh obtains a fresh token for the Service Principal.
-// This method is not safe for concurrent use and should be syncrhonized.
+// This method is safe for concurrent use: a call made while another refresh is in flight waits for
+// it and, if it succeeds, reuses its token rather than requesting another.
 func (spt *ServicePrincipalToken) Refresh() error {
 	return spt.RefreshWithContext(context.Background())
 }
 
 // RefreshWithContext obtains a fresh token for the Service Principal.
-// This method is not safe for concurrent use and should be syncrhonized.
+// This method is safe for concurrent use: a call made while another refresh is in flight waits for
+// it and, if it succeeds, reuses its token rather than requesting another.
 func (spt *ServicePrincipalToken) RefreshWithContext(ctx context.Context) error {
+	// read without the lock, which is held for the duration of any refresh in flight
+	refreshed := atomic.LoadUint32(&spt.refreshed)
+
 	spt.refreshLock.Lock()
 	defer spt.refreshLock.Unlock()
-	return spt.refreshInternal(ctx, spt.inner.Resource)
+	if atomic.LoadUint32(&spt.refreshed) != refreshed {
+		// the token was refreshed while waiting for the lock
+		return nil
+	}
+	return spt.refreshOwnResource(ctx)
+}
+
+// refreshOwnResource refreshes the token for the resource of the ServicePrincipalToken, counting
+// successful refreshes. The caller must hold the write lock.
+func (spt *ServicePrincipalToken) refreshOwnResource(ctx context.Context) error {
+	err := spt.refreshInternal(ctx, spt.inner.Resource)
+	if err == nil {
+		atomic.AddUint32(&spt.refreshed, 1)
+	}
+	return err
 }
 
 // RefreshExchange refreshes the token, but for a different resource.
@@ -783,6 +1181,94 @@ func (spt *ServicePrincipalToken) RefreshExchangeWithContext(ctx context.Context
 	return spt.refreshInternal(ctx, resource)
 }
 
+// ForAuthority returns a ServicePrincipalToken for the passed resource that authenticates the same
+// client, in the same tenant, against the passed Azure Active Directory authority host (e.g.,
+// https://login.chinacloudapi.cn/), rather than the configured one. An empty authorityHost selects
+// the configured authority, and an empty resource the configured resource; if both are the
+// configured ones the ServicePrincipalToken itself is returned. Other tokens are cached by
+// authority host and resource, so the returned ServicePrincipalToken, which may be passed to
+// autorest.NewBearerAuthorizer, is shared by all callers asking for the same pair and refreshes its
+// own token, using the current refresh token when there is one. Tokens from managed identities or
+// token brokers, and manual or authorization code tokens without a refresh token, cannot be
+// redirected to another authority or resource.
+func (spt *ServicePrincipalToken) ForAuthority(authorityHost, resource string) (*ServicePrincipalToken, error) {
+	spt.refreshLock.RLock()
+	inner := spt.inner
+	claims := spt.claims
+	spt.refreshLock.RUnlock()
+
+	if _, ok := inner.Secret.(*ServicePrincipalMSISecret); ok || spt.broker != nil {
+		return nil, fmt.Errorf("adal: authority hosts cannot be overridden for managed identity or brokered tokens")
+	}
+	if resource == "" {
+		resource = inner.Resource
+	}
+	oauthConfig := inner.OauthConfig
+	if authorityHost != "" {
+		tenantID := strings.Trim(oauthConfig.AuthorityEndpoint.Path, "/")
+		if i := strings.LastIndex(tenantID, "/"); i >= 0 {
+			tenantID = tenantID[i+1:]
+		}
+		var apiVersion *string
+		if v := oauthConfig.TokenEndpoint.Query().Get("api-version"); v != "" {
+			apiVersion = &v
+		}
+		config, err := NewOAuthConfigWithAPIVersion(authorityHost, tenantID, apiVersion)
+		if err != nil {
+			return nil, fmt.Errorf("adal: failed to configure the authority host %s: %v", authorityHost, err)
+		}
+		oauthConfig = *config
+	}
+	if oauthConfig == inner.OauthConfig && resource == inner.Resource {
+		return spt, nil
+	}
+	// the new token is obtained with the refresh token, if any, and otherwise with the secret
+	refreshToken := inner.Token.RefreshToken
+	if refreshToken == "" {
+		switch inner.Secret.(type) {
+		case *ServicePrincipalNoSecret, *ServicePrincipalAuthorizationCodeSecret:
+			return nil, fmt.Errorf("adal: a token for another authority or resource requires a refresh token")
+		}
+	}
+	key := strings.ToLower(oauthConfig.TokenEndpoint.Scheme+"://"+oauthConfig.TokenEndpoint.Host) + " " + resource
+
+	spt.refreshLock.Lock()
+	defer spt.refreshLock.Unlock()
+	if authority, ok := spt.authorities[key]; ok {
+		return authority, nil
+	}
+	inner.Token = newToken()
+	inner.Token.RefreshToken = refreshToken
+	inner.OauthConfig = oauthConfig
+	inner.Resource = resource
+	authority := &ServicePrincipalToken{
+		inner:                 inner,
+		refreshLock:           &sync.RWMutex{},
+		sender:                spt.sender,
+		claims:                claims,
+		MaxMSIRefreshAttempts: spt.MaxMSIRefreshAttempts,
+	}
+	if spt.authorities == nil {
+		spt.authorities = map[string]*ServicePrincipalToken{}
+	}
+	spt.authorities[key] = authority
+	return authority, nil
+}
+
+// TokenForAuthority returns a fresh token for the passed resource acquired from the passed Azure
+// Active Directory authority host, refreshing the token cached for the pair if needed (see
+// ForAuthority).
+func (spt *ServicePrincipalToken) TokenForAuthority(ctx context.Context, authorityHost, resource string) (Token, error) {
+	authority, err := spt.ForAuthority(authorityHost, resource)
+	if err != nil {
+		return Token{}, err
+	}
+	if err = authority.EnsureFreshWithContext(ctx); err != nil {
+		return Token{}, err
+	}
+	return authority.Token(), nil
+}
+
 func (spt *ServicePrincipalToken) getGrantType() string {
 	switch spt.inner.Secret.(type) {
 	case *ServicePrincipalUsernamePasswordSecret:
@@ -816,6 +1302,17 @@ func isIMDS(u url.URL, envMsiEndpointExpected string) bool {
 }
 
 func (spt *ServicePrincipalToken) refreshInternal(ctx context.Context, resource string) error {
+	if spt.broker != nil {
+		token, err := spt.broker(ctx, resource)
+		if err != nil {
+			return fmt.Errorf("adal: Failed to acquire a token from the token broker. Error = '%v'", err)
+		}
+		if token.AccessToken == "" {
+			return fmt.Errorf("adal: Empty token received from the token broker")
+		}
+		spt.inner.Token = token
+		return spt.InvokeRefreshCallbacks(token)
+	}
 
 	req, err := http.NewRequest(http.MethodPost, spt.inner.OauthConfig.TokenEndpoint.String(), nil)
 	if err != nil {
@@ -851,6 +1348,10 @@ func (spt *ServicePrincipalToken) refreshInternal(ctx context.Context, resource
 			}
 		}
 
+		if spt.claims != "" {
+			v.Set("claims", spt.claims)
+		}
+
 		s := v.Encode()
 		body := ioutil.NopCloser(strings.NewReader(s))
 		req.ContentLength = int64(len(s))
@@ -985,14 +1486,17 @@ func containsInt(ints []int, n int) bool {
 
 // SetAutoRefresh enables or disables automatic refreshing of stale tokens.
 func (spt *ServicePrincipalToken) SetAutoRefresh(autoRefresh bool) {
+	spt.refreshLock.Lock()
+	defer spt.refreshLock.Unlock()
 	spt.inner.AutoRefresh = autoRefresh
 }
 
 // SetRefreshWithin sets the interval within which if the token will expire, EnsureFresh will
 // refresh the token.
 func (spt *ServicePrincipalToken) SetRefreshWithin(d time.Duration) {
+	spt.refreshLock.Lock()
+	defer spt.refreshLock.Unlock()
 	spt.inner.RefreshWithin = d
-	return
 }
 
 // SetSender sets the http.Client used when obtaining the Service Principal token. An
@@ -1012,3 +1516,9 @@ func (spt *ServicePrincipalToken) Token() Token {
 	defer spt.refreshLock.RUnlock()
 	return spt.inner.Token
 }
+
+// LifetimeRemaining returns the fraction of the current token's lifetime that remains (see
+// Token.LifetimeRemaining), allowing the freshness of the cached token to be monitored.
+func (spt *ServicePrincipalToken) LifetimeRemaining() (fraction float64, ok bool) {
+	return spt.Token().LifetimeRemaining()
+}
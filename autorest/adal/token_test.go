@@ -18,8 +18,10 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -52,6 +54,49 @@ func TestTokenExpires(t *testing.T) {
 	}
 }
 
+func TestTokenExpiresOnValues(t *testing.T) {
+	now := time.Now().Truncate(time.Second).UTC()
+	cases := []struct {
+		name      string
+		expiresOn json.Number
+		expires   time.Time
+		expired   bool
+	}{
+		{"valid", "1500000000", time.Unix(1500000000, 0).UTC(), true},
+		{"past", json.Number(strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)), now.Add(-time.Hour), true},
+		{"future", json.Number(strconv.FormatInt(now.Add(time.Hour).Unix(), 10)), now.Add(time.Hour), false},
+		{"empty", "", time.Time{}, true},
+		{"unparseable", "tomorrow", time.Time{}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tk := Token{ExpiresOn: c.expiresOn}
+			if !c.expires.IsZero() && !tk.Expires().Equal(c.expires) {
+				t.Fatalf("adal: Token#Expires returned %v, expected %v", tk.Expires(), c.expires)
+			}
+			if tk.Expires().Location() != time.UTC {
+				t.Fatalf("adal: Token#Expires returned %v, expected a UTC time", tk.Expires())
+			}
+			if tk.IsExpired() != c.expired {
+				t.Fatalf("adal: Token#IsExpired returned %v, expected %v", tk.IsExpired(), c.expired)
+			}
+		})
+	}
+}
+
+func TestTokenValidFrom(t *testing.T) {
+	tt := time.Now().Add(5 * time.Second).Truncate(time.Second).UTC()
+	tk := newToken()
+	tk.NotBefore = json.Number(strconv.FormatInt(tt.Unix(), 10))
+
+	if !tk.ValidFrom().Equal(tt) {
+		t.Fatalf("adal: Token#ValidFrom miscalculated not before time -- received %v, expected %v", tk.ValidFrom(), tt)
+	}
+	if !(Token{}).ValidFrom().IsZero() {
+		t.Fatalf("adal: Token#ValidFrom returned %v for a token without a not before time", (Token{}).ValidFrom())
+	}
+}
+
 func TestTokenIsExpired(t *testing.T) {
 	tk := newTokenExpiresAt(time.Now().Add(-5 * time.Second))
 
@@ -86,6 +131,51 @@ func TestTokenWillExpireIn(t *testing.T) {
 	}
 }
 
+func TestTokenUnmarshalJSONNumericFields(t *testing.T) {
+	cases := []struct {
+		name      string
+		json      string
+		expiresIn json.Number
+		expiresOn json.Number
+		notBefore json.Number
+	}{
+		{"string", `{"expires_in":"3600","expires_on":"1500003600","not_before":"1500000000"}`, "3600", "1500003600", "1500000000"},
+		{"numeric", `{"expires_in":3600,"expires_on":1500003600,"not_before":1500000000}`, "3600", "1500003600", "1500000000"},
+		{"mixed", `{"expires_in":3600,"expires_on":"1500003600"}`, "3600", "1500003600", ""},
+		{"missing", `{"access_token":"token"}`, "", "", ""},
+		{"null and empty", `{"expires_in":null,"expires_on":""}`, "", "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var tk Token
+			if err := json.Unmarshal([]byte(c.json), &tk); err != nil {
+				t.Fatalf("adal: Token#UnmarshalJSON returned an unexpected error (%v)", err)
+			}
+			if tk.ExpiresIn != c.expiresIn || tk.ExpiresOn != c.expiresOn || tk.NotBefore != c.notBefore {
+				t.Fatalf("adal: Token#UnmarshalJSON got (%q, %q, %q), expected (%q, %q, %q)",
+					tk.ExpiresIn, tk.ExpiresOn, tk.NotBefore, c.expiresIn, c.expiresOn, c.notBefore)
+			}
+		})
+	}
+}
+
+func TestTokenUnmarshalJSONPreservesOtherFields(t *testing.T) {
+	var tk Token
+	if err := json.Unmarshal([]byte(`{"access_token":"a","refresh_token":"r","resource":"res","token_type":"Bearer","expires_on":1}`), &tk); err != nil {
+		t.Fatalf("adal: Token#UnmarshalJSON returned an unexpected error (%v)", err)
+	}
+	if tk.AccessToken != "a" || tk.RefreshToken != "r" || tk.Resource != "res" || tk.Type != "Bearer" {
+		t.Fatalf("adal: Token#UnmarshalJSON dropped fields (%+v)", tk)
+	}
+}
+
+func TestTokenUnmarshalJSONRejectsNonNumeric(t *testing.T) {
+	var tk Token
+	if err := json.Unmarshal([]byte(`{"expires_on":"tomorrow"}`), &tk); err == nil {
+		t.Fatal("adal: Token#UnmarshalJSON accepted a non-numeric expires_on")
+	}
+}
+
 func TestServicePrincipalTokenSetAutoRefresh(t *testing.T) {
 	spt := newServicePrincipalToken()
 
@@ -336,6 +426,93 @@ func TestServicePrincipalTokenCertficateRefreshSetsBody(t *testing.T) {
 	})
 }
 
+func TestServicePrincipalTokenCertificateSendsSignedAssertion(t *testing.T) {
+	spt := newServicePrincipalTokenCertificate(t)
+	secret := spt.inner.Secret.(*ServicePrincipalCertificateSecret)
+	thumbprint := sha1.Sum(secret.Certificate.Raw)
+
+	s := SenderFunc(func(r *http.Request) (*http.Response, error) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("adal: Failed to read body of Service Principal token request (%v)", err)
+		}
+		values, _ := url.ParseQuery(string(b))
+		tok, err := jwt.Parse(values.Get("client_assertion"), func(tok *jwt.Token) (interface{}, error) {
+			if tok.Method != jwt.SigningMethodRS256 {
+				return nil, fmt.Errorf("unexpected signing method %v", tok.Header["alg"])
+			}
+			return &secret.PrivateKey.PublicKey, nil
+		})
+		if err != nil || !tok.Valid {
+			t.Fatalf("adal: ServicePrincipalTokenCertificate#Refresh sent a client assertion that failed verification (%v)", err)
+		}
+		if x5t := tok.Header["x5t"]; x5t != base64.URLEncoding.EncodeToString(thumbprint[:]) {
+			t.Fatalf("adal: ServicePrincipalTokenCertificate#Refresh sent x5t %v, expected the certificate thumbprint", x5t)
+		}
+		claims := tok.Claims.(jwt.MapClaims)
+		if claims["aud"] != TestOAuthConfig.TokenEndpoint.String() || claims["iss"] != "id" || claims["sub"] != "id" {
+			t.Fatalf("adal: ServicePrincipalTokenCertificate#Refresh sent unexpected claims %v", claims)
+		}
+		return mocks.NewResponseWithContent(newTokenJSON(fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()), "resource")), nil
+	})
+	spt.SetSender(s)
+	if err := spt.Refresh(); err != nil {
+		t.Fatalf("adal: ServicePrincipalToken#Refresh returned an unexpected error (%v)", err)
+	}
+}
+
+func TestServicePrincipalTokenCertificateSignsNewAssertionOnEveryRefresh(t *testing.T) {
+	spt := newServicePrincipalTokenCertificate(t)
+	secret := spt.inner.Secret.(*ServicePrincipalCertificateSecret)
+
+	var claims []jwt.MapClaims
+	s := SenderFunc(func(r *http.Request) (*http.Response, error) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("adal: Failed to read body of Service Principal token request (%v)", err)
+		}
+		values, _ := url.ParseQuery(string(b))
+		tok, err := jwt.Parse(values.Get("client_assertion"), func(tok *jwt.Token) (interface{}, error) {
+			return &secret.PrivateKey.PublicKey, nil
+		})
+		if err != nil || !tok.Valid {
+			t.Fatalf("adal: ServicePrincipalTokenCertificate#Refresh sent a client assertion that failed verification (%v)", err)
+		}
+		claims = append(claims, tok.Claims.(jwt.MapClaims))
+		return mocks.NewResponseWithContent(newTokenJSON(fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()), "resource")), nil
+	})
+	spt.SetSender(s)
+	for i := 0; i < 2; i++ {
+		// authenticate with the certificate rather than the refresh token returned by the first refresh
+		spt.inner.Token.RefreshToken = ""
+		if err := spt.Refresh(); err != nil {
+			t.Fatalf("adal: ServicePrincipalToken#Refresh returned an unexpected error (%v)", err)
+		}
+	}
+	if len(claims) != 2 {
+		t.Fatalf("adal: ServicePrincipalToken#Refresh sent %d token requests, expected 2", len(claims))
+	}
+	if claims[0]["jti"] == claims[1]["jti"] {
+		t.Fatalf("adal: ServicePrincipalToken#Refresh reused the client assertion with jti %v", claims[0]["jti"])
+	}
+}
+
+func TestServicePrincipalCertificateSecretAssertionLifetime(t *testing.T) {
+	spt := newServicePrincipalTokenCertificate(t)
+	secret := spt.inner.Secret.(*ServicePrincipalCertificateSecret)
+	secret.AssertionLifetime = time.Hour
+
+	signed, err := secret.SignJwt(spt)
+	if err != nil {
+		t.Fatalf("adal: ServicePrincipalCertificateSecret#SignJwt returned an error (%v)", err)
+	}
+	tok, _ := jwt.Parse(signed, nil)
+	claims := tok.Claims.(jwt.MapClaims)
+	if lifetime := claims["exp"].(float64) - claims["nbf"].(float64); lifetime != time.Hour.Seconds() {
+		t.Fatalf("adal: ServicePrincipalCertificateSecret#SignJwt issued an assertion valid for %vs, expected %vs", lifetime, time.Hour.Seconds())
+	}
+}
+
 func TestServicePrincipalTokenUsernamePasswordRefreshSetsBody(t *testing.T) {
 	spt := newServicePrincipalTokenUsernamePassword(t)
 	testServicePrincipalTokenRefreshSetsBody(t, spt, func(t *testing.T, b []byte) {
@@ -352,6 +529,31 @@ func TestServicePrincipalTokenUsernamePasswordRefreshSetsBody(t *testing.T) {
 	})
 }
 
+func TestServicePrincipalTokenUsernamePasswordReusesRefreshToken(t *testing.T) {
+	spt := newServicePrincipalTokenUsernamePassword(t)
+	var sent []url.Values
+	spt.SetSender(SenderFunc(func(r *http.Request) (*http.Response, error) {
+		b, _ := ioutil.ReadAll(r.Body)
+		v, _ := url.ParseQuery(string(b))
+		sent = append(sent, v)
+		expiresOn := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+		return mocks.NewResponseWithContent(newTokenJSON(expiresOn, "resource")), nil
+	}))
+	for i := 0; i < 2; i++ {
+		if err := spt.Refresh(); err != nil {
+			t.Fatalf("adal: ServicePrincipalToken#Refresh returned an unexpected error (%v)", err)
+		}
+	}
+
+	if sent[0].Get("grant_type") != "password" || sent[0].Get("password") != "password" {
+		t.Fatalf("adal: ServicePrincipalTokenUsernamePassword#Refresh did not submit the credentials (%v)", sent[0])
+	}
+	// newTokenJSON returns the refresh token ABC123
+	if sent[1].Get("grant_type") != "refresh_token" || sent[1].Get("refresh_token") != "ABC123" || sent[1].Get("password") != "" {
+		t.Fatalf("adal: ServicePrincipalTokenUsernamePassword#Refresh did not reuse the refresh token (%v)", sent[1])
+	}
+}
+
 func TestServicePrincipalTokenAuthorizationCodeRefreshSetsBody(t *testing.T) {
 	spt := newServicePrincipalTokenAuthorizationCode(t)
 	testServicePrincipalTokenRefreshSetsBody(t, spt, func(t *testing.T, b []byte) {
@@ -544,6 +746,50 @@ func TestServicePrincipalTokenEnsureFreshRefreshes(t *testing.T) {
 	}
 }
 
+func testServicePrincipalTokenConcurrentRefresh(t *testing.T, refresh func(spt *ServicePrincipalToken) error) {
+	spt := newServicePrincipalToken()
+	expireToken(&spt.inner.Token)
+
+	var mu sync.Mutex
+	requests := 0
+	spt.SetSender(SenderFunc(func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		// keep the refresh in flight while the other goroutines arrive
+		time.Sleep(50 * time.Millisecond)
+		return mocks.NewResponseWithContent(newTokenJSON(fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix()), "resource")), nil
+	}))
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if err := refresh(spt); err != nil {
+				t.Errorf("adal: ServicePrincipalToken refresh returned an unexpected error (%v)", err)
+			}
+			_ = spt.OAuthToken()
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if requests != 1 {
+		t.Fatalf("adal: concurrent refreshes sent %d token requests, expected 1", requests)
+	}
+}
+
+func TestServicePrincipalTokenConcurrentRefresh(t *testing.T) {
+	testServicePrincipalTokenConcurrentRefresh(t, (*ServicePrincipalToken).Refresh)
+}
+
+func TestServicePrincipalTokenConcurrentEnsureFresh(t *testing.T) {
+	testServicePrincipalTokenConcurrentRefresh(t, (*ServicePrincipalToken).EnsureFresh)
+}
+
 func TestServicePrincipalTokenEnsureFreshFails(t *testing.T) {
 	spt := newServicePrincipalToken()
 	expireToken(&spt.inner.Token)
@@ -561,6 +807,25 @@ func TestServicePrincipalTokenEnsureFreshFails(t *testing.T) {
 	}
 }
 
+func TestServicePrincipalTokenEnsureFreshRefreshesWithinMargin(t *testing.T) {
+	spt := newServicePrincipalToken()
+	spt.SetRefreshWithin(5 * time.Minute)
+	setTokenToExpireIn(&spt.inner.Token, 2*time.Minute)
+
+	refreshed := false
+	spt.SetSender(SenderFunc(func(r *http.Request) (*http.Response, error) {
+		refreshed = true
+		expiresOn := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+		return mocks.NewResponseWithContent(newTokenJSON(expiresOn, "resource")), nil
+	}))
+	if err := spt.EnsureFresh(); err != nil {
+		t.Fatalf("adal: ServicePrincipalToken#EnsureFresh returned an unexpected error (%v)", err)
+	}
+	if !refreshed {
+		t.Fatal("adal: ServicePrincipalToken#EnsureFresh failed to refresh a token expiring within the refresh margin")
+	}
+}
+
 func TestServicePrincipalTokenEnsureFreshSkipsIfFresh(t *testing.T) {
 	spt := newServicePrincipalToken()
 	setTokenToExpireIn(&spt.inner.Token, 1000*time.Second)
@@ -627,6 +892,55 @@ func TestRefreshCallbackErrorPropagates(t *testing.T) {
 	}
 }
 
+func TestSetRefreshCallbacksInvokedOncePerRefresh(t *testing.T) {
+	spt := newServicePrincipalToken()
+	var received []Token
+	spt.SetRefreshCallbacks([]TokenRefreshCallback{func(token Token) error {
+		received = append(received, token)
+		return nil
+	}})
+
+	sender := mocks.NewSender()
+	for _, accessToken := range []string{"first", "second"} {
+		expiresOn := strconv.Itoa(int(time.Now().Add(3600 * time.Second).Sub(date.UnixEpoch()).Seconds()))
+		j := strings.Replace(newTokenJSON(expiresOn, "resource"), "accessToken", accessToken, 1)
+		sender.AppendResponse(mocks.NewResponseWithContent(j))
+	}
+	spt.SetSender(sender)
+	for i := 0; i < 2; i++ {
+		if err := spt.Refresh(); err != nil {
+			t.Fatalf("adal: ServicePrincipalToken#Refresh returned an unexpected error (%v)", err)
+		}
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("adal: RefreshCallback was invoked %d times for 2 refreshes", len(received))
+	}
+	if received[0].AccessToken != "first" || received[1].AccessToken != "second" {
+		t.Fatalf("adal: RefreshCallback received tokens %q and %q, expected the refreshed tokens", received[0].AccessToken, received[1].AccessToken)
+	}
+}
+
+func TestServicePrincipalTokenSetClaimsSendsClaims(t *testing.T) {
+	claims := `{"access_token":{"acrs":{"essential":true,"value":"c1"}}}`
+	spt := newServicePrincipalToken()
+	spt.SetClaims(claims)
+
+	var sent url.Values
+	spt.SetSender(SenderFunc(func(r *http.Request) (*http.Response, error) {
+		b, _ := ioutil.ReadAll(r.Body)
+		sent, _ = url.ParseQuery(string(b))
+		expiresOn := strconv.Itoa(int(time.Now().Add(3600 * time.Second).Sub(date.UnixEpoch()).Seconds()))
+		return mocks.NewResponseWithContent(newTokenJSON(expiresOn, "resource")), nil
+	}))
+	if err := spt.Refresh(); err != nil {
+		t.Fatalf("adal: ServicePrincipalToken#Refresh returned an unexpected error (%v)", err)
+	}
+	if sent.Get("claims") != claims {
+		t.Fatalf("adal: ServicePrincipalToken#Refresh sent claims %q, expected %q", sent.Get("claims"), claims)
+	}
+}
+
 // This demonstrates the danger of manual token without a refresh token
 func TestServicePrincipalTokenManualRefreshFailsWithoutRefresh(t *testing.T) {
 	spt := newServicePrincipalTokenManual()
@@ -660,6 +974,63 @@ func TestNewServicePrincipalTokenFromMSI(t *testing.T) {
 	}
 }
 
+func TestServicePrincipalTokenFromMSIRefreshPopulatesToken(t *testing.T) {
+	endpoint, _ := GetMSIVMEndpoint()
+	spt, err := NewServicePrincipalTokenFromMSI(endpoint, "https://management.azure.com/")
+	if err != nil {
+		t.Fatalf("Failed to get MSI SPT: %v", err)
+	}
+
+	expiresOn := time.Now().Add(time.Hour).Unix()
+	sender := mocks.NewSender()
+	sender.AppendResponse(mocks.NewResponseWithContent(fmt.Sprintf(`{
+		"access_token": "msiAccessToken",
+		"refresh_token": "",
+		"expires_in": "3599",
+		"expires_on": "%d",
+		"not_before": "%d",
+		"resource": "https://management.azure.com/",
+		"token_type": "Bearer"
+		}`, expiresOn, expiresOn-3600)))
+	spt.SetSender(sender)
+
+	if err = spt.Refresh(); err != nil {
+		t.Fatalf("adal: ServicePrincipalToken#Refresh returned an unexpected error (%v)", err)
+	}
+	token := spt.Token()
+	if token.AccessToken != "msiAccessToken" || token.Type != "Bearer" || token.Resource != "https://management.azure.com/" {
+		t.Fatalf("adal: ServicePrincipalToken#Refresh failed to populate the token from the MSI response (%v)", token)
+	}
+	if !token.Expires().Equal(time.Unix(expiresOn, 0)) {
+		t.Fatalf("adal: ServicePrincipalToken#Refresh parsed expires_on as %v, expected %v", token.Expires(), time.Unix(expiresOn, 0))
+	}
+}
+
+func TestNewServicePrincipalTokenFromMSIWithSecret(t *testing.T) {
+	spt, err := NewServicePrincipalTokenFromMSIWithSecret("http://localhost:8081/msi/token", "https://resource", "msiSecret")
+	if err != nil {
+		t.Fatalf("Failed to get MSI SPT: %v", err)
+	}
+
+	sender := mocks.NewSender()
+	sender.AppendResponse(mocks.NewResponseWithContent(newTokenJSON("3600", "https://resource")))
+	s := DecorateSender(sender,
+		(func() SendDecorator {
+			return func(s Sender) Sender {
+				return SenderFunc(func(r *http.Request) (*http.Response, error) {
+					if h := r.Header.Get("secret"); h != "msiSecret" {
+						t.Fatalf("adal: ServicePrincipalToken#Refresh sent secret header %q, expected %q", h, "msiSecret")
+					}
+					return s.Do(r)
+				})
+			}
+		})())
+	spt.SetSender(s)
+	if err = spt.Refresh(); err != nil {
+		t.Fatalf("adal: ServicePrincipalToken#Refresh returned an unexpected error (%v)", err)
+	}
+}
+
 func TestNewServicePrincipalTokenFromMSIWithUserAssignedID(t *testing.T) {
 	resource := "https://resource"
 	userID := "abc123"
@@ -815,6 +1186,53 @@ func TestMarshalServicePrincipalAuthorizationCodeSecret(t *testing.T) {
 	}
 }
 
+func TestUnmarshalInnerToken(t *testing.T) {
+	spt := newServicePrincipalTokenManual()
+	token := newTokenExpiresIn(time.Hour)
+	token.AccessToken = "restored"
+	tokenJSON, err := json.Marshal(token)
+	if err != nil {
+		t.Fatalf("failed to marshal test token: %+v", err)
+	}
+
+	if err := spt.UnmarshalTokenJSON(tokenJSON); err != nil {
+		t.Fatalf("failed to unmarshal token: %+v", err)
+	}
+	if spt.Token() != *token {
+		t.Fatalf("tokens don't match: %v, %v", spt.Token(), *token)
+	}
+}
+
+func TestNewServicePrincipalTokenFromConfig(t *testing.T) {
+	spt := newServicePrincipalToken()
+	spt.SetAutoRefresh(false)
+	spt.SetRefreshWithin(time.Minute)
+
+	configJSON, err := json.Marshal(spt.Config())
+	if err != nil {
+		t.Fatalf("failed to marshal config: %+v", err)
+	}
+	if strings.Contains(string(configJSON), "secret") {
+		t.Fatalf("config snapshot contains the secret: %s", configJSON)
+	}
+	var config ServicePrincipalTokenConfig
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		t.Fatalf("failed to unmarshal config: %+v", err)
+	}
+
+	token := newTokenExpiresIn(time.Hour)
+	restored, err := NewServicePrincipalTokenFromConfig(config, *token)
+	if err != nil {
+		t.Fatalf("failed to create token from config: %+v", err)
+	}
+	if !reflect.DeepEqual(restored.Config(), spt.Config()) {
+		t.Fatalf("configs don't match: %+v, %+v", restored.Config(), spt.Config())
+	}
+	if restored.Token() != *token {
+		t.Fatalf("tokens don't match: %v, %v", restored.Token(), *token)
+	}
+}
+
 func TestMarshalInnerToken(t *testing.T) {
 	spt := newServicePrincipalTokenManual()
 	tokenJSON, err := spt.MarshalTokenJSON()
@@ -845,6 +1263,281 @@ func TestMarshalInnerToken(t *testing.T) {
 	}
 }
 
+func TestServicePrincipalTokenRefreshDaemon(t *testing.T) {
+	spt := newServicePrincipalToken()
+	expireToken(&spt.inner.Token)
+	expiresOn := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	refreshed := make(chan struct{}, 1)
+	spt.SetSender(SenderFunc(func(r *http.Request) (*http.Response, error) {
+		select {
+		case refreshed <- struct{}{}:
+		default:
+		}
+		return mocks.NewResponseWithBodyAndStatus(mocks.NewBody(newTokenJSON(expiresOn, "resource")), http.StatusOK, "OK"), nil
+	}))
+
+	if err := spt.StartRefreshDaemon(context.Background()); err != nil {
+		t.Fatalf("adal: ServicePrincipalToken#StartRefreshDaemon returned an error (%v)", err)
+	}
+	if err := spt.StartRefreshDaemon(context.Background()); err == nil {
+		t.Fatal("adal: ServicePrincipalToken#StartRefreshDaemon failed to return an error when already running")
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("adal: ServicePrincipalToken refresh daemon failed to refresh a stale token")
+	}
+	spt.StopRefreshDaemon()
+	if spt.Token().WillExpireIn(spt.inner.RefreshWithin) {
+		t.Fatal("adal: ServicePrincipalToken refresh daemon failed to store the refreshed token")
+	}
+	if err := spt.StartRefreshDaemon(context.Background()); err != nil {
+		t.Fatalf("adal: ServicePrincipalToken#StartRefreshDaemon failed to restart (%v)", err)
+	}
+	spt.StopRefreshDaemon()
+}
+
+func TestServicePrincipalTokenRefreshDaemonStopsOnCancel(t *testing.T) {
+	spt := newServicePrincipalToken()
+	setTokenToExpireIn(&spt.inner.Token, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := spt.StartRefreshDaemon(ctx); err != nil {
+		t.Fatalf("adal: ServicePrincipalToken#StartRefreshDaemon returned an error (%v)", err)
+	}
+	done := spt.daemon.done
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("adal: ServicePrincipalToken refresh daemon failed to exit when its context was canceled")
+	}
+}
+
+func TestServicePrincipalTokenRefreshDaemonSetRefreshWithin(t *testing.T) {
+	spt := newServicePrincipalToken()
+	setTokenToExpireIn(&spt.inner.Token, time.Hour)
+	if err := spt.StartRefreshDaemon(context.Background()); err != nil {
+		t.Fatalf("adal: ServicePrincipalToken#StartRefreshDaemon returned an error (%v)", err)
+	}
+	defer spt.StopRefreshDaemon()
+	// run with -race to detect unsynchronized access between the daemon and the setters
+	for i := 0; i < 10; i++ {
+		spt.SetRefreshWithin(time.Duration(i) * time.Minute)
+		spt.SetAutoRefresh(i%2 == 0)
+	}
+}
+
+func newAccessTokenWithClaims(claims string) string {
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2ln"
+}
+
+func TestSameIdentity(t *testing.T) {
+	cases := []struct {
+		claims1, claims2 string
+		expected         bool
+	}{
+		{`{"oid":"o1","tid":"t1","sub":"s1","aud":"https://management.azure.com/"}`, `{"oid":"o1","tid":"t1","sub":"s1","aud":"https://vault.azure.net"}`, true},
+		{`{"oid":"o1","tid":"t1"}`, `{"oid":"o2","tid":"t1"}`, false},
+		{`{"oid":"o1","tid":"t1"}`, `{"oid":"o1","tid":"t2"}`, false},
+		{`{"tid":"t1","sub":"s1"}`, `{"oid":"o1","tid":"t1","sub":"s1"}`, true},
+		{`{"tid":"t1","sub":"s1"}`, `{"tid":"t1","sub":"s2"}`, false},
+	}
+	for _, c := range cases {
+		same, err := SameIdentity(Token{AccessToken: newAccessTokenWithClaims(c.claims1)}, Token{AccessToken: newAccessTokenWithClaims(c.claims2)})
+		if err != nil {
+			t.Fatalf("adal: SameIdentity returned an error (%v)", err)
+		}
+		if same != c.expected {
+			t.Fatalf("adal: SameIdentity(%s, %s) returned %v, expected %v", c.claims1, c.claims2, same, c.expected)
+		}
+	}
+}
+
+func TestServicePrincipalTokenLifetimeRemaining(t *testing.T) {
+	spt := newServicePrincipalToken()
+	issued := time.Now().Add(-15 * time.Minute)
+	spt.inner.Token.AccessToken = newAccessTokenWithClaims(fmt.Sprintf(`{"iat":%d}`, issued.Unix()))
+	setTokenToExpireAt(&spt.inner.Token, issued.Add(time.Hour))
+
+	fraction, ok := spt.LifetimeRemaining()
+	if !ok {
+		t.Fatal("adal: ServicePrincipalToken#LifetimeRemaining failed for a token with an iat claim")
+	}
+	if fraction < 0.74 || fraction > 0.76 {
+		t.Fatalf("adal: ServicePrincipalToken#LifetimeRemaining returned %v, expected 0.75", fraction)
+	}
+
+	setTokenToExpireAt(&spt.inner.Token, issued.Add(time.Minute))
+	if fraction, ok = spt.LifetimeRemaining(); !ok || fraction != 0 {
+		t.Fatalf("adal: ServicePrincipalToken#LifetimeRemaining returned %v, %v for an expired token", fraction, ok)
+	}
+}
+
+func TestServicePrincipalTokenLifetimeRemainingWithoutIssuedAt(t *testing.T) {
+	spt := newServicePrincipalToken()
+	spt.inner.Token.AccessToken = newAccessTokenWithClaims(`{"oid":"o1"}`)
+	setTokenToExpireIn(&spt.inner.Token, time.Hour)
+	if _, ok := spt.LifetimeRemaining(); ok {
+		t.Fatal("adal: ServicePrincipalToken#LifetimeRemaining returned ok for a token without an iat claim")
+	}
+}
+
+func TestSameIdentityRequiresJWT(t *testing.T) {
+	if _, err := SameIdentity(Token{AccessToken: "opaque"}, Token{AccessToken: newAccessTokenWithClaims(`{"oid":"o1"}`)}); err == nil {
+		t.Fatal("adal: SameIdentity failed to return an error for an access token that is not a JWT")
+	}
+	if _, err := SameIdentity(Token{AccessToken: newAccessTokenWithClaims(`{"aud":"a"}`)}, Token{AccessToken: newAccessTokenWithClaims(`{"oid":"o1"}`)}); err == nil {
+		t.Fatal("adal: SameIdentity failed to return an error for an access token without identity claims")
+	}
+}
+
+func TestNewServicePrincipalTokenFromBroker(t *testing.T) {
+	var resources []string
+	broker := func(ctx context.Context, resource string) (Token, error) {
+		resources = append(resources, resource)
+		token := newTokenExpiresIn(time.Hour)
+		token.AccessToken = "brokered"
+		return *token, nil
+	}
+	refreshed := false
+	spt, err := NewServicePrincipalTokenFromBroker("id", "resource", broker, func(Token) error {
+		refreshed = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("adal: NewServicePrincipalTokenFromBroker returned an error (%v)", err)
+	}
+	spt.SetSender(SenderFunc(func(r *http.Request) (*http.Response, error) {
+		t.Fatal("adal: ServicePrincipalToken sent a request despite using a token broker")
+		return nil, nil
+	}))
+
+	if err = spt.EnsureFresh(); err != nil {
+		t.Fatalf("adal: ServicePrincipalToken#EnsureFresh returned an error (%v)", err)
+	}
+	if err = spt.EnsureFresh(); err != nil {
+		t.Fatalf("adal: ServicePrincipalToken#EnsureFresh returned an error (%v)", err)
+	}
+	if !reflect.DeepEqual(resources, []string{"resource"}) {
+		t.Fatalf("adal: ServicePrincipalToken called the token broker for %v, expected a single call for resource", resources)
+	}
+	if spt.OAuthToken() != "brokered" || !refreshed {
+		t.Fatal("adal: ServicePrincipalToken failed to store the brokered token")
+	}
+}
+
+func TestServicePrincipalTokenForAuthority(t *testing.T) {
+	spt := newServicePrincipalToken()
+	var requests []string
+	spt.SetSender(SenderFunc(func(r *http.Request) (*http.Response, error) {
+		b, _ := ioutil.ReadAll(r.Body)
+		v, _ := url.ParseQuery(string(b))
+		requests = append(requests, r.URL.String()+" "+v.Get("resource"))
+		expiresOn := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+		return mocks.NewResponseWithContent(newTokenJSON(expiresOn, v.Get("resource"))), nil
+	}))
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		token, err := spt.TokenForAuthority(ctx, "https://login.chinacloudapi.cn/", "china")
+		if err != nil {
+			t.Fatalf("adal: ServicePrincipalToken#TokenForAuthority returned an unexpected error (%v)", err)
+		}
+		if token.Resource != "china" {
+			t.Fatalf("adal: ServicePrincipalToken#TokenForAuthority returned a token for %s", token.Resource)
+		}
+	}
+	if _, err := spt.TokenForAuthority(ctx, "", "other"); err != nil {
+		t.Fatalf("adal: ServicePrincipalToken#TokenForAuthority returned an unexpected error (%v)", err)
+	}
+
+	expected := []string{
+		"https://login.chinacloudapi.cn/SomeTenantID/oauth2/token?api-version=1.0 china",
+		"https://login.test.com/SomeTenantID/oauth2/token?api-version=1.0 other",
+	}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Fatalf("adal: ServicePrincipalToken#TokenForAuthority sent %v, expected %v", requests, expected)
+	}
+	if spt.OAuthToken() != "" {
+		t.Fatal("adal: ServicePrincipalToken#TokenForAuthority replaced the configured token")
+	}
+}
+
+func TestServicePrincipalTokenForAuthorityDefaultsToItself(t *testing.T) {
+	spt := newServicePrincipalToken()
+	authority, err := spt.ForAuthority("", "")
+	if err != nil || authority != spt {
+		t.Fatalf("adal: ServicePrincipalToken#ForAuthority returned (%p, %v), expected the ServicePrincipalToken itself", authority, err)
+	}
+}
+
+func TestServicePrincipalTokenForAuthorityCarriesRefreshToken(t *testing.T) {
+	spt := newServicePrincipalTokenManual()
+	var grants []string
+	spt.SetSender(SenderFunc(func(r *http.Request) (*http.Response, error) {
+		b, _ := ioutil.ReadAll(r.Body)
+		v, _ := url.ParseQuery(string(b))
+		grants = append(grants, v.Get("grant_type")+" "+v.Get("refresh_token"))
+		expiresOn := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+		return mocks.NewResponseWithContent(newTokenJSON(expiresOn, v.Get("resource"))), nil
+	}))
+
+	authority, err := spt.ForAuthority("", "other")
+	if err != nil {
+		t.Fatalf("adal: ServicePrincipalToken#ForAuthority returned an unexpected error (%v)", err)
+	}
+	if err := authority.Refresh(); err != nil {
+		t.Fatalf("adal: ServicePrincipalToken#Refresh returned an unexpected error (%v)", err)
+	}
+	if expected := []string{"refresh_token refreshtoken"}; !reflect.DeepEqual(grants, expected) {
+		t.Fatalf("adal: ServicePrincipalToken#ForAuthority refreshed with %v, expected %v", grants, expected)
+	}
+}
+
+func TestServicePrincipalTokenForAuthorityRequiresRefreshToken(t *testing.T) {
+	spt, _ := NewServicePrincipalTokenFromManualToken(TestOAuthConfig, "id", "resource", newToken())
+	if _, err := spt.ForAuthority("", "other"); err == nil {
+		t.Fatal("adal: ServicePrincipalToken#ForAuthority returned a token that cannot be refreshed")
+	}
+}
+
+func TestServicePrincipalTokenForAuthorityDuringRefresh(t *testing.T) {
+	spt := newServicePrincipalToken()
+	spt.SetSender(SenderFunc(func(r *http.Request) (*http.Response, error) {
+		expiresOn := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+		return mocks.NewResponseWithContent(newTokenJSON(expiresOn, "resource")), nil
+	}))
+	// run with -race to detect unsynchronized access to the ServicePrincipalToken
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		spt.Refresh()
+	}()
+	if _, err := spt.ForAuthority("https://login.chinacloudapi.cn/", "china"); err != nil {
+		t.Fatalf("adal: ServicePrincipalToken#ForAuthority returned an unexpected error (%v)", err)
+	}
+	<-done
+}
+
+func TestServicePrincipalTokenForAuthorityRejectsMSI(t *testing.T) {
+	spt, _ := NewServicePrincipalTokenFromMSI("http://msiendpoint/", "resource")
+	if _, err := spt.ForAuthority("https://login.chinacloudapi.cn/", "resource"); err == nil {
+		t.Fatal("adal: ServicePrincipalToken#ForAuthority redirected a managed identity token")
+	}
+}
+
+func TestNewServicePrincipalTokenFromBrokerReturnsBrokerErrors(t *testing.T) {
+	spt, _ := NewServicePrincipalTokenFromBroker("id", "resource", func(ctx context.Context, resource string) (Token, error) {
+		return Token{}, fmt.Errorf("broker unavailable")
+	})
+	if err := spt.Refresh(); err == nil || !strings.Contains(err.Error(), "broker unavailable") {
+		t.Fatalf("adal: ServicePrincipalToken#Refresh returned %v, expected the broker error", err)
+	}
+	if _, err := NewServicePrincipalTokenFromBroker("id", "resource", nil); err == nil {
+		t.Fatal("adal: NewServicePrincipalTokenFromBroker failed to return an error for a nil broker")
+	}
+}
+
 func newTokenJSON(expiresOn string, resource string) string {
 	return fmt.Sprintf(`{
 		"access_token" : "accessToken",
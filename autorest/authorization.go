@@ -15,10 +15,15 @@ package autorest
 //  limitations under the License.
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/noahhai/go-autorest/autorest/adal"
 	"github.com/noahhai/go-autorest/tracing"
@@ -28,11 +33,21 @@ const (
 	bearerChallengeHeader       = "Www-Authenticate"
 	bearer                      = "Bearer"
 	tenantID                    = "tenantID"
+	authority                   = "authority"
 	apiKeyAuthorizerHeader      = "Ocp-Apim-Subscription-Key"
 	bingAPISdkHeader            = "X-BingApis-SDK-Client"
 	golangBingAPISdkHeaderValue = "Go-SDK"
+
+	// tokenNotBeforeSkew is the clock skew tolerated when enforcing a token's not_before time.
+	tokenNotBeforeSkew = time.Minute
+
+	// tokenNotBeforeMaxWait is the longest BearerAuthorizer waits for a token to become valid.
+	tokenNotBeforeMaxWait = 10 * time.Second
 )
 
+// claimsChallengePattern matches the base64 encoded claims parameter of a bearer challenge.
+var claimsChallengePattern = regexp.MustCompile(`(?i)\bclaims="([^"]*)"`)
+
 // Authorizer is the interface that provides a PrepareDecorator used to supply request
 // authorization. Most often, the Authorizer decorator runs last so it has access to the full
 // state of the formed HTTP request.
@@ -40,6 +55,23 @@ type Authorizer interface {
 	WithAuthorization() PrepareDecorator
 }
 
+// authorizerKey is the context key under which ContextWithAuthorizer stores an Authorizer.
+type authorizerKey struct{}
+
+// ContextWithAuthorizer returns a copy of ctx carrying the passed Authorizer. Client.WithAuthorization
+// uses that Authorizer, rather than the Client's Authorizer, for requests sent with the returned
+// context. This allows a single call (e.g., to another tenant) to use different credentials
+// without constructing a new Client.
+func ContextWithAuthorizer(ctx context.Context, a Authorizer) context.Context {
+	return context.WithValue(ctx, authorizerKey{}, a)
+}
+
+// authorizerFromContext returns the Authorizer stored in ctx by ContextWithAuthorizer, if any.
+func authorizerFromContext(ctx context.Context) (Authorizer, bool) {
+	a, ok := ctx.Value(authorizerKey{}).(Authorizer)
+	return a, ok && a != nil
+}
+
 // NullAuthorizer implements a default, "do nothing" Authorizer.
 type NullAuthorizer struct{}
 
@@ -59,6 +91,13 @@ func NewAPIKeyAuthorizerWithHeaders(headers map[string]interface{}) *APIKeyAutho
 	return NewAPIKeyAuthorizer(headers, nil)
 }
 
+// NewAPIKeyAuthorizerWithHeader creates an ApiKeyAuthorizer that adds the named header with the
+// passed key (e.g., Ocp-Apim-Subscription-Key for services fronted by API Management). Combine it
+// with a BearerAuthorizer using NewMultiAuthorizer to send both a key and a token.
+func NewAPIKeyAuthorizerWithHeader(name, key string) *APIKeyAuthorizer {
+	return NewAPIKeyAuthorizerWithHeaders(map[string]interface{}{name: key})
+}
+
 // NewAPIKeyAuthorizerWithQueryParameters creates an ApiKeyAuthorizer with query parameters.
 func NewAPIKeyAuthorizerWithQueryParameters(queryParameters map[string]interface{}) *APIKeyAuthorizer {
 	return NewAPIKeyAuthorizer(nil, queryParameters)
@@ -128,6 +167,10 @@ func (ba *BearerAuthorizer) WithAuthorization() PrepareDecorator {
 					return r, NewErrorWithError(err, "azure.BearerAuthorizer", "WithAuthorization", resp,
 						"Failed to refresh the Token for request to %s", r.URL)
 				}
+				if err = ba.waitUntilValid(r); err != nil {
+					return r, NewErrorWithError(err, "azure.BearerAuthorizer", "WithAuthorization", nil,
+						"Token for request to %s is not yet valid", r.URL)
+				}
 				return Prepare(r, WithHeader(headerAuthorization, fmt.Sprintf("Bearer %s", ba.tokenProvider.OAuthToken())))
 			}
 			return r, err
@@ -135,6 +178,101 @@ func (ba *BearerAuthorizer) WithAuthorization() PrepareDecorator {
 	}
 }
 
+// waitUntilValid enforces the not_before time of the token, if the token provider exposes it.
+// Differences within the allowed clock skew are ignored and small differences are waited out;
+// otherwise an error is returned, as the resource server would reject the token.
+func (ba *BearerAuthorizer) waitUntilValid(r *http.Request) error {
+	var token adal.Token
+	switch tp := ba.tokenProvider.(type) {
+	case *adal.Token:
+		token = *tp
+	case interface {
+		Token() adal.Token
+	}:
+		token = tp.Token()
+	default:
+		return nil
+	}
+	validFrom := token.ValidFrom()
+	wait := time.Until(validFrom.Add(-tokenNotBeforeSkew))
+	if wait <= 0 {
+		return nil
+	}
+	if wait > tokenNotBeforeMaxWait {
+		return fmt.Errorf("token is not valid until %s, %v from now; ensure the system clock is correct",
+			validFrom.Format(time.RFC3339), time.Until(validFrom).Round(time.Second))
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
+
+// DoRetryForClaimsChallenge returns a SendDecorator that completes claims challenges: if the
+// service responds 401 (Unauthorized) with a claims challenge (see ClaimsFromChallenge), the token
+// is re-acquired with the demanded claims and the request is sent once more with the new token.
+// The token provider must implement adal.ClaimsRefresher (as adal.ServicePrincipalToken does);
+// otherwise the 401 response is returned unchanged.
+func (ba *BearerAuthorizer) DoRetryForClaimsChallenge() SendDecorator {
+	return func(s Sender) Sender {
+		return SenderFunc(func(r *http.Request) (*http.Response, error) {
+			rr := NewRetriableRequest(r)
+			if err := rr.Prepare(); err != nil {
+				return nil, err
+			}
+			resp, err := s.Do(rr.Request())
+			if err != nil {
+				return resp, err
+			}
+			claims, ok := ClaimsFromChallenge(resp)
+			if !ok {
+				return resp, err
+			}
+			refresher, ok := ba.tokenProvider.(adal.ClaimsRefresher)
+			if !ok {
+				return resp, err
+			}
+			if err = refresher.RefreshWithClaims(r.Context(), claims); err != nil {
+				return resp, NewErrorWithError(err, "azure.BearerAuthorizer", "DoRetryForClaimsChallenge", resp,
+					"Failed to acquire a token with the claims demanded for request to %s", r.URL)
+			}
+			if err = rr.Prepare(); err != nil {
+				return resp, err
+			}
+			resp.Body.Close()
+			req, err := Prepare(rr.Request(), WithHeader(headerAuthorization, fmt.Sprintf("Bearer %s", ba.tokenProvider.OAuthToken())))
+			if err != nil {
+				return nil, err
+			}
+			return s.Do(req)
+		})
+	}
+}
+
+// ClaimsFromChallenge returns the claims demanded by the claims challenge in the WWW-Authenticate
+// header of an unauthenticated (401) response, e.g.
+//
+//	Bearer authorization_uri="...", error="insufficient_claims", claims="eyJhY2Nlc3NfdG9rZW4iOnt9fQ=="
+//
+// The claims are returned as decoded JSON, suitable for adal.ServicePrincipalToken.RefreshWithClaims.
+func ClaimsFromChallenge(resp *http.Response) (string, bool) {
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized || !hasBearerChallenge(resp) {
+		return "", false
+	}
+	m := claimsChallengePattern.FindStringSubmatch(resp.Header.Get(bearerChallengeHeader))
+	if m == nil || m[1] == "" {
+		return "", false
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(m[1]); err == nil {
+			return string(b), true
+		}
+	}
+	return "", false
+}
+
 // BearerAuthorizerCallbackFunc is the authentication callback signature.
 type BearerAuthorizerCallbackFunc func(tenantID, resource string) (*BearerAuthorizer, error)
 
@@ -190,6 +328,27 @@ func (bacb *BearerAuthorizerCallback) WithAuthorization() PrepareDecorator {
 	}
 }
 
+// TenantFromChallenge returns the authority (e.g. "https://login.windows.net/") and tenant ID
+// advertised by the bearer challenge in the WWW-Authenticate header of an unauthenticated (401)
+// response. This allows multi-tenant applications to discover the tenant owning a resource before
+// acquiring a token for it.
+func TenantFromChallenge(resp *http.Response) (authorityURL, tenant string, err error) {
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		return "", "", NewErrorWithResponse("autorest", "TenantFromChallenge", resp, "response is not an unauthenticated (401) response")
+	}
+	if !hasBearerChallenge(resp) {
+		return "", "", NewErrorWithResponse("autorest", "TenantFromChallenge", resp, "response does not contain a bearer challenge")
+	}
+	bc, err := newBearerChallenge(resp)
+	if err != nil {
+		return "", "", NewErrorWithError(err, "autorest", "TenantFromChallenge", resp, "failed to parse bearer challenge")
+	}
+	if bc.values[tenantID] == "" {
+		return "", "", NewErrorWithResponse("autorest", "TenantFromChallenge", resp, "bearer challenge does not contain an authorization URI")
+	}
+	return bc.values[authority], bc.values[tenantID], nil
+}
+
 // returns true if the HTTP response contains a bearer challenge
 func hasBearerChallenge(resp *http.Response) bool {
 	authHeader := resp.Header.Get(bearerChallengeHeader)
@@ -231,6 +390,7 @@ func newBearerChallenge(resp *http.Response) (bc bearerChallenge, err error) {
 					return bc, err
 				}
 				bc.values[tenantID] = asURL.Path[1:]
+				bc.values[authority] = fmt.Sprintf("%s://%s/", asURL.Scheme, asURL.Host)
 			default:
 				bc.values[key] = value
 			}
@@ -258,3 +418,101 @@ func (egta EventGridKeyAuthorizer) WithAuthorization() PrepareDecorator {
 	}
 	return NewAPIKeyAuthorizerWithHeaders(headers).WithAuthorization()
 }
+
+// MultiAuthorizer applies several Authorizers to each request, such as a BearerAuthorizer and an
+// APIKeyAuthorizer for services that require both a token and a subscription key.
+type MultiAuthorizer struct {
+	authorizers []Authorizer
+}
+
+// NewMultiAuthorizer creates a MultiAuthorizer that applies the passed Authorizers in order. Nil
+// Authorizers are ignored.
+func NewMultiAuthorizer(authorizers ...Authorizer) *MultiAuthorizer {
+	ma := &MultiAuthorizer{}
+	for _, a := range authorizers {
+		if a != nil {
+			ma.authorizers = append(ma.authorizers, a)
+		}
+	}
+	return ma
+}
+
+// WithAuthorization returns a PrepareDecorator that applies the PrepareDecorator of each
+// Authorizer in turn, stopping at the first to return an error.
+func (ma *MultiAuthorizer) WithAuthorization() PrepareDecorator {
+	return func(p Preparer) Preparer {
+		decorators := make([]PrepareDecorator, len(ma.authorizers))
+		for i, a := range ma.authorizers {
+			decorators[i] = a.WithAuthorization()
+		}
+		return DecoratePreparer(p, decorators...)
+	}
+}
+
+// DescribeAuthorization returns a redacted description of the Authorization header the passed
+// Authorizer applies to a request (e.g., "Bearer token (audience: https://management.azure.com/,
+// expires: 2019-01-01T00:00:00Z)"). The credential itself is never included, so the result is
+// safe to log during startup diagnostics. Authorizers that refresh tokens may contact the token
+// endpoint to do so.
+func DescribeAuthorization(a Authorizer) (string, error) {
+	r, err := Prepare(&http.Request{Header: make(http.Header), URL: &url.URL{Scheme: "https", Host: "localhost", Path: "/"}},
+		a.WithAuthorization())
+	if err != nil {
+		return "", NewErrorWithError(err, "autorest", "DescribeAuthorization", nil, "Failed to apply the Authorizer")
+	}
+	value := r.Header.Get(headerAuthorization)
+	if value == "" {
+		return "no Authorization header", nil
+	}
+	parts := strings.SplitN(value, " ", 2)
+	if len(parts) < 2 {
+		return "credential (redacted)", nil
+	}
+	scheme, credential := parts[0], strings.TrimSpace(parts[1])
+	if !strings.EqualFold(scheme, bearer) {
+		return fmt.Sprintf("%s credential (redacted)", scheme), nil
+	}
+	details := describeBearerToken(credential)
+	if len(details) == 0 {
+		return fmt.Sprintf("%s token (opaque)", scheme), nil
+	}
+	return fmt.Sprintf("%s token (%s)", scheme, strings.Join(details, ", ")), nil
+}
+
+// describeBearerToken returns the audience and expiry of a JWT bearer token. The token signature
+// is not verified; nothing is returned if the token is not a JWT.
+func describeBearerToken(token string) []string {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segments[1], "="))
+	if err != nil {
+		return nil
+	}
+	claims := struct {
+		Audience  json.RawMessage `json:"aud"`
+		ExpiresOn json.Number     `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil
+	}
+	var details []string
+	var audience interface{}
+	if len(claims.Audience) > 0 && json.Unmarshal(claims.Audience, &audience) == nil {
+		switch aud := audience.(type) {
+		case string:
+			details = append(details, fmt.Sprintf("audience: %s", aud))
+		case []interface{}:
+			var auds []string
+			for _, a := range aud {
+				auds = append(auds, fmt.Sprint(a))
+			}
+			details = append(details, fmt.Sprintf("audience: %s", strings.Join(auds, " ")))
+		}
+	}
+	if exp, err := claims.ExpiresOn.Int64(); err == nil {
+		details = append(details, fmt.Sprintf("expires: %s", time.Unix(exp, 0).UTC().Format(time.RFC3339)))
+	}
+	return details
+}
@@ -0,0 +1,346 @@
+package autorest
+
+// Copyright 2017 Microsoft Corporation
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	headerStoragePrefix    = "x-ms-"
+	headerStorageDate      = "x-ms-date"
+	headerStorageErrorCode = "x-ms-error-code"
+
+	storageAuthenticationFailed = "AuthenticationFailed"
+)
+
+// CanonicalizedHeaders returns the canonicalized headers string used when signing Azure Storage
+// requests with Shared Key. It contains each x-ms- header, named in lowercase and in lexicographic
+// order, as "name:value" lines separated by "\n". Multiple values of a header are joined by a
+// comma, and whitespace surrounding each value is removed.
+func CanonicalizedHeaders(h http.Header) string {
+	values := map[string][]string{}
+	for name, v := range h {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if strings.HasPrefix(name, headerStoragePrefix) {
+			values[name] = append(values[name], v...)
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		v := values[name]
+		for j := range v {
+			v[j] = strings.TrimSpace(v[j])
+		}
+		lines[i] = name + ":" + strings.Join(v, ",")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// CanonicalizedResource returns the canonicalized resource string used when signing Azure Storage
+// requests with Shared Key. It is formed from "/", the account name and the escaped path of the
+// passed URL, followed by "\n" and the canonicalized query (see CanonicalizedQuery) if the URL has
+// query parameters.
+func CanonicalizedResource(accountName string, u *url.URL) (string, error) {
+	if accountName == "" {
+		return "", NewError("autorest", "CanonicalizedResource", "Invoked without an account name")
+	}
+	if u == nil {
+		return "", NewError("autorest", "CanonicalizedResource", "Invoked with a nil URL")
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	resource := fmt.Sprintf("/%s%s", accountName, path)
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return "", NewErrorWithError(err, "autorest", "CanonicalizedResource", nil, "Failed to parse the query of %s", u)
+	}
+	if q := CanonicalizedQuery(query); q != "" {
+		resource += "\n" + q
+	}
+	return resource, nil
+}
+
+// CanonicalizedQuery returns the canonicalized form of the passed query parameters used when signing
+// Azure Storage requests. It contains one "name:values" line for each parameter, named in lowercase
+// and in lexicographic order, separated by "\n". Parameters whose names differ only in case are
+// merged, and the values of each parameter are sorted and joined by a comma.
+func CanonicalizedQuery(query url.Values) string {
+	values := map[string][]string{}
+	for name, v := range query {
+		name = strings.ToLower(name)
+		values[name] = append(values[name], v...)
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, len(names))
+	for i, name := range names {
+		v := append([]string(nil), values[name]...)
+		sort.Strings(v)
+		lines[i] = name + ":" + strings.Join(v, ",")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// SharedKeyAuthorizer implements Shared Key authorization for Azure Storage. It holds a primary
+// and, optionally, a secondary account key so that keys can be rotated without downtime: requests
+// are signed with the active key and, when combined with DoRetryWithSecondaryKey, a request the
+// service rejects as unauthenticated is signed with the other key and sent once more.
+type SharedKeyAuthorizer struct {
+	accountName string
+	keys        [][]byte
+	active      uint32
+}
+
+// NewSharedKeyAuthorizer creates a SharedKeyAuthorizer for the named account using the passed
+// base64 encoded account key.
+func NewSharedKeyAuthorizer(accountName, accountKey string) (*SharedKeyAuthorizer, error) {
+	return newSharedKeyAuthorizer("NewSharedKeyAuthorizer", accountName, accountKey)
+}
+
+// NewSharedKeyAuthorizerWithSecondaryKey creates a SharedKeyAuthorizer for the named account
+// that signs requests with the primary key and falls back to the secondary key (see
+// DoRetryWithSecondaryKey). Both keys are base64 encoded.
+func NewSharedKeyAuthorizerWithSecondaryKey(accountName, primaryKey, secondaryKey string) (*SharedKeyAuthorizer, error) {
+	return newSharedKeyAuthorizer("NewSharedKeyAuthorizerWithSecondaryKey", accountName, primaryKey, secondaryKey)
+}
+
+func newSharedKeyAuthorizer(method, accountName string, accountKeys ...string) (*SharedKeyAuthorizer, error) {
+	if accountName == "" {
+		return nil, NewError("autorest", method, "Invoked without an account name")
+	}
+	sk := &SharedKeyAuthorizer{accountName: accountName}
+	for i, accountKey := range accountKeys {
+		key, err := base64.StdEncoding.DecodeString(accountKey)
+		if err != nil {
+			return nil, NewErrorWithError(err, "autorest", method, nil, "Failed to decode account key %d", i)
+		}
+		sk.keys = append(sk.keys, key)
+	}
+	return sk, nil
+}
+
+// WithAuthorization returns a PrepareDecorator that signs the request with the active account key
+// and adds the resulting "SharedKey" Authorization header. An x-ms-date header is added if the
+// request does not already carry one.
+func (sk *SharedKeyAuthorizer) WithAuthorization() PrepareDecorator {
+	return sk.withKey(int(atomic.LoadUint32(&sk.active)))
+}
+
+// DoRetryWithSecondaryKey returns a SendDecorator that, if the service responds 403 (Forbidden)
+// with the AuthenticationFailed error code, signs the request with the other account key and
+// sends it once more. If that succeeds, the other key becomes the active key for later requests.
+// Authorizers created with a single key return the 403 response unchanged.
+func (sk *SharedKeyAuthorizer) DoRetryWithSecondaryKey() SendDecorator {
+	return func(s Sender) Sender {
+		return SenderFunc(func(r *http.Request) (*http.Response, error) {
+			rr := NewRetriableRequest(r)
+			if err := rr.Prepare(); err != nil {
+				return nil, err
+			}
+			resp, err := s.Do(rr.Request())
+			if err != nil || len(sk.keys) < 2 || !isStorageAuthenticationFailure(resp) {
+				return resp, err
+			}
+			active := atomic.LoadUint32(&sk.active)
+			other := (active + 1) % uint32(len(sk.keys))
+			if err = rr.Prepare(); err != nil {
+				return resp, err
+			}
+			resp.Body.Close()
+			req, err := Prepare(rr.Request(), sk.withKey(int(other)))
+			if err != nil {
+				return nil, err
+			}
+			resp, err = s.Do(req)
+			if err == nil && !isStorageAuthenticationFailure(resp) {
+				atomic.CompareAndSwapUint32(&sk.active, active, other)
+			}
+			return resp, err
+		})
+	}
+}
+
+func (sk *SharedKeyAuthorizer) withKey(i int) PrepareDecorator {
+	return func(p Preparer) Preparer {
+		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err != nil {
+				return r, err
+			}
+			if len(sk.keys) == 0 {
+				return r, NewError("autorest.SharedKeyAuthorizer", "WithAuthorization", "Invoked without an account key")
+			}
+			if r.Header == nil {
+				r.Header = make(http.Header)
+			}
+			if r.Header.Get(headerStorageDate) == "" {
+				r.Header.Set(headerStorageDate, time.Now().UTC().Format(http.TimeFormat))
+			}
+			signature, err := sk.sign(r, sk.keys[i])
+			if err != nil {
+				return r, NewErrorWithError(err, "autorest.SharedKeyAuthorizer", "WithAuthorization", nil,
+					"Failed to sign request to %s", r.URL)
+			}
+			r.Header.Set(headerAuthorization, fmt.Sprintf("SharedKey %s:%s", sk.accountName, signature))
+			return r, nil
+		})
+	}
+}
+
+// sign returns the base64 encoded HMAC-SHA256 of the Shared Key string-to-sign for the request.
+func (sk *SharedKeyAuthorizer) sign(r *http.Request, key []byte) (string, error) {
+	stringToSign, err := sk.StringToSign(r)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// StringToSign returns the Shared Key string-to-sign for the request as it currently stands. When
+// the service rejects a signature, compare it with the string-to-sign the service reports.
+func (sk *SharedKeyAuthorizer) StringToSign(r *http.Request) (string, error) {
+	resource, err := CanonicalizedResource(sk.accountName, r.URL)
+	if err != nil {
+		return "", err
+	}
+	contentLength := ""
+	if r.ContentLength > 0 {
+		contentLength = strconv.FormatInt(r.ContentLength, 10)
+	}
+	return strings.Join([]string{
+		r.Method,
+		r.Header.Get("Content-Encoding"),
+		r.Header.Get("Content-Language"),
+		contentLength,
+		r.Header.Get("Content-MD5"),
+		r.Header.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		r.Header.Get("If-Modified-Since"),
+		r.Header.Get("If-Match"),
+		r.Header.Get("If-None-Match"),
+		r.Header.Get("If-Unmodified-Since"),
+		r.Header.Get("Range"),
+		CanonicalizedHeaders(r.Header),
+		resource,
+	}, "\n"), nil
+}
+
+// SigningDetails describes how a request was signed, with the signature itself redacted, to aid in
+// diagnosing rejected signatures.
+type SigningDetails struct {
+	// URL is the fully escaped request URL as sent on the wire. The value of a SAS "sig" query
+	// parameter is redacted.
+	URL string
+
+	// StringToSign is the Shared Key string-to-sign for the request. The value of a SAS "sig"
+	// query parameter is redacted.
+	StringToSign string
+
+	// Authorization is the request Authorization header with the signature redacted.
+	Authorization string
+}
+
+// String returns the details in a form suitable for logging.
+func (sd SigningDetails) String() string {
+	return fmt.Sprintf("URL: %s\nAuthorization: %s\nStringToSign:\n%s", sd.URL, sd.Authorization, sd.StringToSign)
+}
+
+// SigningDetails returns the final URL, the string-to-sign and the redacted Authorization header of
+// a request signed by WithAuthorization. Call it after all other PrepareDecorators have run, since
+// any later change to the request alters the string-to-sign.
+func (sk *SharedKeyAuthorizer) SigningDetails(r *http.Request) (SigningDetails, error) {
+	if r == nil || r.URL == nil {
+		return SigningDetails{}, NewError("autorest.SharedKeyAuthorizer", "SigningDetails", "Invoked without a request URL")
+	}
+	stringToSign, err := sk.StringToSign(r)
+	if err != nil {
+		return SigningDetails{}, NewErrorWithError(err, "autorest.SharedKeyAuthorizer", "SigningDetails", nil,
+			"Failed to build the string-to-sign for %s", r.URL)
+	}
+	return SigningDetails{
+		URL:           redactSignature(r.URL).String(),
+		StringToSign:  redactSignatureLine(stringToSign),
+		Authorization: redactAuthorization(r.Header.Get(headerAuthorization)),
+	}, nil
+}
+
+// redactSignature returns a copy of u with the value of any SAS "sig" query parameter redacted.
+func redactSignature(u *url.URL) *url.URL {
+	redacted := *u
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		if strings.HasPrefix(strings.ToLower(param), "sig=") {
+			params[i] = param[:len("sig=")] + "****"
+		}
+	}
+	redacted.RawQuery = strings.Join(params, "&")
+	return &redacted
+}
+
+// redactSignatureLine redacts the value of the canonicalized "sig" query parameter, if any, in the
+// passed string-to-sign.
+func redactSignatureLine(stringToSign string) string {
+	lines := strings.Split(stringToSign, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "sig:") {
+			lines[i] = "sig:****"
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// redactAuthorization replaces the signature following the last ":" of a Shared Key Authorization
+// header value with "****". The credentials of other schemes are redacted entirely.
+func redactAuthorization(v string) string {
+	if i := strings.LastIndex(v, ":"); i >= 0 {
+		return v[:i+1] + "****"
+	}
+	if i := strings.Index(v, " "); i >= 0 {
+		return v[:i+1] + "****"
+	}
+	if v != "" {
+		return "****"
+	}
+	return v
+}
+
+func isStorageAuthenticationFailure(resp *http.Response) bool {
+	return resp != nil && resp.StatusCode == http.StatusForbidden &&
+		resp.Header.Get(headerStorageErrorCode) == storageAuthenticationFailed
+}
@@ -0,0 +1,229 @@
+package autorest
+
+// Copyright 2017 Microsoft Corporation
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/noahhai/go-autorest/autorest/mocks"
+)
+
+func TestCanonicalizedHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-Ms-Version", "2018-03-28")
+	h.Set("x-ms-date", "Fri, 26 Jun 2015 23:39:12 GMT")
+	h.Add("X-Ms-Meta-Tags", " a ")
+	h.Add("X-Ms-Meta-Tags", "b")
+	h.Set("Content-Type", "application/json")
+
+	expected := "x-ms-date:Fri, 26 Jun 2015 23:39:12 GMT\nx-ms-meta-tags:a,b\nx-ms-version:2018-03-28"
+	if got := CanonicalizedHeaders(h); got != expected {
+		t.Fatalf("autorest: CanonicalizedHeaders returned %q, expected %q", got, expected)
+	}
+}
+
+func TestCanonicalizedHeadersWithoutStorageHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Content-Type", "application/json")
+	if got := CanonicalizedHeaders(h); got != "" {
+		t.Fatalf("autorest: CanonicalizedHeaders returned %q, expected an empty string", got)
+	}
+}
+
+func TestCanonicalizedResource(t *testing.T) {
+	u, _ := url.Parse("https://myaccount.blob.core.windows.net/my%20container?restype=container&comp=list&Include=metadata&include=snapshots")
+
+	resource, err := CanonicalizedResource("myaccount", u)
+	if err != nil {
+		t.Fatalf("autorest: CanonicalizedResource returned an error (%v)", err)
+	}
+	expected := "/myaccount/my%20container\ncomp:list\ninclude:metadata,snapshots\nrestype:container"
+	if resource != expected {
+		t.Fatalf("autorest: CanonicalizedResource returned %q, expected %q", resource, expected)
+	}
+}
+
+func TestCanonicalizedResourceWithoutPath(t *testing.T) {
+	u, _ := url.Parse("https://myaccount.blob.core.windows.net?comp=properties&restype=service")
+
+	resource, err := CanonicalizedResource("myaccount", u)
+	if err != nil {
+		t.Fatalf("autorest: CanonicalizedResource returned an error (%v)", err)
+	}
+	expected := "/myaccount/\ncomp:properties\nrestype:service"
+	if resource != expected {
+		t.Fatalf("autorest: CanonicalizedResource returned %q, expected %q", resource, expected)
+	}
+}
+
+func TestCanonicalizedResourceRequiresAccountName(t *testing.T) {
+	u, _ := url.Parse("https://myaccount.blob.core.windows.net/container")
+	if _, err := CanonicalizedResource("", u); err == nil {
+		t.Fatal("autorest: CanonicalizedResource failed to return an error for a missing account name")
+	}
+}
+
+func TestCanonicalizedQuery(t *testing.T) {
+	query := url.Values{
+		"restype": {"container"},
+		"Include": {"snapshots"},
+		"include": {"metadata"},
+		"comp":    {"list"},
+	}
+	expected := "comp:list\ninclude:metadata,snapshots\nrestype:container"
+	if got := CanonicalizedQuery(query); got != expected {
+		t.Fatalf("autorest: CanonicalizedQuery returned %q, expected %q", got, expected)
+	}
+	if got := CanonicalizedQuery(url.Values{}); got != "" {
+		t.Fatalf("autorest: CanonicalizedQuery returned %q for no parameters, expected an empty string", got)
+	}
+}
+
+func TestSharedKeyAuthorizerSignsRequest(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("primary"))
+	sk, err := NewSharedKeyAuthorizer("account", key)
+	if err != nil {
+		t.Fatalf("autorest: NewSharedKeyAuthorizer returned an unexpected error (%v)", err)
+	}
+	r, err := Prepare(mocks.NewRequestWithParams("GET", "https://account.blob.core.windows.net/container?comp=list", nil),
+		sk.WithAuthorization())
+	if err != nil {
+		t.Fatalf("autorest: SharedKeyAuthorizer#WithAuthorization returned an unexpected error (%v)", err)
+	}
+	if r.Header.Get(headerStorageDate) == "" {
+		t.Fatal("autorest: SharedKeyAuthorizer#WithAuthorization did not add an x-ms-date header")
+	}
+	signature, _ := sk.sign(r, []byte("primary"))
+	if expected := fmt.Sprintf("SharedKey account:%s", signature); r.Header.Get(headerAuthorization) != expected {
+		t.Fatalf("autorest: SharedKeyAuthorizer#WithAuthorization set Authorization %q, expected %q", r.Header.Get(headerAuthorization), expected)
+	}
+}
+
+func TestSharedKeyAuthorizerSigningDetails(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("primary"))
+	sk, err := NewSharedKeyAuthorizer("account", key)
+	if err != nil {
+		t.Fatalf("autorest: NewSharedKeyAuthorizer returned an unexpected error (%v)", err)
+	}
+	r, err := Prepare(mocks.NewRequestWithParams("PUT", "https://account.blob.core.windows.net/my%20container/blob?comp=block&sig=secret", nil),
+		WithHeader(headerStorageDate, "Sun, 11 Oct 2009 21:49:13 GMT"),
+		sk.WithAuthorization())
+	if err != nil {
+		t.Fatalf("autorest: SharedKeyAuthorizer#WithAuthorization returned an unexpected error (%v)", err)
+	}
+	sd, err := sk.SigningDetails(r)
+	if err != nil {
+		t.Fatalf("autorest: SharedKeyAuthorizer#SigningDetails returned an unexpected error (%v)", err)
+	}
+	if expected := "https://account.blob.core.windows.net/my%20container/blob?comp=block&sig=****"; sd.URL != expected {
+		t.Fatalf("autorest: SharedKeyAuthorizer#SigningDetails returned URL %q, expected %q", sd.URL, expected)
+	}
+	if expected := "SharedKey account:****"; sd.Authorization != expected {
+		t.Fatalf("autorest: SharedKeyAuthorizer#SigningDetails returned Authorization %q, expected %q", sd.Authorization, expected)
+	}
+	expected := "PUT\n\n\n\n\n\n\n\n\n\n\n\nx-ms-date:Sun, 11 Oct 2009 21:49:13 GMT\n/account/my%20container/blob\ncomp:block\nsig:****"
+	if sd.StringToSign != expected {
+		t.Fatalf("autorest: SharedKeyAuthorizer#SigningDetails returned StringToSign %q, expected %q", sd.StringToSign, expected)
+	}
+	signature, _ := sk.sign(r, []byte("primary"))
+	if strings.Contains(sd.String(), signature) || strings.Contains(sd.String(), "secret") {
+		t.Fatalf("autorest: SharedKeyAuthorizer#SigningDetails failed to redact the signature (%s)", sd)
+	}
+}
+
+func TestRedactAuthorization(t *testing.T) {
+	cases := map[string]string{
+		"SharedKey account:c2lnbmF0dXJl": "SharedKey account:****",
+		"Bearer token":                   "Bearer ****",
+		"token":                          "****",
+		"":                               "",
+	}
+	for v, expected := range cases {
+		if got := redactAuthorization(v); got != expected {
+			t.Fatalf("autorest: redactAuthorization(%q) returned %q, expected %q", v, got, expected)
+		}
+	}
+}
+
+func TestNewSharedKeyAuthorizerRejectsInvalidKey(t *testing.T) {
+	if _, err := NewSharedKeyAuthorizer("account", "not base64!"); err == nil {
+		t.Fatal("autorest: NewSharedKeyAuthorizer accepted an invalid account key")
+	}
+	if _, err := NewSharedKeyAuthorizer("", base64.StdEncoding.EncodeToString([]byte("key"))); err == nil {
+		t.Fatal("autorest: NewSharedKeyAuthorizer accepted an empty account name")
+	}
+}
+
+func TestSharedKeyAuthorizerFallsBackToSecondaryKey(t *testing.T) {
+	sk, err := NewSharedKeyAuthorizerWithSecondaryKey("account",
+		base64.StdEncoding.EncodeToString([]byte("revoked")),
+		base64.StdEncoding.EncodeToString([]byte("current")))
+	if err != nil {
+		t.Fatalf("autorest: NewSharedKeyAuthorizerWithSecondaryKey returned an unexpected error (%v)", err)
+	}
+	var used []string
+	s := SenderFunc(func(r *http.Request) (*http.Response, error) {
+		signature, _ := sk.sign(r, []byte("current"))
+		if strings.HasSuffix(r.Header.Get(headerAuthorization), ":"+signature) {
+			used = append(used, "current")
+			return mocks.NewResponse(), nil
+		}
+		used = append(used, "revoked")
+		resp := mocks.NewResponseWithStatus("403 Forbidden", http.StatusForbidden)
+		mocks.SetResponseHeader(resp, headerStorageErrorCode, storageAuthenticationFailed)
+		return resp, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		r, err := Prepare(mocks.NewRequestWithParams("PUT", "https://account.blob.core.windows.net/container/blob", strings.NewReader("content")),
+			sk.WithAuthorization())
+		if err != nil {
+			t.Fatalf("autorest: SharedKeyAuthorizer#WithAuthorization returned an unexpected error (%v)", err)
+		}
+		resp, err := SendWithSender(s, r, sk.DoRetryWithSecondaryKey())
+		if err != nil {
+			t.Fatalf("autorest: SharedKeyAuthorizer#DoRetryWithSecondaryKey returned an unexpected error (%v)", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("autorest: SharedKeyAuthorizer#DoRetryWithSecondaryKey returned status %d, expected %d", resp.StatusCode, http.StatusOK)
+		}
+	}
+	if expected := "revoked,current,current"; strings.Join(used, ",") != expected {
+		t.Fatalf("autorest: SharedKeyAuthorizer#DoRetryWithSecondaryKey signed with %v, expected %s", used, expected)
+	}
+}
+
+func TestSharedKeyAuthorizerWithSingleKeyDoesNotRetry(t *testing.T) {
+	sk, _ := NewSharedKeyAuthorizer("account", base64.StdEncoding.EncodeToString([]byte("key")))
+	client := mocks.NewSender()
+	resp := mocks.NewResponseWithStatus("403 Forbidden", http.StatusForbidden)
+	mocks.SetResponseHeader(resp, headerStorageErrorCode, storageAuthenticationFailed)
+	client.AppendResponse(resp)
+
+	r, _ := Prepare(mocks.NewRequest(), sk.WithAuthorization())
+	resp, err := SendWithSender(client, r, sk.DoRetryWithSecondaryKey())
+	if err != nil {
+		t.Fatalf("autorest: SharedKeyAuthorizer#DoRetryWithSecondaryKey returned an unexpected error (%v)", err)
+	}
+	if resp.StatusCode != http.StatusForbidden || client.Attempts() != 1 {
+		t.Fatalf("autorest: SharedKeyAuthorizer#DoRetryWithSecondaryKey retried with a single key (status %d, attempts %d)",
+			resp.StatusCode, client.Attempts())
+	}
+}
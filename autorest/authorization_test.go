@@ -15,10 +15,17 @@ package autorest
 //  limitations under the License.
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/noahhai/go-autorest/autorest/adal"
 	"github.com/noahhai/go-autorest/autorest/mocks"
@@ -58,6 +65,40 @@ func TestTokenWithAuthorization(t *testing.T) {
 	}
 }
 
+func TestTokenWithAuthorizationNotYetValid(t *testing.T) {
+	token := &adal.Token{
+		AccessToken: "TestToken",
+		NotBefore:   json.Number(strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)),
+		Resource:    "https://azure.microsoft.com/",
+		Type:        "Bearer",
+	}
+
+	ba := NewBearerAuthorizer(token)
+	_, err := Prepare(&http.Request{}, ba.WithAuthorization())
+	if err == nil {
+		t.Fatal("azure: BearerAuthorizer#WithAuthorization failed to return an error for a token that is not yet valid")
+	}
+}
+
+func TestTokenWithAuthorizationToleratesClockSkew(t *testing.T) {
+	token := &adal.Token{
+		AccessToken: "TestToken",
+		NotBefore:   json.Number(strconv.FormatInt(time.Now().Add(tokenNotBeforeSkew/2).Unix(), 10)),
+		Resource:    "https://azure.microsoft.com/",
+		Type:        "Bearer",
+	}
+
+	ba := NewBearerAuthorizer(token)
+	start := time.Now()
+	_, err := Prepare(&http.Request{}, ba.WithAuthorization())
+	if err != nil {
+		t.Fatalf("azure: BearerAuthorizer#WithAuthorization returned an error (%v)", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("azure: BearerAuthorizer#WithAuthorization waited for a token valid within the allowed clock skew")
+	}
+}
+
 func TestServicePrincipalTokenWithAuthorizationNoRefresh(t *testing.T) {
 	oauthConfig, err := adal.NewOAuthConfig(TestActiveDirectoryEndpoint, TestTenantID)
 	if err != nil {
@@ -187,6 +228,34 @@ func TestBearerAuthorizerCallback(t *testing.T) {
 	}
 }
 
+func TestTenantFromChallenge(t *testing.T) {
+	resp := mocks.NewResponseWithStatus("401 Unauthorized", http.StatusUnauthorized)
+	mocks.SetResponseHeader(resp, bearerChallengeHeader, bearer+" authorization_uri=\"https://login.windows.net/123-tenantID-456\", error=\"invalid_token\"")
+
+	authorityURL, tenant, err := TenantFromChallenge(resp)
+	if err != nil {
+		t.Fatalf("autorest: TenantFromChallenge returned an error (%v)", err)
+	}
+	if authorityURL != "https://login.windows.net/" {
+		t.Fatalf("autorest: TenantFromChallenge returned authority %q", authorityURL)
+	}
+	if tenant != "123-tenantID-456" {
+		t.Fatalf("autorest: TenantFromChallenge returned tenant %q", tenant)
+	}
+}
+
+func TestTenantFromChallengeRequiresChallenge(t *testing.T) {
+	if _, _, err := TenantFromChallenge(mocks.NewResponseWithStatus("401 Unauthorized", http.StatusUnauthorized)); err == nil {
+		t.Fatal("autorest: TenantFromChallenge failed to return an error for a response without a challenge")
+	}
+
+	resp := mocks.NewResponse()
+	mocks.SetResponseHeader(resp, bearerChallengeHeader, bearer+" authorization_uri=\"https://login.windows.net/tenant\"")
+	if _, _, err := TenantFromChallenge(resp); err == nil {
+		t.Fatal("autorest: TenantFromChallenge failed to return an error for a non-401 response")
+	}
+}
+
 func TestApiKeyAuthorization(t *testing.T) {
 
 	headers := make(map[string]interface{})
@@ -215,6 +284,38 @@ func TestApiKeyAuthorization(t *testing.T) {
 	}
 }
 
+func TestMultiAuthorizerWithAPIKeyHeader(t *testing.T) {
+	token := &adal.Token{
+		AccessToken: "TestToken",
+		Resource:    "https://azure.microsoft.com/",
+		Type:        "Bearer",
+	}
+	ma := NewMultiAuthorizer(NewBearerAuthorizer(token), nil, NewAPIKeyAuthorizerWithHeader(apiKeyAuthorizerHeader, "dummyKey"))
+	req, err := Prepare(mocks.NewRequest(), ma.WithAuthorization())
+	if err != nil {
+		t.Fatalf("azure: MultiAuthorizer#WithAuthorization returned an error (%v)", err)
+	}
+	if req.Header.Get(headerAuthorization) != "Bearer TestToken" {
+		t.Fatalf("azure: MultiAuthorizer#WithAuthorization failed to set the Authorization header (%s)", req.Header.Get(headerAuthorization))
+	}
+	if req.Header.Get(apiKeyAuthorizerHeader) != "dummyKey" {
+		t.Fatalf("azure: MultiAuthorizer#WithAuthorization failed to set the %s header", apiKeyAuthorizerHeader)
+	}
+}
+
+func TestMultiAuthorizerReturnsErrors(t *testing.T) {
+	token := &adal.Token{
+		AccessToken: "TestToken",
+		NotBefore:   json.Number(strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)),
+		Resource:    "https://azure.microsoft.com/",
+		Type:        "Bearer",
+	}
+	ma := NewMultiAuthorizer(NewAPIKeyAuthorizerWithHeader(apiKeyAuthorizerHeader, "dummyKey"), NewBearerAuthorizer(token))
+	if _, err := Prepare(mocks.NewRequest(), ma.WithAuthorization()); err == nil {
+		t.Fatal("azure: MultiAuthorizer#WithAuthorization failed to return the error of an Authorizer")
+	}
+}
+
 func TestCognitivesServicesAuthorization(t *testing.T) {
 	subscriptionKey := "dummyKey"
 	csa := NewCognitiveServicesAuthorizer(subscriptionKey)
@@ -228,3 +329,121 @@ func TestCognitivesServicesAuthorization(t *testing.T) {
 		t.Fatalf("azure: CognitiveServicesAuthorizer#WithAuthorization failed to set %s header", apiKeyAuthorizerHeader)
 	}
 }
+
+func TestDescribeAuthorizationBearerToken(t *testing.T) {
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"aud":"https://management.azure.com/","exp":1546300800}`))
+	secret := "header." + claims + ".signature"
+	ba := NewBearerAuthorizer(&adal.Token{AccessToken: secret, Type: "Bearer"})
+
+	d, err := DescribeAuthorization(ba)
+	if err != nil {
+		t.Fatalf("autorest: DescribeAuthorization returned an error (%v)", err)
+	}
+	expected := "Bearer token (audience: https://management.azure.com/, expires: 2019-01-01T00:00:00Z)"
+	if d != expected {
+		t.Fatalf("autorest: DescribeAuthorization returned %q, expected %q", d, expected)
+	}
+	if strings.Contains(d, "signature") {
+		t.Fatal("autorest: DescribeAuthorization leaked the token")
+	}
+}
+
+func TestDescribeAuthorizationOpaqueToken(t *testing.T) {
+	ba := NewBearerAuthorizer(&adal.Token{AccessToken: "secret", Type: "Bearer"})
+	d, err := DescribeAuthorization(ba)
+	if err != nil {
+		t.Fatalf("autorest: DescribeAuthorization returned an error (%v)", err)
+	}
+	if d != "Bearer token (opaque)" {
+		t.Fatalf("autorest: DescribeAuthorization returned %q", d)
+	}
+}
+
+func TestDescribeAuthorizationOtherSchemes(t *testing.T) {
+	a := NewAPIKeyAuthorizerWithHeaders(map[string]interface{}{"Authorization": "SharedKey account:secret"})
+	d, err := DescribeAuthorization(a)
+	if err != nil {
+		t.Fatalf("autorest: DescribeAuthorization returned an error (%v)", err)
+	}
+	if d != "SharedKey credential (redacted)" {
+		t.Fatalf("autorest: DescribeAuthorization returned %q", d)
+	}
+
+	d, _ = DescribeAuthorization(NullAuthorizer{})
+	if d != "no Authorization header" {
+		t.Fatalf("autorest: DescribeAuthorization returned %q for NullAuthorizer", d)
+	}
+}
+
+func TestClaimsFromChallenge(t *testing.T) {
+	claims := `{"access_token":{"acrs":{"essential":true,"value":"c1"}}}`
+	resp := mocks.NewResponseWithStatus("401 Unauthorized", http.StatusUnauthorized)
+	mocks.SetResponseHeader(resp, bearerChallengeHeader, fmt.Sprintf(`Bearer authorization_uri="https://login.windows.net/", error="insufficient_claims", claims="%s"`,
+		base64.StdEncoding.EncodeToString([]byte(claims))))
+
+	c, ok := ClaimsFromChallenge(resp)
+	if !ok || c != claims {
+		t.Fatalf("autorest: ClaimsFromChallenge returned %q, %v, expected %q", c, ok, claims)
+	}
+
+	mocks.SetResponseHeader(resp, bearerChallengeHeader, `Bearer authorization_uri="https://login.windows.net/"`)
+	if _, ok := ClaimsFromChallenge(resp); ok {
+		t.Fatal("autorest: ClaimsFromChallenge found claims in a challenge without any")
+	}
+}
+
+func TestBearerAuthorizerDoRetryForClaimsChallenge(t *testing.T) {
+	claims := `{"access_token":{"acrs":{"essential":true,"value":"c1"}}}`
+	oauthConfig, err := adal.NewOAuthConfig(TestActiveDirectoryEndpoint, TestTenantID)
+	if err != nil {
+		t.Fatalf("autorest: adal.NewOAuthConfig returned an error (%v)", err)
+	}
+	spt, err := adal.NewServicePrincipalToken(*oauthConfig, "id", "secret", "resource")
+	if err != nil {
+		t.Fatalf("autorest: adal.NewServicePrincipalToken returned an error (%v)", err)
+	}
+	tokens := 0
+	spt.SetSender(adal.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		b, _ := ioutil.ReadAll(r.Body)
+		v, _ := url.ParseQuery(string(b))
+		accessToken := "initial"
+		if tokens++; tokens > 1 {
+			if v.Get("claims") != claims {
+				t.Fatalf("autorest: token request sent claims %q, expected %q", v.Get("claims"), claims)
+			}
+			accessToken = "stepped-up"
+		}
+		expiresOn := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+		return mocks.NewResponseWithContent(fmt.Sprintf(`{"access_token": "%s", "expires_in": "3600", "expires_on": "%s", "resource": "resource", "token_type": "Bearer"}`,
+			accessToken, expiresOn)), nil
+	}))
+
+	var sent []string
+	service := SenderFunc(func(r *http.Request) (*http.Response, error) {
+		sent = append(sent, r.Header.Get(headerAuthorization))
+		if r.Header.Get(headerAuthorization) == "Bearer stepped-up" {
+			return mocks.NewResponse(), nil
+		}
+		resp := mocks.NewResponseWithStatus("401 Unauthorized", http.StatusUnauthorized)
+		mocks.SetResponseHeader(resp, bearerChallengeHeader, fmt.Sprintf(`Bearer error="insufficient_claims", claims="%s"`,
+			base64.StdEncoding.EncodeToString([]byte(claims))))
+		return resp, nil
+	})
+
+	ba := NewBearerAuthorizer(spt)
+	req, err := Prepare(mocks.NewRequest(), ba.WithAuthorization())
+	if err != nil {
+		t.Fatalf("autorest: BearerAuthorizer#WithAuthorization returned an error (%v)", err)
+	}
+	resp, err := SendWithSender(service, req, ba.DoRetryForClaimsChallenge())
+	if err != nil {
+		t.Fatalf("autorest: BearerAuthorizer#DoRetryForClaimsChallenge returned an error (%v)", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("autorest: BearerAuthorizer#DoRetryForClaimsChallenge returned status %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+	expected := []string{"Bearer initial", "Bearer stepped-up"}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Fatalf("autorest: BearerAuthorizer#DoRetryForClaimsChallenge sent %v, expected %v", sent, expected)
+	}
+}
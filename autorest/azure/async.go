@@ -22,7 +22,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/noahhai/go-autorest/autorest"
@@ -30,7 +32,11 @@ import (
 )
 
 const (
-	headerAsyncOperation = "Azure-AsyncOperation"
+	headerAsyncOperation   = "Azure-AsyncOperation"
+	headerOperationTimeout = "x-ms-operation-timeout"
+
+	// maxConcurrentWaits bounds the number of long-running operations WaitForAll polls at once.
+	maxConcurrentWaits = 8
 )
 
 const (
@@ -142,6 +148,35 @@ func (f *Future) DoneWithContext(ctx context.Context, sender autorest.Sender) (d
 	return f.pt.hasTerminated(), f.pt.pollingError()
 }
 
+// PollingHints holds the guidance a service may include in a response from a long-running
+// operation about how to poll it.
+type PollingHints struct {
+	// InitialDelay is the delay before polling, from the Retry-After header.
+	InitialDelay time.Duration
+
+	// Timeout is how long the operation is expected to take at most, from the
+	// x-ms-operation-timeout header in seconds.
+	Timeout time.Duration
+}
+
+// GetPollingHints returns the polling hints in the passed response. Hints that are absent or
+// malformed are zero, in which case the configured defaults apply.
+func GetPollingHints(resp *http.Response) PollingHints {
+	if resp == nil {
+		return PollingHints{}
+	}
+	hints := PollingHints{InitialDelay: autorest.GetRetryAfter(resp, 0)}
+	if v := resp.Header.Get(headerOperationTimeout); v != "" {
+		if seconds, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && seconds > 0 {
+			hints.Timeout = time.Duration(seconds) * time.Second
+		}
+	}
+	if hints.InitialDelay < 0 {
+		hints.InitialDelay = 0
+	}
+	return hints
+}
+
 // GetPollingDelay returns a duration the application should wait before checking
 // the status of the asynchronous request and true; this value is returned from
 // the service via the Retry-After response header.  If the header wasn't returned
@@ -180,7 +215,11 @@ func (f Future) WaitForCompletion(ctx context.Context, client autorest.Client) e
 // WaitForCompletionRef will return when one of the following conditions is met: the long
 // running operation has completed, the provided context is cancelled, or the client's
 // polling duration has been exceeded.  It will retry failed polling attempts based on
-// the retry value defined in the client up to the maximum retry attempts.
+// the retry value defined in the client up to the maximum retry attempts. Polling hints in the
+// latest response (see GetPollingHints) delay the first poll and bound polling when the client's
+// PollingDuration is zero or longer than the hinted timeout. If the client's OperationTimeout is set, the wait is bounded by the operation carried by ctx (see
+// autorest.Client.WithOperationTimeout) or, if there is none, by a new one. If the client has a
+// PollingLimiter, polling waits until the limiter allows it.
 func (f *Future) WaitForCompletionRef(ctx context.Context, client autorest.Client) (err error) {
 	ctx = tracing.StartSpan(ctx, "github.com/noahhai/go-autorest/autorest/azure/async.WaitForCompletionRef")
 	defer func() {
@@ -191,12 +230,38 @@ func (f *Future) WaitForCompletionRef(ctx context.Context, client autorest.Clien
 		}
 		tracing.EndSpan(ctx, sc, err)
 	}()
+	if client.OperationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = client.WithOperationTimeout(ctx)
+		defer cancel()
+		autorest.SetOperationPhase(ctx, autorest.OperationPhasePolling)
+		defer func() {
+			err = autorest.CheckOperationTimeout(ctx, err)
+		}()
+	}
+	if client.PollingLimiter != nil {
+		if err = client.PollingLimiter.Acquire(ctx); err != nil {
+			return autorest.NewErrorWithError(err, "Future", "WaitForCompletion", f.pt.latestResponse(), "context has been cancelled while waiting to poll")
+		}
+		defer client.PollingLimiter.Release()
+	}
+	hints := GetPollingHints(f.Response())
 	cancelCtx := ctx
-	if d := client.PollingDuration; d != 0 {
+	// a timeout hint may shorten, but never extend, the configured polling duration
+	d := client.PollingDuration
+	if hints.Timeout > 0 && (d == 0 || hints.Timeout < d) {
+		d = hints.Timeout
+	}
+	if d != 0 {
 		var cancel context.CancelFunc
 		cancelCtx, cancel = context.WithTimeout(ctx, d)
 		defer cancel()
 	}
+	if hints.InitialDelay > 0 {
+		if delayElapsed := autorest.DelayForBackoff(hints.InitialDelay, 0, cancelCtx.Done()); !delayElapsed {
+			return autorest.NewErrorWithError(cancelCtx.Err(), "Future", "WaitForCompletion", f.pt.latestResponse(), "context has been cancelled")
+		}
+	}
 
 	done, err := f.DoneWithContext(ctx, client)
 	for attempts := 0; !done; done, err = f.DoneWithContext(ctx, client) {
@@ -231,6 +296,44 @@ func (f *Future) WaitForCompletionRef(ctx context.Context, client autorest.Clien
 	return
 }
 
+// WaitResult is the outcome of a long-running operation awaited by WaitForAll.
+type WaitResult struct {
+	// Future tracks the operation; its Response is the last polling response.
+	Future Future
+
+	// Err is the error, if any, encountered starting or awaiting the operation.
+	Err error
+}
+
+// WaitForAll awaits the long-running operations started by the passed responses, as
+// WaitForCompletionRef does for one, polling several of them concurrently. It returns once all the
+// operations have completed or failed; the results are in the order of the responses. A client
+// PollingLimiter, if any, further bounds the number of operations polled at once.
+func WaitForAll(ctx context.Context, client autorest.Client, responses ...*http.Response) []WaitResult {
+	results := make([]WaitResult, len(responses))
+	sem := make(chan struct{}, maxConcurrentWaits)
+	var wg sync.WaitGroup
+	for i, resp := range responses {
+		wg.Add(1)
+		go func(i int, resp *http.Response) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if resp == nil {
+				results[i].Err = autorest.NewError("azure", "WaitForAll", "response %d is nil", i)
+				return
+			}
+			future, err := NewFutureFromResponse(resp)
+			if err == nil {
+				err = future.WaitForCompletionRef(ctx, client)
+			}
+			results[i] = WaitResult{Future: future, Err: err}
+		}(i, resp)
+	}
+	wg.Wait()
+	return results
+}
+
 // MarshalJSON implements the json.Marshaler interface.
 func (f Future) MarshalJSON() ([]byte, error) {
 	return json.Marshal(f.pt)
@@ -917,26 +1020,95 @@ func isValidURL(s string) bool {
 // the context associated with the http.Request.
 // Deprecated: Prefer using Futures to allow for non-blocking async operations.
 func DoPollForAsynchronous(delay time.Duration) autorest.SendDecorator {
+	return DoPollForAsynchronousWithInterval(ConstantPollingInterval(delay))
+}
+
+// PollingIntervalFunc returns the delay to wait before the specified polling attempt. Attempts
+// are numbered from zero.
+type PollingIntervalFunc func(attempt int) time.Duration
+
+// ConstantPollingInterval returns a PollingIntervalFunc that always returns the passed delay.
+func ConstantPollingInterval(delay time.Duration) PollingIntervalFunc {
+	return func(attempt int) time.Duration {
+		return delay
+	}
+}
+
+// ExponentialPollingInterval returns a PollingIntervalFunc that starts with the initial delay and
+// doubles it on each subsequent attempt, never exceeding max. This lets quick operations complete
+// with low latency while longer running operations are polled less frequently.
+func ExponentialPollingInterval(initial, max time.Duration) PollingIntervalFunc {
+	return func(attempt int) time.Duration {
+		d := initial
+		for i := 0; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// DoPollForAsynchronousWithInterval returns a SendDecorator that polls if the http.Response is for
+// an Azure long-running operation. It will delay between requests for the duration specified in
+// the RetryAfter header or, if the header is absent, the duration returned by the passed
+// PollingIntervalFunc for the current attempt. Polling may be canceled via the context associated
+// with the http.Request.
+// Deprecated: Prefer using Futures to allow for non-blocking async operations.
+func DoPollForAsynchronousWithInterval(interval PollingIntervalFunc) autorest.SendDecorator {
+	return DoPollForAsynchronousWithTransientCodes(interval, 0)
+}
+
+// DoPollForAsynchronousWithTransientCodes returns a SendDecorator that polls as
+// DoPollForAsynchronousWithInterval does but keeps polling when a polling request fails with one of
+// the passed status codes. This tolerates transient errors, such as a 404 (Not Found) or 409
+// (Conflict) returned before a newly created resource is consistent across the service. Polling
+// stops with the error once such responses have persisted for longer than the passed tolerance; a
+// successful polling response resets the tolerance.
+// Deprecated: Prefer using Futures to allow for non-blocking async operations.
+func DoPollForAsynchronousWithTransientCodes(interval PollingIntervalFunc, tolerance time.Duration, codes ...int) autorest.SendDecorator {
 	return func(s autorest.Sender) autorest.Sender {
 		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
 			resp, err := s.Do(r)
 			if err != nil {
 				return resp, err
 			}
-			if !autorest.ResponseHasStatusCode(resp, pollingCodes[:]...) {
+			// only responses to PUT, PATCH, POST and DELETE requests can start a long-running
+			// operation; others, such as GET, complete in their initial response
+			if !autorest.ResponseHasStatusCode(resp, pollingCodes[:]...) || !isLongRunningMethod(r.Method) {
 				return resp, nil
 			}
+			// operations that complete in their initial response (e.g. a 200 with a terminal
+			// provisioning state) are reported as done by the Future without polling
 			future, err := NewFutureFromResponse(resp)
 			if err != nil {
 				return resp, err
 			}
-			// retry until either the LRO completes or we receive an error
+			// retry until either the LRO completes or we receive an error that is not transient
+			autorest.SetOperationPhase(r.Context(), autorest.OperationPhasePolling)
 			var done bool
-			for done, err = future.Done(s); !done && err == nil; done, err = future.Done(s) {
-				// check for Retry-After delay, if not present use the specified polling delay
-				if pd, ok := future.GetPollingDelay(); ok {
-					delay = pd
+			var transientSince time.Time
+			attempt := 0
+			for done, err = future.Done(s); !done; done, err = future.Done(s) {
+				if err != nil {
+					if !autorest.ResponseHasStatusCode(future.Response(), codes...) {
+						break
+					}
+					if transientSince.IsZero() {
+						transientSince = time.Now()
+					} else if time.Since(transientSince) > tolerance {
+						break
+					}
+				} else {
+					transientSince = time.Time{}
+				}
+				// check for Retry-After delay, if not present use the specified polling interval
+				delay, ok := future.GetPollingDelay()
+				if !ok {
+					delay = interval(attempt)
 				}
+				attempt++
 				// wait until the delay elapses or the context is cancelled
 				if delayElapsed := autorest.DelayForBackoff(delay, 0, r.Context().Done()); !delayElapsed {
 					return future.Response(),
@@ -948,6 +1120,16 @@ func DoPollForAsynchronous(delay time.Duration) autorest.SendDecorator {
 	}
 }
 
+// isLongRunningMethod returns true if requests with the specified method can start an Azure
+// long-running operation.
+func isLongRunningMethod(method string) bool {
+	switch strings.ToUpper(method) {
+	case http.MethodDelete, http.MethodPatch, http.MethodPost, http.MethodPut:
+		return true
+	}
+	return false
+}
+
 // PollingMethodType defines a type used for enumerating polling mechanisms.
 type PollingMethodType string
 
@@ -616,6 +616,37 @@ func TestDoPollForAsynchronous_Success(t *testing.T) {
 	autorest.Respond(r, autorest.ByClosing())
 }
 
+func TestDoPollForAsynchronous_CompletesInInitialResponse(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendResponse(newAsyncResp(newAsyncReq(http.MethodPut, nil), http.StatusOK, mocks.NewBody(fmt.Sprintf(pollingStateFormat, operationSucceeded))))
+
+	r, err := autorest.SendWithSender(sender, newAsyncReq(http.MethodPut, nil), DoPollForAsynchronous(time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to poll for status: %v", err)
+	}
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("wrong status code: %d", r.StatusCode)
+	}
+	if sender.Attempts() != 1 {
+		t.Fatalf("DoPollForAsynchronous polled an operation that completed in its initial response (%d requests)", sender.Attempts())
+	}
+	autorest.Respond(r, autorest.ByClosing())
+}
+
+func TestDoPollForAsynchronous_IgnoresGet(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendResponse(newAsyncResp(newAsyncReq(http.MethodGet, nil), http.StatusOK, mocks.NewBody(someResource)))
+
+	r, err := autorest.SendWithSender(sender, newAsyncReq(http.MethodGet, nil), DoPollForAsynchronous(time.Millisecond))
+	if err != nil {
+		t.Fatalf("DoPollForAsynchronous returned an error for a GET request: %v", err)
+	}
+	if sender.Attempts() != 1 {
+		t.Fatalf("DoPollForAsynchronous polled a GET request (%d requests)", sender.Attempts())
+	}
+	autorest.Respond(r, autorest.ByClosing())
+}
+
 func TestDoPollForAsynchronous_Failed(t *testing.T) {
 	r1 := newSimpleAsyncResp()
 	r2 := newOperationResourceResponse("busy")
@@ -679,6 +710,111 @@ func TestDoPollForAsynchronous_CanBeCanceled(t *testing.T) {
 	}
 }
 
+func TestDoPollForAsynchronousWithInterval_UsesIntervalPerAttempt(t *testing.T) {
+	r1 := newSimpleAsyncResp()
+	r2 := newOperationResourceResponse("busy")
+	r2.Header.Del(autorest.HeaderRetryAfter)
+	r3 := newOperationResourceResponse(operationSucceeded)
+
+	sender := mocks.NewSender()
+	sender.AppendResponse(r1)
+	sender.AppendAndRepeatResponse(r2, 3)
+	sender.AppendResponse(r3)
+
+	var attempts []int
+	interval := func(attempt int) time.Duration {
+		attempts = append(attempts, attempt)
+		return time.Millisecond
+	}
+	r, err := autorest.SendWithSender(sender, newAsyncReq(http.MethodPut, nil), DoPollForAsynchronousWithInterval(interval))
+	if err != nil {
+		t.Fatalf("failed to poll for status: %v", err)
+	}
+	if expected := []int{0, 1, 2}; !reflect.DeepEqual(attempts, expected) {
+		t.Fatalf("DoPollForAsynchronousWithInterval requested intervals for attempts %v, expected %v", attempts, expected)
+	}
+	autorest.Respond(r, autorest.ByClosing())
+}
+
+func TestDoPollForAsynchronousWithTransientCodes_KeepsPolling(t *testing.T) {
+	r1 := newSimpleAsyncResp()
+	r2 := mocks.NewResponseWithBodyAndStatus(mocks.NewBody(errorResponse), http.StatusNotFound, "Not Found")
+	r3 := newOperationResourceResponse(operationSucceeded)
+
+	sender := mocks.NewSender()
+	sender.AppendResponse(r1)
+	sender.AppendAndRepeatResponse(r2, 2)
+	sender.AppendResponse(r3)
+
+	r, err := autorest.SendWithSender(sender, newAsyncReq(http.MethodPut, nil),
+		DoPollForAsynchronousWithTransientCodes(ConstantPollingInterval(time.Millisecond), time.Minute, http.StatusNotFound, http.StatusConflict))
+	if err != nil {
+		t.Fatalf("failed to poll for status: %v", err)
+	}
+	if sender.Attempts() < sender.NumResponses() {
+		t.Fatal("DoPollForAsynchronousWithTransientCodes stopped polling on a transient status code")
+	}
+	autorest.Respond(r, autorest.ByClosing())
+}
+
+func TestDoPollForAsynchronousWithTransientCodes_StopsAfterTolerance(t *testing.T) {
+	r1 := newSimpleAsyncResp()
+	r2 := mocks.NewResponseWithBodyAndStatus(mocks.NewBody(errorResponse), http.StatusNotFound, "Not Found")
+
+	sender := mocks.NewSender()
+	sender.AppendResponse(r1)
+	sender.AppendAndRepeatResponseWithDelay(r2, 5*time.Millisecond, 100)
+
+	r, err := autorest.SendWithSender(sender, newAsyncReq(http.MethodPut, nil),
+		DoPollForAsynchronousWithTransientCodes(ConstantPollingInterval(time.Millisecond), 20*time.Millisecond, http.StatusNotFound))
+	if err == nil {
+		t.Fatal("DoPollForAsynchronousWithTransientCodes failed to return an error once the tolerance elapsed")
+	}
+	if r == nil || r.StatusCode != http.StatusNotFound {
+		t.Fatalf("DoPollForAsynchronousWithTransientCodes returned %v, expected the 404 response", r)
+	}
+	if sender.Attempts() > 50 {
+		t.Fatalf("DoPollForAsynchronousWithTransientCodes polled %d times, beyond the tolerance", sender.Attempts())
+	}
+}
+
+func TestDoPollForAsynchronousWithInterval_StopsOnErrorStatus(t *testing.T) {
+	r1 := newSimpleAsyncResp()
+	r2 := mocks.NewResponseWithBodyAndStatus(mocks.NewBody(errorResponse), http.StatusNotFound, "Not Found")
+
+	sender := mocks.NewSender()
+	sender.AppendResponse(r1)
+	sender.AppendAndRepeatResponse(r2, 2)
+
+	_, err := autorest.SendWithSender(sender, newAsyncReq(http.MethodPut, nil),
+		DoPollForAsynchronousWithInterval(ConstantPollingInterval(time.Millisecond)))
+	if err == nil {
+		t.Fatal("DoPollForAsynchronousWithInterval failed to return an error for a 404")
+	}
+	if sender.Attempts() != 2 {
+		t.Fatalf("DoPollForAsynchronousWithInterval sent %d requests, expected 2", sender.Attempts())
+	}
+}
+
+func TestExponentialPollingInterval(t *testing.T) {
+	interval := ExponentialPollingInterval(time.Second, 5*time.Second)
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for attempt, d := range expected {
+		if got := interval(attempt); got != d {
+			t.Fatalf("ExponentialPollingInterval returned %v for attempt %d, expected %v", got, attempt, d)
+		}
+	}
+}
+
+func TestConstantPollingInterval(t *testing.T) {
+	interval := ConstantPollingInterval(time.Second)
+	for attempt := 0; attempt < 3; attempt++ {
+		if got := interval(attempt); got != time.Second {
+			t.Fatalf("ConstantPollingInterval returned %v for attempt %d, expected %v", got, attempt, time.Second)
+		}
+	}
+}
+
 func TestFuture_PollsUntilProvisioningStatusSucceeds(t *testing.T) {
 	r2 := newOperationResourceResponse("busy")
 	r3 := newOperationResourceResponse(operationSucceeded)
@@ -832,6 +968,33 @@ func TestFuture_WaitForCompletion(t *testing.T) {
 		autorest.ByClosing())
 }
 
+func TestFuture_WaitForCompletionOperationTimeout(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendAndRepeatResponse(newOperationResourceResponse("busy"), 10)
+	client := autorest.Client{
+		PollingDelay:     1 * time.Second,
+		PollingDuration:  autorest.DefaultPollingDuration,
+		RetryAttempts:    autorest.DefaultRetryAttempts,
+		RetryDuration:    1 * time.Second,
+		OperationTimeout: 50 * time.Millisecond,
+		Sender:           sender,
+	}
+
+	future, err := NewFutureFromResponse(newSimpleAsyncResp())
+	if err != nil {
+		t.Fatalf("failed to create future: %v", err)
+	}
+
+	err = future.WaitForCompletionRef(context.Background(), client)
+	te, ok := err.(autorest.OperationTimeoutError)
+	if !ok {
+		t.Fatalf("WaitForCompletionRef returned %v, expected an OperationTimeoutError", err)
+	}
+	if te.Phase != autorest.OperationPhasePolling {
+		t.Fatalf("WaitForCompletionRef timed out while %s, expected %s", te.Phase, autorest.OperationPhasePolling)
+	}
+}
+
 func TestFuture_WaitForCompletionRef(t *testing.T) {
 	r2 := newOperationResourceResponse("busy")
 	r3 := newOperationResourceResponse(operationSucceeded)
@@ -865,6 +1028,99 @@ func TestFuture_WaitForCompletionRef(t *testing.T) {
 		autorest.ByClosing())
 }
 
+func TestFuture_WaitForCompletionRefPollingLimiter(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendResponse(newOperationResourceResponse(operationSucceeded))
+	client := autorest.Client{
+		PollingDelay:    1 * time.Second,
+		PollingDuration: autorest.DefaultPollingDuration,
+		RetryAttempts:   autorest.DefaultRetryAttempts,
+		RetryDuration:   1 * time.Second,
+		Sender:          sender,
+		PollingLimiter:  autorest.NewPollingLimiter(1),
+	}
+	// occupy the only slot, as another operation being awaited would
+	if err := client.PollingLimiter.Acquire(context.Background()); err != nil {
+		t.Fatalf("failed to acquire the polling slot: %v", err)
+	}
+
+	future, err := NewFutureFromResponse(newSimpleAsyncResp())
+	if err != nil {
+		t.Fatalf("failed to create future: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = future.WaitForCompletionRef(ctx, client); err == nil {
+		t.Fatal("WaitForCompletionRef polled beyond the polling limit")
+	}
+	if sender.Attempts() != 0 {
+		t.Fatalf("WaitForCompletionRef sent %d polling requests while queued", sender.Attempts())
+	}
+
+	client.PollingLimiter.Release()
+	if err = future.WaitForCompletionRef(context.Background(), client); err != nil {
+		t.Fatalf("WaitForCompletionRef returned an error (%v)", err)
+	}
+	autorest.Respond(future.Response(),
+		autorest.ByClosing())
+}
+
+func TestWaitForAll(t *testing.T) {
+	var mu sync.Mutex
+	polled := map[string]int{}
+	sender := autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		polled[r.URL.String()]++
+		attempt := polled[r.URL.String()]
+		mu.Unlock()
+		var resp *http.Response
+		switch {
+		case r.URL.String() == mocks.TestAzureAsyncURL+"/failed":
+			resp = newOperationResourceResponse(operationFailed)
+		case attempt < 3:
+			resp = newOperationResourceResponse("busy")
+		default:
+			resp = newOperationResourceResponse(operationSucceeded)
+		}
+		resp.Request = r
+		return resp, nil
+	})
+	client := autorest.Client{
+		PollingDelay:    1 * time.Millisecond,
+		PollingDuration: autorest.DefaultPollingDuration,
+		RetryAttempts:   autorest.DefaultRetryAttempts,
+		RetryDuration:   1 * time.Millisecond,
+		Sender:          sender,
+	}
+	newResp := func(name string) *http.Response {
+		r := newSimpleAsyncResp()
+		mocks.SetResponseHeader(r, headerAsyncOperation, mocks.TestAzureAsyncURL+"/"+name)
+		return r
+	}
+
+	results := WaitForAll(context.Background(), client, newResp("first"), newResp("failed"), nil, newResp("second"))
+	if len(results) != 4 {
+		t.Fatalf("WaitForAll returned %d results, expected 4", len(results))
+	}
+	for _, i := range []int{0, 3} {
+		if results[i].Err != nil {
+			t.Fatalf("WaitForAll returned an error for operation %d (%v)", i, results[i].Err)
+		}
+		if results[i].Future.Status() != operationSucceeded {
+			t.Fatalf("WaitForAll returned status %s for operation %d", results[i].Future.Status(), i)
+		}
+	}
+	if results[1].Err == nil {
+		t.Fatal("WaitForAll failed to return the error of the failed operation")
+	}
+	if results[2].Err == nil {
+		t.Fatal("WaitForAll failed to return an error for the nil response")
+	}
+	if polled[mocks.TestAzureAsyncURL+"/first"] != 3 || polled[mocks.TestAzureAsyncURL+"/second"] != 3 {
+		t.Fatalf("WaitForAll polled the operations %v times", polled)
+	}
+}
+
 func TestFuture_WaitForCompletionTimedOut(t *testing.T) {
 	r2 := newProvisioningStatusResponse("busy")
 
@@ -890,6 +1146,118 @@ func TestFuture_WaitForCompletionTimedOut(t *testing.T) {
 	}
 }
 
+func TestGetPollingHints(t *testing.T) {
+	cases := []struct {
+		retryAfter string
+		timeout    string
+		expected   PollingHints
+	}{
+		{"", "", PollingHints{}},
+		{"5", "", PollingHints{InitialDelay: 5 * time.Second}},
+		{"", "600", PollingHints{Timeout: 10 * time.Minute}},
+		{"5", "600", PollingHints{InitialDelay: 5 * time.Second, Timeout: 10 * time.Minute}},
+		{"soon", "later", PollingHints{}},
+		{"", "-1", PollingHints{}},
+	}
+	for _, c := range cases {
+		resp := newSimpleAsyncResp()
+		if c.retryAfter != "" {
+			mocks.SetResponseHeader(resp, autorest.HeaderRetryAfter, c.retryAfter)
+		}
+		if c.timeout != "" {
+			mocks.SetResponseHeader(resp, headerOperationTimeout, c.timeout)
+		}
+		if got := GetPollingHints(resp); got != c.expected {
+			t.Fatalf("GetPollingHints returned %+v for Retry-After %q and timeout %q, expected %+v", got, c.retryAfter, c.timeout, c.expected)
+		}
+	}
+	if got := GetPollingHints(nil); got != (PollingHints{}) {
+		t.Fatalf("GetPollingHints returned %+v for a nil response", got)
+	}
+}
+
+func TestFuture_WaitForCompletionRefDelaysFirstPoll(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendResponse(newOperationResourceResponse(operationSucceeded))
+	client := autorest.Client{
+		PollingDelay:    1 * time.Second,
+		PollingDuration: autorest.DefaultPollingDuration,
+		RetryAttempts:   autorest.DefaultRetryAttempts,
+		RetryDuration:   1 * time.Second,
+		Sender:          sender,
+	}
+	resp := newSimpleAsyncResp()
+	mocks.SetResponseHeader(resp, autorest.HeaderRetryAfter, "60")
+	future, err := NewFutureFromResponse(resp)
+	if err != nil {
+		t.Fatalf("failed to create future: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = future.WaitForCompletionRef(ctx, client); err == nil {
+		t.Fatal("WaitForCompletionRef returned nil error, should have been cancelled while waiting")
+	}
+	if sender.Attempts() != 0 {
+		t.Fatalf("WaitForCompletionRef polled %d times before the Retry-After delay elapsed", sender.Attempts())
+	}
+}
+
+func TestFuture_WaitForCompletionRefHonorsTimeoutHint(t *testing.T) {
+	r2 := newProvisioningStatusResponse("busy")
+
+	sender := mocks.NewSender()
+	sender.AppendAndRepeatResponseWithDelay(r2, 500*time.Millisecond, 10)
+
+	resp := newSimpleAsyncResp()
+	mocks.SetResponseHeader(resp, headerOperationTimeout, "1")
+	future, err := NewFutureFromResponse(resp)
+	if err != nil {
+		t.Fatalf("failed to create future: %v", err)
+	}
+	client := autorest.Client{
+		PollingDelay:    autorest.DefaultPollingDelay,
+		PollingDuration: autorest.DefaultPollingDuration,
+		RetryAttempts:   autorest.DefaultRetryAttempts,
+		RetryDuration:   1 * time.Second,
+		Sender:          sender,
+	}
+	start := time.Now()
+	if err = future.WaitForCompletionRef(context.Background(), client); err == nil {
+		t.Fatal("WaitForCompletionRef returned nil error, should have timed out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("WaitForCompletionRef ran for %v, beyond the hinted timeout", elapsed)
+	}
+}
+
+func TestFuture_WaitForCompletionRefKeepsShorterPollingDuration(t *testing.T) {
+	r2 := newProvisioningStatusResponse("busy")
+
+	sender := mocks.NewSender()
+	sender.AppendAndRepeatResponseWithDelay(r2, 500*time.Millisecond, 20)
+
+	resp := newSimpleAsyncResp()
+	mocks.SetResponseHeader(resp, headerOperationTimeout, "3600")
+	future, err := NewFutureFromResponse(resp)
+	if err != nil {
+		t.Fatalf("failed to create future: %v", err)
+	}
+	client := autorest.Client{
+		PollingDelay:    autorest.DefaultPollingDelay,
+		PollingDuration: 1 * time.Second,
+		RetryAttempts:   autorest.DefaultRetryAttempts,
+		RetryDuration:   1 * time.Second,
+		Sender:          sender,
+	}
+	start := time.Now()
+	if err = future.WaitForCompletionRef(context.Background(), client); err == nil {
+		t.Fatal("WaitForCompletionRef returned nil error, should have timed out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("WaitForCompletionRef ran for %v, beyond the configured polling duration", elapsed)
+	}
+}
+
 func TestFuture_WaitForCompletionRetriesExceeded(t *testing.T) {
 	r1 := newProvisioningStatusResponse("InProgress")
 
@@ -497,12 +497,12 @@ func (mc MSIConfig) Authorizer() (autorest.Authorizer, error) {
 
 	var spToken *adal.ServicePrincipalToken
 	if mc.ClientID == "" {
-		spToken, err = adal.NewServicePrincipalTokenFromMSI(msiEndpoint, mc.Resource, mc.Secret)
+		spToken, err = adal.NewServicePrincipalTokenFromMSIWithSecret(msiEndpoint, mc.Resource, mc.Secret)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get oauth token from MSI: %v", err)
 		}
 	} else {
-		spToken, err = adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint, mc.Resource, mc.Secret, mc.ClientID)
+		spToken, err = adal.NewServicePrincipalTokenFromMSIWithUserAssignedIDAndSecret(msiEndpoint, mc.Resource, mc.Secret, mc.ClientID)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get oauth token from MSI for user assigned identity: %v", err)
 		}
@@ -17,6 +17,7 @@ package azure
 //  limitations under the License.
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -138,6 +139,63 @@ func (se *ServiceError) populate(code, message string, target *string, details [
 	se.AdditionalInfo = additional
 }
 
+// ErrorDetail is a single entry of a flattened ServiceError.
+type ErrorDetail struct {
+	Code    string
+	Message string
+	Target  string
+}
+
+// Flatten returns the ServiceError and all of its nested details and inner errors as an ordered
+// slice of ErrorDetail. The ServiceError itself comes first, followed by its details and inner
+// error, depth first, so that the complete chain of errors (e.g. the individual violations of a
+// policy) can be logged. Entries with neither a code nor a message are omitted.
+func (se ServiceError) Flatten() []ErrorDetail {
+	var details []ErrorDetail
+	top := ErrorDetail{Code: se.Code, Message: se.Message}
+	if se.Target != nil {
+		top.Target = *se.Target
+	}
+	details = appendErrorDetail(details, top)
+	for _, d := range se.Details {
+		details = flattenErrorDetail(details, d)
+	}
+	if se.InnerError != nil {
+		details = flattenErrorDetail(details, se.InnerError)
+	}
+	return details
+}
+
+// flattenErrorDetail appends the error described by m, followed by its nested errors, to details.
+func flattenErrorDetail(details []ErrorDetail, m map[string]interface{}) []ErrorDetail {
+	d := ErrorDetail{}
+	d.Code, _ = m["code"].(string)
+	d.Message, _ = m["message"].(string)
+	d.Target, _ = m["target"].(string)
+	details = appendErrorDetail(details, d)
+	switch nested := m["details"].(type) {
+	case []interface{}:
+		for _, n := range nested {
+			if nm, ok := n.(map[string]interface{}); ok {
+				details = flattenErrorDetail(details, nm)
+			}
+		}
+	case map[string]interface{}:
+		details = flattenErrorDetail(details, nested)
+	}
+	if inner, ok := m["innererror"].(map[string]interface{}); ok {
+		details = flattenErrorDetail(details, inner)
+	}
+	return details
+}
+
+func appendErrorDetail(details []ErrorDetail, d ErrorDetail) []ErrorDetail {
+	if d.Code == "" && d.Message == "" {
+		return details
+	}
+	return append(details, d)
+}
+
 // RequestError describes an error response returned by Azure service.
 type RequestError struct {
 	autorest.DetailedError
@@ -247,6 +305,21 @@ func WithClientID(uuid string) autorest.PrepareDecorator {
 	return autorest.WithHeader(HeaderClientID, uuid)
 }
 
+// WithNewClientID returns a PrepareDecorator that adds an HTTP extension header of
+// x-ms-client-request-id whose value is a new random UUID (see autorest.NewUUID) for each request
+// prepared. A client request ID already set on the request is left unchanged.
+func WithNewClientID() autorest.PrepareDecorator {
+	return func(p autorest.Preparer) autorest.Preparer {
+		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err != nil || r.Header.Get(HeaderClientID) != "" {
+				return r, err
+			}
+			return autorest.Prepare(r, WithClientID(autorest.NewUUID()))
+		})
+	}
+}
+
 // WithReturnClientID returns a PrepareDecorator that adds an HTTP extension header of
 // x-ms-return-client-request-id whose boolean value indicates if the value of the
 // x-ms-client-request-id header should be included in the http.Response.
@@ -266,6 +339,84 @@ func ExtractRequestID(resp *http.Response) string {
 	return autorest.ExtractHeaderValue(HeaderRequestID, resp)
 }
 
+// IsTokenExpiredError returns true if resp is an unauthenticated (401) response caused by an
+// expired access token, as opposed to, for example, invalid credentials. Only in the former case
+// will acquiring a fresh token and retrying the request succeed; other 401 responses should be
+// surfaced as authentication failures to avoid refresh loops. Both the bearer challenge in the
+// WWW-Authenticate header and the error code in the response body are inspected. The body, if
+// read, is left available to the caller.
+func IsTokenExpiredError(resp *http.Response) bool {
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+	challenge := strings.ToLower(resp.Header.Get("WWW-Authenticate"))
+	if strings.Contains(challenge, "invalid_token") && strings.Contains(challenge, "expired") {
+		return true
+	}
+	if resp.Body == nil {
+		return false
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return false
+	}
+	var e RequestError
+	if err := json.Unmarshal(b, &e); err != nil || e.ServiceError == nil {
+		return false
+	}
+	return e.ServiceError.Code == "ExpiredAuthenticationToken"
+}
+
+// RegionUnavailableCodes are the error codes with which Azure reports, in a 503 (Service
+// Unavailable) response, that a region is temporarily unavailable (e.g., during maintenance).
+// Codes may be added to recognize further services.
+var RegionUnavailableCodes = []string{"RegionUnavailable", "RegionIsUnavailable", "RegionUnderMaintenance"}
+
+// IsRegionUnavailable returns true if resp is a 503 (Service Unavailable) response whose body
+// reports, with one of the RegionUnavailableCodes, that the region is temporarily unavailable. Such
+// requests should be failed over to another region, whereas other 503 responses (e.g., throttling)
+// should be retried in place. The body, if read, is left available to the caller.
+func IsRegionUnavailable(resp *http.Response) bool {
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		return false
+	}
+	return HasServiceErrorCode(resp, RegionUnavailableCodes...)
+}
+
+// HasServiceErrorCode returns true if the body of resp is an Azure error whose code matches, ignoring
+// case, one of the passed codes. The status code of resp is not considered, so it may be used with
+// autorest.DoRetryWithPredicate to retry responses reporting a transient condition in their body.
+// The body, if read, is left available to the caller.
+func HasServiceErrorCode(resp *http.Response, codes ...string) bool {
+	if resp == nil || resp.Body == nil {
+		return false
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return false
+	}
+	var e RequestError
+	if err := json.Unmarshal(b, &e); err != nil || e.ServiceError == nil {
+		return false
+	}
+	for _, code := range codes {
+		if strings.EqualFold(e.ServiceError.Code, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// decompressBody replaces a gzip or deflate encoded response body with a reader that decompresses
+// it and removes the Content-Encoding header (see autorest.ByDecompressing).
+func decompressBody(resp *http.Response) error {
+	return autorest.Respond(resp, autorest.ByDecompressing())
+}
+
 // WithErrorUnlessStatusCode returns a RespondDecorator that emits an
 // azure.RequestError by reading the response body unless the response HTTP status code
 // is among the set passed.
@@ -285,6 +436,11 @@ func WithErrorUnlessStatusCode(codes ...int) autorest.RespondDecorator {
 				var e RequestError
 				defer resp.Body.Close()
 
+				// Some gateways compress error responses, decompress so the error can be parsed.
+				if err := decompressBody(resp); err != nil {
+					return fmt.Errorf("autorest/azure: error response cannot be decompressed: %v", err)
+				}
+
 				// Copy and replace the Body in case it does not contain an error object.
 				// This will leave the Body available to the caller.
 				b, decodeErr := autorest.CopyAndDecode(autorest.EncodedAsJSON, resp.Body, &e)
@@ -318,7 +474,11 @@ func WithErrorUnlessStatusCode(codes ...int) autorest.RespondDecorator {
 				if e.StatusCode == nil {
 					e.StatusCode = resp.StatusCode
 				}
-				err = &e
+				err = autorest.FormatError(resp, autorest.ErrorInfo{
+					Code:    e.ServiceError.Code,
+					Message: e.ServiceError.Message,
+					Err:     &e,
+				})
 			}
 			return err
 		})
@@ -15,6 +15,9 @@ package azure
 //  limitations under the License.
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -79,6 +82,31 @@ func TestWithClientID(t *testing.T) {
 	}
 }
 
+func TestWithNewClientID(t *testing.T) {
+	prepare := autorest.CreatePreparer(WithNewClientID())
+	req1, err := prepare.Prepare(&http.Request{})
+	if err != nil {
+		t.Fatalf("azure: WithNewClientID returned an error (%v)", err)
+	}
+	req2, _ := prepare.Prepare(&http.Request{})
+	id1, id2 := req1.Header.Get(HeaderClientID), req2.Header.Get(HeaderClientID)
+	if len(id1) != 36 || id1 == id2 {
+		t.Fatalf("azure: WithNewClientID failed to set a new UUID for each request -- received %q and %q", id1, id2)
+	}
+}
+
+func TestWithNewClientIDKeepsExistingClientID(t *testing.T) {
+	uuid := "71FDB9F4-5E49-4C12-B266-DE7B4FD999A6"
+	req, _ := autorest.Prepare(&http.Request{},
+		WithClientID(uuid),
+		WithNewClientID())
+
+	if req.Header.Get(HeaderClientID) != uuid {
+		t.Fatalf("azure: WithNewClientID replaced %s -- expected %s, received %s",
+			HeaderClientID, uuid, req.Header.Get(HeaderClientID))
+	}
+}
+
 func TestWithReturnClientID(t *testing.T) {
 	b := false
 	req, _ := autorest.Prepare(&http.Request{},
@@ -235,6 +263,285 @@ func TestWithErrorUnlessStatusCode_FoundAzureErrorWithoutDetails(t *testing.T) {
 
 }
 
+func TestServiceErrorFlatten(t *testing.T) {
+	j := `{
+		"code": "RequestDisallowedByPolicy",
+		"message": "Resource was disallowed by policy.",
+		"target": "vm1",
+		"details": [
+			{
+				"code": "PolicyViolation",
+				"message": "Location is not allowed.",
+				"target": "location",
+				"details": [{"code": "NestedViolation", "message": "SKU is not allowed."}]
+			},
+			{"code": "PolicyViolation", "message": "Tags are required.", "innererror": {"code": "MissingTag", "message": "Tag 'owner' is missing."}}
+		],
+		"innererror": {"code": "InnerCode", "message": "Inner message.", "innererror": {"message": "Innermost message."}}
+	}`
+	var se ServiceError
+	if err := json.Unmarshal([]byte(j), &se); err != nil {
+		t.Fatalf("azure: failed to unmarshal service error: %v", err)
+	}
+	expected := []ErrorDetail{
+		{Code: "RequestDisallowedByPolicy", Message: "Resource was disallowed by policy.", Target: "vm1"},
+		{Code: "PolicyViolation", Message: "Location is not allowed.", Target: "location"},
+		{Code: "NestedViolation", Message: "SKU is not allowed."},
+		{Code: "PolicyViolation", Message: "Tags are required."},
+		{Code: "MissingTag", Message: "Tag 'owner' is missing."},
+		{Code: "InnerCode", Message: "Inner message."},
+		{Message: "Innermost message."},
+	}
+	if actual := se.Flatten(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("azure: ServiceError#Flatten returned %+v, expected %+v", actual, expected)
+	}
+}
+
+func TestIsTokenExpiredError_Challenge(t *testing.T) {
+	r := mocks.NewResponseWithStatus("401 Unauthorized", http.StatusUnauthorized)
+	mocks.SetResponseHeader(r, "WWW-Authenticate", `Bearer authorization_uri="https://login.windows.net/tenant", error="invalid_token", error_description="The access token is expired."`)
+	if !IsTokenExpiredError(r) {
+		t.Fatal("azure: IsTokenExpiredError failed to detect an expired token challenge")
+	}
+}
+
+func TestIsTokenExpiredError_Body(t *testing.T) {
+	j := `{"error": {"code": "ExpiredAuthenticationToken", "message": "The access token expiry UTC time is earlier than current UTC time."}}`
+	r := mocks.NewResponseWithContent(j)
+	r.StatusCode = http.StatusUnauthorized
+	if !IsTokenExpiredError(r) {
+		t.Fatal("azure: IsTokenExpiredError failed to detect an expired token error")
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != j {
+		t.Fatalf("azure: IsTokenExpiredError did not restore the response body. got=%q expected=%q", string(b), j)
+	}
+}
+
+func TestIsTokenExpiredError_OtherUnauthorized(t *testing.T) {
+	r := mocks.NewResponseWithContent(`{"error": {"code": "InvalidAuthenticationToken", "message": "The received access token is not valid."}}`)
+	r.StatusCode = http.StatusUnauthorized
+	mocks.SetResponseHeader(r, "WWW-Authenticate", `Bearer authorization_uri="https://login.windows.net/tenant", error="invalid_token", error_description="The authentication failed because of missing 'Authorization' header."`)
+	if IsTokenExpiredError(r) {
+		t.Fatal("azure: IsTokenExpiredError returned true for an invalid token")
+	}
+	if IsTokenExpiredError(mocks.NewResponse()) {
+		t.Fatal("azure: IsTokenExpiredError returned true for a successful response")
+	}
+	if IsTokenExpiredError(nil) {
+		t.Fatal("azure: IsTokenExpiredError returned true for a nil response")
+	}
+}
+
+func TestIsRegionUnavailable(t *testing.T) {
+	j := `{"error": {"code": "RegionUnavailable", "message": "The region is temporarily unavailable."}}`
+	r := mocks.NewResponseWithContent(j)
+	r.StatusCode = http.StatusServiceUnavailable
+	if !IsRegionUnavailable(r) {
+		t.Fatal("azure: IsRegionUnavailable failed to detect an unavailable region")
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != j {
+		t.Fatalf("azure: IsRegionUnavailable did not restore the response body. got=%q expected=%q", string(b), j)
+	}
+}
+
+func TestIsRegionUnavailable_Throttled(t *testing.T) {
+	r := mocks.NewResponseWithContent(`{"error": {"code": "ServerBusy", "message": "The server is busy."}}`)
+	r.StatusCode = http.StatusServiceUnavailable
+	mocks.SetResponseHeader(r, "Retry-After", "5")
+	if IsRegionUnavailable(r) {
+		t.Fatal("azure: IsRegionUnavailable returned true for a throttled response")
+	}
+	r = mocks.NewResponseWithContent(`{"error": {"code": "RegionUnavailable", "message": "The region is temporarily unavailable."}}`)
+	if IsRegionUnavailable(r) {
+		t.Fatal("azure: IsRegionUnavailable returned true for a successful response")
+	}
+	if IsRegionUnavailable(nil) {
+		t.Fatal("azure: IsRegionUnavailable returned true for a nil response")
+	}
+}
+
+func TestHasServiceErrorCode(t *testing.T) {
+	r := mocks.NewResponseWithContent(`{"error": {"code": "RetryableError", "message": "Try again."}}`)
+	if !HasServiceErrorCode(r, "OtherError", "retryableerror") {
+		t.Fatal("azure: HasServiceErrorCode failed to match the error code")
+	}
+	if HasServiceErrorCode(r, "OtherError") {
+		t.Fatal("azure: HasServiceErrorCode matched an unexpected error code")
+	}
+	if HasServiceErrorCode(mocks.NewResponseWithContent(`{"id": "1"}`), "RetryableError") {
+		t.Fatal("azure: HasServiceErrorCode matched a body without an error")
+	}
+}
+
+func TestDoRetryWithPredicate_ServiceErrorCode(t *testing.T) {
+	r := mocks.NewResponseWithContent(`{"error": {"code": "RetryableError", "message": "Try again."}}`)
+	r.StatusCode = http.StatusConflict
+	r.Status = http.StatusText(r.StatusCode)
+	sender := mocks.NewSender()
+	sender.AppendResponse(r)
+	sender.AppendResponse(mocks.NewResponseWithContent(`{"id": "1"}`))
+
+	resp, err := autorest.SendWithSender(sender, mocks.NewRequest(),
+		autorest.DoRetryWithPredicate(3, 0, func(resp *http.Response) bool {
+			return HasServiceErrorCode(resp, "RetryableError")
+		}))
+	if err != nil {
+		t.Fatalf("azure: DoRetryWithPredicate returned an error (%v)", err)
+	}
+	if sender.Attempts() != 2 {
+		t.Fatalf("azure: DoRetryWithPredicate sent %d requests, expected 2", sender.Attempts())
+	}
+	var v struct{ ID string }
+	err = autorest.Respond(resp,
+		WithErrorUnlessStatusCode(http.StatusOK),
+		autorest.ByUnmarshallingJSON(&v),
+		autorest.ByClosing())
+	if err != nil || v.ID != "1" {
+		t.Fatalf("azure: DoRetryWithPredicate failed to leave the final body for the Responder (%v, %q)", err, v.ID)
+	}
+}
+
+func TestDoRetryWithPredicate_LeavesBodyWhenExhausted(t *testing.T) {
+	j := `{"error": {"code": "RetryableError", "message": "Try again."}}`
+	r := mocks.NewResponseWithContent(j)
+	r.StatusCode = http.StatusConflict
+	sender := mocks.NewSender()
+	sender.AppendAndRepeatResponse(r, 3)
+
+	resp, _ := autorest.SendWithSender(sender, mocks.NewRequest(),
+		autorest.DoRetryWithPredicate(1, 0, func(resp *http.Response) bool {
+			return HasServiceErrorCode(resp, "RetryableError")
+		}))
+	if sender.Attempts() != 2 {
+		t.Fatalf("azure: DoRetryWithPredicate sent %d requests, expected 2", sender.Attempts())
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if string(b) != j {
+		t.Fatalf("azure: DoRetryWithPredicate did not leave the response body. got=%q expected=%q", string(b), j)
+	}
+}
+
+func TestWithErrorUnlessStatusCode_ErrorFormatter(t *testing.T) {
+	r := mocks.NewResponseWithContent(`{"error": {"code": "InternalError", "message": "Azure is having trouble right now."}}`)
+	mocks.SetResponseHeader(r, HeaderRequestID, "71FDB9F4-5E49-4C12-B266-DE7B4FD999A6")
+	r.StatusCode = http.StatusInternalServerError
+	r.Status = http.StatusText(r.StatusCode)
+	sender := mocks.NewSender()
+	sender.AppendResponse(r)
+
+	var info autorest.ErrorInfo
+	client := autorest.Client{
+		Sender: sender,
+		ErrorFormatter: func(i autorest.ErrorInfo) error {
+			info = i
+			return fmt.Errorf("%d %s (%s)", i.StatusCode, i.Code, i.RequestID)
+		},
+	}
+	resp, err := client.Do(mocks.NewRequest())
+	if err != nil {
+		t.Fatalf("azure: Client#Do returned an error (%v)", err)
+	}
+	err = autorest.Respond(resp,
+		WithErrorUnlessStatusCode(http.StatusOK),
+		autorest.ByClosing())
+	expected := "500 InternalError (71FDB9F4-5E49-4C12-B266-DE7B4FD999A6)"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("azure: WithErrorUnlessStatusCode returned %v, expected %s", err, expected)
+	}
+	if info.Message != "Azure is having trouble right now." || info.Method != http.MethodGet {
+		t.Fatalf("azure: WithErrorUnlessStatusCode passed unexpected ErrorInfo %+v", info)
+	}
+	if _, ok := info.Err.(*RequestError); !ok {
+		t.Fatalf("azure: WithErrorUnlessStatusCode passed %T, expected *RequestError", info.Err)
+	}
+}
+
+func TestWithErrorUnlessStatusCode_GzippedAzureError(t *testing.T) {
+	j := `{
+		"error": {
+			"code": "InternalError",
+			"message": "Azure is having trouble right now."
+		}
+	}`
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(j)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := mocks.NewResponse()
+	r.Body = ioutil.NopCloser(&buf)
+	mocks.SetResponseHeader(r, "Content-Encoding", "gzip")
+	r.Request = mocks.NewRequest()
+	r.StatusCode = http.StatusInternalServerError
+	r.Status = http.StatusText(r.StatusCode)
+
+	err := autorest.Respond(r,
+		WithErrorUnlessStatusCode(http.StatusOK),
+		autorest.ByClosing())
+
+	azErr, ok := err.(*RequestError)
+	if !ok {
+		t.Fatalf("azure: returned error is not azure.RequestError: %T", err)
+	}
+	if azErr.ServiceError.Code != "InternalError" || azErr.ServiceError.Message != "Azure is having trouble right now." {
+		t.Fatalf("azure: gzipped service error is not unmarshaled properly: %v", azErr.Error())
+	}
+
+	// the decompressed error body should still be there
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != j {
+		t.Fatalf("response body is wrong. got=%q expected=%q", string(b), j)
+	}
+	if r.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("azure: Content-Encoding header was not removed from the decompressed response")
+	}
+}
+
+func TestWithErrorUnlessStatusCode_DeflatedAzureError(t *testing.T) {
+	j := `{"error": {"code": "InternalError", "message": "Azure is having trouble right now."}}`
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write([]byte(j)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := mocks.NewResponse()
+	r.Body = ioutil.NopCloser(&buf)
+	mocks.SetResponseHeader(r, "Content-Encoding", "deflate")
+	r.Request = mocks.NewRequest()
+	r.StatusCode = http.StatusInternalServerError
+	r.Status = http.StatusText(r.StatusCode)
+
+	err := autorest.Respond(r,
+		WithErrorUnlessStatusCode(http.StatusOK),
+		autorest.ByClosing())
+
+	azErr, ok := err.(*RequestError)
+	if !ok {
+		t.Fatalf("azure: returned error is not azure.RequestError: %T", err)
+	}
+	if azErr.ServiceError.Code != "InternalError" {
+		t.Fatalf("azure: deflated service error is not unmarshaled properly: %v", azErr.Error())
+	}
+}
+
 func TestWithErrorUnlessStatusCode_FoundAzureFullError(t *testing.T) {
 	j := `{
 		"error": {
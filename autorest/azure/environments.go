@@ -31,6 +31,8 @@ var environments = map[string]Environment{
 	"AZUREGERMANCLOUD":       GermanCloud,
 	"AZUREPUBLICCLOUD":       PublicCloud,
 	"AZUREUSGOVERNMENTCLOUD": USGovernmentCloud,
+	// AzureGovernmentCloud is a commonly used alias of AzureUSGovernmentCloud
+	"AZUREGOVERNMENTCLOUD": USGovernmentCloud,
 }
 
 // Environment represents a set of endpoints for each of Azure's Clouds.
@@ -155,7 +157,9 @@ var (
 	}
 )
 
-// EnvironmentFromName returns an Environment based on the common name specified.
+// EnvironmentFromName returns an Environment based on the common name specified: AzurePublicCloud,
+// AzureChinaCloud, AzureUSGovernmentCloud (or AzureGovernmentCloud), AzureGermanCloud or
+// AzureStackCloud. Names are matched case-insensitively.
 func EnvironmentFromName(name string) (Environment, error) {
 	// IMPORTANT
 	// As per @radhikagupta5:
@@ -167,7 +171,7 @@ func EnvironmentFromName(name string) (Environment, error) {
 		return EnvironmentFromFile(os.Getenv(EnvironmentFilepathName))
 	}
 
-	name = strings.ToUpper(name)
+	name = strings.ToUpper(strings.TrimSpace(name))
 	env, ok := environments[name]
 	if !ok {
 		return env, fmt.Errorf("autorest/azure: There is no cloud environment matching the name %q", name)
@@ -24,7 +24,11 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/noahhai/go-autorest/autorest"
 )
 
 // This correlates to the expected contents of ./testdata/test_environment_1.json
@@ -90,6 +94,74 @@ func TestEnvironment_EnvironmentFromURL_OverrideStorageSuffix_Success(t *testing
 	}
 }
 
+func TestEnvironment_EnvironmentFromURL_Endpoints(t *testing.T) {
+	fileContents, _ := ioutil.ReadFile(filepath.Join("testdata", "test_metadata_environment_1.json"))
+	var requested string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.String()
+		w.Write(fileContents)
+	}))
+	defer ts.Close()
+
+	got, err := EnvironmentFromURL(ts.URL + "/")
+	if err != nil {
+		t.Fatalf("azure: EnvironmentFromURL returned an unexpected error (%v)", err)
+	}
+	if requested != "/metadata/endpoints?api-version=1.0" {
+		t.Fatalf("azure: EnvironmentFromURL requested %s", requested)
+	}
+	if got.ResourceManagerEndpoint != ts.URL+"/" || got.ActiveDirectoryEndpoint == "" || got.GalleryEndpoint == "" || got.GraphEndpoint == "" {
+		t.Fatalf("azure: EnvironmentFromURL did not populate the endpoints (%+v)", got)
+	}
+}
+
+func TestEnvironment_EnvironmentFromURL_MalformedMetadata_Failure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"galleryEndpoint":`))
+	}))
+	defer ts.Close()
+
+	if _, err := EnvironmentFromURL(ts.URL); err == nil || !strings.Contains(err.Error(), "unmarshal") {
+		t.Fatalf("azure: EnvironmentFromURL returned %v for malformed metadata", err)
+	}
+}
+
+func TestEnvironment_EnvironmentFromURL_ErrorStatus_Failure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	_, err := EnvironmentFromURL(ts.URL)
+	if derr, ok := err.(autorest.DetailedError); !ok || derr.StatusCode != http.StatusNotFound {
+		t.Fatalf("azure: EnvironmentFromURL returned %v for a 404 response", err)
+	}
+}
+
+func TestEnvironment_EnvironmentFromURL_Unreachable_Failure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Close()
+
+	if _, err := EnvironmentFromURL(ts.URL); err == nil {
+		t.Fatal("azure: EnvironmentFromURL did not return an error for an unreachable endpoint")
+	}
+}
+
+func TestEnvironment_EnvironmentFromURL_Timeout_Failure(t *testing.T) {
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer ts.Close()
+	defer close(unblock)
+	defer func(d time.Duration) { metadataTimeout = d }(metadataTimeout)
+	metadataTimeout = 50 * time.Millisecond
+
+	if _, err := EnvironmentFromURL(ts.URL); err == nil {
+		t.Fatal("azure: EnvironmentFromURL did not return an error when the metadata request timed out")
+	}
+}
+
 func TestEnvironment_EnvironmentFromURL_EmptyEndpoint_Failure(t *testing.T) {
 	_, err := EnvironmentFromURL("")
 
@@ -171,6 +243,16 @@ func TestEnvironmentFromName(t *testing.T) {
 		t.Errorf("Expected to get USGovernmentCloud for %q", name)
 	}
 
+	name = "AzureGovernmentCloud"
+	if env, _ := EnvironmentFromName(name); env != USGovernmentCloud {
+		t.Errorf("Expected to get USGovernmentCloud for %q", name)
+	}
+
+	name = " AzurePublicCloud\n"
+	if env, _ := EnvironmentFromName(name); env != PublicCloud {
+		t.Errorf("Expected to get PublicCloud for %q", name)
+	}
+
 	name = "thisisnotarealcloudenv"
 	if _, err := EnvironmentFromName(name); err == nil {
 		t.Errorf("Expected to get an error for %q", name)
@@ -1,11 +1,13 @@
 package azure
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/noahhai/go-autorest/autorest"
 )
@@ -227,19 +229,34 @@ func overrideProperties(environment *Environment, properties []OverrideProperty)
 	}
 }
 
+// metadataTimeout bounds the request for the metadata of a cloud environment.
+var metadataTimeout = 30 * time.Second
+
 func retrieveMetadataEnvironment(endpoint string) (environment environmentMetadataInfo, err error) {
 	client := autorest.NewClientWithUserAgent("")
 	managementEndpoint := fmt.Sprintf("%s%s", strings.TrimSuffix(endpoint, "/"), "/metadata/endpoints?api-version=1.0")
-	req, _ := http.NewRequest("GET", managementEndpoint, nil)
+	req, err := http.NewRequest("GET", managementEndpoint, nil)
+	if err != nil {
+		return environment, autorest.NewErrorWithError(err, "azure", "EnvironmentFromURL", nil, "Failed to create the metadata request for %s", endpoint)
+	}
+	// the timeout is applied through the context to keep the client's default sender
+	ctx, cancel := context.WithTimeout(context.Background(), metadataTimeout)
+	defer cancel()
+	req = req.WithContext(ctx)
 	response, err := client.Do(req)
 	if err != nil {
-		return environment, err
+		return environment, autorest.NewErrorWithError(err, "azure", "EnvironmentFromURL", nil, "Failed to retrieve the metadata from %s", managementEndpoint)
 	}
 	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return environment, autorest.NewErrorWithResponse("azure", "EnvironmentFromURL", response, "Failed to retrieve the metadata from %s", managementEndpoint)
+	}
 	jsonResponse, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return environment, err
+		return environment, autorest.NewErrorWithError(err, "azure", "EnvironmentFromURL", response, "Failed to read the metadata from %s", managementEndpoint)
 	}
-	err = json.Unmarshal(jsonResponse, &environment)
-	return environment, err
+	if err = json.Unmarshal(jsonResponse, &environment); err != nil {
+		return environment, autorest.NewErrorWithError(err, "azure", "EnvironmentFromURL", response, "Failed to unmarshal the metadata from %s", managementEndpoint)
+	}
+	return environment, nil
 }
@@ -0,0 +1,167 @@
+package azure
+
+// Copyright 2017 Microsoft Corporation
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/noahhai/go-autorest/autorest"
+)
+
+// page is the envelope of a single page of results returned by a list operation.
+type page struct {
+	Value    json.RawMessage `json:"value"`
+	NextLink *string         `json:"nextLink"`
+}
+
+// ByCollectingPages returns a RespondDecorator that unmarshals the "value" array of a paged list
+// response into the slice pointed to by out, then follows each "nextLink" by sending a GET
+// request through the passed Sender and appends the values of every subsequent page until no
+// pages remain. The Sender is typically the autorest.Client used to send the initial request so
+// that the same authorization is applied to every page. If any page fails, no values are
+// collected; use ByCollectingPagesWithOptions with PartialResults to keep them.
+func ByCollectingPages(sender autorest.Sender, out interface{}) autorest.RespondDecorator {
+	return ByCollectingPagesWithLimit(sender, out, 0)
+}
+
+// ByCollectingPagesWithLimit returns a RespondDecorator that behaves like ByCollectingPages but
+// stops with an error once more than maxItems values have been collected, guarding against
+// unbounded memory use. A maxItems of zero or less collects all values.
+func ByCollectingPagesWithLimit(sender autorest.Sender, out interface{}, maxItems int) autorest.RespondDecorator {
+	return byCollectingPages(sender, out, PageOptions{}, maxItems)
+}
+
+// PageOptions controls when ByCollectingPagesWithOptions stops collecting values. Once it stops,
+// no further pages are requested.
+type PageOptions struct {
+	// MaxItems, if greater than zero, is the number of values after which collection stops.
+	MaxItems int
+
+	// StopWhen, if not nil, is invoked with each value before it is collected. Collection stops,
+	// without collecting the value, when it returns true.
+	StopWhen func(item json.RawMessage) bool
+
+	// PartialResults, if true, keeps the values collected before a subsequent page fails and
+	// returns a *PageError from which collection may be resumed. Otherwise, no values are
+	// collected when any page fails.
+	PartialResults bool
+}
+
+// PageError is returned by ByCollectingPagesWithOptions, when PartialResults is set, if a page
+// following the first cannot be retrieved. The values of the preceding pages remain collected.
+type PageError struct {
+	// NextLink is the link of the page that failed; collection may be resumed by requesting it.
+	NextLink string
+
+	// Err is the error that occurred.
+	Err error
+}
+
+// Error returns a string describing the failed page and the error.
+func (pe PageError) Error() string {
+	return fmt.Sprintf("autorest/azure: failed to retrieve page %s: %v", pe.NextLink, pe.Err)
+}
+
+// ByCollectingPagesWithOptions returns a RespondDecorator that behaves like ByCollectingPages but
+// stops early, without error, as specified by the passed PageOptions.
+func ByCollectingPagesWithOptions(sender autorest.Sender, out interface{}, options PageOptions) autorest.RespondDecorator {
+	return byCollectingPages(sender, out, options, 0)
+}
+
+func byCollectingPages(sender autorest.Sender, out interface{}, options PageOptions, limit int) autorest.RespondDecorator {
+	return func(r autorest.Responder) autorest.Responder {
+		return autorest.ResponderFunc(func(resp *http.Response) error {
+			err := r.Respond(resp)
+			if err != nil {
+				return err
+			}
+			v := reflect.ValueOf(out)
+			if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+				return fmt.Errorf("autorest/azure: ByCollectingPages requires a pointer to a slice, received %T", out)
+			}
+			items := v.Elem()
+			start := items.Len()
+			pageFailed := func(err error, link string) error {
+				if link == "" {
+					return err
+				}
+				if !options.PartialResults {
+					v.Elem().Set(v.Elem().Slice(0, start))
+					return err
+				}
+				return &PageError{NextLink: link, Err: err}
+			}
+			var link string
+			for {
+				// the page body is fully read and closed before any further page is requested
+				var p page
+				err = autorest.Respond(resp,
+					autorest.ByUnmarshallingJSON(&p),
+					autorest.ByClosing())
+				if err != nil {
+					return pageFailed(err, link)
+				}
+				var values []json.RawMessage
+				if len(p.Value) > 0 {
+					if err := json.Unmarshal(p.Value, &values); err != nil {
+						return pageFailed(fmt.Errorf("autorest/azure: failed to unmarshal page values: %v", err), link)
+					}
+				}
+				for _, value := range values {
+					if options.StopWhen != nil && options.StopWhen(value) {
+						return nil
+					}
+					item := reflect.New(items.Type().Elem())
+					if err := json.Unmarshal(value, item.Interface()); err != nil {
+						return pageFailed(fmt.Errorf("autorest/azure: failed to unmarshal page values: %v", err), link)
+					}
+					if limit > 0 && items.Len() >= limit {
+						return fmt.Errorf("autorest/azure: paged results exceeded the limit of %d items", limit)
+					}
+					items = reflect.Append(items, item.Elem())
+					v.Elem().Set(items)
+					if options.MaxItems > 0 && items.Len() >= options.MaxItems {
+						return nil
+					}
+				}
+				v.Elem().Set(items)
+				if p.NextLink == nil || *p.NextLink == "" {
+					return nil
+				}
+				link = *p.NextLink
+				req, err := http.NewRequest(http.MethodGet, link, nil)
+				if err != nil {
+					return pageFailed(fmt.Errorf("autorest/azure: failed to create request for next page %q: %v", link, err), link)
+				}
+				if resp.Request != nil {
+					req = req.WithContext(resp.Request.Context())
+				}
+				resp, err = sender.Do(req)
+				if err != nil {
+					if resp != nil && resp.Body != nil {
+						resp.Body.Close()
+					}
+					return pageFailed(autorest.NewErrorWithError(err, "azure", "ByCollectingPages", resp, "failure sending next page request"), link)
+				}
+				if err = autorest.Respond(resp, WithErrorUnlessStatusCode(http.StatusOK), autorest.ByClosingIfError()); err != nil {
+					return pageFailed(err, link)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package azure
+
+// Copyright 2017 Microsoft Corporation
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/noahhai/go-autorest/autorest"
+	"github.com/noahhai/go-autorest/autorest/mocks"
+)
+
+type pagedItem struct {
+	Name string `json:"name"`
+}
+
+func newPageResponse(body string) *http.Response {
+	r := mocks.NewResponseWithContent(body)
+	r.Request = mocks.NewRequest()
+	return r
+}
+
+func TestByCollectingPages(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendResponse(newPageResponse(`{"value": [{"name": "b"}], "nextLink": "https://microsoft.com/a/b/c/?page=3"}`))
+	sender.AppendResponse(newPageResponse(`{"value": [{"name": "c"}, {"name": "d"}]}`))
+
+	var items []pagedItem
+	err := autorest.Respond(newPageResponse(`{"value": [{"name": "a"}], "nextLink": "https://microsoft.com/a/b/c/?page=2"}`),
+		ByCollectingPages(sender, &items))
+	if err != nil {
+		t.Fatalf("azure: ByCollectingPages returned an error (%v)", err)
+	}
+	expected := []pagedItem{{"a"}, {"b"}, {"c"}, {"d"}}
+	if !reflect.DeepEqual(items, expected) {
+		t.Fatalf("azure: ByCollectingPages collected %v, expected %v", items, expected)
+	}
+	if sender.Attempts() != 2 {
+		t.Fatalf("azure: ByCollectingPages requested %d pages, expected 2", sender.Attempts())
+	}
+}
+
+func TestByCollectingPagesWithLimit(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendAndRepeatResponse(newPageResponse(`{"value": [{"name": "b"}, {"name": "c"}], "nextLink": "https://microsoft.com/a/b/c/?page=n"}`), 10)
+
+	var items []pagedItem
+	err := autorest.Respond(newPageResponse(`{"value": [{"name": "a"}], "nextLink": "https://microsoft.com/a/b/c/?page=2"}`),
+		ByCollectingPagesWithLimit(sender, &items, 2))
+	if err == nil {
+		t.Fatal("azure: ByCollectingPagesWithLimit failed to return an error when exceeding the limit")
+	}
+	if len(items) != 2 {
+		t.Fatalf("azure: ByCollectingPagesWithLimit collected %d items, expected 2", len(items))
+	}
+	if sender.Attempts() != 1 {
+		t.Fatalf("azure: ByCollectingPagesWithLimit continued requesting pages after exceeding the limit")
+	}
+}
+
+func TestByCollectingPagesWithOptionsMaxItems(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendResponse(newPageResponse(`{"value": [{"name": "b"}, {"name": "c"}], "nextLink": "https://microsoft.com/a/b/c/?page=3"}`))
+	sender.AppendResponse(newPageResponse(`{"value": [{"name": "d"}]}`))
+
+	var items []pagedItem
+	err := autorest.Respond(newPageResponse(`{"value": [{"name": "a"}], "nextLink": "https://microsoft.com/a/b/c/?page=2"}`),
+		ByCollectingPagesWithOptions(sender, &items, PageOptions{MaxItems: 2}))
+	if err != nil {
+		t.Fatalf("azure: ByCollectingPagesWithOptions returned an error (%v)", err)
+	}
+	expected := []pagedItem{{"a"}, {"b"}}
+	if !reflect.DeepEqual(items, expected) {
+		t.Fatalf("azure: ByCollectingPagesWithOptions collected %v, expected %v", items, expected)
+	}
+	if sender.Attempts() != 1 {
+		t.Fatalf("azure: ByCollectingPagesWithOptions requested %d pages, expected 1", sender.Attempts())
+	}
+}
+
+func TestByCollectingPagesWithOptionsStopWhen(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendResponse(newPageResponse(`{"value": [{"name": "b"}, {"name": "stop"}, {"name": "c"}], "nextLink": "https://microsoft.com/a/b/c/?page=3"}`))
+
+	var items []pagedItem
+	err := autorest.Respond(newPageResponse(`{"value": [{"name": "a"}], "nextLink": "https://microsoft.com/a/b/c/?page=2"}`),
+		ByCollectingPagesWithOptions(sender, &items, PageOptions{
+			StopWhen: func(item json.RawMessage) bool {
+				return strings.Contains(string(item), `"stop"`)
+			},
+		}))
+	if err != nil {
+		t.Fatalf("azure: ByCollectingPagesWithOptions returned an error (%v)", err)
+	}
+	expected := []pagedItem{{"a"}, {"b"}}
+	if !reflect.DeepEqual(items, expected) {
+		t.Fatalf("azure: ByCollectingPagesWithOptions collected %v, expected %v", items, expected)
+	}
+	if sender.Attempts() != 1 {
+		t.Fatalf("azure: ByCollectingPagesWithOptions requested %d pages, expected 1", sender.Attempts())
+	}
+}
+
+func TestByCollectingPagesReturnsPageErrors(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendResponse(mocks.NewResponseWithStatus("500 Internal Server Error", http.StatusInternalServerError))
+
+	var items []pagedItem
+	err := autorest.Respond(newPageResponse(`{"value": [{"name": "a"}], "nextLink": "https://microsoft.com/a/b/c/?page=2"}`),
+		ByCollectingPages(sender, &items))
+	if err == nil {
+		t.Fatal("azure: ByCollectingPages failed to return an error for a failed page request")
+	}
+	if len(items) != 0 {
+		t.Fatalf("azure: ByCollectingPages collected %v despite a failed page request", items)
+	}
+}
+
+func TestByCollectingPagesClosesFailedPages(t *testing.T) {
+	failed := mocks.NewResponseWithStatus("500 Internal Server Error", http.StatusInternalServerError)
+	body := mocks.NewBody(`{"error": {"code": "InternalError", "message": "failed"}}`)
+	failed.Body = body
+	sender := mocks.NewSender()
+	sender.AppendResponse(failed)
+
+	var items []pagedItem
+	err := autorest.Respond(newPageResponse(`{"value": [{"name": "a"}], "nextLink": "https://microsoft.com/a/b/c/?page=2"}`),
+		ByCollectingPages(sender, &items))
+	if err == nil {
+		t.Fatal("azure: ByCollectingPages failed to return an error for a failed page request")
+	}
+	if body.IsOpen() {
+		t.Fatal("azure: ByCollectingPages did not close the body of a failed page")
+	}
+}
+
+func TestByCollectingPagesClosesPagesReturnedWithErrors(t *testing.T) {
+	body := mocks.NewBody(`{"value": []}`)
+	sender := autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		resp := mocks.NewResponse()
+		resp.Body = body
+		return resp, fmt.Errorf("faux error")
+	})
+
+	var items []pagedItem
+	err := autorest.Respond(newPageResponse(`{"value": [{"name": "a"}], "nextLink": "https://microsoft.com/a/b/c/?page=2"}`),
+		ByCollectingPages(sender, &items))
+	if err == nil {
+		t.Fatal("azure: ByCollectingPages failed to return an error for a failed page request")
+	}
+	if body.IsOpen() {
+		t.Fatal("azure: ByCollectingPages did not close the body of a page returned with an error")
+	}
+}
+
+func TestByCollectingPagesWithOptionsPartialResults(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendResponse(newPageResponse(`{"value": [{"name": "b"}], "nextLink": "https://microsoft.com/a/b/c/?page=3"}`))
+	sender.AppendResponse(mocks.NewResponseWithStatus("500 Internal Server Error", http.StatusInternalServerError))
+
+	var items []pagedItem
+	err := autorest.Respond(newPageResponse(`{"value": [{"name": "a"}], "nextLink": "https://microsoft.com/a/b/c/?page=2"}`),
+		ByCollectingPagesWithOptions(sender, &items, PageOptions{PartialResults: true}))
+	pe, ok := err.(*PageError)
+	if !ok {
+		t.Fatalf("azure: ByCollectingPagesWithOptions returned %v, expected a *PageError", err)
+	}
+	if pe.NextLink != "https://microsoft.com/a/b/c/?page=3" {
+		t.Fatalf("azure: ByCollectingPagesWithOptions returned NextLink %s, expected the failed page", pe.NextLink)
+	}
+	expected := []pagedItem{{"a"}, {"b"}}
+	if !reflect.DeepEqual(items, expected) {
+		t.Fatalf("azure: ByCollectingPagesWithOptions collected %v, expected %v", items, expected)
+	}
+}
+
+func TestByCollectingPagesRequiresSlicePointer(t *testing.T) {
+	var items []pagedItem
+	err := autorest.Respond(newPageResponse(`{"value": []}`), ByCollectingPages(mocks.NewSender(), items))
+	if err == nil {
+		t.Fatal("azure: ByCollectingPages failed to return an error for a non-pointer argument")
+	}
+}
@@ -25,6 +25,10 @@ import (
 	"github.com/noahhai/go-autorest/autorest"
 )
 
+// missingRegistrationCode is the error code returned when a subscription isn't registered with
+// the resource provider of the requested resource.
+const missingRegistrationCode = "MissingSubscriptionRegistration"
+
 // DoRetryWithRegistration tries to register the resource provider in case it is unregistered.
 // It also handles request retries
 func DoRetryWithRegistration(client autorest.Client) autorest.SendDecorator {
@@ -57,7 +61,7 @@ func DoRetryWithRegistration(client autorest.Client) autorest.SendDecorator {
 				}
 				err = re
 
-				if re.ServiceError != nil && re.ServiceError.Code == "MissingSubscriptionRegistration" {
+				if _, ok := IsMissingRegistrationError(re); ok {
 					regErr := register(client, r, re)
 					if regErr != nil {
 						return resp, fmt.Errorf("failed auto registering Resource Provider: %s. Original error: %s", regErr, err)
@@ -69,6 +73,34 @@ func DoRetryWithRegistration(client autorest.Client) autorest.SendDecorator {
 	}
 }
 
+// IsMissingRegistrationError returns true if err is an Azure service error reporting that the
+// subscription is not registered to use a resource provider. When available, the namespace of the
+// unregistered resource provider (e.g., "Microsoft.EventGrid") is also returned.
+func IsMissingRegistrationError(err error) (provider string, ok bool) {
+	var se *ServiceError
+	switch e := err.(type) {
+	case *RequestError:
+		se = e.ServiceError
+	case RequestError:
+		se = e.ServiceError
+	case *ServiceError:
+		se = e
+	case ServiceError:
+		se = &e
+	case autorest.DetailedError:
+		return IsMissingRegistrationError(e.Original)
+	}
+	if se == nil || se.Code != missingRegistrationCode {
+		return "", false
+	}
+	for _, detail := range se.Details {
+		if target, ok := detail["target"].(string); ok && target != "" {
+			return target, true
+		}
+	}
+	return "", true
+}
+
 func getProvider(re RequestError) (string, error) {
 	if re.ServiceError != nil && len(re.ServiceError.Details) > 0 {
 		return re.ServiceError.Details[0]["target"].(string), nil
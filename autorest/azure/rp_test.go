@@ -16,6 +16,7 @@ package azure
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"sync"
 	"testing"
@@ -167,3 +168,60 @@ func TestDoRetryWithRegistration_CanBeCancelled(t *testing.T) {
 		t.Fatalf("azure: DoRetryWithRegistration failed to cancel")
 	}
 }
+
+func TestIsMissingRegistrationError(t *testing.T) {
+	err := &RequestError{
+		ServiceError: &ServiceError{
+			Code: "MissingSubscriptionRegistration",
+			Details: []map[string]interface{}{
+				{"code": "MissingSubscriptionRegistration", "target": "Microsoft.EventGrid"},
+			},
+		},
+	}
+	provider, ok := IsMissingRegistrationError(err)
+	if !ok {
+		t.Fatalf("azure: IsMissingRegistrationError failed to detect a missing registration error")
+	}
+	if provider != "Microsoft.EventGrid" {
+		t.Fatalf("azure: IsMissingRegistrationError returned provider %q, expected %q", provider, "Microsoft.EventGrid")
+	}
+}
+
+func TestIsMissingRegistrationErrorUnwrapsDetailedError(t *testing.T) {
+	err := autorest.DetailedError{
+		Original: RequestError{
+			ServiceError: &ServiceError{
+				Code:    "MissingSubscriptionRegistration",
+				Details: []map[string]interface{}{{"target": "Microsoft.Storage"}},
+			},
+		},
+	}
+	provider, ok := IsMissingRegistrationError(err)
+	if !ok || provider != "Microsoft.Storage" {
+		t.Fatalf("azure: IsMissingRegistrationError failed to unwrap autorest.DetailedError -- got (%q, %v)", provider, ok)
+	}
+}
+
+func TestIsMissingRegistrationErrorWithoutTarget(t *testing.T) {
+	provider, ok := IsMissingRegistrationError(&ServiceError{Code: "MissingSubscriptionRegistration"})
+	if !ok {
+		t.Fatalf("azure: IsMissingRegistrationError failed to detect a missing registration error without details")
+	}
+	if provider != "" {
+		t.Fatalf("azure: IsMissingRegistrationError returned unexpected provider %q", provider)
+	}
+}
+
+func TestIsMissingRegistrationErrorIgnoresOtherErrors(t *testing.T) {
+	errs := []error{
+		nil,
+		fmt.Errorf("boom"),
+		&RequestError{ServiceError: &ServiceError{Code: "ResourceNotFound"}},
+		&RequestError{},
+	}
+	for _, err := range errs {
+		if _, ok := IsMissingRegistrationError(err); ok {
+			t.Fatalf("azure: IsMissingRegistrationError returned true for %v", err)
+		}
+	}
+}
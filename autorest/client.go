@@ -16,6 +16,8 @@ package autorest
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -23,6 +25,7 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/noahhai/go-autorest/logger"
@@ -151,20 +154,99 @@ type Client struct {
 	// Setting this to zero will use the provided context to control the duration.
 	PollingDuration time.Duration
 
+	// PollingLimiter, if not nil, caps the number of long-running operations awaited concurrently
+	// (e.g., by azure.Future.WaitForCompletionRef); further awaits queue until one completes. Copies
+	// of a Client share its PollingLimiter, so one limiter may also be shared between Clients.
+	PollingLimiter *PollingLimiter
+
 	// RetryAttempts sets the default number of retry attempts for client.
 	RetryAttempts int
 
 	// RetryDuration sets the delay duration for retries.
 	RetryDuration time.Duration
 
+	// OperationTimeout, if greater than zero, bounds the total duration of an operation, including
+	// retries and polling for its completion, after which an OperationTimeoutError is returned. To
+	// bound the initial request and the polling together, send both with the context returned by
+	// WithOperationTimeout; otherwise each request sent through Do, and each wait for a long-running
+	// operation, is bounded separately.
+	OperationTimeout time.Duration
+
+	// PerRequestTimeout, if greater than zero, bounds each request sent through Do, including
+	// reading its response body, after which the request fails with context.DeadlineExceeded.
+	// Unlike the Timeout of an http.Client Sender, it applies to this Client only. Retries made by
+	// middleware added with Use share the timeout, while each retry made by calling Do again (e.g.,
+	// with SendWithSender) is bounded separately. Zero imposes no timeout.
+	PerRequestTimeout time.Duration
+
 	// UserAgent, if not empty, will be set as the HTTP User-Agent header on all requests sent
 	// through the Do method.
 	UserAgent string
 
 	Jar http.CookieJar
 
+	// FollowRedirectsWithBody, if true, allows the default Sender to follow 307 (Temporary Redirect)
+	// and 308 (Permanent Redirect) responses to requests with a body, re-sending the body to the
+	// redirect target. By default such responses are returned to the caller instead, since the
+	// target may be another host and the body may be large. It has no effect if Sender is set.
+	FollowRedirectsWithBody bool
+
 	// Set to true to skip attempted registration of resource providers (false by default).
 	SkipResourceProviderRegistration bool
+
+	// DryRun, if not nil, puts the Client in dry-run mode: requests sent through the Do method are
+	// fully prepared, then recorded by DryRun rather than sent, and an empty 200 (OK) response is
+	// returned in place of the service's.
+	DryRun *DryRunRecorder
+
+	// ErrorFormatter, if not nil, produces the errors returned for failed responses to requests sent
+	// through the Do method (see WithErrorUnlessStatusCode), allowing error messages to be
+	// standardized.
+	ErrorFormatter ErrorFormatter
+
+	// ThrottlingCallback, if not nil, is invoked whenever a request sent through the Do method is
+	// throttled (429 or 503 with a Retry-After header) and retried after the commanded delay by one
+	// of the retry decorators (e.g., DoRetryForStatusCodes).
+	ThrottlingCallback ThrottlingCallback
+
+	// RequestEventHook, if not nil, is invoked with a RequestEvent describing each request sent
+	// through the Do method once it completes.
+	RequestEventHook RequestEventHook
+
+	// middleware holds the SendDecorators registered through Use.
+	middleware []SendDecorator
+}
+
+// PollingLimiter limits the number of concurrently polling long-running operations. It is safe
+// for concurrent use.
+type PollingLimiter struct {
+	slots chan struct{}
+}
+
+// NewPollingLimiter returns a PollingLimiter allowing up to max operations to poll concurrently.
+// A max less than one is treated as one.
+func NewPollingLimiter(max int) *PollingLimiter {
+	if max < 1 {
+		max = 1
+	}
+	return &PollingLimiter{slots: make(chan struct{}, max)}
+}
+
+// Acquire waits until fewer than the maximum number of operations are polling, then claims a slot
+// for the caller, which must call Release once done. An error is returned if ctx is canceled, or
+// its deadline passes, before a slot becomes available.
+func (pl *PollingLimiter) Acquire(ctx context.Context) error {
+	select {
+	case pl.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees the slot claimed by a successful call to Acquire.
+func (pl *PollingLimiter) Release() {
+	<-pl.slots
 }
 
 // NewClientWithUserAgent returns an instance of a Client with the UserAgent set to the passed
@@ -182,13 +264,31 @@ func NewClientWithUserAgent(ua string) Client {
 	return c
 }
 
-// AddToUserAgent adds an extension to the current user agent
+// AddToUserAgent adds an extension to the current user agent, separated from it by a space (e.g.,
+// an application name and version such as "myapp/1.0"). Surrounding whitespace is removed from the
+// extension; an empty extension is rejected. Requests sent through Do carry the resulting
+// UserAgent unless they already have a User-Agent header (e.g., set by WithUserAgent).
 func (c *Client) AddToUserAgent(extension string) error {
-	if extension != "" {
+	extension = strings.TrimSpace(extension)
+	if extension == "" {
+		return fmt.Errorf("Extension was empty, User Agent stayed as %s", c.UserAgent)
+	}
+	if c.UserAgent == "" {
+		c.UserAgent = extension
+	} else {
 		c.UserAgent = fmt.Sprintf("%s %s", c.UserAgent, extension)
-		return nil
 	}
-	return fmt.Errorf("Extension was empty, User Agent stayed as %s", c.UserAgent)
+	return nil
+}
+
+// Use registers middleware, in the form of SendDecorators, that wraps the Sender for every request
+// sent through the Do method. Middleware runs in the order registered: the first registered sees
+// the request first and the response last. Since middleware wraps the Sender, it observes the
+// request after authorization and inspection have been applied.
+func (c *Client) Use(middleware ...SendDecorator) {
+	m := make([]SendDecorator, 0, len(c.middleware)+len(middleware))
+	m = append(m, c.middleware...)
+	c.middleware = append(m, middleware...)
 }
 
 // Do implements the Sender interface by invoking the active Sender after applying authorization.
@@ -221,27 +321,336 @@ func (c Client) Do(r *http.Request) (*http.Response, error) {
 			return true, v
 		},
 	})
-	resp, err := SendWithSender(c.sender(), r)
+	if c.DryRun != nil {
+		return c.DryRun.record(r)
+	}
+	if c.ErrorFormatter != nil {
+		r = r.WithContext(withErrorFormatter(r.Context(), c.ErrorFormatter))
+	}
+	if c.ThrottlingCallback != nil {
+		r = r.WithContext(WithThrottlingCallback(r.Context(), c.ThrottlingCallback))
+	}
+	var cancels []context.CancelFunc
+	if c.OperationTimeout > 0 && operationFromContext(r.Context()) == nil {
+		ctx, cancel := c.WithOperationTimeout(r.Context())
+		cancels = append(cancels, cancel)
+		r = r.WithContext(ctx)
+	}
+	if c.PerRequestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), c.PerRequestTimeout)
+		cancels = append(cancels, cancel)
+		r = r.WithContext(ctx)
+	}
+	cancel := func() {
+		for i := len(cancels) - 1; i >= 0; i-- {
+			cancels[i]()
+		}
+	}
+	sender := c.decoratedSender()
+	attempts := 0
+	if c.RequestEventHook != nil {
+		base := c.sender()
+		sender = c.decorateSender(SenderFunc(func(r *http.Request) (*http.Response, error) {
+			attempts++
+			return base.Do(r)
+		}))
+	}
+	start := time.Now()
+	resp, err := SendWithSender(sender, r)
+	err = CheckOperationTimeout(r.Context(), err)
+	if c.RequestEventHook != nil {
+		c.RequestEventHook(newRequestEvent(r, resp, err, time.Since(start), attempts))
+	}
+	if len(cancels) > 0 {
+		// the body of a successful response is read after Do returns, so the operation ends when
+		// the body is closed
+		if err != nil || resp == nil || resp.Body == nil {
+			cancel()
+		} else {
+			resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		}
+	}
 	logger.Instance.WriteResponse(resp, logger.Filter{})
 	Respond(resp, c.ByInspecting())
 	return resp, err
 }
 
+// RequestEvent describes a request sent through Client.Do once it has completed. It is intended to
+// be marshalled to JSON, giving log and metrics pipelines a consistent schema for all requests.
+type RequestEvent struct {
+	// Method is the HTTP method of the request.
+	Method string `json:"method"`
+
+	// Host is the host, and port if any, to which the request was sent.
+	Host string `json:"host"`
+
+	// PathTemplate is the path template of the request (see PathTemplate) or, if the path was not
+	// formed from a template, the request path.
+	PathTemplate string `json:"pathTemplate"`
+
+	// StatusCode is the status code of the response, or zero if no response was received.
+	StatusCode int `json:"statusCode,omitempty"`
+
+	// Duration is the time taken to send the request and receive the response headers, including
+	// any retries. It is marshalled as "durationMs", in milliseconds.
+	Duration time.Duration `json:"-"`
+
+	// Retries is the number of times the request was retried by the Client's middleware (see
+	// Client.Use).
+	Retries int `json:"retries"`
+
+	// RequestID is the value of the x-ms-request-id response header, if any.
+	RequestID string `json:"requestId,omitempty"`
+
+	// Error is the error returned for the request, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (e RequestEvent) MarshalJSON() ([]byte, error) {
+	type event RequestEvent
+	return json.Marshal(struct {
+		event
+		DurationMS float64 `json:"durationMs"`
+	}{
+		event:      event(e),
+		DurationMS: float64(e.Duration) / float64(time.Millisecond),
+	})
+}
+
+// RequestEventHook is invoked by Client.Do with a RequestEvent once each request completes.
+type RequestEventHook func(RequestEvent)
+
+func newRequestEvent(r *http.Request, resp *http.Response, err error, d time.Duration, attempts int) RequestEvent {
+	e := RequestEvent{
+		Method:   r.Method,
+		Duration: d,
+	}
+	if r.URL != nil {
+		e.Host = r.URL.Host
+		e.PathTemplate = r.URL.Path
+	}
+	if template, ok := PathTemplate(r); ok {
+		e.PathTemplate = template
+	}
+	if attempts > 1 {
+		e.Retries = attempts - 1
+	}
+	if resp != nil {
+		e.StatusCode = resp.StatusCode
+		e.RequestID = resp.Header.Get(headerRequestID)
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// Phases of an operation reported by OperationTimeoutError.
+const (
+	// OperationPhaseSending indicates a request was being sent.
+	OperationPhaseSending = "sending"
+
+	// OperationPhaseRetrying indicates the operation was waiting to retry a failed request. Once
+	// the request is sent again, the operation returns to the phase it was in (e.g., sending).
+	OperationPhaseRetrying = "retrying"
+
+	// OperationPhasePolling indicates a long-running operation was being polled for completion.
+	OperationPhasePolling = "polling"
+)
+
+// operationKey is the context key under which WithOperationTimeout stores an operation.
+type operationKey struct{}
+
+// operation tracks the deadline and current phase of an operation bounded by OperationTimeout.
+type operation struct {
+	timeout  time.Duration
+	deadline time.Time
+
+	mu    sync.Mutex
+	phase string
+}
+
+// WithOperationTimeout returns a copy of ctx that is done once the Client's OperationTimeout has
+// elapsed, along with a CancelFunc that must be called once the operation completes. Requests and
+// waits for long-running operations that use the returned context share the one deadline and, if
+// it is exceeded, return an OperationTimeoutError naming the phase of the operation. If
+// OperationTimeout is not set, or ctx already carries an operation, only cancellation is added.
+func (c Client) WithOperationTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.OperationTimeout <= 0 || operationFromContext(ctx) != nil {
+		return context.WithCancel(ctx)
+	}
+	op := &operation{
+		timeout:  c.OperationTimeout,
+		deadline: time.Now().Add(c.OperationTimeout),
+		phase:    OperationPhaseSending,
+	}
+	return context.WithDeadline(context.WithValue(ctx, operationKey{}, op), op.deadline)
+}
+
+// operationFromContext returns the operation carried by ctx, if any.
+func operationFromContext(ctx context.Context) *operation {
+	op, _ := ctx.Value(operationKey{}).(*operation)
+	return op
+}
+
+// SetOperationPhase records the phase of the operation carried by ctx (see WithOperationTimeout),
+// if any, for reporting should the operation time out.
+func SetOperationPhase(ctx context.Context, phase string) {
+	if op := operationFromContext(ctx); op != nil {
+		op.mu.Lock()
+		op.phase = phase
+		op.mu.Unlock()
+	}
+}
+
+// operationPhase returns the current phase of the operation carried by ctx, or "" if there is none.
+func operationPhase(ctx context.Context) string {
+	op := operationFromContext(ctx)
+	if op == nil {
+		return ""
+	}
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.phase
+}
+
+// OperationTimeoutError is returned when an operation exceeds the Client's OperationTimeout.
+type OperationTimeoutError struct {
+	// Timeout is the OperationTimeout that was exceeded.
+	Timeout time.Duration
+
+	// Phase is the phase of the operation when it timed out (e.g., OperationPhasePolling).
+	Phase string
+
+	// Err is the error returned when the operation was interrupted.
+	Err error
+}
+
+// Error returns a string naming the timeout, the phase and the error.
+func (e OperationTimeoutError) Error() string {
+	return fmt.Sprintf("autorest: operation timed out after %v while %s: %v", e.Timeout, e.Phase, e.Err)
+}
+
+// CheckOperationTimeout returns an OperationTimeoutError wrapping err if err is not nil and the
+// operation carried by ctx (see WithOperationTimeout) has exceeded its timeout; otherwise it
+// returns err.
+func CheckOperationTimeout(ctx context.Context, err error) error {
+	op := operationFromContext(ctx)
+	if err == nil || op == nil || time.Now().Before(op.deadline) {
+		return err
+	}
+	if _, ok := err.(OperationTimeoutError); ok {
+		return err
+	}
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return OperationTimeoutError{Timeout: op.timeout, Phase: op.phase, Err: err}
+}
+
+// DryRunRecorder records the requests a Client in dry-run mode would have sent (see Client.DryRun).
+// The zero value is ready to use. It is safe for concurrent use.
+type DryRunRecorder struct {
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+// Requests returns the requests recorded, in the order they were sent. The body of each request
+// may be read once.
+func (d *DryRunRecorder) Requests() []*http.Request {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*http.Request(nil), d.requests...)
+}
+
+// Reset discards the requests recorded.
+func (d *DryRunRecorder) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requests = nil
+}
+
+// record records the passed request and returns the response sent in its place.
+func (d *DryRunRecorder) record(r *http.Request) (*http.Response, error) {
+	if r.Body != nil {
+		b, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, NewErrorWithError(err, "autorest/Client", "Do", nil, "Failed to record the request body")
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	}
+	d.mu.Lock()
+	d.requests = append(d.requests, r)
+	d.mu.Unlock()
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		Request:    r,
+	}, nil
+}
+
 // sender returns the Sender to which to send requests.
 func (c Client) sender() Sender {
 	if c.Sender == nil {
 		j, _ := cookiejar.New(nil)
 		client := &http.Client{Jar: j, Transport: tracing.Transport}
+		if !c.FollowRedirectsWithBody {
+			client.CheckRedirect = refuseRedirectsWithBody
+		}
 		return client
 	}
 
 	return c.Sender
 }
 
+// maxRedirects is the number of redirects followed by the default Sender, matching http.Client.
+const maxRedirects = 10
+
+// refuseRedirectsWithBody is an http.Client CheckRedirect function that returns 307 and 308
+// redirects of requests with a body to the caller rather than re-sending the body.
+func refuseRedirectsWithBody(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("autorest: stopped after %d redirects", maxRedirects)
+	}
+	if req.Response != nil && req.Body != nil &&
+		(req.Response.StatusCode == http.StatusTemporaryRedirect || req.Response.StatusCode == http.StatusPermanentRedirect) {
+		return http.ErrUseLastResponse
+	}
+	return nil
+}
+
+// decoratedSender returns the Sender wrapped by the middleware registered through Use.
+func (c Client) decoratedSender() Sender {
+	return c.decorateSender(c.sender())
+}
+
+// decorateSender returns s decorated with the SendDecorators registered through Use.
+func (c Client) decorateSender(s Sender) Sender {
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		s = c.middleware[i](s)
+	}
+	return s
+}
+
 // WithAuthorization is a convenience method that returns the WithAuthorization PrepareDecorator
-// from the current Authorizer. If not Authorizer is set, it uses the NullAuthorizer.
+// from the current Authorizer. If not Authorizer is set, it uses the NullAuthorizer. Requests whose
+// context carries an Authorizer (see ContextWithAuthorizer) use that Authorizer instead.
 func (c Client) WithAuthorization() PrepareDecorator {
-	return c.authorizer().WithAuthorization()
+	return func(p Preparer) Preparer {
+		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			a, ok := authorizerFromContext(r.Context())
+			if !ok {
+				a = c.authorizer()
+			}
+			return DecoratePreparer(p, a.WithAuthorization()).Prepare(r)
+		})
+	}
 }
 
 // authorizer returns the Authorizer to use.
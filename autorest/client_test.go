@@ -16,6 +16,8 @@ package autorest
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -193,6 +195,61 @@ func TestClientDoInvokesSender(t *testing.T) {
 	}
 }
 
+func TestClientUseInvokesMiddlewareInOrder(t *testing.T) {
+	c := Client{Sender: mocks.NewSender()}
+
+	var calls []string
+	record := func(name string) SendDecorator {
+		return func(s Sender) Sender {
+			return SenderFunc(func(r *http.Request) (*http.Response, error) {
+				calls = append(calls, name+" before")
+				resp, err := s.Do(r)
+				calls = append(calls, name+" after")
+				return resp, err
+			})
+		}
+	}
+	c.Use(record("first"))
+	c.Use(record("second"))
+
+	c.Do(mocks.NewRequest())
+	expected := []string{"first before", "second before", "second after", "first after"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("autorest: Client#Use invoked middleware out of order -- expected %v, received %v", expected, calls)
+	}
+}
+
+func TestClientUseMiddlewareSeesAuthorizedRequest(t *testing.T) {
+	c := Client{
+		Authorizer: mockAuthorizer{},
+		Sender:     mocks.NewSender(),
+	}
+
+	var authorized bool
+	c.Use(func(s Sender) Sender {
+		return SenderFunc(func(r *http.Request) (*http.Response, error) {
+			authorized = r.Header.Get(http.CanonicalHeaderKey(headerAuthorization)) == mocks.TestAuthorizationHeader
+			return s.Do(r)
+		})
+	})
+
+	c.Do(mocks.NewRequest())
+	if !authorized {
+		t.Fatal("autorest: Client#Use middleware did not receive the authorized request")
+	}
+}
+
+func TestClientUseDoesNotAffectCopies(t *testing.T) {
+	c := Client{Sender: mocks.NewSender()}
+	c.Use(WithLogging(log.New(ioutil.Discard, "", 0)))
+
+	c1 := c
+	c1.Use(AsIs())
+	if len(c.middleware) != 1 {
+		t.Fatalf("autorest: Client#Use modified the middleware of a copied Client -- received %v decorators", len(c.middleware))
+	}
+}
+
 func TestClientDoSetsUserAgent(t *testing.T) {
 	ua := "UserAgent"
 	c := Client{UserAgent: ua}
@@ -208,6 +265,38 @@ func TestClientDoSetsUserAgent(t *testing.T) {
 	}
 }
 
+func TestAddToUserAgentWithoutBase(t *testing.T) {
+	c := Client{}
+	if err := c.AddToUserAgent(" myapp/1.0 "); err != nil {
+		t.Fatalf("autorest: AddToUserAgent returned error -- expected nil, received %s", err)
+	}
+	if c.UserAgent != "myapp/1.0" {
+		t.Fatalf("autorest: AddToUserAgent set the UserAgent to %q, expected %q", c.UserAgent, "myapp/1.0")
+	}
+	if err := c.AddToUserAgent("   "); err == nil {
+		t.Fatal("autorest: AddToUserAgent accepted a blank extension")
+	}
+}
+
+func TestClientDoSendsComposedUserAgent(t *testing.T) {
+	c := NewClientWithUserAgent("base/2.0")
+	c.Sender = mocks.NewSender()
+	if err := c.AddToUserAgent("myapp/1.0"); err != nil {
+		t.Fatalf("autorest: AddToUserAgent returned error -- expected nil, received %s", err)
+	}
+	r := mocks.NewRequest()
+	c.Do(r)
+	if expected := fmt.Sprintf("%s base/2.0 myapp/1.0", version.UserAgent()); r.UserAgent() != expected {
+		t.Fatalf("autorest: Client#Do sent User-Agent %q, expected %q", r.UserAgent(), expected)
+	}
+
+	r, _ = Prepare(mocks.NewRequest(), WithUserAgent("override/1.0"))
+	c.Do(r)
+	if r.UserAgent() != "override/1.0" {
+		t.Fatalf("autorest: Client#Do replaced the User-Agent set by WithUserAgent with %q", r.UserAgent())
+	}
+}
+
 func TestClientDoSetsAuthorization(t *testing.T) {
 	r := mocks.NewRequest()
 	s := mocks.NewSender()
@@ -269,6 +358,260 @@ func TestClientDoDoesNotSendIfPrepareFails(t *testing.T) {
 	}
 }
 
+func TestClientWithAuthorizationUsesContextAuthorizer(t *testing.T) {
+	c := Client{}
+	c.Authorizer = mockAuthorizer{}
+
+	ctx := ContextWithAuthorizer(context.Background(), NewAPIKeyAuthorizerWithHeaders(map[string]interface{}{"x-api-key": "override"}))
+	req, err := Prepare(mocks.NewRequest().WithContext(ctx),
+		c.WithAuthorization())
+	if err != nil {
+		t.Fatalf("autorest: Client#WithAuthorization returned an error (%v)", err)
+	}
+	if req.Header.Get(headerAuthorization) != "" {
+		t.Fatal("autorest: Client#WithAuthorization applied the Client Authorizer despite an override")
+	}
+	if req.Header.Get("x-api-key") != "override" {
+		t.Fatal("autorest: Client#WithAuthorization failed to apply the Authorizer from the request context")
+	}
+}
+
+func TestClientDoOperationTimeout(t *testing.T) {
+	c := Client{
+		OperationTimeout: 20 * time.Millisecond,
+		Sender: SenderFunc(func(r *http.Request) (*http.Response, error) {
+			<-r.Context().Done()
+			return nil, r.Context().Err()
+		}),
+	}
+
+	_, err := c.Do(mocks.NewRequest())
+	te, ok := err.(OperationTimeoutError)
+	if !ok {
+		t.Fatalf("autorest: Client#Do returned %v, expected an OperationTimeoutError", err)
+	}
+	if te.Phase != OperationPhaseSending || te.Timeout != c.OperationTimeout {
+		t.Fatalf("autorest: Client#Do timed out after %v while %s, expected %v while %s", te.Timeout, te.Phase, c.OperationTimeout, OperationPhaseSending)
+	}
+}
+
+func TestOperationTimeoutWhileResendingReportsSending(t *testing.T) {
+	c := Client{OperationTimeout: 50 * time.Millisecond}
+	ctx, cancel := c.WithOperationTimeout(context.Background())
+	defer cancel()
+
+	attempts := 0
+	s := SenderFunc(func(r *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts == 1 {
+			return mocks.NewResponseWithStatus("500 Internal Server Error", http.StatusInternalServerError), nil
+		}
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})
+	_, err := SendWithSender(s, mocks.NewRequest().WithContext(ctx), DoRetryForStatusCodes(3, 0, http.StatusInternalServerError))
+	te, ok := CheckOperationTimeout(ctx, err).(OperationTimeoutError)
+	if !ok {
+		t.Fatalf("autorest: retried request returned %v, expected an OperationTimeoutError", err)
+	}
+	if te.Phase != OperationPhaseSending {
+		t.Fatalf("autorest: retried request timed out while %s, expected %s", te.Phase, OperationPhaseSending)
+	}
+}
+
+func TestClientDoPerRequestTimeout(t *testing.T) {
+	c := Client{
+		PerRequestTimeout: 20 * time.Millisecond,
+		Sender: SenderFunc(func(r *http.Request) (*http.Response, error) {
+			select {
+			case <-time.After(time.Second):
+				return mocks.NewResponse(), nil
+			case <-r.Context().Done():
+				return nil, r.Context().Err()
+			}
+		}),
+	}
+
+	start := time.Now()
+	_, err := c.Do(mocks.NewRequest())
+	if err != context.DeadlineExceeded {
+		t.Fatalf("autorest: Client#Do returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("autorest: Client#Do took %v, beyond the PerRequestTimeout", elapsed)
+	}
+}
+
+func TestClientDoWithoutPerRequestTimeout(t *testing.T) {
+	c := Client{
+		Sender: SenderFunc(func(r *http.Request) (*http.Response, error) {
+			if _, ok := r.Context().Deadline(); ok {
+				t.Fatal("autorest: Client#Do set a deadline without a PerRequestTimeout")
+			}
+			return mocks.NewResponse(), nil
+		}),
+	}
+	if _, err := c.Do(mocks.NewRequest()); err != nil {
+		t.Fatalf("autorest: Client#Do returned an error (%v)", err)
+	}
+}
+
+func TestClientDoPerRequestTimeoutLeavesBodyReadable(t *testing.T) {
+	c := Client{
+		PerRequestTimeout: time.Minute,
+		Sender:            mocks.NewSender(),
+	}
+	resp, err := c.Do(mocks.NewRequest())
+	if err != nil {
+		t.Fatalf("autorest: Client#Do returned an error (%v)", err)
+	}
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatalf("autorest: Client#Do returned an unreadable body (%v)", err)
+	}
+	resp.Body.Close()
+}
+
+func TestClientDoRequestEventHook(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendResponse(mocks.NewResponseWithStatus("500 Internal Server Error", http.StatusInternalServerError))
+	resp := mocks.NewResponse()
+	mocks.SetResponseHeader(resp, headerRequestID, "request-id")
+	sender.AppendResponse(resp)
+
+	var events []RequestEvent
+	c := Client{
+		Sender: sender,
+		RequestEventHook: func(e RequestEvent) {
+			events = append(events, e)
+		},
+	}
+	c.Use(DoRetryForStatusCodes(2, 0, http.StatusInternalServerError))
+
+	req, err := Prepare(&http.Request{Method: http.MethodGet},
+		WithBaseURL("https://microsoft.com/"),
+		WithPathParameters("/subscriptions/{subscriptionId}", map[string]interface{}{"subscriptionId": "123"}))
+	if err != nil {
+		t.Fatalf("autorest: Prepare returned an error (%v)", err)
+	}
+	if _, err = c.Do(req); err != nil {
+		t.Fatalf("autorest: Client#Do returned an error (%v)", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("autorest: Client#Do produced %d events, expected 1", len(events))
+	}
+	e := events[0]
+	if e.Method != http.MethodGet || e.Host != "microsoft.com" || e.PathTemplate != "/subscriptions/{subscriptionId}" ||
+		e.StatusCode != http.StatusOK || e.Retries != 1 || e.RequestID != "request-id" || e.Error != "" {
+		t.Fatalf("autorest: Client#Do produced an unexpected event %+v", e)
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatalf("autorest: RequestEvent#MarshalJSON returned an error (%v)", err)
+	}
+	m := map[string]interface{}{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("autorest: RequestEvent#MarshalJSON returned invalid JSON (%v)", err)
+	}
+	for _, name := range []string{"method", "host", "pathTemplate", "statusCode", "durationMs", "retries", "requestId"} {
+		if _, ok := m[name]; !ok {
+			t.Fatalf("autorest: RequestEvent#MarshalJSON omitted %s (%s)", name, b)
+		}
+	}
+}
+
+func TestClientDoRequestEventHookReportsErrors(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.SetError(fmt.Errorf("connection refused"))
+	var event RequestEvent
+	c := Client{
+		Sender: sender,
+		RequestEventHook: func(e RequestEvent) {
+			event = e
+		},
+	}
+	if _, err := c.Do(mocks.NewRequest()); err == nil {
+		t.Fatal("autorest: Client#Do failed to return the Sender error")
+	}
+	if event.Error == "" || event.PathTemplate != "/a/b/c/" || event.Retries != 0 {
+		t.Fatalf("autorest: Client#Do produced an unexpected event %+v", event)
+	}
+}
+
+func TestClientDoOperationTimeoutSpansRetries(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendAndRepeatResponse(mocks.NewResponseWithStatus("500 Internal Server Error", http.StatusInternalServerError), 10)
+	c := Client{
+		OperationTimeout: 50 * time.Millisecond,
+		Sender:           sender,
+	}
+	c.Use(DoRetryForStatusCodes(5, time.Second, http.StatusInternalServerError))
+
+	ctx, cancel := c.WithOperationTimeout(context.Background())
+	defer cancel()
+	_, err := c.Do(mocks.NewRequest().WithContext(ctx))
+	te, ok := err.(OperationTimeoutError)
+	if !ok {
+		t.Fatalf("autorest: Client#Do returned %v, expected an OperationTimeoutError", err)
+	}
+	if te.Phase != OperationPhaseRetrying {
+		t.Fatalf("autorest: Client#Do timed out while %s, expected %s", te.Phase, OperationPhaseRetrying)
+	}
+}
+
+func TestClientDoOperationTimeoutLeavesBodyReadable(t *testing.T) {
+	c := Client{
+		OperationTimeout: time.Minute,
+		Sender:           mocks.NewSender(),
+	}
+	resp, err := c.Do(mocks.NewRequest())
+	if err != nil {
+		t.Fatalf("autorest: Client#Do returned an error (%v)", err)
+	}
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatalf("autorest: Client#Do returned an unreadable body (%v)", err)
+	}
+	resp.Body.Close()
+}
+
+func TestClientDryRun(t *testing.T) {
+	sender := mocks.NewSender()
+	c := Client{
+		Authorizer: mockAuthorizer{},
+		Sender:     sender,
+		DryRun:     &DryRunRecorder{},
+	}
+
+	r, _ := Prepare(mocks.NewRequest(), AsPut(), WithJSON(map[string]string{"name": "value"}))
+	resp, err := c.Do(r)
+	if err != nil {
+		t.Fatalf("autorest: Client#Do returned an error in dry-run mode (%v)", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("autorest: Client#Do returned status %d in dry-run mode, expected 200", resp.StatusCode)
+	}
+	if sender.Attempts() != 0 {
+		t.Fatal("autorest: Client#Do sent the request in dry-run mode")
+	}
+
+	requests := c.DryRun.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("autorest: DryRunRecorder recorded %d requests, expected 1", len(requests))
+	}
+	if requests[0].Method != http.MethodPut || requests[0].Header.Get(headerAuthorization) == "" {
+		t.Fatal("autorest: DryRunRecorder failed to record the prepared request")
+	}
+	b, _ := ioutil.ReadAll(requests[0].Body)
+	if string(b) != `{"name":"value"}` {
+		t.Fatalf("autorest: DryRunRecorder recorded body %s", b)
+	}
+
+	c.DryRun.Reset()
+	if len(c.DryRun.Requests()) != 0 {
+		t.Fatal("autorest: DryRunRecorder#Reset failed to discard the recorded requests")
+	}
+}
+
 func TestClientAuthorizerReturnsNullAuthorizerByDefault(t *testing.T) {
 	c := Client{}
 
@@ -405,6 +748,123 @@ func TestCookies(t *testing.T) {
 	}
 }
 
+func newRedirectWithBodyServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/target", http.StatusTemporaryRedirect)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("autorest: ioutil.ReadAll failed reading request body: %s", err)
+		}
+		w.Write(b)
+	}))
+}
+
+func TestClientFollowsRedirectsWithBody(t *testing.T) {
+	server := newRedirectWithBodyServer(t)
+	defer server.Close()
+
+	r, err := Prepare(&http.Request{},
+		AsPost(),
+		WithBaseURL(server.URL+"/redirect"),
+		WithString("payload"))
+	if err != nil {
+		t.Fatalf("autorest: Prepare failed (%v)", err)
+	}
+	client := Client{FollowRedirectsWithBody: true}
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatalf("autorest: Client#Do failed (%v)", err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(b) != "payload" {
+		t.Fatalf("autorest: Client#Do returned %d %q, expected the body re-sent to the redirect target", resp.StatusCode, b)
+	}
+}
+
+func TestClientReturnsRedirectsWithBodyByDefault(t *testing.T) {
+	server := newRedirectWithBodyServer(t)
+	defer server.Close()
+
+	r, err := Prepare(&http.Request{},
+		AsPost(),
+		WithBaseURL(server.URL+"/redirect"),
+		WithString("payload"))
+	if err != nil {
+		t.Fatalf("autorest: Prepare failed (%v)", err)
+	}
+	resp, err := Client{}.Do(r)
+	if err != nil {
+		t.Fatalf("autorest: Client#Do failed (%v)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("autorest: Client#Do returned %d, expected %d", resp.StatusCode, http.StatusTemporaryRedirect)
+	}
+}
+
+func TestClientFollowsRedirectsWithoutBody(t *testing.T) {
+	server := newRedirectWithBodyServer(t)
+	defer server.Close()
+
+	r, err := http.NewRequest(http.MethodGet, server.URL+"/redirect", nil)
+	if err != nil {
+		t.Fatalf("autorest: http.NewRequest failed (%v)", err)
+	}
+	resp, err := Client{}.Do(r)
+	if err != nil {
+		t.Fatalf("autorest: Client#Do failed (%v)", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("autorest: Client#Do returned %d, expected %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestClientThrottlingCallback(t *testing.T) {
+	sender := mocks.NewSender()
+	resp := mocks.NewResponseWithStatus("429 Too Many Requests", http.StatusTooManyRequests)
+	mocks.SetResponseHeader(resp, "Retry-After", "1")
+	sender.AppendResponse(resp)
+	sender.AppendResponse(mocks.NewResponse())
+
+	var events []ThrottlingEvent
+	c := Client{
+		Sender: sender,
+		ThrottlingCallback: func(e ThrottlingEvent) {
+			events = append(events, e)
+		},
+	}
+	r, err := SendWithSender(c, mocks.NewRequest(), DoRetryForStatusCodes(1, 0, http.StatusTooManyRequests))
+	if err != nil || r.StatusCode != http.StatusOK {
+		t.Fatalf("autorest: Client#Do returned (%v, %v), expected 200 OK", r.Status, err)
+	}
+	if len(events) != 1 || events[0].StatusCode != http.StatusTooManyRequests || events[0].Delay != time.Second {
+		t.Fatalf("autorest: Client#ThrottlingCallback received %+v, expected one 429 event", events)
+	}
+}
+
+func TestPollingLimiter(t *testing.T) {
+	pl := NewPollingLimiter(2)
+	for i := 0; i < 2; i++ {
+		if err := pl.Acquire(context.Background()); err != nil {
+			t.Fatalf("autorest: PollingLimiter#Acquire returned an error (%v)", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := pl.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("autorest: PollingLimiter#Acquire returned %v beyond the limit, expected %v", err, context.DeadlineExceeded)
+	}
+	pl.Release()
+	if err := pl.Acquire(context.Background()); err != nil {
+		t.Fatalf("autorest: PollingLimiter#Acquire returned an error after Release (%v)", err)
+	}
+}
+
 func randomString(n int) string {
 	const chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
 	r := rand.New(rand.NewSource(time.Now().UTC().UnixNano()))
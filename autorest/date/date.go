@@ -94,3 +94,20 @@ func (d Date) String() string {
 func (d Date) ToTime() time.Time {
 	return d.Time
 }
+
+// ToRFC3339 returns the Date formatted as an RFC3339 date-time string (i.e.,
+// 2006-01-02T00:00:00Z).
+func (d Date) ToRFC3339() string {
+	return Format(d.Time, RFC3339)
+}
+
+// ToRFC1123 returns the Date, in UTC, formatted as an RFC1123 date-time string (i.e.,
+// Mon, 02 Jan 2006 00:00:00 GMT).
+func (d Date) ToRFC1123() string {
+	return Format(d.Time, RFC1123)
+}
+
+// ToDateOnly returns the Date formatted as an RFC3339 full-date string (i.e., 2006-01-02).
+func (d Date) ToDateOnly() string {
+	return Format(d.Time, DateOnly)
+}
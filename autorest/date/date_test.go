@@ -235,3 +235,16 @@ func TestDateUnmarshalTextReturnsError(t *testing.T) {
 		t.Fatal("date: Date failed to return error for malformed Text date")
 	}
 }
+
+func TestDateLayouts(t *testing.T) {
+	d, _ := ParseDate("2001-02-03")
+	if s := d.ToRFC3339(); s != "2001-02-03T00:00:00Z" {
+		t.Fatalf("date: ToRFC3339 returned %s", s)
+	}
+	if s := d.ToRFC1123(); s != "Sat, 03 Feb 2001 00:00:00 GMT" {
+		t.Fatalf("date: ToRFC1123 returned %s", s)
+	}
+	if s := d.ToDateOnly(); s != "2001-02-03" {
+		t.Fatalf("date: ToDateOnly returned %s", s)
+	}
+}
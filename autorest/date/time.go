@@ -101,3 +101,20 @@ func (t Time) String() string {
 func (t Time) ToTime() time.Time {
 	return t.Time
 }
+
+// ToRFC3339 returns the Time formatted as an RFC3339 date-time string (i.e.,
+// 2006-01-02T15:04:05Z).
+func (t Time) ToRFC3339() string {
+	return Format(t.Time, RFC3339)
+}
+
+// ToRFC1123 returns the Time, in UTC, formatted as an RFC1123 date-time string (i.e.,
+// Mon, 02 Jan 2006 15:04:05 GMT).
+func (t Time) ToRFC1123() string {
+	return Format(t.Time, RFC1123)
+}
+
+// ToDateOnly returns the Time formatted as an RFC3339 full-date string (i.e., 2006-01-02).
+func (t Time) ToDateOnly() string {
+	return Format(t.Time, DateOnly)
+}
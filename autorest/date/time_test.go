@@ -275,3 +275,16 @@ func TestUnmarshalTextNegOffset(t *testing.T) {
 		t.Fatalf("date: Time#UnmarshalText failed (%v)", err)
 	}
 }
+
+func TestTimeLayouts(t *testing.T) {
+	d := Time{time.Date(2001, time.February, 3, 4, 5, 6, 0, time.FixedZone("", 3600))}
+	if s := d.ToRFC3339(); s != "2001-02-03T04:05:06+01:00" {
+		t.Fatalf("date: ToRFC3339 returned %s", s)
+	}
+	if s := d.ToRFC1123(); s != "Sat, 03 Feb 2001 03:05:06 GMT" {
+		t.Fatalf("date: ToRFC1123 returned %s", s)
+	}
+	if s := d.ToDateOnly(); s != "2001-02-03" {
+		t.Fatalf("date: ToDateOnly returned %s", s)
+	}
+}
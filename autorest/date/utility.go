@@ -19,6 +19,36 @@ import (
 	"time"
 )
 
+// Layout identifies a format in which Azure APIs expect dates and times.
+type Layout int
+
+const (
+	// RFC3339 is the RFC3339 date-time layout (i.e., 2006-01-02T15:04:05Z), used by most APIs.
+	RFC3339 Layout = iota
+
+	// RFC1123 is the RFC1123 date-time layout in GMT (i.e., Mon, 02 Jan 2006 15:04:05 GMT), used by
+	// HTTP headers such as If-Modified-Since and x-ms-date.
+	RFC1123
+
+	// DateOnly is the RFC3339 full-date layout (i.e., 2006-01-02).
+	DateOnly
+)
+
+// rfc1123GMT is the RFC1123 layout required by HTTP, which always uses GMT.
+const rfc1123GMT = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Format returns t formatted in the passed layout. Times formatted as RFC1123 are converted to UTC.
+func Format(t time.Time, layout Layout) string {
+	switch layout {
+	case RFC1123:
+		return t.UTC().Format(rfc1123GMT)
+	case DateOnly:
+		return t.Format(fullDate)
+	default:
+		return t.Format(rfc3339)
+	}
+}
+
 // ParseTime to parse Time string to specified format.
 func ParseTime(format string, t string) (d time.Time, err error) {
 	return time.Parse(format, strings.ToUpper(t))
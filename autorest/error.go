@@ -15,8 +15,11 @@ package autorest
 //  limitations under the License.
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 const (
@@ -96,3 +99,152 @@ func (e DetailedError) Error() string {
 	}
 	return fmt.Sprintf("%s#%s: %s: StatusCode=%d -- Original Error: %v", e.PackageType, e.Method, e.Message, e.StatusCode, e.Original)
 }
+
+// Unwrap returns the original error (if any).
+func (e DetailedError) Unwrap() error {
+	return e.Original
+}
+
+// detailedError returns e. It is promoted to types embedding a DetailedError (e.g.,
+// azure.RequestError), allowing FormatErrorChain to find their details.
+func (e DetailedError) detailedError() DetailedError {
+	return e
+}
+
+// FormatErrorChain renders err, and each error it wraps, on its own line so that errors wrapped by
+// several decorators remain readable when logged. Each DetailedError in the chain is rendered as
+// its package, method and message followed by any HTTP status code, service error code and request
+// identifier. Other errors are followed through their Unwrap method, if any.
+func FormatErrorChain(err error) string {
+	var lines []string
+	for err != nil {
+		next := unwrapError(err)
+		line := errorHeadline(err, next)
+		if d, ok := err.(interface{ detailedError() DetailedError }); ok {
+			if details := errorDetails(d.detailedError()); details != "" {
+				line = fmt.Sprintf("%s [%s]", line, details)
+			}
+		}
+		if len(lines) > 0 {
+			line = "  caused by: " + line
+		}
+		lines = append(lines, line)
+		err = next
+	}
+	return strings.Join(lines, "\n")
+}
+
+// unwrapError returns the error wrapped by err, if any.
+func unwrapError(err error) error {
+	if u, ok := err.(interface{ Unwrap() error }); ok {
+		return u.Unwrap()
+	}
+	return nil
+}
+
+// errorHeadline returns the message of err, excluding that of the error it wraps.
+func errorHeadline(err, next error) string {
+	switch e := err.(type) {
+	case DetailedError:
+		return fmt.Sprintf("%s#%s: %s", e.PackageType, e.Method, e.Message)
+	case *DetailedError:
+		return fmt.Sprintf("%s#%s: %s", e.PackageType, e.Method, e.Message)
+	}
+	msg := err.Error()
+	if next != nil {
+		msg = strings.TrimSuffix(msg, next.Error())
+		msg = strings.TrimRight(strings.TrimSuffix(strings.TrimSpace(msg), "Original Error:"), " :-")
+	}
+	return msg
+}
+
+// errorDetails returns the HTTP status code, service error code and request identifier of e.
+func errorDetails(e DetailedError) string {
+	var details []string
+	if e.StatusCode != nil && e.StatusCode != UndefinedStatusCode {
+		details = append(details, fmt.Sprintf("status=%v", e.StatusCode))
+	}
+	if code := serviceErrorCode(e.ServiceError); code != "" {
+		details = append(details, fmt.Sprintf("code=%s", code))
+	}
+	if e.Response != nil {
+		if id := e.Response.Header.Get(headerRequestID); id != "" {
+			details = append(details, fmt.Sprintf("request-id=%s", id))
+		}
+	}
+	return strings.Join(details, " ")
+}
+
+// serviceErrorCode returns the error code of a service error body, which may or may not wrap the
+// error in an "error" object.
+func serviceErrorCode(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	var body struct {
+		Code  string `json:"code"`
+		Error *struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(b, &body); err != nil {
+		return ""
+	}
+	if body.Error != nil && body.Error.Code != "" {
+		return body.Error.Code
+	}
+	return body.Code
+}
+
+// ErrorInfo describes a failed response to an ErrorFormatter.
+type ErrorInfo struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+
+	// Method and URL identify the request.
+	Method string
+	URL    string
+
+	// RequestID is the service generated request identifier (from the x-ms-request-id header).
+	RequestID string
+
+	// Code and Message are the error code and message returned by the service, if any.
+	Code    string
+	Message string
+
+	// Err is the error that would be returned without an ErrorFormatter (e.g., an
+	// azure.RequestError carrying the full service error).
+	Err error
+}
+
+// ErrorFormatter returns the error for a failed response, allowing error messages to be
+// formatted consistently (see Client.ErrorFormatter).
+type ErrorFormatter func(info ErrorInfo) error
+
+// errorFormatterKey is the context key under which Client.Do stores its ErrorFormatter.
+type errorFormatterKey struct{}
+
+// withErrorFormatter returns a copy of ctx carrying the passed ErrorFormatter.
+func withErrorFormatter(ctx context.Context, f ErrorFormatter) context.Context {
+	return context.WithValue(ctx, errorFormatterKey{}, f)
+}
+
+// FormatError returns the error for the failed response resp, described by info, produced by the
+// ErrorFormatter of the Client that sent the request. If the Client has no ErrorFormatter,
+// info.Err is returned. The StatusCode, Method, URL and RequestID of info are set from resp.
+func FormatError(resp *http.Response, info ErrorInfo) error {
+	if resp == nil || resp.Request == nil {
+		return info.Err
+	}
+	f, ok := resp.Request.Context().Value(errorFormatterKey{}).(ErrorFormatter)
+	if !ok || f == nil {
+		return info.Err
+	}
+	info.StatusCode = resp.StatusCode
+	info.Method = resp.Request.Method
+	if resp.Request.URL != nil {
+		info.URL = resp.Request.URL.String()
+	}
+	info.RequestID = resp.Header.Get(headerRequestID)
+	return f(info)
+}
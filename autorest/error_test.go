@@ -200,3 +200,49 @@ func TestDetailedErrorSkipsOriginal(t *testing.T) {
 			`.*Original.*`, e.Error())
 	}
 }
+
+type wrappingError struct {
+	err error
+}
+
+func (e wrappingError) Error() string {
+	return fmt.Sprintf("retrying failed: %v", e.err)
+}
+
+func (e wrappingError) Unwrap() error {
+	return e.err
+}
+
+func TestFormatErrorChain(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusConflict, Header: http.Header{}}
+	resp.Header.Set(headerRequestID, "71FDB9F4")
+	err := DetailedError{
+		PackageType: "autorest/Client",
+		Method:      "Do",
+		Message:     "Sending request failed",
+		StatusCode:  UndefinedStatusCode,
+		Original: wrappingError{err: &DetailedError{
+			PackageType:  "autorest",
+			Method:       "WithErrorUnlessStatusCode",
+			Message:      "Unexpected response",
+			StatusCode:   http.StatusConflict,
+			ServiceError: []byte(`{"error": {"code": "Conflict", "message": "In use."}}`),
+			Response:     resp,
+			Original:     fmt.Errorf("connection reset"),
+		}},
+	}
+
+	expected := "autorest/Client#Do: Sending request failed\n" +
+		"  caused by: retrying failed\n" +
+		"  caused by: autorest#WithErrorUnlessStatusCode: Unexpected response [status=409 code=Conflict request-id=71FDB9F4]\n" +
+		"  caused by: connection reset"
+	if s := FormatErrorChain(err); s != expected {
+		t.Fatalf("autorest: FormatErrorChain returned\n%s\nexpected\n%s", s, expected)
+	}
+}
+
+func TestFormatErrorChainNil(t *testing.T) {
+	if s := FormatErrorChain(nil); s != "" {
+		t.Fatalf("autorest: FormatErrorChain returned %q for a nil error", s)
+	}
+}
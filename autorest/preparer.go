@@ -16,24 +16,40 @@ package autorest
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/noahhai/go-autorest/autorest/date"
 )
 
 const (
 	mimeTypeJSON        = "application/json"
 	mimeTypeOctetStream = "application/octet-stream"
 	mimeTypeFormPost    = "application/x-www-form-urlencoded"
-
-	headerAuthorization = "Authorization"
-	headerContentType   = "Content-Type"
-	headerUserAgent     = "User-Agent"
+	mimeTypeXML         = "application/xml"
+
+	headerAccept          = "Accept"
+	headerAuthorization   = "Authorization"
+	headerContentEncoding = "Content-Encoding"
+	headerContentRange    = "Content-Range"
+	headerContentType     = "Content-Type"
+	headerMetadataPrefix  = "x-ms-meta-"
+	headerRange           = "Range"
+	headerRequestID       = "x-ms-request-id"
+	headerUserAgent       = "User-Agent"
 )
 
 // Preparer is the interface that wraps the Prepare method.
@@ -95,6 +111,20 @@ func WithNothing() PrepareDecorator {
 	}
 }
 
+// WithContext returns a PrepareDecorator that attaches the passed context to the request, so that
+// its cancellation and deadline govern sending the request (and any retries or polling driven by
+// it) without changing the Client that sends it.
+func WithContext(ctx context.Context) PrepareDecorator {
+	return func(p Preparer) Preparer {
+		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			if ctx == nil {
+				return r, NewError("autorest", "WithContext", "Invoked with a nil context")
+			}
+			return p.Prepare(r.WithContext(ctx))
+		})
+	}
+}
+
 // WithHeader returns a PrepareDecorator that sets the specified HTTP header of the http.Request to
 // the passed value. It canonicalizes the passed header name (via http.CanonicalHeaderKey) before
 // adding the header.
@@ -115,7 +145,8 @@ func WithHeader(header string, value string) PrepareDecorator {
 
 // WithHeaders returns a PrepareDecorator that sets the specified HTTP headers of the http.Request to
 // the passed value. It canonicalizes the passed headers name (via http.CanonicalHeaderKey) before
-// adding them.
+// adding them. Values that are not strings are formatted with fmt's %v verb, as for path and query
+// parameters, and replace any existing values of the header.
 func WithHeaders(headers map[string]interface{}) PrepareDecorator {
 	h := ensureValueStrings(headers)
 	return func(p Preparer) Preparer {
@@ -135,6 +166,77 @@ func WithHeaders(headers map[string]interface{}) PrepareDecorator {
 	}
 }
 
+// WithMetadata returns a PrepareDecorator that adds an x-ms-meta-<name> header for each entry in
+// the passed map. Since Azure treats metadata names as case-insensitive but preserves the case
+// used when they were set, names are sent exactly as supplied and replace any existing header for
+// the same name regardless of its case. Names must be valid metadata names (see
+// ValidateMetadataName).
+func WithMetadata(metadata map[string]string) PrepareDecorator {
+	return func(p Preparer) Preparer {
+		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err == nil {
+				if r.Header == nil {
+					r.Header = make(http.Header)
+				}
+				for name, value := range metadata {
+					if err := ValidateMetadataName(name); err != nil {
+						return r, NewErrorWithError(err, "autorest", "WithMetadata", nil, "Invalid metadata name")
+					}
+					key := headerMetadataPrefix + name
+					for k := range r.Header {
+						if strings.EqualFold(k, key) {
+							delete(r.Header, k)
+						}
+					}
+					r.Header[key] = []string{value}
+				}
+			}
+			return r, err
+		})
+	}
+}
+
+// WithRange returns a PrepareDecorator that adds an HTTP Range header requesting the bytes from
+// start to end, inclusive (e.g., "bytes=0-499"). Passing a negative end requests all bytes from
+// start to the end of the resource (e.g., "bytes=500-").
+func WithRange(start, end int64) PrepareDecorator {
+	return func(p Preparer) Preparer {
+		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err == nil {
+				if start < 0 {
+					return r, NewError("autorest", "WithRange", "Invalid range start %d", start)
+				}
+				if end >= 0 && end < start {
+					return r, NewError("autorest", "WithRange", "Invalid range %d-%d", start, end)
+				}
+				if r.Header == nil {
+					r.Header = make(http.Header)
+				}
+				v := fmt.Sprintf("bytes=%d-", start)
+				if end >= 0 {
+					v += strconv.FormatInt(end, 10)
+				}
+				r.Header.Set(http.CanonicalHeaderKey(headerRange), v)
+			}
+			return r, err
+		})
+	}
+}
+
+// WithDateHeader returns a PrepareDecorator that sets the specified HTTP header of the request to
+// the passed time formatted in the passed layout (e.g., date.RFC1123 for If-Modified-Since).
+func WithDateHeader(header string, t time.Time, layout date.Layout) PrepareDecorator {
+	return WithHeader(header, date.Format(t, layout))
+}
+
+// WithDateQueryParameter returns a PrepareDecorator that adds the named query parameter to the
+// request URL with the passed time formatted in the passed layout (e.g., date.DateOnly).
+func WithDateQueryParameter(name string, t time.Time, layout date.Layout) PrepareDecorator {
+	return WithQueryParameters(map[string]interface{}{name: url.QueryEscape(date.Format(t, layout))})
+}
+
 // WithBearerAuthorization returns a PrepareDecorator that adds an HTTP Authorization header whose
 // value is "Bearer " followed by the supplied token.
 func WithBearerAuthorization(token string) PrepareDecorator {
@@ -153,6 +255,22 @@ func WithUserAgent(ua string) PrepareDecorator {
 	return WithHeader(headerUserAgent, ua)
 }
 
+// WithoutKeepAlive returns a PrepareDecorator that marks the request to close its connection once
+// the response has been read, preventing the connection from being pooled and reused. This is
+// useful for one-off requests to endpoints behind rotating backends, where a pooled connection
+// would remain pinned to a stale instance.
+func WithoutKeepAlive() PrepareDecorator {
+	return func(p Preparer) Preparer {
+		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err == nil {
+				r.Close = true
+			}
+			return r, err
+		})
+	}
+}
+
 // AsFormURLEncoded returns a PrepareDecorator that adds an HTTP Content-Type header whose value is
 // "application/x-www-form-urlencoded".
 func AsFormURLEncoded() PrepareDecorator {
@@ -165,22 +283,51 @@ func AsJSON() PrepareDecorator {
 	return AsContentType(mimeTypeJSON)
 }
 
+// AsXML returns a PrepareDecorator that adds HTTP Accept and Content-Type headers whose values are
+// "application/xml".
+func AsXML() PrepareDecorator {
+	return WithHeaders(map[string]interface{}{
+		headerAccept:      mimeTypeXML,
+		headerContentType: mimeTypeXML,
+	})
+}
+
 // AsOctetStream returns a PrepareDecorator that adds the "application/octet-stream" Content-Type header.
 func AsOctetStream() PrepareDecorator {
 	return AsContentType(mimeTypeOctetStream)
 }
 
 // WithMethod returns a PrepareDecorator that sets the HTTP method of the passed request. The
-// decorator does not validate that the passed method string is a known HTTP method.
+// method need not be a known HTTP method, allowing it to be chosen at runtime (e.g., from a
+// specification), but it must be a valid token as defined by RFC 7230.
 func WithMethod(method string) PrepareDecorator {
 	return func(p Preparer) Preparer {
 		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			if !isMethodToken(method) {
+				return r, NewError("autorest", "WithMethod", "Invalid HTTP method %q", method)
+			}
 			r.Method = method
 			return p.Prepare(r)
 		})
 	}
 }
 
+// isMethodToken returns true if method is a non-empty RFC 7230 token.
+func isMethodToken(method string) bool {
+	if method == "" {
+		return false
+	}
+	for _, c := range method {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // AsDelete returns a PrepareDecorator that sets the HTTP method to DELETE.
 func AsDelete() PrepareDecorator { return WithMethod("DELETE") }
 
@@ -248,8 +395,7 @@ func WithFormData(v url.Values) PrepareDecorator {
 					r.Header = make(http.Header)
 				}
 				r.Header.Set(http.CanonicalHeaderKey(headerContentType), mimeTypeFormPost)
-				r.ContentLength = int64(len(s))
-				r.Body = ioutil.NopCloser(strings.NewReader(s))
+				setBufferedBody(r, []byte(s))
 			}
 			return r, err
 		})
@@ -287,8 +433,7 @@ func WithMultiPartFormData(formDataParameters map[string]interface{}) PrepareDec
 					r.Header = make(http.Header)
 				}
 				r.Header.Set(http.CanonicalHeaderKey(headerContentType), writer.FormDataContentType())
-				r.Body = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
-				r.ContentLength = int64(body.Len())
+				setBufferedBody(r, body.Bytes())
 				return r, err
 			}
 			return r, err
@@ -296,24 +441,190 @@ func WithMultiPartFormData(formDataParameters map[string]interface{}) PrepareDec
 	}
 }
 
-// WithFile returns a PrepareDecorator that sends file in request body.
+// WithStreamingMultipartFormData returns a PrepareDecorator that sets the request body to a
+// multipart/form-data document, with the Content-Type header naming its boundary. Parameters whose
+// values are []byte or io.Reader are written as file parts, named after the parameter, and all other
+// values as form fields; parameters are written in lexicographic order. Unlike WithMultiPartFormData,
+// the body is streamed from the readers as it is sent rather than buffered, so its length is not
+// known in advance and it cannot be replayed; readers that are also io.Closers are closed once
+// copied, or when the body is closed before being read.
+func WithStreamingMultipartFormData(formData map[string]interface{}) PrepareDecorator {
+	return func(p Preparer) Preparer {
+		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err != nil {
+				return r, err
+			}
+			keys := make([]string, 0, len(formData))
+			for key := range formData {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			pr, pw := io.Pipe()
+			writer := multipart.NewWriter(pw)
+			if r.Header == nil {
+				r.Header = make(http.Header)
+			}
+			r.Header.Set(http.CanonicalHeaderKey(headerContentType), writer.FormDataContentType())
+			r.Body = &multipartBody{pr: pr, pw: pw, writer: writer, keys: keys, formData: formData}
+			r.ContentLength = -1
+			return r, nil
+		})
+	}
+}
+
+// multipartBody streams a multipart/form-data document through a pipe. The goroutine writing the
+// document is only started by the first Read, so a body that is never read holds no goroutine.
+type multipartBody struct {
+	pr       *io.PipeReader
+	pw       *io.PipeWriter
+	writer   *multipart.Writer
+	keys     []string
+	formData map[string]interface{}
+	start    sync.Once
+}
+
+func (mb *multipartBody) Read(p []byte) (int, error) {
+	mb.start.Do(func() {
+		go func() {
+			mb.pw.CloseWithError(writeMultipartFormData(mb.writer, mb.keys, mb.formData))
+		}()
+	})
+	return mb.pr.Read(p)
+}
+
+// Close closes the pipe, which ends a running writing goroutine; if the body was never read, the
+// readers in the form data are closed instead.
+func (mb *multipartBody) Close() error {
+	mb.start.Do(func() {
+		for _, value := range mb.formData {
+			if c, ok := value.(io.Closer); ok {
+				c.Close()
+			}
+		}
+	})
+	return mb.pr.Close()
+}
+
+// writeMultipartFormData writes the passed form data, in the order of keys, to writer.
+func writeMultipartFormData(writer *multipart.Writer, keys []string, formData map[string]interface{}) error {
+	for _, key := range keys {
+		var content io.Reader
+		switch v := formData[key].(type) {
+		case []byte:
+			content = bytes.NewReader(v)
+		case io.Reader:
+			content = v
+		default:
+			if err := writer.WriteField(key, ensureValueString(v)); err != nil {
+				return err
+			}
+			continue
+		}
+		part, err := writer.CreateFormFile(key, key)
+		if err == nil {
+			_, err = io.Copy(part, content)
+		}
+		if c, ok := content.(io.Closer); ok {
+			c.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// WithFile returns a PrepareDecorator that sends file in request body. If f is an *os.File the
+// body is streamed from the file, starting at its current offset, rather than read into memory,
+// and the request's GetBody re-reads it from that offset so that retries re-send the complete
+// file. An *os.File must therefore stay open until the request, including any retries, has been
+// sent; the caller remains responsible for closing it afterwards.
 func WithFile(f io.ReadCloser) PrepareDecorator {
 	return func(p Preparer) Preparer {
 		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
 			r, err := p.Prepare(r)
 			if err == nil {
+				if file, ok := f.(*os.File); ok {
+					return withOSFile(r, file)
+				}
 				b, err := ioutil.ReadAll(f)
 				if err != nil {
 					return r, err
 				}
-				r.Body = ioutil.NopCloser(bytes.NewReader(b))
-				r.ContentLength = int64(len(b))
+				setBufferedBody(r, b)
 			}
 			return r, err
 		})
 	}
 }
 
+// WithReplayableBody returns a PrepareDecorator that sets the request body to the first body
+// returned by getBody and, where supported (Go 1.8 and later), sets the request's GetBody to
+// getBody. Retries then obtain a fresh body from getBody for each attempt, allowing bodies that
+// cannot be buffered or rewound (e.g., encrypted or generated streams) to be re-sent. The
+// Content-Length of the request is left unknown unless it is set by a subsequent decorator.
+func WithReplayableBody(getBody func() (io.ReadCloser, error)) PrepareDecorator {
+	return func(p Preparer) Preparer {
+		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err != nil {
+				return r, err
+			}
+			body, err := getBody()
+			if err != nil {
+				return r, NewErrorWithError(err, "autorest", "WithReplayableBody", nil, "Failed to get the request body")
+			}
+			return withReplayableBody(r, body, getBody), nil
+		})
+	}
+}
+
+// WithProgressReader returns a PrepareDecorator that streams the request body from rd, which must
+// yield size bytes, and sets the Content-Length header to size. As the transport reads the body,
+// callback is invoked with the number of bytes read so far and size, the final invocation
+// reporting all size bytes. The body is closed by closing rd, if it is an io.Closer. Since rd is
+// read only once, decorators that retry requests (e.g., DoRetryForStatusCodes) first buffer the
+// body, reporting its progress as it is buffered.
+func WithProgressReader(rd io.Reader, size int64, callback func(bytesSent, total int64)) PrepareDecorator {
+	return func(p Preparer) Preparer {
+		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err == nil {
+				r.Body = &progressReader{r: rd, total: size, callback: callback}
+				r.ContentLength = size
+			}
+			return r, err
+		})
+	}
+}
+
+// progressReader reports the progress of reading a request body.
+type progressReader struct {
+	r        io.Reader
+	sent     int64
+	total    int64
+	callback func(bytesSent, total int64)
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	if n > 0 {
+		pr.sent += int64(n)
+		if pr.callback != nil {
+			pr.callback(pr.sent, pr.total)
+		}
+	}
+	return n, err
+}
+
+func (pr *progressReader) Close() error {
+	if c, ok := pr.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 // WithBool returns a PrepareDecorator that encodes the passed bool into the body of the request
 // and sets the Content-Length header.
 func WithBool(v bool) PrepareDecorator {
@@ -351,8 +662,7 @@ func WithString(v string) PrepareDecorator {
 		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
 			r, err := p.Prepare(r)
 			if err == nil {
-				r.ContentLength = int64(len(v))
-				r.Body = ioutil.NopCloser(strings.NewReader(v))
+				setBufferedBody(r, []byte(v))
 			}
 			return r, err
 		})
@@ -361,6 +671,12 @@ func WithString(v string) PrepareDecorator {
 
 // WithJSON returns a PrepareDecorator that encodes the data passed as JSON into the body of the
 // request and sets the Content-Length header.
+//
+// Azure Resource Manager distinguishes between three states of a property in a request body:
+//   - absent: the property is left unchanged. Pointer fields tagged omitempty are omitted when nil.
+//   - empty: the property is set to its empty value (e.g., to.StringPtr("") encodes as "").
+//   - null: the property is cleared. Since nil pointers tagged omitempty are omitted rather than
+//     encoded as null, use WithJSONNullFields to send an explicit null.
 func WithJSON(v interface{}) PrepareDecorator {
 	return func(p Preparer) Preparer {
 		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
@@ -368,15 +684,147 @@ func WithJSON(v interface{}) PrepareDecorator {
 			if err == nil {
 				b, err := json.Marshal(v)
 				if err == nil {
-					r.ContentLength = int64(len(b))
-					r.Body = ioutil.NopCloser(bytes.NewReader(b))
+					setBufferedBody(r, b)
+				}
+			}
+			return r, err
+		})
+	}
+}
+
+// WithXML returns a PrepareDecorator that encodes the data passed as XML into the body of the
+// request and sets the Content-Length and Content-Type ("application/xml") headers. The XML
+// header is not written; the document is encoded as UTF-8.
+func WithXML(v interface{}) PrepareDecorator {
+	return func(p Preparer) Preparer {
+		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err == nil {
+				b, err := xml.Marshal(v)
+				if err != nil {
+					return r, NewErrorWithError(err, "autorest", "WithXML", nil, "failed to encode value of type %T as XML", v)
+				}
+				setBufferedBody(r, b)
+				if r.Header == nil {
+					r.Header = make(http.Header)
 				}
+				r.Header.Set(http.CanonicalHeaderKey(headerContentType), mimeTypeXML)
 			}
 			return r, err
 		})
 	}
 }
 
+// WithJSONNullFields returns a PrepareDecorator that encodes the data passed as JSON into the body
+// of the request, as WithJSON does, and then sets each of the named fields to an explicit null.
+// This allows a property to be cleared even though its field would otherwise be omitted (see
+// WithJSON). Fields are named by their JSON names; nested fields are separated by periods (e.g.,
+// "properties.description"). The data passed must encode as a JSON object.
+func WithJSONNullFields(v interface{}, nullFields ...string) PrepareDecorator {
+	return func(p Preparer) Preparer {
+		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err != nil {
+				return r, err
+			}
+			b, err := json.Marshal(v)
+			if err != nil {
+				return r, err
+			}
+			var m map[string]interface{}
+			dec := json.NewDecoder(bytes.NewReader(b))
+			dec.UseNumber()
+			if err = dec.Decode(&m); err != nil || m == nil {
+				return r, NewError("autorest", "WithJSONNullFields", "value of type %T does not encode as a JSON object", v)
+			}
+			for _, field := range nullFields {
+				if err = setJSONNull(m, strings.Split(field, ".")); err != nil {
+					return r, NewErrorWithError(err, "autorest", "WithJSONNullFields", nil, "failed to set field %s to null", field)
+				}
+			}
+			if b, err = json.Marshal(m); err != nil {
+				return r, err
+			}
+			setBufferedBody(r, b)
+			return r, nil
+		})
+	}
+}
+
+// setJSONNull sets the field at path within m to null, creating intermediate objects as needed.
+func setJSONNull(m map[string]interface{}, path []string) error {
+	if len(path) == 1 {
+		m[path[0]] = nil
+		return nil
+	}
+	child, ok := m[path[0]].(map[string]interface{})
+	if !ok {
+		if m[path[0]] != nil {
+			return fmt.Errorf("field %s is not a JSON object", path[0])
+		}
+		child = map[string]interface{}{}
+		m[path[0]] = child
+	}
+	return setJSONNull(child, path[1:])
+}
+
+// WithBodyValidation returns a PrepareDecorator that passes the request body, as set by the
+// preceding decorators, to the supplied func before the request is sent and fails if it returns an
+// error. It is typically placed after WithJSON with a func that checks the body against a JSON
+// schema, allowing callers to use the schema library of their choice. Requests without a body, or with
+// an empty body, are not validated.
+func WithBodyValidation(validate func(body []byte) error) PrepareDecorator {
+	return func(p Preparer) Preparer {
+		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err != nil || r.Body == nil {
+				return r, err
+			}
+			b, err := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				return r, NewErrorWithError(err, "autorest", "WithBodyValidation", nil, "failed to read the request body")
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(b))
+			if len(b) == 0 {
+				return r, nil
+			}
+			if err = validate(b); err != nil {
+				return r, NewErrorWithError(err, "autorest", "WithBodyValidation", nil, "request body failed validation")
+			}
+			return r, nil
+		})
+	}
+}
+
+// WithRequestValidation returns a PrepareDecorator that checks that the request prepared by the
+// preceding decorators is complete: it must have a valid HTTP method and an absolute URL (with a
+// scheme and host). It fails with an error naming what is missing (e.g., a WithBaseURL decorator),
+// rather than leaving the request to fail when sent. Place it last, so that it validates the
+// request produced by all other decorators.
+func WithRequestValidation() PrepareDecorator {
+	return func(p Preparer) Preparer {
+		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err != nil {
+				return r, err
+			}
+			if !isMethodToken(r.Method) {
+				return r, NewError("autorest", "WithRequestValidation", "Request has an invalid HTTP method %q (is a method decorator such as AsGet missing?)", r.Method)
+			}
+			switch {
+			case r.URL == nil:
+				return r, NewError("autorest", "WithRequestValidation", "Request has no URL (is WithBaseURL missing?)")
+			case r.URL.Scheme == "":
+				return r, NewError("autorest", "WithRequestValidation", "Request URL %q has no scheme (is WithBaseURL missing?)", r.URL)
+			case r.URL.Host == "":
+				return r, NewError("autorest", "WithRequestValidation", "Request URL %q has no host (is WithBaseURL missing?)", r.URL)
+			}
+			return r, nil
+		})
+	}
+}
+
 // WithPath returns a PrepareDecorator that adds the supplied path to the request URL. If the path
 // is absolute (that is, it begins with a "/"), it replaces the existing path.
 func WithPath(path string) PrepareDecorator {
@@ -408,12 +856,14 @@ func WithEscapedPathParameters(path string, pathParameters map[string]interface{
 				if r.URL == nil {
 					return r, NewError("autorest", "WithEscapedPathParameters", "Invoked with a nil URL")
 				}
+				resolved := path
 				for key, value := range parameters {
-					path = strings.Replace(path, "{"+key+"}", value, -1)
+					resolved = strings.Replace(resolved, "{"+key+"}", value, -1)
 				}
-				if r.URL, err = parseURL(r.URL, path); err != nil {
+				if r.URL, err = parseURL(r.URL, resolved); err != nil {
 					return r, err
 				}
+				r = r.WithContext(context.WithValue(r.Context(), pathTemplateKey{}, path))
 			}
 			return r, err
 		})
@@ -431,19 +881,37 @@ func WithPathParameters(path string, pathParameters map[string]interface{}) Prep
 				if r.URL == nil {
 					return r, NewError("autorest", "WithPathParameters", "Invoked with a nil URL")
 				}
+				resolved := path
 				for key, value := range parameters {
-					path = strings.Replace(path, "{"+key+"}", value, -1)
+					resolved = strings.Replace(resolved, "{"+key+"}", value, -1)
 				}
 
-				if r.URL, err = parseURL(r.URL, path); err != nil {
+				if r.URL, err = parseURL(r.URL, resolved); err != nil {
 					return r, err
 				}
+				r = r.WithContext(context.WithValue(r.Context(), pathTemplateKey{}, path))
 			}
 			return r, err
 		})
 	}
 }
 
+// pathTemplateKey is the context key under which WithPathParameters and WithEscapedPathParameters
+// store the path template of a request.
+type pathTemplateKey struct{}
+
+// PathTemplate returns the path template, with its brace-enclosed keys, from which the path of
+// the passed request was formed by WithPathParameters or WithEscapedPathParameters. Unlike the
+// request path, the template does not vary with the parameter values, making it suitable for
+// grouping requests in logs and metrics.
+func PathTemplate(r *http.Request) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	template, ok := r.Context().Value(pathTemplateKey{}).(string)
+	return template, ok
+}
+
 func parseURL(u *url.URL, path string) (*url.URL, error) {
 	p := strings.TrimRight(u.String(), "/")
 	if !strings.HasPrefix(path, "/") {
@@ -453,9 +921,11 @@ func parseURL(u *url.URL, path string) (*url.URL, error) {
 }
 
 // WithQueryParameters returns a PrepareDecorators that encodes and applies the query parameters
-// given in the supplied map (i.e., key=value).
+// given in the supplied map (i.e., key=value). Values that are a []string or []interface{} are
+// encoded as repeated parameters, one per element (i.e., key=a&key=b), the "multi" collection
+// format; all other values are encoded as a single parameter.
 func WithQueryParameters(queryParameters map[string]interface{}) PrepareDecorator {
-	parameters := ensureValueStrings(queryParameters)
+	parameters := ensureQueryValueStrings(queryParameters)
 	return func(p Preparer) Preparer {
 		return PreparerFunc(func(r *http.Request) (*http.Request, error) {
 			r, err := p.Prepare(r)
@@ -465,12 +935,14 @@ func WithQueryParameters(queryParameters map[string]interface{}) PrepareDecorato
 				}
 
 				v := r.URL.Query()
-				for key, value := range parameters {
-					d, err := url.QueryUnescape(value)
-					if err != nil {
-						return r, err
+				for key, values := range parameters {
+					for _, value := range values {
+						d, err := url.QueryUnescape(value)
+						if err != nil {
+							return r, err
+						}
+						v.Add(key, d)
 					}
-					v.Add(key, d)
 				}
 				r.URL.RawQuery = v.Encode()
 			}
@@ -0,0 +1,61 @@
+// +build !go1.8
+
+// Copyright 2017 Microsoft Corporation
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package autorest
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// withOSFile streams the request body from f, starting at its current offset, through an
+// io.SectionReader. Without GetBody, retries fall back to the copy made by RetriableRequest.
+func withOSFile(r *http.Request, f *os.File) (*http.Request, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return r, err
+	}
+	offset, err := f.Seek(0, 1 /*io.SeekCurrent*/)
+	if err != nil {
+		return r, err
+	}
+	size := fi.Size() - offset
+	r.Body = ioutil.NopCloser(io.NewSectionReader(f, offset, size))
+	r.ContentLength = size
+	return r, nil
+}
+
+// withReplayableBody sets the request body. Without GetBody, retries fall back to the copy made by
+// RetriableRequest.
+func withReplayableBody(r *http.Request, body io.ReadCloser, getBody func() (io.ReadCloser, error)) *http.Request {
+	r.Body = body
+	r.ContentLength = 0
+	return r
+}
+
+// setBufferedBody sets the request body to b, along with its length.
+func setBufferedBody(r *http.Request, b []byte) {
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	r.ContentLength = int64(len(b))
+}
+
+// hasBody returns true if the request has a body to send.
+func hasBody(r *http.Request) bool {
+	return r.Body != nil
+}
@@ -0,0 +1,69 @@
+// +build go1.8
+
+// Copyright 2017 Microsoft Corporation
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package autorest
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// withOSFile streams the request body from f, starting at its current offset. The body and each
+// call to GetBody read the file through their own io.SectionReader, so the complete file is
+// re-sent on retries without sharing the file offset with a previous attempt still being read.
+func withOSFile(r *http.Request, f *os.File) (*http.Request, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return r, err
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return r, err
+	}
+	size := fi.Size() - offset
+	r.Body = ioutil.NopCloser(io.NewSectionReader(f, offset, size))
+	r.ContentLength = size
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.NewSectionReader(f, offset, size)), nil
+	}
+	return r, nil
+}
+
+// withReplayableBody sets the request body and its GetBody.
+func withReplayableBody(r *http.Request, body io.ReadCloser, getBody func() (io.ReadCloser, error)) *http.Request {
+	r.Body = body
+	r.ContentLength = 0
+	r.GetBody = getBody
+	return r
+}
+
+// setBufferedBody sets the request body to b, along with its length and a GetBody returning a new
+// reader over b, so the body is re-sent on retries and when following 307 and 308 redirects.
+func setBufferedBody(r *http.Request, b []byte) {
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	r.ContentLength = int64(len(b))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+}
+
+// hasBody returns true if the request has a body to send; http.NoBody is treated as no body.
+func hasBody(r *http.Request) bool {
+	return r.Body != nil && r.Body != http.NoBody
+}
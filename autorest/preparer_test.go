@@ -15,16 +15,26 @@ package autorest
 //  limitations under the License.
 
 import (
+	"context"
+	"encoding/xml"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
+	"os"
 	"reflect"
 	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/noahhai/go-autorest/autorest/date"
 	"github.com/noahhai/go-autorest/autorest/mocks"
+	"github.com/noahhai/go-autorest/autorest/to"
 )
 
 // PrepareDecorators wrap and invoke a Preparer. Most often, the decorator invokes the passed
@@ -387,6 +397,61 @@ func TestAsJSON(t *testing.T) {
 	}
 }
 
+func TestAsXML(t *testing.T) {
+	r, err := Prepare(mocks.NewRequest(), AsXML())
+	if err != nil {
+		t.Fatalf("autorest: AsXML returned an unexpected error (%v)", err)
+	}
+	if r.Header.Get(headerContentType) != mimeTypeXML {
+		t.Fatalf("autorest: AsXML failed to add header (%s=%s)", headerContentType, r.Header.Get(headerContentType))
+	}
+	if r.Header.Get(headerAccept) != mimeTypeXML {
+		t.Fatalf("autorest: AsXML failed to add header (%s=%s)", headerAccept, r.Header.Get(headerAccept))
+	}
+}
+
+func TestWithXML(t *testing.T) {
+	type blob struct {
+		XMLName xml.Name `xml:"Blob"`
+		Name    string   `xml:"Name"`
+		Size    int      `xml:"Properties>Content-Length"`
+	}
+	in := blob{Name: "rob.txt", Size: 42}
+	r, err := Prepare(mocks.NewRequest(), WithXML(&in))
+	if err != nil {
+		t.Fatalf("autorest: WithXML returned an unexpected error (%v)", err)
+	}
+	if r.Header.Get(headerContentType) != mimeTypeXML {
+		t.Fatalf("autorest: WithXML failed to set header (%s=%s)", headerContentType, r.Header.Get(headerContentType))
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatalf("autorest: WithXML failed to read the body (%v)", err)
+	}
+	if r.ContentLength != int64(len(b)) {
+		t.Fatalf("autorest: WithXML set Content-Length to %d, expected %d", r.ContentLength, len(b))
+	}
+
+	out := blob{}
+	resp := mocks.NewResponseWithContent(string(b))
+	if err = Respond(resp, ByUnmarshallingXML(&out), ByClosing()); err != nil {
+		t.Fatalf("autorest: ByUnmarshallingXML failed to decode the WithXML body (%v)", err)
+	}
+	if out.Name != in.Name || out.Size != in.Size {
+		t.Fatalf("autorest: WithXML and ByUnmarshallingXML failed to round-trip %v, got %v", in, out)
+	}
+	if resp.Body.(*mocks.Body).IsOpen() {
+		t.Fatal("autorest: ByClosing failed to close the response body")
+	}
+}
+
+func TestWithXMLReturnsErrorForUnencodableValues(t *testing.T) {
+	_, err := Prepare(mocks.NewRequest(), WithXML(map[string]string{"name": "value"}))
+	if err == nil {
+		t.Fatal("autorest: WithXML failed to return an error for a map")
+	}
+}
+
 func TestWithNothing(t *testing.T) {
 	r1 := mocks.NewRequest()
 	r2, err := Prepare(r1, WithNothing())
@@ -409,6 +474,80 @@ func TestWithBearerAuthorization(t *testing.T) {
 	}
 }
 
+func TestWithoutKeepAlive(t *testing.T) {
+	r, err := Prepare(mocks.NewRequest(), WithoutKeepAlive())
+	if err != nil {
+		t.Fatalf("autorest: WithoutKeepAlive failed with error (%v)", err)
+	}
+	if !r.Close {
+		t.Fatal("autorest: WithoutKeepAlive failed to mark the request to close its connection")
+	}
+}
+
+func TestWithMetadata(t *testing.T) {
+	r, err := Prepare(mocks.NewRequest(), WithMetadata(map[string]string{"Category": "images", "owner": "me"}))
+	if err != nil {
+		t.Fatalf("autorest: WithMetadata failed with error (%v)", err)
+	}
+	if v := r.Header["x-ms-meta-Category"]; len(v) != 1 || v[0] != "images" {
+		t.Fatalf("autorest: WithMetadata failed to preserve the metadata name casing (%v)", r.Header)
+	}
+	if r.Header.Get("x-ms-meta-owner") != "" {
+		t.Fatalf("autorest: WithMetadata unexpectedly canonicalized the metadata name (%v)", r.Header)
+	}
+	if v := r.Header["x-ms-meta-owner"]; len(v) != 1 || v[0] != "me" {
+		t.Fatalf("autorest: WithMetadata failed to add header (%v)", r.Header)
+	}
+}
+
+func TestWithMetadataReplacesExistingHeaders(t *testing.T) {
+	r := mocks.NewRequest()
+	r.Header.Set("x-ms-meta-category", "old")
+	r, err := Prepare(r, WithMetadata(map[string]string{"category": "new"}))
+	if err != nil {
+		t.Fatalf("autorest: WithMetadata failed with error (%v)", err)
+	}
+	if len(r.Header) != 1 || r.Header["x-ms-meta-category"][0] != "new" {
+		t.Fatalf("autorest: WithMetadata failed to replace the existing header (%v)", r.Header)
+	}
+}
+
+func TestWithMetadataRejectsInvalidNames(t *testing.T) {
+	_, err := Prepare(mocks.NewRequest(), WithMetadata(map[string]string{"not-valid": "x"}))
+	if err == nil {
+		t.Fatal("autorest: WithMetadata accepted an invalid metadata name")
+	}
+}
+
+func TestWithRange(t *testing.T) {
+	r, err := Prepare(mocks.NewRequest(), WithRange(0, 499))
+	if err != nil {
+		t.Fatalf("autorest: WithRange failed with error (%v)", err)
+	}
+	if r.Header.Get(headerRange) != "bytes=0-499" {
+		t.Fatalf("autorest: WithRange failed to set Range header (%s)", r.Header.Get(headerRange))
+	}
+}
+
+func TestWithRangeOpenEnded(t *testing.T) {
+	r, err := Prepare(mocks.NewRequest(), WithRange(500, -1))
+	if err != nil {
+		t.Fatalf("autorest: WithRange failed with error (%v)", err)
+	}
+	if r.Header.Get(headerRange) != "bytes=500-" {
+		t.Fatalf("autorest: WithRange failed to set open-ended Range header (%s)", r.Header.Get(headerRange))
+	}
+}
+
+func TestWithRangeRejectsInvalidRange(t *testing.T) {
+	if _, err := Prepare(mocks.NewRequest(), WithRange(-1, 10)); err == nil {
+		t.Fatal("autorest: WithRange failed to reject a negative start")
+	}
+	if _, err := Prepare(mocks.NewRequest(), WithRange(10, 5)); err == nil {
+		t.Fatal("autorest: WithRange failed to reject an end before the start")
+	}
+}
+
 func TestWithUserAgent(t *testing.T) {
 	ua := "User Agent Go"
 	r, err := Prepare(mocks.NewRequest(), WithUserAgent(ua))
@@ -427,6 +566,24 @@ func TestWithMethod(t *testing.T) {
 	}
 }
 
+func TestWithMethodAcceptsExtensionMethods(t *testing.T) {
+	r, err := Prepare(mocks.NewRequest(), WithMethod("MKCOL"))
+	if err != nil {
+		t.Fatalf("autorest: WithMethod failed with error (%v)", err)
+	}
+	if r.Method != "MKCOL" {
+		t.Fatalf("autorest: WithMethod set method %q, expected MKCOL", r.Method)
+	}
+}
+
+func TestWithMethodRejectsInvalidMethods(t *testing.T) {
+	for _, method := range []string{"", "GE T", "GET\r\n", "P(OST)"} {
+		if _, err := Prepare(mocks.NewRequest(), WithMethod(method)); err == nil {
+			t.Fatalf("autorest: WithMethod failed to return an error for method %q", method)
+		}
+	}
+}
+
 func TestAsDelete(t *testing.T) {
 	r, _ := Prepare(mocks.NewRequest(), AsDelete())
 	if r.Method != "DELETE" {
@@ -535,6 +692,132 @@ func TestWithMultiPartFormDataSetsContentLength(t *testing.T) {
 	}
 }
 
+func TestWithStreamingMultipartFormData(t *testing.T) {
+	file := mocks.NewBody("file content")
+	r, err := Prepare(&http.Request{},
+		WithStreamingMultipartFormData(map[string]interface{}{
+			"name":  "value",
+			"count": 42,
+			"file":  file,
+			"bytes": []byte("byte content"),
+		}))
+	if err != nil {
+		t.Fatalf("autorest: WithStreamingMultipartFormData failed with error (%v)", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		t.Fatalf("autorest: WithStreamingMultipartFormData set Content-Type %q", r.Header.Get("Content-Type"))
+	}
+	if r.ContentLength != -1 {
+		t.Fatalf("autorest: WithStreamingMultipartFormData set Content-Length to %d for a streamed body", r.ContentLength)
+	}
+
+	fields := map[string]string{}
+	files := map[string]string{}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("autorest: WithStreamingMultipartFormData produced an invalid body (%v)", err)
+		}
+		b, _ := ioutil.ReadAll(part)
+		if part.FileName() != "" {
+			files[part.FormName()] = string(b)
+		} else {
+			fields[part.FormName()] = string(b)
+		}
+	}
+	if !reflect.DeepEqual(fields, map[string]string{"name": "value", "count": "42"}) {
+		t.Fatalf("autorest: WithStreamingMultipartFormData wrote fields %v", fields)
+	}
+	if !reflect.DeepEqual(files, map[string]string{"file": "file content", "bytes": "byte content"}) {
+		t.Fatalf("autorest: WithStreamingMultipartFormData wrote files %v", files)
+	}
+	if file.IsOpen() {
+		t.Fatal("autorest: WithStreamingMultipartFormData did not close the file")
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestWithStreamingMultipartFormDataReportsReadErrors(t *testing.T) {
+	r, err := Prepare(&http.Request{},
+		WithStreamingMultipartFormData(map[string]interface{}{
+			"file": errReader{fmt.Errorf("read failed")},
+		}))
+	if err != nil {
+		t.Fatalf("autorest: WithStreamingMultipartFormData failed with error (%v)", err)
+	}
+	if _, err = ioutil.ReadAll(r.Body); err == nil {
+		t.Fatal("autorest: WithStreamingMultipartFormData did not report the error reading a file")
+	}
+}
+
+func TestWithStreamingMultipartFormDataNotRead(t *testing.T) {
+	reads := make(chan struct{}, 1)
+	file := mocks.NewBody("file content")
+	_, err := Prepare(&http.Request{},
+		WithStreamingMultipartFormData(map[string]interface{}{
+			"file": readerFunc(func(p []byte) (int, error) {
+				reads <- struct{}{}
+				return 0, io.EOF
+			}),
+			"other": file,
+		}),
+		func(p Preparer) Preparer {
+			return PreparerFunc(func(r *http.Request) (*http.Request, error) {
+				return r, fmt.Errorf("faux error")
+			})
+		})
+	if err == nil {
+		t.Fatal("autorest: Prepare did not return the error of a later decorator")
+	}
+	select {
+	case <-reads:
+		t.Fatal("autorest: WithStreamingMultipartFormData read the form data of a body that was never read")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !file.IsOpen() {
+		t.Fatal("autorest: WithStreamingMultipartFormData closed a file before the body was read or closed")
+	}
+}
+
+func TestWithStreamingMultipartFormDataClosedBeforeRead(t *testing.T) {
+	file := mocks.NewBody("file content")
+	r, err := Prepare(&http.Request{},
+		WithStreamingMultipartFormData(map[string]interface{}{
+			"file": file,
+		}))
+	if err != nil {
+		t.Fatalf("autorest: WithStreamingMultipartFormData failed with error (%v)", err)
+	}
+	if err := r.Body.Close(); err != nil {
+		t.Fatalf("autorest: closing the body failed with error (%v)", err)
+	}
+	if file.IsOpen() {
+		t.Fatal("autorest: WithStreamingMultipartFormData did not close the file when the body was closed")
+	}
+	if _, err := ioutil.ReadAll(r.Body); err == nil {
+		t.Fatal("autorest: WithStreamingMultipartFormData body could be read after being closed")
+	}
+}
+
+// readerFunc adapts a function to io.Reader.
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
 func TestWithMultiPartFormDataWithNoFile(t *testing.T) {
 	v := map[string]interface{}{
 		"file": "no file",
@@ -573,6 +856,84 @@ func TestWithFile(t *testing.T) {
 	}
 }
 
+func TestWithFileStreamsOSFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "autorest")
+	if err != nil {
+		t.Fatalf("autorest: failed to create temp file (%v)", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err = f.WriteString("Hello Gopher"); err != nil {
+		t.Fatalf("autorest: failed to write temp file (%v)", err)
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("autorest: failed to seek temp file (%v)", err)
+	}
+
+	r, err := Prepare(mocks.NewRequest(), WithFile(f))
+	if err != nil {
+		t.Fatalf("autorest: WithFile failed with error (%v)", err)
+	}
+	if r.ContentLength != int64(len("Hello Gopher")) {
+		t.Fatalf("autorest: WithFile set Content-Length to %v, expected %v", r.ContentLength, len("Hello Gopher"))
+	}
+
+	var bodies []string
+	s := SenderFunc(func(r *http.Request) (*http.Response, error) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, string(b))
+		if len(bodies) == 1 {
+			return nil, fmt.Errorf("Faux Error")
+		}
+		return mocks.NewResponse(), nil
+	})
+	_, err = SendWithSender(s, r, DoRetryForAttempts(2, time.Duration(0)))
+	if err != nil {
+		t.Fatalf("autorest: WithFile retry failed with error (%v)", err)
+	}
+	if len(bodies) != 2 || bodies[0] != "Hello Gopher" || bodies[1] != "Hello Gopher" {
+		t.Fatalf("autorest: WithFile failed to re-send the file on retry (%v)", bodies)
+	}
+}
+
+func TestWithFileDoesNotShareFileOffset(t *testing.T) {
+	f, err := ioutil.TempFile("", "autorest")
+	if err != nil {
+		t.Fatalf("autorest: failed to create temp file (%v)", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err = f.WriteString("Hello Gopher"); err != nil {
+		t.Fatalf("autorest: failed to write temp file (%v)", err)
+	}
+	if _, err = f.Seek(int64(len("Hello ")), io.SeekStart); err != nil {
+		t.Fatalf("autorest: failed to seek temp file (%v)", err)
+	}
+
+	r, err := Prepare(mocks.NewRequest(), WithFile(f))
+	if err != nil {
+		t.Fatalf("autorest: WithFile failed with error (%v)", err)
+	}
+	part := make([]byte, 2)
+	if _, err = io.ReadFull(r.Body, part); err != nil {
+		t.Fatalf("autorest: failed to read the request body (%v)", err)
+	}
+	// moving the file offset must not affect the body being read
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("autorest: failed to seek temp file (%v)", err)
+	}
+	rest, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatalf("autorest: failed to read the request body (%v)", err)
+	}
+	if b := string(part) + string(rest); b != "Gopher" {
+		t.Fatalf("autorest: WithFile sent %q, expected %q", b, "Gopher")
+	}
+}
+
 func TestWithBool_SetsTheBody(t *testing.T) {
 	r, err := Prepare(&http.Request{},
 		WithBool(false))
@@ -721,6 +1082,215 @@ func TestWithJSONSetsContentLength(t *testing.T) {
 	}
 }
 
+func TestWithJSONNullFields(t *testing.T) {
+	type properties struct {
+		Description *string `json:"description,omitempty"`
+		Owner       *string `json:"owner,omitempty"`
+	}
+	type resource struct {
+		Name       *string     `json:"name,omitempty"`
+		Tags       *string     `json:"tags,omitempty"`
+		Properties *properties `json:"properties,omitempty"`
+	}
+	v := resource{
+		Name:       to.StringPtr(""),
+		Properties: &properties{Owner: to.StringPtr("me")},
+	}
+	r, err := Prepare(&http.Request{},
+		WithJSONNullFields(v, "tags", "properties.description"))
+	if err != nil {
+		t.Fatalf("autorest: WithJSONNullFields failed with error (%v)", err)
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatalf("autorest: WithJSONNullFields failed with error (%v)", err)
+	}
+	expected := `{"name":"","properties":{"description":null,"owner":"me"},"tags":null}`
+	if string(b) != expected {
+		t.Fatalf("autorest: WithJSONNullFields encoded %s, expected %s", b, expected)
+	}
+	if r.ContentLength != int64(len(b)) {
+		t.Fatalf("autorest: WithJSONNullFields set Content-Length to %v, expected %v", r.ContentLength, len(b))
+	}
+}
+
+func TestWithJSONNullFieldsRequiresObject(t *testing.T) {
+	_, err := Prepare(&http.Request{}, WithJSONNullFields([]string{"a"}, "tags"))
+	if err == nil {
+		t.Fatal("autorest: WithJSONNullFields failed to return an error for a value that is not a JSON object")
+	}
+}
+
+func TestWithBodyValidation(t *testing.T) {
+	var validated []byte
+	r, err := Prepare(&http.Request{},
+		WithJSON(map[string]string{"name": "value"}),
+		WithBodyValidation(func(body []byte) error {
+			validated = body
+			return nil
+		}))
+	if err != nil {
+		t.Fatalf("autorest: WithBodyValidation failed with error (%v)", err)
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatalf("autorest: WithBodyValidation failed with error (%v)", err)
+	}
+	expected := `{"name":"value"}`
+	if string(validated) != expected {
+		t.Fatalf("autorest: WithBodyValidation validated %s, expected %s", validated, expected)
+	}
+	if string(b) != expected {
+		t.Fatalf("autorest: WithBodyValidation left body %s, expected %s", b, expected)
+	}
+}
+
+func TestWithBodyValidationReturnsValidationErrors(t *testing.T) {
+	_, err := Prepare(&http.Request{},
+		WithJSON(map[string]string{"name": "value"}),
+		WithBodyValidation(func(body []byte) error {
+			return fmt.Errorf("property 'id' is required")
+		}))
+	if err == nil || !strings.Contains(err.Error(), "property 'id' is required") {
+		t.Fatalf("autorest: WithBodyValidation returned %v, expected the validation error", err)
+	}
+}
+
+func TestWithBodyValidationIgnoresMissingBody(t *testing.T) {
+	_, err := Prepare(&http.Request{},
+		WithBodyValidation(func(body []byte) error {
+			return fmt.Errorf("unexpected validation")
+		}))
+	if err != nil {
+		t.Fatalf("autorest: WithBodyValidation validated a request without a body (%v)", err)
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "value")
+	r, err := Prepare(mocks.NewRequest(), WithContext(ctx))
+	if err != nil {
+		t.Fatalf("autorest: WithContext returned an unexpected error (%v)", err)
+	}
+	if r.Context().Value(key{}) != "value" {
+		t.Fatal("autorest: WithContext did not attach the context to the request")
+	}
+}
+
+func TestWithContextCancelledBeforeSending(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, err := Prepare(mocks.NewRequest(), WithContext(ctx))
+	if err != nil {
+		t.Fatalf("autorest: WithContext returned an unexpected error (%v)", err)
+	}
+	client := mocks.NewSender()
+	if _, err = SendWithSender(client, r); err != context.Canceled {
+		t.Fatalf("autorest: SendWithSender returned %v, expected %v", err, context.Canceled)
+	}
+	if client.Attempts() != 0 {
+		t.Fatalf("autorest: SendWithSender sent a request with a cancelled context (%d attempts)", client.Attempts())
+	}
+}
+
+func TestWithRequestValidation(t *testing.T) {
+	r, err := Prepare(&http.Request{},
+		AsGet(),
+		WithBaseURL("https://microsoft.com/"),
+		WithPath("a/b"),
+		WithRequestValidation())
+	if err != nil {
+		t.Fatalf("autorest: WithRequestValidation rejected a complete request (%v)", err)
+	}
+	if r.URL.String() != "https://microsoft.com/a/b" {
+		t.Fatalf("autorest: WithRequestValidation modified the request URL (%s)", r.URL)
+	}
+}
+
+func TestWithRequestValidationReportsMissingParts(t *testing.T) {
+	cases := []struct {
+		name       string
+		url        *url.URL
+		decorators []PrepareDecorator
+		missing    string
+	}{
+		{"method", nil, []PrepareDecorator{WithBaseURL("https://microsoft.com/")}, "method"},
+		{"URL", nil, []PrepareDecorator{AsGet()}, "no URL"},
+		{"base URL", &url.URL{Path: "/"}, []PrepareDecorator{AsGet(), WithPath("a/b")}, "no scheme"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := Prepare(&http.Request{URL: c.url}, append(c.decorators, WithRequestValidation())...)
+			if err == nil || !strings.Contains(err.Error(), c.missing) {
+				t.Fatalf("autorest: WithRequestValidation returned %v, expected an error mentioning %q", err, c.missing)
+			}
+		})
+	}
+}
+
+func TestWithDateHeader(t *testing.T) {
+	d := time.Date(2001, time.February, 3, 4, 5, 6, 0, time.UTC)
+	r, err := Prepare(mocks.NewRequest(), WithDateHeader("If-Modified-Since", d, date.RFC1123))
+	if err != nil {
+		t.Fatalf("autorest: WithDateHeader failed (%v)", err)
+	}
+	if v := r.Header.Get("If-Modified-Since"); v != "Sat, 03 Feb 2001 04:05:06 GMT" {
+		t.Fatalf("autorest: WithDateHeader set header to %s", v)
+	}
+}
+
+func TestWithDateQueryParameter(t *testing.T) {
+	d := time.Date(2001, time.February, 3, 4, 5, 6, 0, time.FixedZone("", 3600))
+	r, err := Prepare(mocks.NewRequestForURL("https://microsoft.com/a/b/c/"),
+		WithDateQueryParameter("since", d, date.RFC3339),
+		WithDateQueryParameter("day", d, date.DateOnly))
+	if err != nil {
+		t.Fatalf("autorest: WithDateQueryParameter failed (%v)", err)
+	}
+	if v := r.URL.Query().Get("since"); v != "2001-02-03T04:05:06+01:00" {
+		t.Fatalf("autorest: WithDateQueryParameter set since to %s", v)
+	}
+	if v := r.URL.Query().Get("day"); v != "2001-02-03" {
+		t.Fatalf("autorest: WithDateQueryParameter set day to %s", v)
+	}
+}
+
+func TestWithReplayableBody(t *testing.T) {
+	getBody := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("generated")), nil
+	}
+	var bodies []string
+	sender := SenderFunc(func(r *http.Request) (*http.Response, error) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		resp := mocks.NewResponseWithStatus("500 Internal Server Error", http.StatusInternalServerError)
+		resp.Request = r
+		return resp, nil
+	})
+
+	r, err := Prepare(mocks.NewRequestWithParams(http.MethodPut, mocks.TestURL, nil), WithReplayableBody(getBody))
+	if err != nil {
+		t.Fatalf("autorest: WithReplayableBody failed with error (%v)", err)
+	}
+	SendWithSender(sender, r, DoRetryForStatusCodes(2, 0, http.StatusInternalServerError))
+
+	expected := []string{"generated", "generated", "generated"}
+	if !reflect.DeepEqual(bodies, expected) {
+		t.Fatalf("autorest: WithReplayableBody sent bodies %q, expected %q", bodies, expected)
+	}
+}
+
+func TestWithReplayableBodyReturnsErrors(t *testing.T) {
+	_, err := Prepare(mocks.NewRequest(), WithReplayableBody(func() (io.ReadCloser, error) {
+		return nil, fmt.Errorf("generator failed")
+	}))
+	if err == nil || !strings.Contains(err.Error(), "generator failed") {
+		t.Fatalf("autorest: WithReplayableBody returned %v, expected the body error", err)
+	}
+}
+
 func TestWithHeaderAllocatesHeaders(t *testing.T) {
 	r, err := Prepare(mocks.NewRequest(), WithHeader("x-foo", "bar"))
 	if err != nil {
@@ -731,6 +1301,105 @@ func TestWithHeaderAllocatesHeaders(t *testing.T) {
 	}
 }
 
+func TestWithProgressReader(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	var counts []int64
+	r, err := Prepare(mocks.NewRequest(),
+		WithProgressReader(iotest.HalfReader(strings.NewReader(content)), int64(len(content)), func(bytesSent, total int64) {
+			if total != int64(len(content)) {
+				t.Fatalf("autorest: WithProgressReader reported a total of %d, expected %d", total, len(content))
+			}
+			counts = append(counts, bytesSent)
+		}))
+	if err != nil {
+		t.Fatalf("autorest: WithProgressReader returned an unexpected error (%v)", err)
+	}
+	if r.ContentLength != int64(len(content)) {
+		t.Fatalf("autorest: WithProgressReader set Content-Length to %d, expected %d", r.ContentLength, len(content))
+	}
+	if len(counts) != 0 {
+		t.Fatal("autorest: WithProgressReader reported progress before the body was read")
+	}
+
+	sender := SenderFunc(func(r *http.Request) (*http.Response, error) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		if string(b) != content {
+			t.Fatal("autorest: WithProgressReader altered the request body")
+		}
+		return mocks.NewResponse(), r.Body.Close()
+	})
+	if _, err = sender.Do(r); err != nil {
+		t.Fatalf("autorest: sending the request returned an unexpected error (%v)", err)
+	}
+	if len(counts) < 2 {
+		t.Fatalf("autorest: WithProgressReader reported progress %d times, expected several", len(counts))
+	}
+	for i := 1; i < len(counts); i++ {
+		if counts[i] <= counts[i-1] {
+			t.Fatalf("autorest: WithProgressReader reported decreasing progress %v", counts)
+		}
+	}
+	if last := counts[len(counts)-1]; last != int64(len(content)) {
+		t.Fatalf("autorest: WithProgressReader last reported %d bytes, expected %d", last, len(content))
+	}
+}
+
+func TestWithProgressReaderClosesReader(t *testing.T) {
+	body := mocks.NewBody("content")
+	r, err := Prepare(mocks.NewRequest(), WithProgressReader(body, 7, nil))
+	if err != nil {
+		t.Fatalf("autorest: WithProgressReader returned an unexpected error (%v)", err)
+	}
+	if _, err = ioutil.ReadAll(r.Body); err != nil {
+		t.Fatalf("autorest: reading the body returned an unexpected error (%v)", err)
+	}
+	r.Body.Close()
+	if body.IsOpen() {
+		t.Fatal("autorest: WithProgressReader failed to close the reader")
+	}
+}
+
+func TestWithHeaders(t *testing.T) {
+	req := mocks.NewRequest()
+	req.Header.Set("X-Count", "1")
+	r, err := Prepare(req, WithHeaders(map[string]interface{}{
+		"x-name":  "value",
+		"x-count": 42,
+		"x-flag":  true,
+	}))
+	if err != nil {
+		t.Fatalf("autorest: WithHeaders failed (%v)", err)
+	}
+	expected := map[string]string{"X-Name": "value", "X-Count": "42", "X-Flag": "true"}
+	for name, value := range expected {
+		if v := r.Header[name]; len(v) != 1 || v[0] != value {
+			t.Fatalf("autorest: WithHeaders set %s=%v, expected %s", name, v, value)
+		}
+	}
+}
+
+func TestPathTemplate(t *testing.T) {
+	decorator := WithPathParameters("/{a}/{b}", map[string]interface{}{"a": "x", "b": "y"})
+	for i := 0; i < 2; i++ {
+		r, err := Prepare(mocks.NewRequestForURL("https://microsoft.com"), decorator)
+		if err != nil {
+			t.Fatalf("autorest: WithPathParameters returned an error (%v)", err)
+		}
+		if r.URL.Path != "/x/y" {
+			t.Fatalf("autorest: WithPathParameters set path %s, expected /x/y", r.URL.Path)
+		}
+		if template, ok := PathTemplate(r); !ok || template != "/{a}/{b}" {
+			t.Fatalf("autorest: PathTemplate returned %q, expected /{a}/{b}", template)
+		}
+	}
+	if _, ok := PathTemplate(mocks.NewRequest()); ok {
+		t.Fatal("autorest: PathTemplate returned a template for a request without one")
+	}
+}
+
 func TestWithPathCatchesNilURL(t *testing.T) {
 	_, err := Prepare(&http.Request{}, WithPath("a"))
 	if err == nil {
@@ -759,6 +1428,21 @@ func TestWithQueryParametersCatchesNilURL(t *testing.T) {
 	}
 }
 
+func TestWithQueryParametersRepeatsSliceValues(t *testing.T) {
+	r, err := Prepare(mocks.NewRequestForURL("https://microsoft.com/a"), WithQueryParameters(map[string]interface{}{
+		"tag":    []string{"b", "a"},
+		"id":     []interface{}{1, "two"},
+		"top":    10,
+		"filter": "name eq 'x'",
+	}))
+	if err != nil {
+		t.Fatalf("autorest: WithQueryParameters returned an error (%v)", err)
+	}
+	if expected := "filter=name+eq+%27x%27&id=1&id=two&tag=b&tag=a&top=10"; r.URL.RawQuery != expected {
+		t.Fatalf("autorest: WithQueryParameters encoded %q, expected %q", r.URL.RawQuery, expected)
+	}
+}
+
 func TestModifyingExistingRequest(t *testing.T) {
 	r, err := Prepare(mocks.NewRequestForURL("https://bing.com"), WithPath("search"), WithQueryParameters(map[string]interface{}{"q": "golang"}))
 	if err != nil {
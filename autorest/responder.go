@@ -15,14 +15,25 @@ package autorest
 //  limitations under the License.
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Responder is the interface that wraps the Respond method.
@@ -71,6 +82,11 @@ func DecorateResponder(r Responder, decorators ...RespondDecorator) Responder {
 
 // Respond accepts an http.Response and a, possibly empty, set of RespondDecorators.
 // It creates a Responder from the decorators it then applies to the passed http.Response.
+//
+// The response is never discarded when a decorator fails, so headers remain available for
+// diagnostics. Decorators that read the body and then fail (e.g., WithErrorUnlessStatusCode and,
+// when decoding fails, ByUnmarshallingJSON and ByUnmarshallingXML) replace it with a buffer of the
+// content read; the buffer survives ByClosing and needs no further closing.
 func Respond(r *http.Response, decorators ...RespondDecorator) error {
 	if r == nil {
 		return nil
@@ -120,6 +136,134 @@ func ByDiscardingBody() RespondDecorator {
 	}
 }
 
+// ByStreamingLines returns a RespondDecorator that first invokes the passed Responder after which
+// it reads the response body line by line, invoking fn with each line, without its line ending, as
+// it arrives. The body is not buffered, allowing streams (e.g., of logs) to be consumed as they are
+// produced. Reading stops, returning the error, if fn returns an error, and stops, returning the
+// context's error, if the context of the request is canceled. The body is not closed.
+func ByStreamingLines(fn func(line []byte) error) RespondDecorator {
+	return func(r Responder) Responder {
+		return ResponderFunc(func(resp *http.Response) error {
+			err := r.Respond(resp)
+			if err == nil && resp != nil && resp.Body != nil {
+				err = streamLines(resp, fn)
+			}
+			return err
+		})
+	}
+}
+
+// ByStreamingEvents returns a RespondDecorator that behaves like ByStreamingLines but invokes fn
+// once for each server-sent event, that is, with the lines (e.g., "event: ..." and "data: ...")
+// preceding each blank line, joined by "\n".
+func ByStreamingEvents(fn func(event []byte) error) RespondDecorator {
+	return func(r Responder) Responder {
+		return ResponderFunc(func(resp *http.Response) error {
+			err := r.Respond(resp)
+			if err != nil || resp == nil || resp.Body == nil {
+				return err
+			}
+			var event []byte
+			err = streamLines(resp, func(line []byte) error {
+				if len(line) > 0 {
+					if len(event) > 0 {
+						event = append(event, '\n')
+					}
+					event = append(event, line...)
+					return nil
+				}
+				if len(event) == 0 {
+					return nil
+				}
+				e := event
+				event = nil
+				return fn(e)
+			})
+			if err == nil && len(event) > 0 {
+				err = fn(event)
+			}
+			return err
+		})
+	}
+}
+
+// streamLines reads the body of resp line by line, invoking fn with each line.
+func streamLines(resp *http.Response, fn func(line []byte) error) error {
+	var done <-chan struct{}
+	if resp.Request != nil {
+		done = resp.Request.Context().Done()
+	}
+	br := bufio.NewReader(resp.Body)
+	for {
+		select {
+		case <-done:
+			return resp.Request.Context().Err()
+		default:
+		}
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if errFn := fn(bytes.TrimRight(line, "\r\n")); errFn != nil {
+				return errFn
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if resp.Request != nil && resp.Request.Context().Err() != nil {
+				return resp.Request.Context().Err()
+			}
+			return fmt.Errorf("Error reading the response body: %v", err)
+		}
+	}
+}
+
+// ByVerifyingHMAC returns a RespondDecorator that verifies the HMAC-SHA256 signature, computed with
+// the passed key, of the response body against the value of the named header before invoking the
+// passed Responder. The signature may be base64 or hex encoded and prefixed by "sha256=". An error
+// is returned, without invoking the passed Responder, if the header is missing or the signature
+// does not match. The body is buffered and left available to the passed Responder.
+func ByVerifyingHMAC(key []byte, headerName string) RespondDecorator {
+	return func(r Responder) Responder {
+		return ResponderFunc(func(resp *http.Response) error {
+			if resp == nil {
+				return r.Respond(resp)
+			}
+			signature := strings.TrimPrefix(strings.TrimSpace(resp.Header.Get(headerName)), "sha256=")
+			if signature == "" {
+				return NewErrorWithResponse("autorest", "ByVerifyingHMAC", resp, "Response is missing the %s signature header", headerName)
+			}
+			var b []byte
+			if resp.Body != nil {
+				var err error
+				b, err = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					return NewErrorWithError(err, "autorest", "ByVerifyingHMAC", resp, "Failed to read the response body")
+				}
+				resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+			}
+			mac := hmac.New(sha256.New, key)
+			mac.Write(b)
+			if !hmacMatches(mac.Sum(nil), signature) {
+				return NewErrorWithResponse("autorest", "ByVerifyingHMAC", resp, "Response body does not match the %s signature", headerName)
+			}
+			return r.Respond(resp)
+		})
+	}
+}
+
+// hmacMatches returns true if signature is the base64 or hex encoding of expected.
+func hmacMatches(expected []byte, signature string) bool {
+	if actual, err := base64.StdEncoding.DecodeString(signature); err == nil && hmac.Equal(expected, actual) {
+		return true
+	}
+	if actual, err := hex.DecodeString(signature); err == nil && hmac.Equal(expected, actual) {
+		return true
+	}
+	return false
+}
+
 // ByClosing returns a RespondDecorator that first invokes the passed Responder after which it
 // closes the response body. Since the passed Responder is invoked prior to closing the response
 // body, the decorator may occur anywhere within the set.
@@ -153,22 +297,109 @@ func ByClosingIfError() RespondDecorator {
 	}
 }
 
+// ByDecompressing returns a RespondDecorator that, when the Content-Encoding header of the response
+// is gzip or deflate, replaces the response body with a reader that decompresses it. It must
+// precede the decorators that read the body (e.g., ByUnmarshallingJSON). The Content-Encoding
+// header is removed and ContentLength set to -1 (unknown), as the length of the decompressed body
+// is not known in advance. Closing the replacement body closes the original body.
+func ByDecompressing() RespondDecorator {
+	return func(r Responder) Responder {
+		return ResponderFunc(func(resp *http.Response) error {
+			err := r.Respond(resp)
+			if err != nil || resp.Body == nil {
+				return err
+			}
+			var rc io.ReadCloser
+			switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get(headerContentEncoding))); encoding {
+			case "gzip", "x-gzip":
+				rc, err = gzip.NewReader(resp.Body)
+			case "deflate":
+				rc, err = newDeflateReader(resp.Body)
+			default:
+				return nil
+			}
+			if err != nil {
+				return NewErrorWithError(err, "autorest", "ByDecompressing", resp, "Failed to decompress the response body")
+			}
+			resp.Body = decompressingBody{ReadCloser: rc, body: resp.Body}
+			resp.Header.Del(headerContentEncoding)
+			resp.ContentLength = -1
+			resp.Uncompressed = true
+			return nil
+		})
+	}
+}
+
+// newDeflateReader returns a reader decompressing a deflate encoded body. The deflate content
+// coding is zlib wrapped deflate data (RFC 1950), but some servers send raw deflate data (RFC 1951);
+// both are accepted.
+func newDeflateReader(body io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(body)
+	header, err := br.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// decompressingBody reads from a decompressing reader and closes both it and the original body.
+type decompressingBody struct {
+	io.ReadCloser
+	body io.ReadCloser
+}
+
+func (db decompressingBody) Close() error {
+	db.ReadCloser.Close()
+	return db.body.Close()
+}
+
 // ByUnmarshallingJSON returns a RespondDecorator that decodes a JSON document returned in the
 // response Body into the value pointed to by v.
 func ByUnmarshallingJSON(v interface{}) RespondDecorator {
+	return ByUnmarshallingJSONWithLimits(v, JSONLimits{})
+}
+
+// JSONLimits bounds the JSON documents decoded by ByUnmarshallingJSONWithLimits. Zero values impose
+// no limit.
+type JSONLimits struct {
+	// MaxBytes is the maximum size of the document in bytes.
+	MaxBytes int64
+
+	// MaxDepth is the maximum nesting depth of objects and arrays.
+	MaxDepth int
+
+	// MaxTokens is the maximum number of tokens (delimiters, keys and values) in the document.
+	MaxTokens int
+}
+
+// ByUnmarshallingJSONWithLimits returns a RespondDecorator that behaves like ByUnmarshallingJSON
+// except that it fails, without decoding, documents exceeding the passed limits. It protects
+// against excessively large or deeply nested documents from untrusted sources. Documents larger
+// than limits.MaxBytes are not read beyond the limit.
+func ByUnmarshallingJSONWithLimits(v interface{}, limits JSONLimits) RespondDecorator {
 	return func(r Responder) Responder {
 		return ResponderFunc(func(resp *http.Response) error {
 			err := r.Respond(resp)
 			if err == nil {
-				b, errInner := ioutil.ReadAll(resp.Body)
-				// Some responses might include a BOM, remove for successful unmarshalling
-				b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+				body := io.Reader(resp.Body)
+				if limits.MaxBytes > 0 {
+					body = io.LimitReader(resp.Body, limits.MaxBytes+1)
+				}
+				b, errInner := ioutil.ReadAll(body)
+				// Some responses (e.g. those rewritten by proxies) might include a BOM, possibly
+				// surrounded by whitespace, remove for successful unmarshalling
+				trimmed := bytes.TrimSpace(bytes.TrimPrefix(bytes.TrimSpace(b), []byte("\xef\xbb\xbf")))
 				if errInner != nil {
 					err = fmt.Errorf("Error occurred reading http.Response#Body - Error = '%v'", errInner)
-				} else if len(strings.Trim(string(b), " ")) > 0 {
-					errInner = json.Unmarshal(b, v)
+				} else if limits.MaxBytes > 0 && int64(len(b)) > limits.MaxBytes {
+					err = NewErrorWithResponse("autorest", "ByUnmarshallingJSONWithLimits", resp, "JSON document exceeds %d bytes", limits.MaxBytes)
+				} else if errInner = checkJSONLimits(trimmed, limits); errInner != nil {
+					err = NewErrorWithError(errInner, "autorest", "ByUnmarshallingJSONWithLimits", resp, "JSON document exceeds the decoding limits")
+				} else if len(trimmed) > 0 {
+					errInner = json.Unmarshal(trimmed, v)
 					if errInner != nil {
 						err = fmt.Errorf("Error occurred unmarshalling JSON - Error = '%v' JSON = '%s'", errInner, string(b))
+						restoreBody(resp, b)
 					}
 				}
 			}
@@ -177,21 +408,217 @@ func ByUnmarshallingJSON(v interface{}) RespondDecorator {
 	}
 }
 
+// checkJSONLimits returns an error if the JSON document b exceeds the depth or token limits. Syntax
+// errors are left for json.Unmarshal to report.
+func checkJSONLimits(b []byte, limits JSONLimits) error {
+	if limits.MaxDepth <= 0 && limits.MaxTokens <= 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	depth, tokens := 0, 0
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		tokens++
+		if limits.MaxTokens > 0 && tokens > limits.MaxTokens {
+			return fmt.Errorf("more than %d tokens", limits.MaxTokens)
+		}
+		if d, ok := t.(json.Delim); ok {
+			switch d {
+			case '{', '[':
+				depth++
+				if limits.MaxDepth > 0 && depth > limits.MaxDepth {
+					return fmt.Errorf("nesting deeper than %d", limits.MaxDepth)
+				}
+			default:
+				depth--
+			}
+		}
+	}
+}
+
+// restoreBody closes the response body, whose content b has been read, and replaces it with a
+// buffer of b. ByClosing does not discard the buffer, so the body remains available to the caller.
+func restoreBody(resp *http.Response, b []byte) {
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+}
+
+// ByUnmarshallingJSONFromField returns a RespondDecorator that decodes the value of the named
+// top-level field of a JSON document returned in the response Body into the value pointed to by v.
+// It supports responses that wrap their result in an envelope (e.g., {"d": {...}} in OData v2).
+// An error is returned if the document does not contain the field.
+func ByUnmarshallingJSONFromField(field string, v interface{}) RespondDecorator {
+	return func(r Responder) Responder {
+		return ResponderFunc(func(resp *http.Response) error {
+			var envelope map[string]json.RawMessage
+			err := ByUnmarshallingJSON(&envelope)(r).Respond(resp)
+			if err != nil {
+				return err
+			}
+			raw, ok := envelope[field]
+			if !ok {
+				return fmt.Errorf("Error occurred unmarshalling JSON - Field '%s' not found in response", field)
+			}
+			if errInner := json.Unmarshal(raw, v); errInner != nil {
+				return fmt.Errorf("Error occurred unmarshalling JSON field '%s' - Error = '%v' JSON = '%s'", field, errInner, string(raw))
+			}
+			return nil
+		})
+	}
+}
+
+// ByUnmarshallingBytes returns a RespondDecorator that reads the entire response Body, without
+// interpreting it, into the slice pointed to by v and then closes the body. A missing or empty body
+// leaves v pointing to an empty, non-nil slice.
+func ByUnmarshallingBytes(v *[]byte) RespondDecorator {
+	return func(r Responder) Responder {
+		return ResponderFunc(func(resp *http.Response) error {
+			err := r.Respond(resp)
+			if err == nil {
+				if v == nil {
+					return NewError("autorest", "ByUnmarshallingBytes", "Invoked with a nil slice pointer")
+				}
+				*v = []byte{}
+				if resp == nil || resp.Body == nil {
+					return nil
+				}
+				b, errInner := ioutil.ReadAll(resp.Body)
+				if errInner != nil {
+					err = fmt.Errorf("Error occurred reading http.Response#Body - Error = '%v'", errInner)
+				} else {
+					*v = b
+				}
+				if errInner = resp.Body.Close(); errInner != nil && err == nil {
+					err = fmt.Errorf("Error closing the response body: %v", errInner)
+				}
+			}
+			return err
+		})
+	}
+}
+
 // ByUnmarshallingXML returns a RespondDecorator that decodes a XML document returned in the
-// response Body into the value pointed to by v.
+// response Body into the value pointed to by v. As with ByUnmarshallingJSON, a leading BOM is
+// ignored and an empty body leaves v unchanged.
 func ByUnmarshallingXML(v interface{}) RespondDecorator {
 	return func(r Responder) Responder {
 		return ResponderFunc(func(resp *http.Response) error {
 			err := r.Respond(resp)
 			if err == nil {
 				b, errInner := ioutil.ReadAll(resp.Body)
+				trimmed := bytes.TrimSpace(bytes.TrimPrefix(bytes.TrimSpace(b), []byte("\xef\xbb\xbf")))
 				if errInner != nil {
 					err = fmt.Errorf("Error occurred reading http.Response#Body - Error = '%v'", errInner)
-				} else {
-					errInner = xml.Unmarshal(b, v)
+				} else if len(trimmed) > 0 {
+					errInner = xml.Unmarshal(trimmed, v)
 					if errInner != nil {
 						err = fmt.Errorf("Error occurred unmarshalling Xml - Error = '%v' Xml = '%s'", errInner, string(b))
+						restoreBody(resp, b)
+					}
+				}
+			}
+			return err
+		})
+	}
+}
+
+// ByExtractingMetadata returns a RespondDecorator that collects the values of all x-ms-meta-*
+// headers in the response into the map pointed to by metadata, keyed by the metadata name with
+// the prefix removed. Since Azure treats metadata names as case-insensitive and http.Header
+// canonicalizes header names, the names are returned in lower case.
+func ByExtractingMetadata(metadata *map[string]string) RespondDecorator {
+	return func(r Responder) Responder {
+		return ResponderFunc(func(resp *http.Response) error {
+			err := r.Respond(resp)
+			if err == nil {
+				m := make(map[string]string)
+				for k, v := range resp.Header {
+					name := strings.ToLower(k)
+					if strings.HasPrefix(name, headerMetadataPrefix) && len(name) > len(headerMetadataPrefix) && len(v) > 0 {
+						m[strings.TrimPrefix(name, headerMetadataPrefix)] = v[0]
+					}
+				}
+				*metadata = m
+			}
+			return err
+		})
+	}
+}
+
+// DuplicateHeaderPolicy selects which occurrence of a repeated header ByNormalizingHeaders keeps.
+type DuplicateHeaderPolicy int
+
+const (
+	// KeepFirstHeader keeps the first occurrence of a repeated header.
+	KeepFirstHeader DuplicateHeaderPolicy = iota
+
+	// KeepLastHeader keeps the last occurrence of a repeated header.
+	KeepLastHeader
+)
+
+// ByNormalizingHeaders returns a RespondDecorator that, for each of the named headers occurring
+// more than once in the response (e.g., Set-Cookie or WWW-Authenticate headers added by several
+// proxies), keeps only the occurrence selected by policy. The values removed are stored in the map
+// pointed to by dropped, if not nil, keyed by canonical header name. Since the headers are
+// normalized before the passed Responder is invoked, the decorator may occur anywhere within the
+// set.
+func ByNormalizingHeaders(policy DuplicateHeaderPolicy, dropped *map[string][]string, headers ...string) RespondDecorator {
+	return func(r Responder) Responder {
+		return ResponderFunc(func(resp *http.Response) error {
+			if resp != nil && resp.Header != nil {
+				d := make(map[string][]string)
+				for _, header := range headers {
+					name := http.CanonicalHeaderKey(header)
+					v := resp.Header[name]
+					if len(v) < 2 {
+						continue
 					}
+					if policy == KeepLastHeader {
+						resp.Header[name] = []string{v[len(v)-1]}
+						d[name] = append([]string(nil), v[:len(v)-1]...)
+					} else {
+						resp.Header[name] = []string{v[0]}
+						d[name] = append([]string(nil), v[1:]...)
+					}
+				}
+				if dropped != nil {
+					*dropped = d
+				}
+			}
+			return r.Respond(resp)
+		})
+	}
+}
+
+// ContentRange describes the range of bytes served in a response as reported by the HTTP
+// Content-Range header. Start and End are inclusive offsets; Size is the complete length of the
+// resource or -1 if the server reported it as unknown.
+type ContentRange struct {
+	Start int64
+	End   int64
+	Size  int64
+}
+
+// ByParsingContentRange returns a RespondDecorator that parses the HTTP Content-Range header of a
+// partial (206) response into the value pointed to by cr. If the response is not a partial
+// response and has no Content-Range header, cr describes the full body when its length is known.
+func ByParsingContentRange(cr *ContentRange) RespondDecorator {
+	return func(r Responder) Responder {
+		return ResponderFunc(func(resp *http.Response) error {
+			err := r.Respond(resp)
+			if err == nil {
+				v := resp.Header.Get(headerContentRange)
+				switch {
+				case v != "":
+					*cr, err = parseContentRange(v)
+				case resp.StatusCode == http.StatusPartialContent:
+					err = NewErrorWithResponse("autorest", "ByParsingContentRange", resp, "Content-Range header missing from partial response")
+				case resp.ContentLength > 0:
+					*cr = ContentRange{Start: 0, End: resp.ContentLength - 1, Size: resp.ContentLength}
 				}
 			}
 			return err
@@ -199,9 +626,161 @@ func ByUnmarshallingXML(v interface{}) RespondDecorator {
 	}
 }
 
+// parseContentRange parses values of the form "bytes 0-499/1234" or "bytes 0-499/*".
+func parseContentRange(v string) (cr ContentRange, err error) {
+	const unit = "bytes "
+	if !strings.HasPrefix(v, unit) {
+		return cr, fmt.Errorf("autorest: unsupported Content-Range %q", v)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(v, unit), "/", 2)
+	if len(parts) != 2 {
+		return cr, fmt.Errorf("autorest: malformed Content-Range %q", v)
+	}
+	cr.Size = -1
+	if parts[1] != "*" {
+		if cr.Size, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return cr, fmt.Errorf("autorest: malformed Content-Range %q", v)
+		}
+	}
+	bounds := strings.SplitN(parts[0], "-", 2)
+	if len(bounds) != 2 {
+		return cr, fmt.Errorf("autorest: malformed Content-Range %q", v)
+	}
+	if cr.Start, err = strconv.ParseInt(bounds[0], 10, 64); err != nil {
+		return cr, fmt.Errorf("autorest: malformed Content-Range %q", v)
+	}
+	if cr.End, err = strconv.ParseInt(bounds[1], 10, 64); err != nil {
+		return cr, fmt.Errorf("autorest: malformed Content-Range %q", v)
+	}
+	if cr.End < cr.Start || (cr.Size >= 0 && cr.End >= cr.Size) {
+		return cr, fmt.Errorf("autorest: invalid Content-Range %q", v)
+	}
+	return cr, nil
+}
+
+// RangeDownloadFunc requests the bytes from start through end, inclusive, of a resource; an end of
+// -1 requests the remainder. It returns the (200 or 206) response, whose body the caller reads and
+// closes.
+type RangeDownloadFunc func(ctx context.Context, start, end int64) (*http.Response, error)
+
+// DownloadRanges writes a resource to w by issuing sequential range requests of at most chunkSize
+// bytes through download, or a single open-ended request if chunkSize is not positive. Each partial
+// response must start at the first missing byte, as reported by its Content-Range header. A request
+// that fails, or whose body ends early, is resumed from the first missing byte; after attempts
+// consecutive failures without progress DownloadRanges gives up. Between failures it waits for an
+// exponential backoff (see DelayForBackoff). When the server does not report the complete length,
+// a 416 (Requested Range Not Satisfiable) response to a range past the first byte marks the end of
+// the resource. It returns the number of bytes written to w, which, when the server reports the
+// complete length, must equal that length.
+func DownloadRanges(ctx context.Context, w io.Writer, chunkSize int64, attempts int, backoff time.Duration, download RangeDownloadFunc) (int64, error) {
+	rw := &rangeWriter{w: w}
+	var offset int64
+	size := int64(-1)
+	failures := 0
+	for size < 0 || offset < size {
+		end := int64(-1)
+		if chunkSize > 0 {
+			end = offset + chunkSize - 1
+			if size >= 0 && end >= size {
+				end = size - 1
+			}
+		}
+		n, done, err := downloadRange(ctx, rw, offset, end, &size, download)
+		offset += n
+		if rw.err != nil {
+			return offset, NewErrorWithError(rw.err, "autorest", "DownloadRanges", nil, "Failed to write bytes from %d", offset)
+		}
+		if err == nil {
+			failures = 0
+			if done {
+				break
+			}
+			continue
+		}
+		if n > 0 {
+			failures = 0
+		}
+		failures++
+		if failures >= attempts {
+			return offset, NewErrorWithError(err, "autorest", "DownloadRanges", nil, "Failed to download bytes from %d after %d attempts", offset, failures)
+		}
+		if !DelayForBackoff(backoff, failures-1, ctx.Done()) {
+			return offset, ctx.Err()
+		}
+	}
+	if size >= 0 && offset != size {
+		return offset, NewError("autorest", "DownloadRanges", "Downloaded %d bytes, expected %d", offset, size)
+	}
+	return offset, nil
+}
+
+// downloadRange copies the bytes from start through end to w, recording the complete length of the
+// resource in size once known. It reports done when the server has no more bytes to send.
+func downloadRange(ctx context.Context, w io.Writer, start, end int64, size *int64, download RangeDownloadFunc) (n int64, done bool, err error) {
+	resp, err := download(ctx, start, end)
+	if err != nil {
+		return 0, false, err
+	}
+	if resp == nil || resp.Body == nil {
+		return 0, false, NewError("autorest", "DownloadRanges", "Range request for bytes from %d returned no response", start)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && start > 0 && *size < 0 {
+		// the resource, of unknown length, ended exactly at the end of the previous range
+		return 0, true, nil
+	}
+	var cr ContentRange
+	if err = Respond(resp, WithErrorUnlessStatusCode(http.StatusOK, http.StatusPartialContent), ByParsingContentRange(&cr)); err != nil {
+		return 0, false, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		if start != 0 {
+			return 0, false, NewErrorWithResponse("autorest", "DownloadRanges", resp, "Range request for bytes from %d returned the complete resource", start)
+		}
+		cr = ContentRange{Start: 0, End: resp.ContentLength - 1, Size: resp.ContentLength}
+	}
+	if cr.Start != start {
+		return 0, false, NewErrorWithResponse("autorest", "DownloadRanges", resp, "Received bytes from %d, expected bytes from %d", cr.Start, start)
+	}
+	if cr.Size >= 0 {
+		if *size >= 0 && *size != cr.Size {
+			return 0, false, NewErrorWithResponse("autorest", "DownloadRanges", resp, "Resource length changed from %d to %d", *size, cr.Size)
+		}
+		*size = cr.Size
+	}
+	if cr.End < cr.Start {
+		// the length of the body is unknown; copy it to the end
+		n, err = io.Copy(w, resp.Body)
+		return n, err == nil, err
+	}
+	expected := cr.End - cr.Start + 1
+	n, err = io.CopyN(w, resp.Body, expected)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err == nil && *size < 0 && (end < 0 || expected < end-start+1), err
+}
+
+// rangeWriter records the first error returned by the wrapped writer, distinguishing it from
+// errors reading a response body.
+type rangeWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (rw *rangeWriter) Write(p []byte) (int, error) {
+	n, err := rw.w.Write(p)
+	if err != nil && rw.err == nil {
+		rw.err = err
+	}
+	return n, err
+}
+
 // WithErrorUnlessStatusCode returns a RespondDecorator that emits an error unless the response
 // StatusCode is among the set passed. On error, response body is fully read into a buffer and
 // presented in the returned error, as well as in the response body.
+// If the request was sent by a Client with an ErrorFormatter, the error it returns is emitted
+// instead.
 func WithErrorUnlessStatusCode(codes ...int) RespondDecorator {
 	return func(r Responder) Responder {
 		return ResponderFunc(func(resp *http.Response) error {
@@ -217,7 +796,7 @@ func WithErrorUnlessStatusCode(codes ...int) RespondDecorator {
 					derr.ServiceError = b
 					resp.Body = ioutil.NopCloser(bytes.NewReader(b))
 				}
-				err = derr
+				err = FormatError(resp, ErrorInfo{Err: derr})
 			}
 			return err
 		})
@@ -230,6 +809,45 @@ func WithErrorUnlessOK() RespondDecorator {
 	return WithErrorUnlessStatusCode(http.StatusOK)
 }
 
+// WithErrorUnlessHeaderEquals returns a RespondDecorator that emits an error unless the response
+// includes the named header with a value equal to the passed value. It may be used, for example,
+// to detect a response whose schema version differs from that expected by the client before the
+// response is decoded.
+func WithErrorUnlessHeaderEquals(header string, value string) RespondDecorator {
+	return withErrorUnlessHeader("WithErrorUnlessHeaderEquals", header, value, func(v string) bool {
+		return v == value
+	})
+}
+
+// WithErrorUnlessHeaderContains returns a RespondDecorator that emits an error unless the response
+// includes the named header with a value containing the passed value.
+func WithErrorUnlessHeaderContains(header string, value string) RespondDecorator {
+	return withErrorUnlessHeader("WithErrorUnlessHeaderContains", header, value, func(v string) bool {
+		return strings.Contains(v, value)
+	})
+}
+
+func withErrorUnlessHeader(method, header, value string, matches func(string) bool) RespondDecorator {
+	return func(r Responder) Responder {
+		return ResponderFunc(func(resp *http.Response) error {
+			err := r.Respond(resp)
+			if err == nil {
+				values := ExtractHeader(header, resp)
+				if len(values) == 0 {
+					return NewErrorWithResponse("autorest", method, resp, "response is missing header %s, expected %q", header, value)
+				}
+				for _, v := range values {
+					if matches(v) {
+						return nil
+					}
+				}
+				err = NewErrorWithResponse("autorest", method, resp, "response header %s has unexpected value %q, expected %q", header, values[0], value)
+			}
+			return err
+		})
+	}
+}
+
 // ExtractHeader extracts all values of the specified header from the http.Response. It returns an
 // empty string slice if the passed http.Response is nil or the header does not exist.
 func ExtractHeader(header string, resp *http.Response) []string {
@@ -16,8 +16,17 @@ package autorest
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"reflect"
@@ -402,6 +411,173 @@ func TestByDiscardingBodyAcceptsNilBody(t *testing.T) {
 		ByDiscardingBody())
 }
 
+func TestByStreamingLines(t *testing.T) {
+	var lines []string
+	r := mocks.NewResponseWithContent("first\r\nsecond\n\nlast")
+	err := Respond(r,
+		ByStreamingLines(func(line []byte) error {
+			lines = append(lines, string(line))
+			return nil
+		}),
+		ByClosing())
+	if err != nil {
+		t.Fatalf("autorest: ByStreamingLines failed (%v)", err)
+	}
+	expected := []string{"first", "second", "", "last"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("autorest: ByStreamingLines returned lines %q, expected %q", lines, expected)
+	}
+}
+
+func TestByStreamingLinesStopsOnCallbackError(t *testing.T) {
+	count := 0
+	r := mocks.NewResponseWithContent("first\nsecond\n")
+	err := Respond(r,
+		ByStreamingLines(func(line []byte) error {
+			count++
+			return fmt.Errorf("stop")
+		}),
+		ByClosing())
+	if err == nil || count != 1 {
+		t.Fatalf("autorest: ByStreamingLines returned %v after %d lines, expected an error after 1", err, count)
+	}
+}
+
+func TestByStreamingLinesStopsOnCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := mocks.NewResponseWithContent("first\nsecond\n")
+	r.Request = mocks.NewRequest().WithContext(ctx)
+	count := 0
+	err := Respond(r,
+		ByStreamingLines(func(line []byte) error {
+			count++
+			cancel()
+			return nil
+		}),
+		ByClosing())
+	if err != context.Canceled || count != 1 {
+		t.Fatalf("autorest: ByStreamingLines returned %v after %d lines, expected %v after 1", err, count, context.Canceled)
+	}
+}
+
+func TestByStreamingEvents(t *testing.T) {
+	var events []string
+	r := mocks.NewResponseWithContent("event: add\ndata: 1\n\n\ndata: 2\n\ndata: 3")
+	err := Respond(r,
+		ByStreamingEvents(func(event []byte) error {
+			events = append(events, string(event))
+			return nil
+		}),
+		ByClosing())
+	if err != nil {
+		t.Fatalf("autorest: ByStreamingEvents failed (%v)", err)
+	}
+	expected := []string{"event: add\ndata: 1", "data: 2", "data: 3"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("autorest: ByStreamingEvents returned events %q, expected %q", events, expected)
+	}
+}
+
+func TestByNormalizingHeaders(t *testing.T) {
+	r := mocks.NewResponse()
+	r.Header = http.Header{}
+	r.Header.Add("WWW-Authenticate", `Bearer authorization="https://login.windows.net/a"`)
+	r.Header.Add("WWW-Authenticate", `Bearer authorization="https://login.windows.net/b"`)
+	r.Header.Add("Set-Cookie", "a=1")
+	r.Header.Add("Set-Cookie", "b=2")
+	r.Header.Add("Set-Cookie", "c=3")
+	r.Header.Add("X-Other", "1")
+	r.Header.Add("X-Other", "2")
+
+	var dropped map[string][]string
+	err := Respond(r,
+		ByNormalizingHeaders(KeepLastHeader, &dropped, "www-authenticate", "Set-Cookie"),
+		ByClosing())
+	if err != nil {
+		t.Fatalf("autorest: ByNormalizingHeaders failed (%v)", err)
+	}
+	if v := r.Header["Www-Authenticate"]; len(v) != 1 || !strings.HasSuffix(v[0], `/b"`) {
+		t.Fatalf("autorest: ByNormalizingHeaders kept WWW-Authenticate %q, expected the last occurrence", v)
+	}
+	if v := r.Header["Set-Cookie"]; !reflect.DeepEqual(v, []string{"c=3"}) {
+		t.Fatalf("autorest: ByNormalizingHeaders kept Set-Cookie %q, expected the last occurrence", v)
+	}
+	if v := r.Header["X-Other"]; len(v) != 2 {
+		t.Fatalf("autorest: ByNormalizingHeaders normalized an unlisted header %q", v)
+	}
+	if v := dropped["Set-Cookie"]; !reflect.DeepEqual(v, []string{"a=1", "b=2"}) {
+		t.Fatalf("autorest: ByNormalizingHeaders reported dropped Set-Cookie %q", v)
+	}
+	if len(dropped) != 2 {
+		t.Fatalf("autorest: ByNormalizingHeaders reported %d dropped headers, expected 2", len(dropped))
+	}
+}
+
+func TestByNormalizingHeadersKeepsFirst(t *testing.T) {
+	r := mocks.NewResponse()
+	r.Header = http.Header{}
+	r.Header.Add("Set-Cookie", "a=1")
+	r.Header.Add("Set-Cookie", "b=2")
+
+	err := Respond(r, ByNormalizingHeaders(KeepFirstHeader, nil, "Set-Cookie"))
+	if err != nil {
+		t.Fatalf("autorest: ByNormalizingHeaders failed (%v)", err)
+	}
+	if v := r.Header["Set-Cookie"]; !reflect.DeepEqual(v, []string{"a=1"}) {
+		t.Fatalf("autorest: ByNormalizingHeaders kept Set-Cookie %q, expected the first occurrence", v)
+	}
+}
+
+func TestByVerifyingHMAC(t *testing.T) {
+	key := []byte("secret")
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(jsonT))
+	sum := mac.Sum(nil)
+
+	for _, signature := range []string{base64.StdEncoding.EncodeToString(sum), "sha256=" + hex.EncodeToString(sum)} {
+		r := mocks.NewResponseWithContent(jsonT)
+		mocks.SetResponseHeader(r, "x-ms-signature", signature)
+		v := &mocks.T{}
+		err := Respond(r,
+			ByVerifyingHMAC(key, "x-ms-signature"),
+			ByUnmarshallingJSON(v),
+			ByClosing())
+		if err != nil {
+			t.Fatalf("autorest: ByVerifyingHMAC failed for signature %s (%v)", signature, err)
+		}
+		if v.Name != "Rob Pike" {
+			t.Fatal("autorest: ByVerifyingHMAC failed to leave the body available")
+		}
+	}
+}
+
+func TestByVerifyingHMACRejectsMismatch(t *testing.T) {
+	mac := hmac.New(sha256.New, []byte("other"))
+	mac.Write([]byte(jsonT))
+
+	r := mocks.NewResponseWithContent(jsonT)
+	mocks.SetResponseHeader(r, "x-ms-signature", base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	decoded := false
+	err := Respond(r,
+		ByVerifyingHMAC([]byte("secret"), "x-ms-signature"),
+		ByUnmarshallingJSON(&mocks.T{}),
+		func(r Responder) Responder {
+			return ResponderFunc(func(resp *http.Response) error {
+				err := r.Respond(resp)
+				decoded = err == nil
+				return err
+			})
+		})
+	if err == nil || decoded {
+		t.Fatalf("autorest: ByVerifyingHMAC returned %v and decoded=%v for a mismatched signature", err, decoded)
+	}
+
+	r = mocks.NewResponseWithContent(jsonT)
+	if err := Respond(r, ByVerifyingHMAC([]byte("secret"), "x-ms-signature")); err == nil {
+		t.Fatal("autorest: ByVerifyingHMAC failed to return an error for a missing signature")
+	}
+}
+
 func TestByUnmarshallingJSON(t *testing.T) {
 	v := &mocks.T{}
 	r := mocks.NewResponseWithContent(jsonT)
@@ -416,6 +592,45 @@ func TestByUnmarshallingJSON(t *testing.T) {
 	}
 }
 
+func TestByUnmarshallingJSONWithBOM(t *testing.T) {
+	v := &mocks.T{}
+	r := mocks.NewResponseWithContent("\xef\xbb\xbf" + jsonT)
+	err := Respond(r,
+		ByUnmarshallingJSON(v),
+		ByClosing())
+	if err != nil {
+		t.Fatalf("autorest: ByUnmarshallingJSON failed to unmarshal a BOM prefixed body (%v)", err)
+	}
+	if v.Name != "Rob Pike" || v.Age != 42 {
+		t.Fatalf("autorest: ByUnmarshallingJSON failed to properly unmarshal a BOM prefixed body")
+	}
+}
+
+func TestByUnmarshallingJSONWithBOMAndWhitespace(t *testing.T) {
+	v := &mocks.T{}
+	r := mocks.NewResponseWithContent("\r\n\xef\xbb\xbf\t" + jsonT + "\n")
+	err := Respond(r,
+		ByUnmarshallingJSON(v),
+		ByClosing())
+	if err != nil {
+		t.Fatalf("autorest: ByUnmarshallingJSON failed to unmarshal a BOM and whitespace wrapped body (%v)", err)
+	}
+	if v.Name != "Rob Pike" || v.Age != 42 {
+		t.Fatalf("autorest: ByUnmarshallingJSON failed to properly unmarshal a BOM and whitespace wrapped body")
+	}
+}
+
+func TestByUnmarshallingJSONWhitespaceOnly(t *testing.T) {
+	v := &mocks.T{}
+	r := mocks.NewResponseWithContent(" \r\n\t")
+	err := Respond(r,
+		ByUnmarshallingJSON(v),
+		ByClosing())
+	if err != nil {
+		t.Fatalf("autorest: ByUnmarshallingJSON failed for a whitespace only body (%v)", err)
+	}
+}
+
 func TestByUnmarshallingJSON_HandlesReadErrors(t *testing.T) {
 	v := &mocks.T{}
 	r := mocks.NewResponseWithContent(jsonT)
@@ -441,6 +656,99 @@ func TestByUnmarshallingJSONIncludesJSONInErrors(t *testing.T) {
 	}
 }
 
+func compressedResponse(encoding, content string) (*http.Response, *mocks.Body) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+		encoding = "deflate"
+	}
+	w.Write([]byte(content))
+	w.Close()
+	body := mocks.NewBody(buf.String())
+	r := mocks.NewResponse()
+	r.Body = body
+	r.ContentLength = int64(buf.Len())
+	mocks.SetResponseHeader(r, "Content-Encoding", encoding)
+	return r, body
+}
+
+func TestByDecompressing(t *testing.T) {
+	for _, encoding := range []string{"gzip", "deflate", "raw deflate"} {
+		t.Run(encoding, func(t *testing.T) {
+			r, body := compressedResponse(encoding, jsonT)
+			v := &mocks.T{}
+			err := Respond(r,
+				ByDecompressing(),
+				ByUnmarshallingJSON(v),
+				ByClosing())
+			if err != nil {
+				t.Fatalf("autorest: ByDecompressing failed (%v)", err)
+			}
+			if v.Name != "Rob Pike" || v.Age != 42 {
+				t.Fatalf("autorest: ByDecompressing did not decode the body (%+v)", v)
+			}
+			if body.IsOpen() {
+				t.Fatal("autorest: ByDecompressing did not close the original body")
+			}
+			if r.Header.Get("Content-Encoding") != "" || r.ContentLength != -1 {
+				t.Fatalf("autorest: ByDecompressing left Content-Encoding %q and ContentLength %d", r.Header.Get("Content-Encoding"), r.ContentLength)
+			}
+		})
+	}
+}
+
+func TestByDecompressingIgnoresUnencodedBody(t *testing.T) {
+	r := mocks.NewResponseWithContent(jsonT)
+	v := &mocks.T{}
+	if err := Respond(r, ByDecompressing(), ByUnmarshallingJSON(v), ByClosing()); err != nil || v.Name != "Rob Pike" {
+		t.Fatalf("autorest: ByDecompressing altered an unencoded body (%v)", err)
+	}
+}
+
+func TestByDecompressingReturnsErrorForInvalidGzip(t *testing.T) {
+	r := mocks.NewResponseWithContent("not gzip")
+	mocks.SetResponseHeader(r, "Content-Encoding", "gzip")
+	if err := Respond(r, ByDecompressing(), ByClosing()); err == nil {
+		t.Fatal("autorest: ByDecompressing did not return an error for an invalid gzip body")
+	}
+}
+
+func TestByUnmarshallingJSONPreservesBodyOnError(t *testing.T) {
+	v := &mocks.T{}
+	j := jsonT[0 : len(jsonT)-2]
+	r := mocks.NewResponseWithContent(j)
+	mocks.SetResponseHeader(r, "x-ms-request-id", "id")
+	body := r.Body.(*mocks.Body)
+	if err := Respond(r, ByUnmarshallingJSON(v), ByClosing()); err == nil {
+		t.Fatal("autorest: ByUnmarshallingJSON did not return an error for malformed JSON")
+	}
+	if body.IsOpen() {
+		t.Fatal("autorest: ByUnmarshallingJSON left the original response body open")
+	}
+	b, _ := ioutil.ReadAll(r.Body)
+	if string(b) != j || r.Header.Get("x-ms-request-id") != "id" {
+		t.Fatalf("autorest: ByUnmarshallingJSON did not preserve the response (body %q)", string(b))
+	}
+}
+
+func TestByUnmarshallingXMLPreservesBodyOnError(t *testing.T) {
+	v := &mocks.T{}
+	x := "<T><Name>"
+	r := mocks.NewResponseWithContent(x)
+	if err := Respond(r, ByUnmarshallingXML(v), ByClosing()); err == nil {
+		t.Fatal("autorest: ByUnmarshallingXML did not return an error for malformed XML")
+	}
+	if b, _ := ioutil.ReadAll(r.Body); string(b) != x {
+		t.Fatalf("autorest: ByUnmarshallingXML did not preserve the response body (%q)", string(b))
+	}
+}
+
 func TestByUnmarshallingJSONEmptyInput(t *testing.T) {
 	v := &mocks.T{}
 	r := mocks.NewResponseWithContent(``)
@@ -452,6 +760,73 @@ func TestByUnmarshallingJSONEmptyInput(t *testing.T) {
 	}
 }
 
+func TestByUnmarshallingJSONWithLimits(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		limits  JSONLimits
+		wantErr bool
+	}{
+		{"no limits", jsonT, JSONLimits{}, false},
+		{"within limits", jsonT, JSONLimits{MaxBytes: 1024, MaxDepth: 1, MaxTokens: 6}, false},
+		{"too large", jsonT, JSONLimits{MaxBytes: 10}, true},
+		{"too deep", `{"name":[[[["Rob Pike"]]]]}`, JSONLimits{MaxDepth: 4}, true},
+		{"too many tokens", jsonT, JSONLimits{MaxTokens: 5}, true},
+		{"empty", ``, JSONLimits{MaxBytes: 10, MaxDepth: 1, MaxTokens: 1}, false},
+	}
+	for _, c := range cases {
+		v := &mocks.T{}
+		r := mocks.NewResponseWithContent(c.content)
+		err := Respond(r,
+			ByUnmarshallingJSONWithLimits(v, c.limits),
+			ByClosing())
+		if c.wantErr && err == nil {
+			t.Fatalf("autorest: ByUnmarshallingJSONWithLimits (%s) failed to return an error", c.name)
+		} else if !c.wantErr && err != nil {
+			t.Fatalf("autorest: ByUnmarshallingJSONWithLimits (%s) returned an unexpected error (%v)", c.name, err)
+		}
+		if !c.wantErr && c.content == jsonT && (v.Name != "Rob Pike" || v.Age != 42) {
+			t.Fatalf("autorest: ByUnmarshallingJSONWithLimits (%s) failed to properly unmarshal", c.name)
+		}
+	}
+}
+
+func TestByUnmarshallingJSONWithLimitsReportsSyntaxErrors(t *testing.T) {
+	v := &mocks.T{}
+	r := mocks.NewResponseWithContent(`{"name":`)
+	err := Respond(r,
+		ByUnmarshallingJSONWithLimits(v, JSONLimits{MaxDepth: 1}),
+		ByClosing())
+	if err == nil || !strings.Contains(err.Error(), "unmarshalling JSON") {
+		t.Fatalf("autorest: ByUnmarshallingJSONWithLimits failed to report the syntax error (%v)", err)
+	}
+}
+
+func TestByUnmarshallingJSONFromField(t *testing.T) {
+	v := &mocks.T{}
+	r := mocks.NewResponseWithContent(`{"d": ` + jsonT + `}`)
+	err := Respond(r,
+		ByUnmarshallingJSONFromField("d", v),
+		ByClosing())
+	if err != nil {
+		t.Fatalf("autorest: ByUnmarshallingJSONFromField failed (%v)", err)
+	}
+	if v.Name != "Rob Pike" || v.Age != 42 {
+		t.Fatalf("autorest: ByUnmarshallingJSONFromField failed to properly unmarshal")
+	}
+}
+
+func TestByUnmarshallingJSONFromFieldReturnsErrorForMissingField(t *testing.T) {
+	v := &mocks.T{}
+	r := mocks.NewResponseWithContent(`{"result": ` + jsonT + `}`)
+	err := Respond(r,
+		ByUnmarshallingJSONFromField("d", v),
+		ByClosing())
+	if err == nil || !strings.Contains(err.Error(), "'d' not found") {
+		t.Fatalf("autorest: ByUnmarshallingJSONFromField returned %v, expected a missing field error", err)
+	}
+}
+
 func TestByUnmarshallingXML(t *testing.T) {
 	v := &mocks.T{}
 	r := mocks.NewResponseWithContent(xmlT)
@@ -466,6 +841,77 @@ func TestByUnmarshallingXML(t *testing.T) {
 	}
 }
 
+func TestByUnmarshallingBytes(t *testing.T) {
+	var v []byte
+	r := mocks.NewResponseWithContent(jsonT)
+	err := Respond(r,
+		WithErrorUnlessStatusCode(http.StatusOK),
+		ByUnmarshallingBytes(&v))
+	if err != nil {
+		t.Fatalf("autorest: ByUnmarshallingBytes failed (%v)", err)
+	}
+	if string(v) != jsonT {
+		t.Fatalf("autorest: ByUnmarshallingBytes read %q, expected %q", string(v), jsonT)
+	}
+	if r.Body.(*mocks.Body).IsOpen() {
+		t.Fatal("autorest: ByUnmarshallingBytes failed to close the response body")
+	}
+}
+
+func TestByUnmarshallingBytesEmptyBody(t *testing.T) {
+	var v []byte
+	if err := Respond(mocks.NewResponseWithContent(``), ByUnmarshallingBytes(&v)); err != nil {
+		t.Fatalf("autorest: ByUnmarshallingBytes failed (%v)", err)
+	}
+	if v == nil || len(v) != 0 {
+		t.Fatalf("autorest: ByUnmarshallingBytes returned %v for an empty body, expected an empty slice", v)
+	}
+
+	v = nil
+	r := mocks.NewResponse()
+	r.Body = nil
+	if err := Respond(r, ByUnmarshallingBytes(&v)); err != nil {
+		t.Fatalf("autorest: ByUnmarshallingBytes failed for a missing body (%v)", err)
+	}
+	if v == nil || len(v) != 0 {
+		t.Fatalf("autorest: ByUnmarshallingBytes returned %v for a missing body, expected an empty slice", v)
+	}
+}
+
+func TestByUnmarshallingBytes_HandlesReadErrors(t *testing.T) {
+	var v []byte
+	r := mocks.NewResponseWithContent(jsonT)
+	r.Body.(*mocks.Body).Close()
+	if err := Respond(r, ByUnmarshallingBytes(&v)); err == nil {
+		t.Fatal("autorest: ByUnmarshallingBytes failed to receive / respond to read error")
+	}
+}
+
+func TestByUnmarshallingXMLWithBOM(t *testing.T) {
+	v := &mocks.T{}
+	r := mocks.NewResponseWithContent("\xef\xbb\xbf" + xmlT)
+	err := Respond(r,
+		ByUnmarshallingXML(v),
+		ByClosing())
+	if err != nil {
+		t.Fatalf("autorest: ByUnmarshallingXML failed (%v)", err)
+	}
+	if v.Name != "Rob Pike" || v.Age != 42 {
+		t.Fatalf("autorest: ByUnmarshallingXML failed to properly unmarshal")
+	}
+}
+
+func TestByUnmarshallingXMLEmptyInput(t *testing.T) {
+	v := &mocks.T{}
+	r := mocks.NewResponseWithContent(``)
+	err := Respond(r,
+		ByUnmarshallingXML(v),
+		ByClosing())
+	if err != nil {
+		t.Fatalf("autorest: ByUnmarshallingXML failed to return nil in case of empty XML (%v)", err)
+	}
+}
+
 func TestByUnmarshallingXML_HandlesReadErrors(t *testing.T) {
 	v := &mocks.T{}
 	r := mocks.NewResponseWithContent(xmlT)
@@ -568,6 +1014,26 @@ func TestWithErrorUnlessStatusCode(t *testing.T) {
 	}
 }
 
+func TestWithErrorUnlessStatusCodeUsesErrorFormatter(t *testing.T) {
+	sender := mocks.NewSender()
+	sender.AppendResponse(mocks.NewResponseWithStatus("400 BadRequest", http.StatusBadRequest))
+	client := Client{
+		Sender: sender,
+		ErrorFormatter: func(info ErrorInfo) error {
+			return fmt.Errorf("%s %s returned %d", info.Method, info.URL, info.StatusCode)
+		},
+	}
+	resp, err := client.Do(mocks.NewRequest())
+	if err != nil {
+		t.Fatalf("autorest: Client#Do returned an error (%v)", err)
+	}
+	err = Respond(resp, WithErrorUnlessStatusCode(http.StatusOK), ByClosing())
+	expected := fmt.Sprintf("GET %s returned 400", mocks.TestURL)
+	if err == nil || err.Error() != expected {
+		t.Fatalf("autorest: WithErrorUnlessStatusCode returned %v, expected %s", err, expected)
+	}
+}
+
 func TestWithErrorUnlessStatusCodeEmitsErrorForUnacceptableStatusCode(t *testing.T) {
 	r := mocks.NewResponse()
 	r.Request = mocks.NewRequest()
@@ -596,6 +1062,48 @@ func TestWithErrorUnlessOK(t *testing.T) {
 	}
 }
 
+func TestWithErrorUnlessHeaderEquals(t *testing.T) {
+	r := mocks.NewResponse()
+	mocks.SetResponseHeader(r, "x-ms-schema-version", "2019-01-01")
+
+	err := Respond(r, WithErrorUnlessHeaderEquals("x-ms-schema-version", "2019-01-01"))
+	if err != nil {
+		t.Fatalf("autorest: WithErrorUnlessHeaderEquals returned an error for a matching header (%v)", err)
+	}
+}
+
+func TestWithErrorUnlessHeaderEqualsEmitsErrorIfDifferent(t *testing.T) {
+	r := mocks.NewResponse()
+	mocks.SetResponseHeader(r, "x-ms-schema-version", "2020-01-01")
+
+	err := Respond(r, WithErrorUnlessHeaderEquals("x-ms-schema-version", "2019-01-01"))
+	if err == nil {
+		t.Fatal("autorest: WithErrorUnlessHeaderEquals failed to return an error for a different header value")
+	}
+	if !strings.Contains(err.Error(), "2020-01-01") {
+		t.Fatalf("autorest: WithErrorUnlessHeaderEquals returned an error without the received value (%v)", err)
+	}
+}
+
+func TestWithErrorUnlessHeaderEqualsEmitsErrorIfMissing(t *testing.T) {
+	err := Respond(mocks.NewResponse(), WithErrorUnlessHeaderEquals("x-ms-schema-version", "2019-01-01"))
+	if err == nil {
+		t.Fatal("autorest: WithErrorUnlessHeaderEquals failed to return an error for a missing header")
+	}
+}
+
+func TestWithErrorUnlessHeaderContains(t *testing.T) {
+	r := mocks.NewResponse()
+	mocks.SetResponseHeader(r, headerContentType, "application/json; odata.metadata=minimal")
+
+	if err := Respond(r, WithErrorUnlessHeaderContains(headerContentType, "odata.metadata=minimal")); err != nil {
+		t.Fatalf("autorest: WithErrorUnlessHeaderContains returned an error for a matching header (%v)", err)
+	}
+	if err := Respond(r, WithErrorUnlessHeaderContains(headerContentType, "odata.metadata=full")); err == nil {
+		t.Fatal("autorest: WithErrorUnlessHeaderContains failed to return an error for a non-matching header")
+	}
+}
+
 func TestWithErrorUnlessOKEmitsErrorIfNotOK(t *testing.T) {
 	r := mocks.NewResponse()
 	r.Request = mocks.NewRequest()
@@ -611,6 +1119,230 @@ func TestWithErrorUnlessOKEmitsErrorIfNotOK(t *testing.T) {
 	}
 }
 
+func TestByExtractingMetadata(t *testing.T) {
+	r := mocks.NewResponse()
+	mocks.SetResponseHeader(r, "x-ms-meta-Category", "images")
+	mocks.SetResponseHeader(r, "X-MS-META-OWNER", "me")
+	mocks.SetResponseHeader(r, "x-ms-request-id", "id")
+
+	var metadata map[string]string
+	err := Respond(r, ByExtractingMetadata(&metadata))
+	if err != nil {
+		t.Fatalf("autorest: ByExtractingMetadata failed with error (%v)", err)
+	}
+	expected := map[string]string{"category": "images", "owner": "me"}
+	if !reflect.DeepEqual(metadata, expected) {
+		t.Fatalf("autorest: ByExtractingMetadata returned %v, expected %v", metadata, expected)
+	}
+}
+
+func TestByParsingContentRangePartialResponse(t *testing.T) {
+	r := mocks.NewResponseWithStatus("206 Partial Content", http.StatusPartialContent)
+	mocks.SetResponseHeader(r, headerContentRange, "bytes 500-999/1234")
+
+	cr := ContentRange{}
+	err := Respond(r, ByParsingContentRange(&cr), ByClosing())
+	if err != nil {
+		t.Fatalf("autorest: ByParsingContentRange failed (%v)", err)
+	}
+	if cr.Start != 500 || cr.End != 999 || cr.Size != 1234 {
+		t.Fatalf("autorest: ByParsingContentRange parsed an incorrect range (%+v)", cr)
+	}
+}
+
+func TestByParsingContentRangeUnknownSize(t *testing.T) {
+	r := mocks.NewResponseWithStatus("206 Partial Content", http.StatusPartialContent)
+	mocks.SetResponseHeader(r, headerContentRange, "bytes 0-499/*")
+
+	cr := ContentRange{}
+	err := Respond(r, ByParsingContentRange(&cr), ByClosing())
+	if err != nil {
+		t.Fatalf("autorest: ByParsingContentRange failed (%v)", err)
+	}
+	if cr.Start != 0 || cr.End != 499 || cr.Size != -1 {
+		t.Fatalf("autorest: ByParsingContentRange parsed an incorrect range (%+v)", cr)
+	}
+}
+
+func TestByParsingContentRangeFullResponse(t *testing.T) {
+	r := mocks.NewResponseWithBodyAndStatus(mocks.NewBody("Hello Gopher"), http.StatusOK, "200 OK")
+
+	cr := ContentRange{}
+	err := Respond(r, ByParsingContentRange(&cr), ByClosing())
+	if err != nil {
+		t.Fatalf("autorest: ByParsingContentRange failed (%v)", err)
+	}
+	if cr.Start != 0 || cr.End != 11 || cr.Size != 12 {
+		t.Fatalf("autorest: ByParsingContentRange returned an incorrect range for a full response (%+v)", cr)
+	}
+}
+
+func TestByParsingContentRangeMissingHeader(t *testing.T) {
+	r := mocks.NewResponseWithStatus("206 Partial Content", http.StatusPartialContent)
+
+	cr := ContentRange{}
+	err := Respond(r, ByParsingContentRange(&cr), ByClosing())
+	if err == nil {
+		t.Fatal("autorest: ByParsingContentRange failed to return an error for a partial response without Content-Range")
+	}
+}
+
+func TestByParsingContentRangeMalformedHeader(t *testing.T) {
+	for _, v := range []string{"items 0-1/2", "bytes 0-499", "bytes a-b/10", "bytes 10-5/20", "bytes 0-20/10"} {
+		r := mocks.NewResponseWithStatus("206 Partial Content", http.StatusPartialContent)
+		mocks.SetResponseHeader(r, headerContentRange, v)
+
+		cr := ContentRange{}
+		if err := Respond(r, ByParsingContentRange(&cr), ByClosing()); err == nil {
+			t.Fatalf("autorest: ByParsingContentRange failed to return an error for %q", v)
+		}
+	}
+}
+
+// rangeServer serves ranges of content, truncating the body of the responses listed in truncate.
+type rangeServer struct {
+	content     string
+	truncate    map[int]bool
+	unknownSize bool
+	requests    []string
+}
+
+func (rs *rangeServer) download(ctx context.Context, start, end int64) (*http.Response, error) {
+	rs.requests = append(rs.requests, fmt.Sprintf("%d-%d", start, end))
+	size := int64(len(rs.content))
+	if rs.unknownSize && start >= size {
+		return mocks.NewResponseWithStatus("416 Requested Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable), nil
+	}
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+	body := rs.content[start : end+1]
+	if rs.truncate[len(rs.requests)] {
+		body = body[:len(body)/2]
+	}
+	resp := mocks.NewResponseWithContent(body)
+	resp.StatusCode = http.StatusPartialContent
+	if rs.unknownSize {
+		mocks.SetResponseHeader(resp, headerContentRange, fmt.Sprintf("bytes %d-%d/*", start, end))
+	} else {
+		mocks.SetResponseHeader(resp, headerContentRange, fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	return resp, nil
+}
+
+func TestDownloadRanges(t *testing.T) {
+	rs := &rangeServer{content: "0123456789abcdefghij"}
+	var b bytes.Buffer
+	n, err := DownloadRanges(context.Background(), &b, 8, 3, 0, rs.download)
+	if err != nil {
+		t.Fatalf("autorest: DownloadRanges returned an unexpected error (%v)", err)
+	}
+	if n != 20 || b.String() != rs.content {
+		t.Fatalf("autorest: DownloadRanges wrote %d bytes %q, expected %q", n, b.String(), rs.content)
+	}
+	if expected := "0-7,8-15,16-19"; strings.Join(rs.requests, ",") != expected {
+		t.Fatalf("autorest: DownloadRanges requested %v, expected %s", rs.requests, expected)
+	}
+}
+
+func TestDownloadRangesUnknownSizeExactMultipleOfChunkSize(t *testing.T) {
+	rs := &rangeServer{content: "0123456789abcdef", unknownSize: true}
+	var b bytes.Buffer
+	n, err := DownloadRanges(context.Background(), &b, 8, 3, 0, rs.download)
+	if err != nil {
+		t.Fatalf("autorest: DownloadRanges returned an unexpected error (%v)", err)
+	}
+	if n != 16 || b.String() != rs.content {
+		t.Fatalf("autorest: DownloadRanges wrote %d bytes %q, expected %q", n, b.String(), rs.content)
+	}
+	if expected := "0-7,8-15,16-23"; strings.Join(rs.requests, ",") != expected {
+		t.Fatalf("autorest: DownloadRanges requested %v, expected %s", rs.requests, expected)
+	}
+}
+
+func TestDownloadRangesResumesTruncatedRange(t *testing.T) {
+	rs := &rangeServer{content: "0123456789abcdefghij", truncate: map[int]bool{2: true}}
+	var b bytes.Buffer
+	_, err := DownloadRanges(context.Background(), &b, 8, 3, 0, rs.download)
+	if err != nil {
+		t.Fatalf("autorest: DownloadRanges returned an unexpected error (%v)", err)
+	}
+	if b.String() != rs.content {
+		t.Fatalf("autorest: DownloadRanges wrote %q, expected %q", b.String(), rs.content)
+	}
+	if expected := "0-7,8-15,12-19"; strings.Join(rs.requests, ",") != expected {
+		t.Fatalf("autorest: DownloadRanges requested %v, expected %s", rs.requests, expected)
+	}
+}
+
+func TestDownloadRangesRetriesFailedRange(t *testing.T) {
+	rs := &rangeServer{content: "0123456789"}
+	failed := false
+	download := func(ctx context.Context, start, end int64) (*http.Response, error) {
+		if start == 5 && !failed {
+			failed = true
+			return mocks.NewResponseWithStatus("503 Service Unavailable", http.StatusServiceUnavailable), nil
+		}
+		return rs.download(ctx, start, end)
+	}
+	var b bytes.Buffer
+	if _, err := DownloadRanges(context.Background(), &b, 5, 2, 0, download); err != nil {
+		t.Fatalf("autorest: DownloadRanges returned an unexpected error (%v)", err)
+	}
+	if b.String() != rs.content {
+		t.Fatalf("autorest: DownloadRanges wrote %q, expected %q", b.String(), rs.content)
+	}
+}
+
+func TestDownloadRangesFailsAfterAttempts(t *testing.T) {
+	attempts := 0
+	download := func(ctx context.Context, start, end int64) (*http.Response, error) {
+		attempts++
+		return nil, fmt.Errorf("connection reset")
+	}
+	var b bytes.Buffer
+	if _, err := DownloadRanges(context.Background(), &b, 5, 3, 0, download); err == nil {
+		t.Fatal("autorest: DownloadRanges did not return an error")
+	}
+	if attempts != 3 {
+		t.Fatalf("autorest: DownloadRanges made %d attempts, expected 3", attempts)
+	}
+}
+
+func TestDownloadRangesNilResponse(t *testing.T) {
+	download := func(ctx context.Context, start, end int64) (*http.Response, error) {
+		return nil, nil
+	}
+	var b bytes.Buffer
+	if _, err := DownloadRanges(context.Background(), &b, 5, 2, 0, download); err == nil {
+		t.Fatal("autorest: DownloadRanges did not return an error for a nil response")
+	}
+}
+
+func TestDownloadRangesRejectsUnexpectedRange(t *testing.T) {
+	rs := &rangeServer{content: "0123456789"}
+	download := func(ctx context.Context, start, end int64) (*http.Response, error) {
+		return rs.download(ctx, 0, end)
+	}
+	var b bytes.Buffer
+	if _, err := DownloadRanges(context.Background(), &b, 5, 1, 0, download); err == nil {
+		t.Fatal("autorest: DownloadRanges accepted a range that did not start at the first missing byte")
+	}
+}
+
+func TestDownloadRangesFullResponse(t *testing.T) {
+	download := func(ctx context.Context, start, end int64) (*http.Response, error) {
+		resp := mocks.NewResponseWithContent("complete")
+		resp.ContentLength = -1
+		return resp, nil
+	}
+	var b bytes.Buffer
+	n, err := DownloadRanges(context.Background(), &b, 0, 1, 0, download)
+	if err != nil || n != 8 || b.String() != "complete" {
+		t.Fatalf("autorest: DownloadRanges returned (%d, %v) and wrote %q, expected the complete resource", n, err, b.String())
+	}
+}
+
 func TestExtractHeader(t *testing.T) {
 	r := mocks.NewResponse()
 	v := []string{"v1", "v2", "v3"}
@@ -16,6 +16,7 @@ package autorest
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -50,3 +51,21 @@ func (rr *RetriableRequest) prepareFromByteReader() (err error) {
 	rr.req.Body = ioutil.NopCloser(rr.br)
 	return err
 }
+
+// bodyNotRewindableError is returned by RetriableRequest.Prepare when the request body cannot be
+// obtained again for another attempt.
+type bodyNotRewindableError struct {
+	err error
+}
+
+func (e bodyNotRewindableError) Error() string {
+	return fmt.Sprintf("autorest: the request body cannot be rewound for another attempt: %v", e.err)
+}
+
+// isBodyNotRewindable returns true if err, returned by RetriableRequest.Prepare, indicates the
+// request cannot be retried because its body cannot be sent again. Retrying decorators then return
+// the outcome of the last attempt.
+func isBodyNotRewindable(err error) bool {
+	_, ok := err.(bodyNotRewindableError)
+	return ok
+}
@@ -28,6 +28,9 @@ type RetriableRequest struct {
 	req *http.Request
 	rc  io.ReadCloser
 	br  *bytes.Reader
+
+	// rewindErr, if not nil, is the error from GetBody that prevents the body being sent again.
+	rewindErr error
 }
 
 // Prepare signals that the request is about to be sent.
@@ -35,6 +38,9 @@ func (rr *RetriableRequest) Prepare() (err error) {
 	// preserve the request body; this is to support retry logic as
 	// the underlying transport will always close the reqeust body
 	if rr.req.Body != nil {
+		if rr.rewindErr != nil {
+			return rr.rewindErr
+		}
 		if rr.rc != nil {
 			rr.req.Body = rr.rc
 		} else if rr.br != nil {
@@ -49,7 +55,10 @@ func (rr *RetriableRequest) Prepare() (err error) {
 			// make a copy.  note we need to do this on each iteration
 			rr.rc, err = rr.req.GetBody()
 			if err != nil {
-				return err
+				// the body for this attempt is intact, so send it but fail any further attempt
+				rr.rc = nil
+				rr.rewindErr = bodyNotRewindableError{err: err}
+				return nil
 			}
 		} else if rr.br == nil {
 			// fall back to making a copy (only do this once)
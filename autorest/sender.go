@@ -15,11 +15,22 @@ package autorest
 //  limitations under the License.
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
 	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/noahhai/go-autorest/tracing"
@@ -50,6 +61,76 @@ func CreateSender(decorators ...SendDecorator) Sender {
 	return DecorateSender(&http.Client{}, decorators...)
 }
 
+// SenderOption configures the http.Transport of a Sender created by NewSender.
+type SenderOption func(t *http.Transport)
+
+// NewSender returns, as a Sender, a new http.Client whose transport, configured as
+// http.DefaultTransport and then by the passed options, traces requests as the default Sender does.
+func NewSender(options ...SenderOption) Sender {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	for _, option := range options {
+		option(t)
+	}
+	traced := *tracing.Transport
+	traced.Base = t
+	return &http.Client{Transport: &traced}
+}
+
+// WithResolver returns a SenderOption that resolves host names using the passed net.Resolver
+// (e.g., one querying the DNS server of a private network) in place of the system resolver.
+func WithResolver(resolver *net.Resolver) SenderOption {
+	return func(t *http.Transport) {
+		t.DialContext = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Resolver:  resolver,
+		}).DialContext
+	}
+}
+
+// WithHostOverrides returns a SenderOption that connects to the address mapped to a host, rather
+// than to the address the host name resolves to, much like an entry in /etc/hosts. Addresses may
+// include a port, which replaces the port of the request. Requests keep the original host name,
+// so the Host header and TLS server name verification are unaffected. Other hosts are dialed as
+// before.
+func WithHostOverrides(overrides map[string]string) SenderOption {
+	addrs := make(map[string]string, len(overrides))
+	for host, addr := range overrides {
+		addrs[strings.ToLower(host)] = addr
+	}
+	return func(t *http.Transport) {
+		dial := t.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			if override, ok := addrs[strings.ToLower(host)]; ok {
+				if _, _, err := net.SplitHostPort(override); err == nil {
+					addr = override
+				} else {
+					addr = net.JoinHostPort(override, port)
+				}
+			}
+			return dial(ctx, network, addr)
+		}
+	}
+}
+
 // DecorateSender accepts a Sender and a, possibly empty, set of SendDecorators, which is applies to
 // the Sender. Decorators are applied in the order received, but their affect upon the request
 // depends on whether they are a pre-decorator (change the http.Request and then pass it along) or a
@@ -77,8 +158,12 @@ func Send(r *http.Request, decorators ...SendDecorator) (*http.Response, error)
 // http.Response and possible error. It also accepts a, possibly empty, set of SendDecorators which
 // it will apply the http.Client before invoking the Do method.
 //
-// SendWithSender will not poll or retry requests.
+// SendWithSender will not poll or retry requests. If the context of the request is already done
+// (see WithContext), its error is returned without sending the request.
 func SendWithSender(s Sender, r *http.Request, decorators ...SendDecorator) (*http.Response, error) {
+	if err := r.Context().Err(); err != nil {
+		return nil, err
+	}
 	return DecorateSender(s, decorators...).Do(r)
 }
 
@@ -191,15 +276,20 @@ func DoRetryForAttempts(attempts int, backoff time.Duration) SendDecorator {
 	return func(s Sender) Sender {
 		return SenderFunc(func(r *http.Request) (resp *http.Response, err error) {
 			rr := NewRetriableRequest(r)
+			phase := operationPhase(r.Context())
 			for attempt := 0; attempt < attempts; attempt++ {
-				err = rr.Prepare()
-				if err != nil {
-					return resp, err
+				if perr := rr.Prepare(); perr != nil {
+					if attempt > 0 && isBodyNotRewindable(perr) {
+						return resp, err
+					}
+					return resp, perr
 				}
+				setSendingPhase(r.Context(), phase)
 				resp, err = s.Do(rr.Request())
 				if err == nil {
 					return resp, err
 				}
+				setRetryingPhase(r.Context())
 				if !DelayForBackoff(backoff, attempt, r.Context().Done()) {
 					return nil, r.Context().Err()
 				}
@@ -212,30 +302,187 @@ func DoRetryForAttempts(attempts int, backoff time.Duration) SendDecorator {
 // DoRetryForStatusCodes returns a SendDecorator that retries for specified statusCodes for up to the specified
 // number of attempts, exponentially backing off between requests using the supplied backoff
 // time.Duration (which may be zero). Retrying may be canceled by closing the optional channel on
-// the http.Request.
+// the http.Request. Each attempt sends the complete request body, obtained from the request's
+// GetBody or, if it has none, from a copy made before the first attempt. If GetBody fails, the
+// request is not retried and the response to the last attempt is returned.
 func DoRetryForStatusCodes(attempts int, backoff time.Duration, codes ...int) SendDecorator {
+	return DoRetryForStatusCodesWithCallback(attempts, backoff, nil, codes...)
+}
+
+// RetryExhaustedFunc is invoked when a request is abandoned because all retry attempts have been
+// used. It receives the final response and error (either of which may be nil), the number of
+// attempts made, and the total time spent sending and retrying the request.
+type RetryExhaustedFunc func(resp *http.Response, err error, attempts int, elapsed time.Duration)
+
+// DoRetryForStatusCodesWithCallback returns a SendDecorator that behaves like DoRetryForStatusCodes
+// and, if the retry attempts are exhausted without success, invokes the passed RetryExhaustedFunc
+// (which may be nil). It is not invoked when the request succeeds, fails with a non-retriable
+// error or is canceled.
+func DoRetryForStatusCodesWithCallback(attempts int, backoff time.Duration, onExhausted RetryExhaustedFunc, codes ...int) SendDecorator {
+	return doRetryForStatusCodes(attempts, onExhausted, func(attempt int, cancel <-chan struct{}) bool {
+		return DelayForBackoff(backoff, attempt, cancel)
+	}, statusCodesPredicate(codes))
+}
+
+// DoRetryWithPredicate returns a SendDecorator that behaves like DoRetryForStatusCodes except that
+// a response is retried when the passed predicate returns true, rather than when it has one of a
+// set of status codes. This allows retrying responses whose status code alone does not indicate a
+// transient failure (e.g., a 409 (Conflict) carrying a retryable error code in its body). A
+// predicate that reads the response body must restore it, so the body remains available to the
+// final Responder (see azure.HasServiceErrorCode).
+func DoRetryWithPredicate(attempts int, backoff time.Duration, retry func(resp *http.Response) bool) SendDecorator {
+	return doRetryForStatusCodes(attempts, nil, func(attempt int, cancel <-chan struct{}) bool {
+		return DelayForBackoff(backoff, attempt, cancel)
+	}, retry)
+}
+
+// DoRetryForStatusCodesWithRetryAfter returns a SendDecorator that behaves like DoRetryForStatusCodes
+// except that, whenever a response with one of the passed status codes carries a Retry-After header,
+// the server-specified delay is waited instead of the backoff. The header may hold a number of
+// seconds or an HTTP-date (RFC 1123). DoRetryForStatusCodes honors the header on 429 (Too Many
+// Requests) and 503 (Service Unavailable) responses only.
+func DoRetryForStatusCodesWithRetryAfter(attempts int, backoff time.Duration, codes ...int) SendDecorator {
+	return doRetryWithRetryAfter(attempts, nil, func(attempt int, cancel <-chan struct{}) bool {
+		return DelayForBackoff(backoff, attempt, cancel)
+	}, statusCodesPredicate(codes), parseRetryAfter)
+}
+
+// statusCodesPredicate returns a predicate matching responses with one of the passed status codes.
+func statusCodesPredicate(codes []int) func(resp *http.Response) bool {
+	return func(resp *http.Response) bool {
+		return ResponseHasStatusCode(resp, codes...)
+	}
+}
+
+// DoRetryForStatusCodesWithJitter returns a SendDecorator that behaves like DoRetryForStatusCodes
+// except that the delay between attempts is chosen at random, using the passed rand.Source, from
+// between zero and the exponential backoff delay (see JitteredBackoff). Randomizing the delays
+// prevents clients that failed at the same time from retrying in lockstep. If src is nil a source
+// seeded with the current time is used; tests may pass a fixed source to make delays predictable.
+func DoRetryForStatusCodesWithJitter(attempts int, backoff time.Duration, src rand.Source, codes ...int) SendDecorator {
+	jitter := JitteredBackoff(src)
+	return doRetryForStatusCodes(attempts, nil, func(attempt int, cancel <-chan struct{}) bool {
+		return delayFor(jitter(backoff, attempt), cancel)
+	}, statusCodesPredicate(codes))
+}
+
+// DoExponentialBackoffRetry returns a SendDecorator that retries requests whose responses have one
+// of the passed status codes, or that fail with a temporary network error, for up to the specified
+// number of attempts. The delay between attempts starts at initialBackoff and doubles with each
+// attempt up to maxBackoff; each delay is then chosen at random between zero and that value ("full
+// jitter") so that clients failing together do not retry in lockstep. The request body is rewound
+// before each attempt, so POST and PUT requests resend their payload. A Retry-After header on 429
+// and 503 responses takes precedence over the backoff, as for DoRetryForStatusCodes.
+func DoExponentialBackoffRetry(attempts int, initialBackoff, maxBackoff time.Duration, codes ...int) SendDecorator {
+	return DoExponentialBackoffRetryWithSource(attempts, initialBackoff, maxBackoff, nil, codes...)
+}
+
+// DoExponentialBackoffRetryWithSource returns a SendDecorator that behaves like
+// DoExponentialBackoffRetry, drawing the random delays from src (see JitteredBackoff).
+func DoExponentialBackoffRetryWithSource(attempts int, initialBackoff, maxBackoff time.Duration, src rand.Source, codes ...int) SendDecorator {
+	jitter := jitteredBackoff(src, maxBackoff)
+	return doRetryForStatusCodes(attempts, nil, func(attempt int, cancel <-chan struct{}) bool {
+		return delayFor(jitter(initialBackoff, attempt), cancel)
+	}, statusCodesPredicate(codes))
+}
+
+// JitteredBackoff returns a function computing "full jitter" exponential backoff delays: a random
+// duration between zero and the passed backoff doubled attempt times. Unlike DelayForBackoff, the
+// delay is not truncated to whole seconds. Random values are drawn from src, or a source seeded with
+// the current time if src is nil. The returned function is safe for concurrent use.
+func JitteredBackoff(src rand.Source) func(backoff time.Duration, attempt int) time.Duration {
+	return jitteredBackoff(src, 0)
+}
+
+// jitteredBackoff returns a function computing delays as JitteredBackoff, with the backoff doubled
+// attempt times capped at max when max is positive.
+func jitteredBackoff(src rand.Source, max time.Duration) func(backoff time.Duration, attempt int) time.Duration {
+	if src == nil {
+		src = rand.NewSource(time.Now().UnixNano())
+	}
+	rnd := rand.New(src)
+	var mu sync.Mutex
+	return func(backoff time.Duration, attempt int) time.Duration {
+		d := float64(backoff) * math.Pow(2, float64(attempt))
+		if max > 0 && d > float64(max) {
+			d = float64(max)
+		}
+		var ceiling time.Duration
+		if d >= float64(math.MaxInt64) {
+			ceiling = time.Duration(math.MaxInt64)
+		} else {
+			ceiling = time.Duration(d)
+		}
+		if ceiling <= 0 {
+			return 0
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if ceiling == math.MaxInt64 {
+			return time.Duration(rnd.Int63())
+		}
+		return time.Duration(rnd.Int63n(int64(ceiling) + 1))
+	}
+}
+
+// setRetryingPhase records that the operation carried by ctx is waiting to retry a failed request,
+// unless ctx is already done, in which case the request failed while in its current phase.
+func setRetryingPhase(ctx context.Context) {
+	if ctx.Err() == nil {
+		SetOperationPhase(ctx, OperationPhaseRetrying)
+	}
+}
+
+// setSendingPhase restores the phase the operation carried by ctx was in before retrying began (see
+// OperationPhaseRetrying), as a request is about to be sent.
+func setSendingPhase(ctx context.Context, phase string) {
+	if phase != "" {
+		SetOperationPhase(ctx, phase)
+	}
+}
+
+func doRetryForStatusCodes(attempts int, onExhausted RetryExhaustedFunc, delay func(attempt int, cancel <-chan struct{}) bool, retry func(resp *http.Response) bool) SendDecorator {
+	return doRetryWithRetryAfter(attempts, onExhausted, delay, retry, retryAfterDelay)
+}
+
+// doRetryWithRetryAfter retries as described by DoRetryForStatusCodes, waiting for the delay returned
+// by retryAfter, when positive, in place of the delay chosen by the passed delay function.
+func doRetryWithRetryAfter(attempts int, onExhausted RetryExhaustedFunc, delay func(attempt int, cancel <-chan struct{}) bool, retry func(resp *http.Response) bool, retryAfter func(resp *http.Response) time.Duration) SendDecorator {
 	return func(s Sender) Sender {
 		return SenderFunc(func(r *http.Request) (resp *http.Response, err error) {
 			rr := NewRetriableRequest(r)
+			phase := operationPhase(r.Context())
+			start := time.Now()
+			sent := 0
 			// Increment to add the first call (attempts denotes number of retries)
 			attempts++
 			for attempt := 0; attempt < attempts; {
-				err = rr.Prepare()
-				if err != nil {
-					return resp, err
+				if perr := rr.Prepare(); perr != nil {
+					// a body that cannot be sent again ends retrying with the last outcome
+					if sent > 0 && isBodyNotRewindable(perr) {
+						return resp, err
+					}
+					return resp, perr
 				}
+				setSendingPhase(r.Context(), phase)
 				resp, err = s.Do(rr.Request())
+				sent++
 				// if the error isn't temporary don't bother retrying
 				if err != nil && !IsTemporaryNetworkError(err) {
 					return nil, err
 				}
 				// we want to retry if err is not nil (e.g. transient network failure).  note that for failed authentication
 				// resp and err will both have a value, so in this case we don't want to retry as it will never succeed.
-				if err == nil && !ResponseHasStatusCode(resp, codes...) || IsTokenRefreshError(err) {
+				if err == nil && !retry(resp) || IsTokenRefreshError(err) {
 					return resp, err
 				}
-				delayed := DelayWithRetryAfter(resp, r.Context().Done())
-				if !delayed && !DelayForBackoff(backoff, attempt, r.Context().Done()) {
+				setRetryingPhase(r.Context())
+				d := retryAfter(resp)
+				delayed := d > 0 && delayFor(d, r.Context().Done())
+				if delayed {
+					notifyThrottled(r, resp, d)
+				}
+				if !delayed && !delay(attempt, r.Context().Done()) {
 					return resp, r.Context().Err()
 				}
 				// don't count a 429 against the number of attempts
@@ -244,27 +491,119 @@ func DoRetryForStatusCodes(attempts int, backoff time.Duration, codes ...int) Se
 					attempt++
 				}
 			}
+			if onExhausted != nil {
+				onExhausted(resp, err, sent, time.Since(start))
+			}
 			return resp, err
 		})
 	}
 }
 
 // DelayWithRetryAfter invokes time.After for the duration specified in the "Retry-After" header in
-// responses with status code 429
+// responses with status code 429 (Too Many Requests) or 503 (Service Unavailable)
 func DelayWithRetryAfter(resp *http.Response, cancel <-chan struct{}) bool {
-	if resp == nil {
+	d := retryAfterDelay(resp)
+	if d <= 0 {
 		return false
 	}
-	retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
-	if resp.StatusCode == http.StatusTooManyRequests && retryAfter > 0 {
-		select {
-		case <-time.After(time.Duration(retryAfter) * time.Second):
-			return true
-		case <-cancel:
-			return false
+	select {
+	case <-time.After(d):
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// retryAfterDelay returns the delay commanded by the Retry-After header of a throttled response (429
+// or 503), or zero if the response is not throttled or has no valid Retry-After header.
+func retryAfterDelay(resp *http.Response) time.Duration {
+	if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return 0
+	}
+	return parseRetryAfter(resp)
+}
+
+// parseRetryAfter returns the delay specified by the Retry-After header of the response, either as
+// a number of seconds or as an HTTP-date, or zero if the header is absent, malformed or in the past.
+func parseRetryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0
+	}
+	if retryAfter, err := strconv.Atoi(v); err == nil {
+		if retryAfter <= 0 {
+			return 0
 		}
+		return time.Duration(retryAfter) * time.Second
 	}
-	return false
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// ThrottlingEvent describes a request the service throttled with a Retry-After header.
+type ThrottlingEvent struct {
+	// Host is the host that throttled the request.
+	Host string
+
+	// StatusCode is the status code of the throttled response (429 or 503).
+	StatusCode int
+
+	// Delay is the delay, commanded by the Retry-After header, honored before retrying.
+	Delay time.Duration
+
+	// RateLimitHeaders holds the rate limit headers of the throttled response (e.g.,
+	// x-ms-ratelimit-remaining-subscription-reads).
+	RateLimitHeaders http.Header
+}
+
+// ThrottlingCallback is invoked whenever a request is retried after the delay commanded by the
+// Retry-After header of a throttled response (see Client.ThrottlingCallback).
+type ThrottlingCallback func(e ThrottlingEvent)
+
+// throttlingCallbackKey is the context key under which the ThrottlingCallback is stored.
+type throttlingCallbackKey struct{}
+
+// WithThrottlingCallback returns a copy of ctx carrying the passed ThrottlingCallback, which the
+// retry decorators (e.g., DoRetryForStatusCodes) invoke for requests sent with the returned context.
+func WithThrottlingCallback(ctx context.Context, f ThrottlingCallback) context.Context {
+	return context.WithValue(ctx, throttlingCallbackKey{}, f)
+}
+
+// notifyThrottled invokes the ThrottlingCallback carried by the request, preferring the request as
+// sent (which carries the callback of the Client that sent it), for the throttled response resp
+// whose Retry-After delay d was honored.
+func notifyThrottled(r *http.Request, resp *http.Response, d time.Duration) {
+	f, _ := r.Context().Value(throttlingCallbackKey{}).(ThrottlingCallback)
+	if resp.Request != nil {
+		if sent, ok := resp.Request.Context().Value(throttlingCallbackKey{}).(ThrottlingCallback); ok {
+			f = sent
+		}
+	}
+	if f == nil {
+		return
+	}
+	e := ThrottlingEvent{
+		StatusCode:       resp.StatusCode,
+		Delay:            d,
+		RateLimitHeaders: http.Header{},
+	}
+	if r.URL != nil {
+		e.Host = r.URL.Host
+	}
+	for name, v := range resp.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-ms-ratelimit-") || strings.HasPrefix(lower, "ratelimit") {
+			e.RateLimitHeaders[name] = v
+		}
+	}
+	f(e)
 }
 
 // DoRetryForDuration returns a SendDecorator that retries the request until the total time is equal
@@ -275,16 +614,21 @@ func DoRetryForDuration(d time.Duration, backoff time.Duration) SendDecorator {
 	return func(s Sender) Sender {
 		return SenderFunc(func(r *http.Request) (resp *http.Response, err error) {
 			rr := NewRetriableRequest(r)
+			phase := operationPhase(r.Context())
 			end := time.Now().Add(d)
 			for attempt := 0; time.Now().Before(end); attempt++ {
-				err = rr.Prepare()
-				if err != nil {
-					return resp, err
+				if perr := rr.Prepare(); perr != nil {
+					if attempt > 0 && isBodyNotRewindable(perr) {
+						return resp, err
+					}
+					return resp, perr
 				}
+				setSendingPhase(r.Context(), phase)
 				resp, err = s.Do(rr.Request())
 				if err == nil {
 					return resp, err
 				}
+				setRetryingPhase(r.Context())
 				if !DelayForBackoff(backoff, attempt, r.Context().Done()) {
 					return nil, r.Context().Err()
 				}
@@ -311,6 +655,371 @@ func WithLogging(logger *log.Logger) SendDecorator {
 	}
 }
 
+// Span is the subset of a tracing span used by WithTracing. Implementations typically adapt a
+// span from a tracing library such as OpenTelemetry.
+type Span interface {
+	// SetAttribute records the key/value pair on the span.
+	SetAttribute(key string, value interface{})
+
+	// End completes the span, recording err if it is not nil.
+	End(err error)
+}
+
+// Tracer starts spans and propagates their context to outgoing requests. It allows WithTracing to
+// emit spans without tying this package to a particular tracing library.
+type Tracer interface {
+	// Start creates a span, as a child of any span carried by ctx, and returns a context holding it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+
+	// Inject writes the trace context held by ctx into the passed headers (e.g., traceparent).
+	Inject(ctx context.Context, header http.Header)
+}
+
+// RequestTimings holds the durations of the phases of sending a request, as measured by
+// WithRequestTimings. Phases that did not occur (e.g., DNS lookup and connecting when an idle
+// connection was reused) have zero durations.
+type RequestTimings struct {
+	// DNSLookup is the time spent resolving the host name.
+	DNSLookup time.Duration
+
+	// Connect is the time spent establishing the TCP connection.
+	Connect time.Duration
+
+	// TLSHandshake is the time spent on the TLS handshake.
+	TLSHandshake time.Duration
+
+	// TimeToFirstByte is the time from sending the request until the first byte of the response
+	// was received.
+	TimeToFirstByte time.Duration
+
+	// Total is the time from sending the request until the response headers were received.
+	Total time.Duration
+
+	// ConnReused is true if the request was sent over a previously used connection.
+	ConnReused bool
+}
+
+// WithRequestTimings returns a SendDecorator that measures, using net/http/httptrace, the DNS
+// lookup, connect, TLS handshake and time-to-first-byte durations of each request and passes them,
+// once the response headers have been received (or sending failed), to the supplied callback. This
+// helps distinguish network latency from server processing time.
+func WithRequestTimings(callback func(r *http.Request, timings RequestTimings)) SendDecorator {
+	return func(s Sender) Sender {
+		return SenderFunc(func(r *http.Request) (*http.Response, error) {
+			var mu sync.Mutex
+			var timings RequestTimings
+			var dnsStart, connectStart, tlsStart time.Time
+			elapsed := func(start time.Time) time.Duration {
+				if start.IsZero() {
+					return 0
+				}
+				return time.Since(start)
+			}
+			trace := &httptrace.ClientTrace{
+				DNSStart: func(httptrace.DNSStartInfo) {
+					mu.Lock()
+					dnsStart = time.Now()
+					mu.Unlock()
+				},
+				DNSDone: func(httptrace.DNSDoneInfo) {
+					mu.Lock()
+					timings.DNSLookup = elapsed(dnsStart)
+					mu.Unlock()
+				},
+				ConnectStart: func(network, addr string) {
+					mu.Lock()
+					if connectStart.IsZero() {
+						connectStart = time.Now()
+					}
+					mu.Unlock()
+				},
+				ConnectDone: func(network, addr string, err error) {
+					mu.Lock()
+					if err == nil && timings.Connect == 0 {
+						timings.Connect = elapsed(connectStart)
+					}
+					mu.Unlock()
+				},
+				TLSHandshakeStart: func() {
+					mu.Lock()
+					tlsStart = time.Now()
+					mu.Unlock()
+				},
+				TLSHandshakeDone: func(tls.ConnectionState, error) {
+					mu.Lock()
+					timings.TLSHandshake = elapsed(tlsStart)
+					mu.Unlock()
+				},
+				GotConn: func(info httptrace.GotConnInfo) {
+					mu.Lock()
+					timings.ConnReused = info.Reused
+					mu.Unlock()
+				},
+			}
+			start := time.Now()
+			trace.GotFirstResponseByte = func() {
+				mu.Lock()
+				timings.TimeToFirstByte = time.Since(start)
+				mu.Unlock()
+			}
+			resp, err := s.Do(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+			mu.Lock()
+			timings.Total = time.Since(start)
+			result := timings
+			mu.Unlock()
+			callback(r, result)
+			return resp, err
+		})
+	}
+}
+
+// redactedHeaders are the headers whose values WithLoggingRedacted always redacts.
+var redactedHeaders = []string{"Authorization", "Ocp-Apim-Subscription-Key"}
+
+// WithLoggingRedacted returns a SendDecorator that behaves like WithLogging and additionally logs the
+// request headers. The values of sensitive headers, Authorization, Ocp-Apim-Subscription-Key and
+// those named by redactHeaders (matched case-insensitively), are logged as "****"; the request
+// itself is not modified.
+func WithLoggingRedacted(logger *log.Logger, redactHeaders ...string) SendDecorator {
+	redact := map[string]bool{}
+	for _, h := range append(append([]string(nil), redactedHeaders...), redactHeaders...) {
+		redact[http.CanonicalHeaderKey(h)] = true
+	}
+	return func(s Sender) Sender {
+		return SenderFunc(func(r *http.Request) (*http.Response, error) {
+			logger.Printf("Sending %s %s%s", r.Method, r.URL, formatHeaders(r.Header, redact))
+			resp, err := s.Do(r)
+			if err != nil {
+				logger.Printf("%s %s received error '%v'", r.Method, r.URL, err)
+			} else {
+				logger.Printf("%s %s received %s", r.Method, r.URL, resp.Status)
+			}
+			return resp, err
+		})
+	}
+}
+
+// formatHeaders returns the passed headers as indented "Name: value" lines in lexicographic order,
+// replacing the values of the headers in redact with "****".
+func formatHeaders(h http.Header, redact map[string]bool) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _, name := range names {
+		v := strings.Join(h[name], ", ")
+		if redact[http.CanonicalHeaderKey(name)] {
+			v = "****"
+		}
+		fmt.Fprintf(&b, "\n  %s: %s", name, v)
+	}
+	return b.String()
+}
+
+// WithTracing returns a SendDecorator that wraps each request in a span started from the passed
+// Tracer. The span records the HTTP method, URL, status code and, when present, the
+// x-ms-request-id returned by the service. The trace context is propagated to the service via the
+// request headers. When placed ahead of a retrying decorator (e.g., DoRetryForStatusCodes), each
+// attempt is recorded as a separate child span of the span carried by the request context.
+func WithTracing(t Tracer) SendDecorator {
+	return func(s Sender) Sender {
+		return SenderFunc(func(r *http.Request) (*http.Response, error) {
+			ctx, span := t.Start(r.Context(), fmt.Sprintf("HTTP %s", r.Method))
+			span.SetAttribute("http.method", r.Method)
+			span.SetAttribute("http.url", r.URL.String())
+			r = r.WithContext(ctx)
+			if r.Header == nil {
+				r.Header = make(http.Header)
+			}
+			t.Inject(ctx, r.Header)
+			resp, err := s.Do(r)
+			if resp != nil {
+				span.SetAttribute("http.status_code", resp.StatusCode)
+				if id := resp.Header.Get(headerRequestID); id != "" {
+					span.SetAttribute(headerRequestID, id)
+				}
+			}
+			span.End(err)
+			return resp, err
+		})
+	}
+}
+
+// WithEndpointFailover returns a SendDecorator that sends the request to each of the passed
+// endpoints (e.g., "https://eastus.management.azure.com") in turn, replacing the scheme and host of
+// the request URL, until one of them returns a response. Only failures to obtain a response, such
+// as connection failures, cause the next endpoint to be tried; HTTP error responses are returned
+// as is. If every endpoint fails, the returned error describes each failure. The request is left
+// addressed to the last endpoint tried.
+func WithEndpointFailover(endpoints ...string) SendDecorator {
+	return func(s Sender) Sender {
+		return SenderFunc(func(r *http.Request) (resp *http.Response, err error) {
+			if len(endpoints) == 0 {
+				return s.Do(r)
+			}
+			rr := NewRetriableRequest(r)
+			failures := make([]string, 0, len(endpoints))
+			for _, endpoint := range endpoints {
+				u, perr := url.Parse(endpoint)
+				if perr != nil || u.Scheme == "" || u.Host == "" {
+					return nil, NewError("autorest", "WithEndpointFailover", "invalid endpoint %q", endpoint)
+				}
+				err = rr.Prepare()
+				if err != nil {
+					return resp, err
+				}
+				req := rr.Request()
+				target := *req.URL
+				target.Scheme = u.Scheme
+				target.Host = u.Host
+				req.URL = &target
+				req.Host = ""
+				resp, err = s.Do(req)
+				if err == nil {
+					return resp, nil
+				}
+				if r.Context().Err() != nil {
+					return resp, err
+				}
+				failures = append(failures, fmt.Sprintf("%s: %v", u.Host, err))
+			}
+			return resp, NewErrorWithError(err, "autorest", "WithEndpointFailover", resp,
+				"all endpoints failed: %s", strings.Join(failures, "; "))
+		})
+	}
+}
+
+// WithHedging returns a SendDecorator that hedges slow idempotent requests. If a GET, HEAD or
+// OPTIONS request without a body (or with http.NoBody) has not completed within the passed delay, an identical request
+// is sent and the response of whichever request completes successfully first is returned. The
+// other request is canceled and its response body, if any, drained and closed. Other requests are
+// sent as is.
+func WithHedging(delay time.Duration) SendDecorator {
+	return func(s Sender) Sender {
+		return SenderFunc(func(r *http.Request) (*http.Response, error) {
+			if !isIdempotentMethod(r.Method) || hasBody(r) {
+				return s.Do(r)
+			}
+			type result struct {
+				resp  *http.Response
+				err   error
+				index int
+			}
+			results := make(chan result, 2)
+			var cancels []context.CancelFunc
+			send := func() {
+				ctx, cancel := context.WithCancel(r.Context())
+				index := len(cancels)
+				cancels = append(cancels, cancel)
+				req := r.WithContext(ctx)
+				req.Header = make(http.Header, len(r.Header))
+				for k, v := range r.Header {
+					req.Header[k] = append([]string(nil), v...)
+				}
+				go func() {
+					resp, err := s.Do(req)
+					results <- result{resp: resp, err: err, index: index}
+				}()
+			}
+
+			send()
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			var res result
+			for received := 0; ; {
+				select {
+				case <-timer.C:
+					send()
+					continue
+				case res = <-results:
+					received++
+				}
+				if res.err != nil && received < len(cancels) {
+					// the other request may yet succeed
+					continue
+				}
+				// cancel the outstanding request, draining its response once it completes
+				for i := received; i < len(cancels); i++ {
+					go func() {
+						loser := <-results
+						if loser.resp != nil && loser.resp.Body != nil {
+							Respond(loser.resp, ByDiscardingBody(), ByClosing())
+						}
+					}()
+				}
+				for i, cancel := range cancels {
+					if i != res.index {
+						cancel()
+					}
+				}
+				break
+			}
+			// release the winning request's context once its body has been consumed
+			if res.resp != nil && res.resp.Body != nil {
+				res.resp.Body = cancelOnClose{ReadCloser: res.resp.Body, cancel: cancels[res.index]}
+			} else {
+				cancels[res.index]()
+			}
+			return res.resp, res.err
+		})
+	}
+}
+
+// cancelOnClose is an io.ReadCloser that invokes cancel once closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// WaitForEndpoint sends GET requests for the passed endpoint through the passed Sender, waiting
+// interval between attempts, until a response is received or ctx is done. Any response, whatever
+// its status code, indicates the endpoint's host has resolved and is accepting requests. It is
+// intended for endpoints that were just provisioned and may not yet be reachable (e.g., while DNS
+// records propagate). If ctx is done first, the error returned includes the last failure.
+func WaitForEndpoint(ctx context.Context, s Sender, endpoint string, interval time.Duration) error {
+	for {
+		req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+		if err != nil {
+			return NewErrorWithError(err, "autorest", "WaitForEndpoint", nil, "Failure creating request for %s", endpoint)
+		}
+		resp, err := s.Do(req.WithContext(ctx))
+		if err == nil {
+			Respond(resp, ByDiscardingBody(), ByClosing())
+			return nil
+		}
+		if !delayFor(interval, ctx.Done()) {
+			return NewErrorWithError(err, "autorest", "WaitForEndpoint", nil, "Endpoint %s was not ready: %v", endpoint, ctx.Err())
+		}
+	}
+}
+
+// delayFor waits for the passed duration or until the passed channel is closed, returning false if
+// the wait was canceled.
+func delayFor(d time.Duration, cancel <-chan struct{}) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
 // DelayForBackoff invokes time.After for the supplied backoff duration raised to the power of
 // passed attempt (i.e., an exponential backoff delay). Backoff duration is in seconds and can set
 // to zero for no delay. The delay may be canceled by closing the passed channel. If terminated early,
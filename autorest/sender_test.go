@@ -18,10 +18,17 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -710,6 +717,34 @@ func TestWithLogging_HandlesMissingResponse(t *testing.T) {
 		ByClosing())
 }
 
+func TestWithLoggingRedacted(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := log.New(buf, "autorest: ", 0)
+	client := mocks.NewSender()
+
+	r := mocks.NewRequest()
+	r.Header.Set("Authorization", "Bearer secret-token")
+	r.Header.Set("Ocp-Apim-Subscription-Key", "secret-key")
+	r.Header.Set("X-Custom-Secret", "secret-custom")
+	r.Header.Set("X-Visible", "visible")
+	resp, _ := SendWithSender(client, r, WithLoggingRedacted(logger, "x-custom-secret"))
+
+	out := buf.String()
+	if strings.Contains(out, "secret") {
+		t.Fatalf("autorest: WithLoggingRedacted logged a sensitive header:\n%s", out)
+	}
+	if !strings.Contains(out, "Authorization: ****") || !strings.Contains(out, "X-Visible: visible") {
+		t.Fatalf("autorest: WithLoggingRedacted did not log the headers:\n%s", out)
+	}
+	if r.Header.Get("Authorization") != "Bearer secret-token" {
+		t.Fatal("autorest: WithLoggingRedacted modified the request")
+	}
+
+	Respond(resp,
+		ByDiscardingBody(),
+		ByClosing())
+}
+
 func TestDoRetryForStatusCodesWithSuccess(t *testing.T) {
 	client := mocks.NewSender()
 	client.AppendAndRepeatResponse(mocks.NewResponseWithStatus("408 Request Timeout", http.StatusRequestTimeout), 2)
@@ -746,6 +781,119 @@ func TestDoRetryForStatusCodesWithNoSuccess(t *testing.T) {
 	}
 }
 
+func TestDoRetryForStatusCodesWithCallbackInvokedOnExhaustion(t *testing.T) {
+	client := mocks.NewSender()
+	client.AppendAndRepeatResponse(mocks.NewResponseWithStatus("504 Gateway Timeout", http.StatusGatewayTimeout), 5)
+
+	called := 0
+	var attempts int
+	var status int
+	r, _ := SendWithSender(client, mocks.NewRequest(),
+		DoRetryForStatusCodesWithCallback(2, time.Millisecond, func(resp *http.Response, err error, a int, elapsed time.Duration) {
+			called++
+			attempts = a
+			status = resp.StatusCode
+		}, http.StatusGatewayTimeout),
+	)
+	Respond(r,
+		ByDiscardingBody(),
+		ByClosing())
+
+	if called != 1 {
+		t.Fatalf("autorest: Sender#DoRetryForStatusCodesWithCallback invoked the callback %v times; Want: 1", called)
+	}
+	if attempts != 3 || status != http.StatusGatewayTimeout {
+		t.Fatalf("autorest: Sender#DoRetryForStatusCodesWithCallback -- Got: %v attempts with StatusCode %v; Want: 3 attempts with StatusCode 504",
+			attempts, status)
+	}
+}
+
+func TestDoRetryForStatusCodesWithCallbackNotInvokedOnSuccess(t *testing.T) {
+	client := mocks.NewSender()
+	client.AppendResponse(mocks.NewResponseWithStatus("504 Gateway Timeout", http.StatusGatewayTimeout))
+	client.AppendResponse(mocks.NewResponseWithStatus("200 OK", http.StatusOK))
+
+	r, _ := SendWithSender(client, mocks.NewRequest(),
+		DoRetryForStatusCodesWithCallback(2, time.Millisecond, func(resp *http.Response, err error, a int, elapsed time.Duration) {
+			t.Fatal("autorest: Sender#DoRetryForStatusCodesWithCallback invoked the callback for a successful request")
+		}, http.StatusGatewayTimeout),
+	)
+	Respond(r,
+		ByDiscardingBody(),
+		ByClosing())
+}
+
+func TestJitteredBackoffIsDeterministicWithSource(t *testing.T) {
+	jitter := JitteredBackoff(rand.NewSource(42))
+	rnd := rand.New(rand.NewSource(42))
+	backoff := 2 * time.Second
+	for attempt := 0; attempt < 5; attempt++ {
+		max := int64(backoff) << uint(attempt)
+		expected := time.Duration(rnd.Int63n(max + 1))
+		if d := jitter(backoff, attempt); d != expected {
+			t.Fatalf("autorest: JitteredBackoff returned %v for attempt %d, expected %v", d, attempt, expected)
+		}
+	}
+}
+
+func TestJitteredBackoffSubSecondBackoff(t *testing.T) {
+	jitter := JitteredBackoff(rand.NewSource(42))
+	backoff := 500 * time.Millisecond
+	nonzero := false
+	for i := 0; i < 10; i++ {
+		d := jitter(backoff, 0)
+		if d < 0 || d > backoff {
+			t.Fatalf("autorest: JitteredBackoff returned %v, expected a delay within [0, %v]", d, backoff)
+		}
+		nonzero = nonzero || d > 0
+	}
+	if !nonzero {
+		t.Fatal("autorest: JitteredBackoff truncated a sub-second backoff to zero")
+	}
+}
+
+func TestJitteredBackoffLargeAttempt(t *testing.T) {
+	jitter := JitteredBackoff(rand.NewSource(42))
+	for _, attempt := range []int{62, 63, 100, 1000} {
+		if d := jitter(time.Second, attempt); d <= 0 {
+			t.Fatalf("autorest: JitteredBackoff returned %v for attempt %d, expected a positive delay", d, attempt)
+		}
+	}
+	capped := jitteredBackoff(rand.NewSource(42), time.Hour)
+	for _, attempt := range []int{62, 63, 100, 1000} {
+		if d := capped(time.Second, attempt); d <= 0 || d > time.Hour {
+			t.Fatalf("autorest: jitteredBackoff returned %v for attempt %d, expected a delay within (0, %v]", d, attempt, time.Hour)
+		}
+	}
+}
+
+func TestJitteredBackoffZeroBackoff(t *testing.T) {
+	if d := JitteredBackoff(nil)(0, 3); d != 0 {
+		t.Fatalf("autorest: JitteredBackoff returned %v for a zero backoff", d)
+	}
+}
+
+func TestDoRetryForStatusCodesWithJitter(t *testing.T) {
+	client := mocks.NewSender()
+	client.AppendAndRepeatResponse(mocks.NewResponseWithStatus("503 Service Unavailable", http.StatusServiceUnavailable), 2)
+	client.AppendResponse(mocks.NewResponseWithStatus("200 OK", http.StatusOK))
+
+	r, err := SendWithSender(client, mocks.NewRequest(),
+		DoRetryForStatusCodesWithJitter(5, 0, rand.NewSource(42), http.StatusServiceUnavailable),
+	)
+	if err != nil {
+		t.Fatalf("autorest: DoRetryForStatusCodesWithJitter returned an error (%v)", err)
+	}
+	Respond(r,
+		ByDiscardingBody(),
+		ByClosing())
+
+	if client.Attempts() != 3 || r.StatusCode != http.StatusOK {
+		t.Fatalf("autorest: DoRetryForStatusCodesWithJitter -- Got: StatusCode %v in %v attempts; Want: StatusCode 200 in 3 attempts",
+			r.StatusCode, client.Attempts())
+	}
+}
+
 func TestDoRetryForStatusCodes_CodeNotInRetryList(t *testing.T) {
 	client := mocks.NewSender()
 	client.AppendAndRepeatResponse(mocks.NewResponseWithStatus("204 No Content", http.StatusNoContent), 1)
@@ -781,6 +929,77 @@ func TestDoRetryForStatusCodes_RequestBodyReadError(t *testing.T) {
 	}
 }
 
+func TestDoRetryForStatusCodesResendsBody(t *testing.T) {
+	const content = `{"name":"Rob Pike","age":42}`
+	newBody := func() io.ReadCloser { return ioutil.NopCloser(strings.NewReader(content)) }
+	cases := map[string]func() *http.Request{
+		"buffered": func() *http.Request {
+			r, _ := Prepare(mocks.NewRequestWithParams(http.MethodPost, mocks.TestURL, nil), WithString(content))
+			return r
+		},
+		"streamed": func() *http.Request {
+			return mocks.NewRequestWithParams(http.MethodPost, mocks.TestURL, newBody())
+		},
+		"replayable": func() *http.Request {
+			r, _ := Prepare(mocks.NewRequestWithParams(http.MethodPost, mocks.TestURL, nil),
+				WithReplayableBody(func() (io.ReadCloser, error) { return newBody(), nil }))
+			return r
+		},
+	}
+	for name, newRequest := range cases {
+		var bodies []string
+		s := SenderFunc(func(r *http.Request) (*http.Response, error) {
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return nil, err
+			}
+			r.Body.Close()
+			bodies = append(bodies, string(b))
+			if len(bodies) < 3 {
+				return mocks.NewResponseWithStatus("500 Internal Server Error", http.StatusInternalServerError), nil
+			}
+			return mocks.NewResponse(), nil
+		})
+		resp, err := SendWithSender(s, newRequest(), DoRetryForStatusCodes(5, 0, http.StatusInternalServerError))
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("autorest: DoRetryForStatusCodes (%s) returned %v, %v", name, resp, err)
+		}
+		if len(bodies) != 3 {
+			t.Fatalf("autorest: DoRetryForStatusCodes (%s) made %d attempts, expected 3", name, len(bodies))
+		}
+		for i, b := range bodies {
+			if b != content {
+				t.Fatalf("autorest: DoRetryForStatusCodes (%s) sent body %q in attempt %d, expected %q", name, b, i+1, content)
+			}
+		}
+	}
+}
+
+func TestDoRetryForStatusCodesDoesNotRetryUnrewindableBody(t *testing.T) {
+	client := mocks.NewSender()
+	client.AppendAndRepeatResponse(mocks.NewResponseWithStatus("500 Internal Server Error", http.StatusInternalServerError), 3)
+
+	calls := 0
+	r, _ := Prepare(mocks.NewRequestWithParams(http.MethodPost, mocks.TestURL, nil),
+		WithReplayableBody(func() (io.ReadCloser, error) {
+			calls++
+			if calls > 1 {
+				return nil, fmt.Errorf("body consumed")
+			}
+			return ioutil.NopCloser(strings.NewReader("content")), nil
+		}))
+	resp, err := SendWithSender(client, r, DoRetryForStatusCodes(3, 0, http.StatusInternalServerError))
+	if err != nil {
+		t.Fatalf("autorest: DoRetryForStatusCodes returned an error (%v)", err)
+	}
+	if resp == nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("autorest: DoRetryForStatusCodes returned %v, expected the original response", resp)
+	}
+	if client.Attempts() != 1 {
+		t.Fatalf("autorest: DoRetryForStatusCodes made %d attempts, expected 1", client.Attempts())
+	}
+}
+
 func newAcceptedResponse() *http.Response {
 	resp := mocks.NewResponseWithStatus("202 Accepted", http.StatusAccepted)
 	mocks.SetAcceptedHeaders(resp)
@@ -817,6 +1036,128 @@ func TestDelayWithRetryAfterWithSuccess(t *testing.T) {
 	}
 }
 
+func TestDoRetryForStatusCodesWithRetryAfterSeconds(t *testing.T) {
+	client := mocks.NewSender()
+	resp := mocks.NewResponseWithStatus("500 Internal Server Error", http.StatusInternalServerError)
+	mocks.SetResponseHeader(resp, "Retry-After", "1")
+	client.AppendResponse(resp)
+	client.AppendResponse(mocks.NewResponse())
+
+	start := time.Now()
+	r, err := SendWithSender(client, mocks.NewRequest(),
+		DoRetryForStatusCodesWithRetryAfter(1, 0, http.StatusInternalServerError))
+	if err != nil || r.StatusCode != http.StatusOK {
+		t.Fatalf("autorest: DoRetryForStatusCodesWithRetryAfter returned (%v, %v), expected 200 OK", r.Status, err)
+	}
+	if time.Since(start) < time.Second {
+		t.Fatal("autorest: DoRetryForStatusCodesWithRetryAfter did not wait for the Retry-After delay")
+	}
+}
+
+func TestDoRetryForStatusCodesWithRetryAfterDate(t *testing.T) {
+	client := mocks.NewSender()
+	resp := mocks.NewResponseWithStatus("503 Service Unavailable", http.StatusServiceUnavailable)
+	mocks.SetResponseHeader(resp, "Retry-After", time.Now().Add(2*time.Second).UTC().Format(http.TimeFormat))
+	client.AppendResponse(resp)
+	client.AppendResponse(mocks.NewResponse())
+
+	start := time.Now()
+	r, err := SendWithSender(client, mocks.NewRequest(),
+		DoRetryForStatusCodesWithRetryAfter(1, 0, http.StatusServiceUnavailable))
+	if err != nil || r.StatusCode != http.StatusOK {
+		t.Fatalf("autorest: DoRetryForStatusCodesWithRetryAfter returned (%v, %v), expected 200 OK", r.Status, err)
+	}
+	// HTTP-dates have a resolution of one second
+	if time.Since(start) < time.Second {
+		t.Fatal("autorest: DoRetryForStatusCodesWithRetryAfter did not wait until the Retry-After date")
+	}
+}
+
+func TestDoRetryForStatusCodesWithRetryAfterFallsBackToBackoff(t *testing.T) {
+	client := mocks.NewSender()
+	client.AppendResponse(mocks.NewResponseWithStatus("500 Internal Server Error", http.StatusInternalServerError))
+	client.AppendResponse(mocks.NewResponse())
+
+	start := time.Now()
+	r, err := SendWithSender(client, mocks.NewRequest(),
+		DoRetryForStatusCodesWithRetryAfter(1, time.Second, http.StatusInternalServerError))
+	if err != nil || r.StatusCode != http.StatusOK {
+		t.Fatalf("autorest: DoRetryForStatusCodesWithRetryAfter returned (%v, %v), expected 200 OK", r.Status, err)
+	}
+	if time.Since(start) < time.Second || client.Attempts() != 2 {
+		t.Fatalf("autorest: DoRetryForStatusCodesWithRetryAfter did not back off (attempts %d)", client.Attempts())
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	cases := map[string]bool{
+		"":                              false,
+		"0":                             false,
+		"-1":                            false,
+		"soon":                          false,
+		"5":                             true,
+		"Fri, 26 Jun 2015 23:39:12 GMT": false,
+		time.Now().Add(time.Hour).UTC().Format(http.TimeFormat): true,
+	}
+	for v, positive := range cases {
+		resp := mocks.NewResponse()
+		mocks.SetResponseHeader(resp, "Retry-After", v)
+		if d := parseRetryAfter(resp); (d > 0) != positive {
+			t.Fatalf("autorest: parseRetryAfter returned %v for %q", d, v)
+		}
+	}
+}
+
+func TestDoRetryForStatusCodesInvokesThrottlingCallback(t *testing.T) {
+	client := mocks.NewSender()
+	resp := mocks.NewResponseWithStatus("503 Service Unavailable", http.StatusServiceUnavailable)
+	mocks.SetResponseHeader(resp, "Retry-After", "1")
+	mocks.SetResponseHeader(resp, "x-ms-ratelimit-remaining-subscription-reads", "0")
+	mocks.SetResponseHeader(resp, "x-ms-request-id", "id")
+	client.AppendResponse(resp)
+	client.AppendResponse(mocks.NewResponseWithStatus("200 OK", http.StatusOK))
+
+	var events []ThrottlingEvent
+	ctx := WithThrottlingCallback(context.Background(), func(e ThrottlingEvent) {
+		events = append(events, e)
+	})
+	start := time.Now()
+	r, err := SendWithSender(client, mocks.NewRequest().WithContext(ctx),
+		DoRetryForStatusCodes(1, 0, http.StatusServiceUnavailable))
+	if err != nil || r.StatusCode != http.StatusOK {
+		t.Fatalf("autorest: DoRetryForStatusCodes returned (%v, %v), expected 200 OK", r.Status, err)
+	}
+	if time.Since(start) < time.Second {
+		t.Fatal("autorest: DoRetryForStatusCodes did not honor the Retry-After header of a 503 response")
+	}
+	if len(events) != 1 {
+		t.Fatalf("autorest: ThrottlingCallback invoked %d times, expected once", len(events))
+	}
+	e := events[0]
+	if e.Host != "microsoft.com" || e.StatusCode != http.StatusServiceUnavailable || e.Delay != time.Second {
+		t.Fatalf("autorest: ThrottlingCallback received unexpected event %+v", e)
+	}
+	if e.RateLimitHeaders.Get("x-ms-ratelimit-remaining-subscription-reads") != "0" || e.RateLimitHeaders.Get("x-ms-request-id") != "" {
+		t.Fatalf("autorest: ThrottlingCallback received unexpected rate limit headers %v", e.RateLimitHeaders)
+	}
+}
+
+func TestDoRetryForStatusCodesWithoutRetryAfterIsNotThrottled(t *testing.T) {
+	client := mocks.NewSender()
+	client.AppendResponse(mocks.NewResponseWithStatus("503 Service Unavailable", http.StatusServiceUnavailable))
+	client.AppendResponse(mocks.NewResponseWithStatus("200 OK", http.StatusOK))
+
+	invoked := false
+	ctx := WithThrottlingCallback(context.Background(), func(e ThrottlingEvent) {
+		invoked = true
+	})
+	SendWithSender(client, mocks.NewRequest().WithContext(ctx),
+		DoRetryForStatusCodes(1, 0, http.StatusServiceUnavailable))
+	if invoked {
+		t.Fatal("autorest: ThrottlingCallback invoked for a response without a Retry-After header")
+	}
+}
+
 type temporaryError struct {
 	message string
 }
@@ -929,3 +1270,417 @@ func TestDoRetryForStatusCodes_Cancel429(t *testing.T) {
 		t.Fatalf("too many attempts: %d", client.Attempts())
 	}
 }
+
+type spanKey struct{}
+
+type testSpan struct {
+	name   string
+	parent *testSpan
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) {
+	s.attrs[key] = value
+}
+
+func (s *testSpan) End(err error) {
+	s.err = err
+	s.ended = true
+}
+
+type testTracer struct {
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(*testSpan)
+	span := &testSpan{name: name, parent: parent, attrs: map[string]interface{}{}}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (t *testTracer) Inject(ctx context.Context, header http.Header) {
+	if span, ok := ctx.Value(spanKey{}).(*testSpan); ok {
+		header.Set("traceparent", span.name)
+	}
+}
+
+func TestWithEndpointFailover(t *testing.T) {
+	var hosts []string
+	s := SenderFunc(func(r *http.Request) (*http.Response, error) {
+		hosts = append(hosts, r.URL.Host)
+		if r.URL.Host == "westus.management.azure.com" {
+			resp := mocks.NewResponseWithStatus("404 Not Found", http.StatusNotFound)
+			resp.Request = r
+			return resp, nil
+		}
+		return nil, fmt.Errorf("connection refused")
+	})
+
+	r := mocks.NewRequestForURL("https://management.azure.com/subscriptions?api-version=2018-01-01")
+	resp, err := SendWithSender(s, r,
+		WithEndpointFailover("https://eastus.management.azure.com", "https://westus.management.azure.com", "https://northeurope.management.azure.com"))
+	if err != nil {
+		t.Fatalf("autorest: WithEndpointFailover returned an error (%v)", err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("autorest: WithEndpointFailover returned StatusCode %v, expected %v", resp.StatusCode, http.StatusNotFound)
+	}
+	expected := []string{"eastus.management.azure.com", "westus.management.azure.com"}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Fatalf("autorest: WithEndpointFailover sent requests to %v, expected %v", hosts, expected)
+	}
+	if resp.Request.URL.Path != "/subscriptions" || resp.Request.URL.RawQuery != "api-version=2018-01-01" {
+		t.Fatalf("autorest: WithEndpointFailover modified the request path (%s)", resp.Request.URL)
+	}
+}
+
+func TestWithEndpointFailoverAggregatesErrors(t *testing.T) {
+	client := mocks.NewSender()
+	client.SetAndRepeatError(fmt.Errorf("connection refused"), -1)
+
+	_, err := SendWithSender(client, mocks.NewRequest(),
+		WithEndpointFailover("https://eastus.management.azure.com", "https://westus.management.azure.com"))
+	if err == nil {
+		t.Fatal("autorest: WithEndpointFailover failed to return an error when all endpoints failed")
+	}
+	if !strings.Contains(err.Error(), "eastus.management.azure.com") || !strings.Contains(err.Error(), "westus.management.azure.com") {
+		t.Fatalf("autorest: WithEndpointFailover returned an error that omits endpoint failures (%v)", err)
+	}
+	if client.Attempts() != 2 {
+		t.Fatalf("autorest: WithEndpointFailover sent %v requests, expected 2", client.Attempts())
+	}
+}
+
+func TestWithHedgingUsesFasterResponse(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	slowCanceled := make(chan struct{})
+	s := SenderFunc(func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		calls++
+		call := calls
+		mu.Unlock()
+		if call == 1 {
+			// the first request is slow and is expected to be canceled
+			<-r.Context().Done()
+			close(slowCanceled)
+			return nil, r.Context().Err()
+		}
+		return mocks.NewResponseWithStatus("200 OK", http.StatusOK), nil
+	})
+
+	r, _ := http.NewRequest(http.MethodGet, "https://microsoft.com/a/b/c/", nil)
+	resp, err := SendWithSender(s, r, WithHedging(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("autorest: WithHedging returned an error (%v)", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("autorest: WithHedging returned StatusCode %v, expected %v", resp.StatusCode, http.StatusOK)
+	}
+	Respond(resp, ByDiscardingBody(), ByClosing())
+	select {
+	case <-slowCanceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("autorest: WithHedging failed to cancel the slower request")
+	}
+}
+
+func TestWithHedgingHedgesNoBody(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	s := SenderFunc(func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		calls++
+		call := calls
+		mu.Unlock()
+		if call == 1 {
+			select {
+			case <-r.Context().Done():
+				return nil, r.Context().Err()
+			case <-time.After(5 * time.Second):
+				return nil, fmt.Errorf("request was not hedged")
+			}
+		}
+		return mocks.NewResponseWithStatus("200 OK", http.StatusOK), nil
+	})
+
+	r, _ := http.NewRequest(http.MethodGet, "https://microsoft.com/a/b/c/", nil)
+	r.Body = http.NoBody
+	resp, err := SendWithSender(s, r, WithHedging(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("autorest: WithHedging failed to hedge a request with http.NoBody (%v)", err)
+	}
+	Respond(resp, ByDiscardingBody(), ByClosing())
+}
+
+func TestWithHedgingDoesNotHedgeFastResponses(t *testing.T) {
+	client := mocks.NewSender()
+	r, _ := http.NewRequest(http.MethodGet, "https://microsoft.com/a/b/c/", nil)
+	resp, err := SendWithSender(client, r, WithHedging(time.Second))
+	if err != nil {
+		t.Fatalf("autorest: WithHedging returned an error (%v)", err)
+	}
+	Respond(resp, ByDiscardingBody(), ByClosing())
+	if client.Attempts() != 1 {
+		t.Fatalf("autorest: WithHedging sent %v requests, expected 1", client.Attempts())
+	}
+}
+
+func TestWithHedgingIgnoresNonIdempotentMethods(t *testing.T) {
+	client := mocks.NewSender()
+	client.AppendResponseWithDelay(mocks.NewResponse(), 20*time.Millisecond)
+	r, _ := http.NewRequest(http.MethodPost, "https://microsoft.com/a/b/c/", nil)
+	resp, err := SendWithSender(client, r, WithHedging(time.Millisecond))
+	if err != nil {
+		t.Fatalf("autorest: WithHedging returned an error (%v)", err)
+	}
+	Respond(resp, ByDiscardingBody(), ByClosing())
+	if client.Attempts() != 1 {
+		t.Fatalf("autorest: WithHedging hedged a %s request", http.MethodPost)
+	}
+}
+
+func TestWithTracing(t *testing.T) {
+	client := mocks.NewSender()
+	resp := mocks.NewResponseWithStatus("200 OK", http.StatusOK)
+	mocks.SetResponseHeader(resp, headerRequestID, "request-id")
+	client.AppendResponse(resp)
+
+	tracer := &testTracer{}
+	r, err := SendWithSender(client, mocks.NewRequest(), WithTracing(tracer))
+	if err != nil {
+		t.Fatalf("autorest: WithTracing returned an unexpected error (%v)", err)
+	}
+	if len(tracer.spans) != 1 {
+		t.Fatalf("autorest: WithTracing started %d spans, expected 1", len(tracer.spans))
+	}
+	span := tracer.spans[0]
+	if !span.ended {
+		t.Fatal("autorest: WithTracing failed to end the span")
+	}
+	if span.attrs["http.method"] != "GET" || span.attrs["http.status_code"] != http.StatusOK {
+		t.Fatalf("autorest: WithTracing recorded unexpected attributes (%v)", span.attrs)
+	}
+	if span.attrs[headerRequestID] != "request-id" {
+		t.Fatalf("autorest: WithTracing failed to record the request ID (%v)", span.attrs)
+	}
+	if r.Request.Header.Get("traceparent") != span.name {
+		t.Fatal("autorest: WithTracing failed to propagate the trace context")
+	}
+}
+
+func TestWithTracingRecordsRetriesAsChildSpans(t *testing.T) {
+	client := mocks.NewSender()
+	client.SetAndRepeatError(fmt.Errorf("Faux Error"), 2)
+
+	tracer := &testTracer{}
+	ctx, root := tracer.Start(context.Background(), "operation")
+	req := mocks.NewRequest().WithContext(ctx)
+	_, err := SendWithSender(client, req,
+		WithTracing(tracer),
+		DoRetryForAttempts(3, time.Duration(0)))
+	if err != nil {
+		t.Fatalf("autorest: WithTracing returned an unexpected error (%v)", err)
+	}
+	if len(tracer.spans) != 4 {
+		t.Fatalf("autorest: WithTracing started %d spans, expected 4", len(tracer.spans))
+	}
+	for i, span := range tracer.spans[1:] {
+		if span.parent != root {
+			t.Fatalf("autorest: WithTracing span %d is not a child of the operation span", i)
+		}
+		if (span.err != nil) != (i < 2) {
+			t.Fatalf("autorest: WithTracing span %d recorded an unexpected error (%v)", i, span.err)
+		}
+	}
+}
+
+func TestWaitForEndpoint(t *testing.T) {
+	client := mocks.NewSender()
+	client.SetAndRepeatError(fmt.Errorf("no such host"), 2)
+	client.AppendResponse(mocks.NewResponseWithStatus("404 Not Found", http.StatusNotFound))
+
+	err := WaitForEndpoint(context.Background(), client, "https://example.com/", time.Millisecond)
+	if err != nil {
+		t.Fatalf("autorest: WaitForEndpoint returned an error (%v)", err)
+	}
+	if client.Attempts() != 3 {
+		t.Fatalf("autorest: WaitForEndpoint made %d attempts, expected 3", client.Attempts())
+	}
+}
+
+func TestWaitForEndpointStopsAtDeadline(t *testing.T) {
+	client := mocks.NewSender()
+	client.SetAndRepeatError(fmt.Errorf("no such host"), -1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := WaitForEndpoint(ctx, client, "https://example.com/", time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "no such host") {
+		t.Fatalf("autorest: WaitForEndpoint returned %v, expected the last failure", err)
+	}
+}
+
+// withoutProxy ignores any proxy configured in the environment of the test.
+func withoutProxy(t *http.Transport) {
+	t.Proxy = nil
+}
+
+func TestNewSenderWithHostOverrides(t *testing.T) {
+	var host string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+
+	s := NewSender(withoutProxy, WithHostOverrides(map[string]string{"Private.Endpoint.Test": "127.0.0.1"}))
+	r, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://private.endpoint.test:%s/", port), nil)
+	resp, err := s.Do(r)
+	if err != nil {
+		t.Fatalf("autorest: NewSender failed to dial the overridden host (%v)", err)
+	}
+	resp.Body.Close()
+	if expected := "private.endpoint.test:" + port; host != expected {
+		t.Fatalf("autorest: NewSender sent Host %q, expected %q", host, expected)
+	}
+}
+
+func TestNewSenderWithHostOverridesPort(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	s := NewSender(withoutProxy, WithHostOverrides(map[string]string{"private.endpoint.test": u.Host}))
+	r, _ := http.NewRequest(http.MethodGet, "http://private.endpoint.test/", nil)
+	resp, err := s.Do(r)
+	if err != nil {
+		t.Fatalf("autorest: NewSender failed to dial the overridden address (%v)", err)
+	}
+	resp.Body.Close()
+}
+
+func TestJitteredBackoffIsCapped(t *testing.T) {
+	initial, max := 100*time.Millisecond, time.Second
+	a := jitteredBackoff(rand.NewSource(42), max)
+	b := jitteredBackoff(rand.NewSource(42), max)
+	for attempt := 0; attempt < 10; attempt++ {
+		ceiling := initial << uint(attempt)
+		if ceiling > max {
+			ceiling = max
+		}
+		d := a(initial, attempt)
+		if d < 0 || d > ceiling {
+			t.Fatalf("autorest: jitteredBackoff returned %v for attempt %d, expected a delay within [0, %v]", d, attempt, ceiling)
+		}
+		if other := b(initial, attempt); other != d {
+			t.Fatalf("autorest: jitteredBackoff returned %v and %v for attempt %d with the same seed", d, other, attempt)
+		}
+	}
+}
+
+// countingSource is a rand.Source counting the values drawn from it.
+type countingSource struct {
+	rand.Source
+	draws int
+}
+
+func (s *countingSource) Int63() int64 {
+	s.draws++
+	return s.Source.Int63()
+}
+
+func TestDoExponentialBackoffRetryWithSource(t *testing.T) {
+	client := mocks.NewSender()
+	client.AppendAndRepeatResponse(mocks.NewResponseWithStatus("500 Internal Server Error", http.StatusInternalServerError), 2)
+	client.AppendResponse(mocks.NewResponse())
+	src := &countingSource{Source: rand.NewSource(42)}
+
+	resp, err := SendWithSender(client, mocks.NewRequest(),
+		DoExponentialBackoffRetryWithSource(5, time.Millisecond, 5*time.Millisecond, src, http.StatusInternalServerError))
+	if err != nil || resp.StatusCode != http.StatusOK || client.Attempts() != 3 {
+		t.Fatalf("autorest: DoExponentialBackoffRetryWithSource returned (%v, %v) in %d attempts, expected 200 OK in 3 attempts", resp.Status, err, client.Attempts())
+	}
+	if src.draws < 2 {
+		t.Fatalf("autorest: DoExponentialBackoffRetryWithSource drew %d values from the source, expected one per retry", src.draws)
+	}
+}
+
+func TestDoExponentialBackoffRetryResendsBody(t *testing.T) {
+	var bodies []string
+	s := SenderFunc(func(r *http.Request) (*http.Response, error) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if len(bodies) < 3 {
+			return mocks.NewResponseWithStatus("500 Internal Server Error", http.StatusInternalServerError), nil
+		}
+		return mocks.NewResponse(), nil
+	})
+	r := mocks.NewRequestWithParams(http.MethodPost, "https://microsoft.com/a", strings.NewReader("payload"))
+	resp, err := SendWithSender(s, r, DoExponentialBackoffRetry(3, time.Millisecond, 5*time.Millisecond, http.StatusInternalServerError))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("autorest: DoExponentialBackoffRetry returned (%v, %v), expected 200 OK", resp.Status, err)
+	}
+	if expected := "payload,payload,payload"; strings.Join(bodies, ",") != expected {
+		t.Fatalf("autorest: DoExponentialBackoffRetry sent bodies %v, expected %s", bodies, expected)
+	}
+}
+
+func TestDoExponentialBackoffRetryStopsAfterAttempts(t *testing.T) {
+	client := mocks.NewSender()
+	client.AppendAndRepeatResponse(mocks.NewResponseWithStatus("500 Internal Server Error", http.StatusInternalServerError), 5)
+	resp, _ := SendWithSender(client, mocks.NewRequest(), DoExponentialBackoffRetry(2, time.Millisecond, time.Millisecond, http.StatusInternalServerError))
+	if resp.StatusCode != http.StatusInternalServerError || client.Attempts() != 3 {
+		t.Fatalf("autorest: DoExponentialBackoffRetry made %d attempts, expected 3", client.Attempts())
+	}
+}
+
+func TestWithRequestTimings(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	var timings []RequestTimings
+	s := DecorateSender(ts.Client(), WithRequestTimings(func(r *http.Request, rt RequestTimings) {
+		timings = append(timings, rt)
+	}))
+	for i := 0; i < 2; i++ {
+		r, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		resp, err := s.Do(r)
+		if err != nil {
+			t.Fatalf("autorest: WithRequestTimings returned an unexpected error (%v)", err)
+		}
+		Respond(resp, ByDiscardingBody(), ByClosing())
+	}
+
+	if len(timings) != 2 {
+		t.Fatalf("autorest: WithRequestTimings invoked the callback %d times, expected 2", len(timings))
+	}
+	first, second := timings[0], timings[1]
+	if first.Connect <= 0 || first.TLSHandshake <= 0 || first.ConnReused {
+		t.Fatalf("autorest: WithRequestTimings did not measure establishing the connection (%+v)", first)
+	}
+	if first.TimeToFirstByte < 10*time.Millisecond || first.Total < first.TimeToFirstByte {
+		t.Fatalf("autorest: WithRequestTimings mismeasured the time to first byte (%+v)", first)
+	}
+	if !second.ConnReused || second.Connect != 0 || second.TLSHandshake != 0 {
+		t.Fatalf("autorest: WithRequestTimings measured a reused connection as new (%+v)", second)
+	}
+}
+
+func TestWithRequestTimingsReportsFailures(t *testing.T) {
+	invoked := false
+	client := mocks.NewSender()
+	client.SetError(fmt.Errorf("Faux Error"))
+	_, err := SendWithSender(client, mocks.NewRequest(), WithRequestTimings(func(r *http.Request, rt RequestTimings) {
+		invoked = true
+	}))
+	if err == nil || !invoked {
+		t.Fatalf("autorest: WithRequestTimings did not report a failed request (%v)", err)
+	}
+}
@@ -16,6 +16,7 @@ package autorest
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
@@ -25,6 +26,7 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/noahhai/go-autorest/autorest/adal"
 )
@@ -110,6 +112,27 @@ func ensureValueStrings(mapOfInterface map[string]interface{}) map[string]string
 	return mapOfStrings
 }
 
+// ensureQueryValueStrings converts the passed query parameters to strings, expanding []string and
+// []interface{} values to one string per element.
+func ensureQueryValueStrings(mapOfInterface map[string]interface{}) map[string][]string {
+	mapOfStrings := make(map[string][]string)
+	for key, value := range mapOfInterface {
+		switch v := value.(type) {
+		case []string:
+			mapOfStrings[key] = append([]string(nil), v...)
+		case []interface{}:
+			values := make([]string, len(v))
+			for i := range v {
+				values[i] = ensureValueString(v[i])
+			}
+			mapOfStrings[key] = values
+		default:
+			mapOfStrings[key] = []string{ensureValueString(value)}
+		}
+	}
+	return mapOfStrings
+}
+
 func ensureValueString(value interface{}) string {
 	if value == nil {
 		return ""
@@ -226,3 +249,113 @@ func IsTemporaryNetworkError(err error) bool {
 	}
 	return false
 }
+
+// CompareAPIVersions compares two API versions of the form YYYY-MM-DD[-suffix] (e.g., "2018-06-01"
+// or "2018-06-01-preview"). It returns -1 if a is older than b, 1 if a is newer than b and 0 if
+// they are equal. A version with a suffix (e.g., a preview) is older than the version without a
+// suffix from the same date. Versions not in the expected format are compared as strings.
+func CompareAPIVersions(a, b string) int {
+	a = strings.ToLower(strings.TrimSpace(a))
+	b = strings.ToLower(strings.TrimSpace(b))
+	da, sa, errA := splitAPIVersion(a)
+	db, sb, errB := splitAPIVersion(b)
+	if errA != nil || errB != nil {
+		return strings.Compare(a, b)
+	}
+	switch {
+	case da.Before(db):
+		return -1
+	case da.After(db):
+		return 1
+	case sa == sb:
+		return 0
+	case sa == "":
+		return 1
+	case sb == "":
+		return -1
+	}
+	return strings.Compare(sa, sb)
+}
+
+// splitAPIVersion splits an API version into its date and optional suffix (e.g., "preview").
+func splitAPIVersion(v string) (time.Time, string, error) {
+	const layout = "2006-01-02"
+	if len(v) < len(layout) {
+		return time.Time{}, "", fmt.Errorf("autorest: invalid API version %q", v)
+	}
+	d, err := time.Parse(layout, v[:len(layout)])
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	suffix := v[len(layout):]
+	if suffix != "" && !strings.HasPrefix(suffix, "-") {
+		return time.Time{}, "", fmt.Errorf("autorest: invalid API version %q", v)
+	}
+	return d, strings.TrimPrefix(suffix, "-"), nil
+}
+
+// NewUUID returns a random (version 4) RFC 4122 UUID in its canonical string form, e.g.
+// "71fdb9f4-5e49-4c12-b266-de7b4fd999a6". It is suitable for values such as client request IDs
+// and idempotency keys. NewUUID panics if the system's secure random number generator fails.
+func NewUUID() string {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		panic(fmt.Sprintf("autorest: failed to generate UUID: %v", err))
+	}
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // variant RFC 4122
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// ValidateMetadataName returns an error if name is not a valid Azure Storage metadata name. Since
+// metadata is sent as x-ms-meta-<name> headers, and may be exposed as properties by the .NET client
+// libraries, names must be C# identifiers: ASCII letters, digits and underscores, not starting with
+// a digit.
+func ValidateMetadataName(name string) error {
+	if name == "" {
+		return fmt.Errorf("autorest: metadata name must not be empty")
+	}
+	for i, c := range name {
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9' {
+			continue
+		}
+		return fmt.Errorf("autorest: invalid metadata name %q; names must consist of letters, digits and underscores and not start with a digit", name)
+	}
+	return nil
+}
+
+// MetadataToHeaders returns the x-ms-meta-<name> headers for the passed metadata, skipping nil
+// values. Names are validated with ValidateMetadataName and, as Azure treats them as
+// case-insensitive, names differing only in case are rejected. Names are used exactly as supplied
+// (rather than canonicalized) since Azure preserves their case.
+func MetadataToHeaders(metadata map[string]*string) (http.Header, error) {
+	h := make(http.Header, len(metadata))
+	seen := make(map[string]string, len(metadata))
+	for name, value := range metadata {
+		if err := ValidateMetadataName(name); err != nil {
+			return nil, err
+		}
+		if other, ok := seen[strings.ToLower(name)]; ok {
+			return nil, fmt.Errorf("autorest: metadata names %q and %q differ only in case", other, name)
+		}
+		seen[strings.ToLower(name)] = name
+		if value != nil {
+			h[headerMetadataPrefix+name] = []string{*value}
+		}
+	}
+	return h, nil
+}
+
+// MetadataFromHeaders returns the metadata carried by the x-ms-meta-<name> headers in h, keyed by
+// name in lower case (see ByExtractingMetadata).
+func MetadataFromHeaders(h http.Header) map[string]*string {
+	metadata := make(map[string]*string)
+	for k, v := range h {
+		name := strings.ToLower(k)
+		if strings.HasPrefix(name, headerMetadataPrefix) && len(name) > len(headerMetadataPrefix) && len(v) > 0 {
+			value := v[0]
+			metadata[strings.TrimPrefix(name, headerMetadataPrefix)] = &value
+		}
+	}
+	return metadata
+}
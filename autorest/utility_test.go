@@ -23,6 +23,7 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"regexp"
 	"sort"
 	"strings"
 	"testing"
@@ -366,6 +367,44 @@ func TestIsTemporaryNetworkErrorFalse(t *testing.T) {
 	}
 }
 
+func TestCompareAPIVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"2018-06-01", "2018-06-01", 0},
+		{"2017-03-30", "2018-06-01", -1},
+		{"2018-06-01", "2017-03-30", 1},
+		{"2018-06-01-preview", "2018-06-01", -1},
+		{"2018-06-01", "2018-06-01-preview", 1},
+		{"2018-06-01-preview", "2018-05-01", 1},
+		{"2018-06-01-Preview", " 2018-06-01-preview ", 0},
+		{"2018-06-01-beta", "2018-06-01-preview", -1},
+	}
+	for _, test := range tests {
+		if got := CompareAPIVersions(test.a, test.b); got != test.expected {
+			t.Fatalf("autorest: CompareAPIVersions(%q, %q) returned %d, expected %d", test.a, test.b, got, test.expected)
+		}
+	}
+}
+
+func TestCompareAPIVersionsSortsPreviewBeforeGA(t *testing.T) {
+	versions := []string{"2018-06-01", "2018-06-01-preview", "2017-03-30", "2019-01-01-preview"}
+	sort.Slice(versions, func(i, j int) bool {
+		return CompareAPIVersions(versions[i], versions[j]) < 0
+	})
+	expected := []string{"2017-03-30", "2018-06-01-preview", "2018-06-01", "2019-01-01-preview"}
+	if !reflect.DeepEqual(versions, expected) {
+		t.Fatalf("autorest: CompareAPIVersions sorted versions incorrectly -- expected %v, received %v", expected, versions)
+	}
+}
+
+func TestCompareAPIVersionsInvalidFormat(t *testing.T) {
+	if CompareAPIVersions("v1", "v2") != -1 || CompareAPIVersions("2018-06-01x", "2018-06-01x") != 0 {
+		t.Fatal("autorest: CompareAPIVersions failed to fall back to string comparison")
+	}
+}
+
 func isEqual(v, u url.Values) bool {
 	for key, value := range v {
 		if len(u[key]) == 0 {
@@ -460,3 +499,58 @@ func withErrorRespondDecorator(e *error) RespondDecorator {
 		})
 	}
 }
+
+func TestNewUUID(t *testing.T) {
+	re := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		u := NewUUID()
+		if !re.MatchString(u) {
+			t.Fatalf("autorest: NewUUID returned %q, which is not a version 4 UUID", u)
+		}
+		if seen[u] {
+			t.Fatalf("autorest: NewUUID returned duplicate UUID %q", u)
+		}
+		seen[u] = true
+	}
+}
+
+func TestValidateMetadataName(t *testing.T) {
+	for _, name := range []string{"category", "Owner_1", "_private"} {
+		if err := ValidateMetadataName(name); err != nil {
+			t.Fatalf("autorest: ValidateMetadataName rejected %q (%v)", name, err)
+		}
+	}
+	for _, name := range []string{"", "1st", "has-dash", "has space", "naïve"} {
+		if err := ValidateMetadataName(name); err == nil {
+			t.Fatalf("autorest: ValidateMetadataName accepted %q", name)
+		}
+	}
+}
+
+func TestMetadataToHeadersAndBack(t *testing.T) {
+	images, me := "images", "me"
+	h, err := MetadataToHeaders(map[string]*string{"Category": &images, "owner": &me, "skipped": nil})
+	if err != nil {
+		t.Fatalf("autorest: MetadataToHeaders returned an error (%v)", err)
+	}
+	expected := http.Header{"x-ms-meta-Category": {"images"}, "x-ms-meta-owner": {"me"}}
+	if !reflect.DeepEqual(h, expected) {
+		t.Fatalf("autorest: MetadataToHeaders returned %v, expected %v", h, expected)
+	}
+
+	m := MetadataFromHeaders(h)
+	if len(m) != 2 || *m["category"] != "images" || *m["owner"] != "me" {
+		t.Fatalf("autorest: MetadataFromHeaders returned %v", m)
+	}
+}
+
+func TestMetadataToHeadersRejectsInvalidNames(t *testing.T) {
+	v := "value"
+	if _, err := MetadataToHeaders(map[string]*string{"bad-name": &v}); err == nil {
+		t.Fatal("autorest: MetadataToHeaders accepted an invalid name")
+	}
+	if _, err := MetadataToHeaders(map[string]*string{"Name": &v, "name": &v}); err == nil {
+		t.Fatal("autorest: MetadataToHeaders accepted names differing only in case")
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -97,6 +98,46 @@ func Validate(m []Validation) error {
 	return nil
 }
 
+// SliceError is returned by ValidateSlice when one or more elements fail validation.
+type SliceError struct {
+	// Errors holds the validation error of each failed element, keyed by its index.
+	Errors map[int]error
+}
+
+// Error returns the validation errors of the failed elements, in index order.
+func (e SliceError) Error() string {
+	indices := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	msgs := make([]string, 0, len(indices))
+	for _, i := range indices {
+		msgs = append(msgs, fmt.Sprintf("element %d: %v", i, e.Errors[i]))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ValidateSlice validates the constraints on each element of the passed slice or array. Unlike
+// Validate, it does not stop at the first failed element; if any element fails, a SliceError
+// holding the first error of every failed element is returned.
+func ValidateSlice(slice interface{}, constraints []Constraint) error {
+	x := reflect.ValueOf(slice)
+	if x.Kind() != reflect.Slice && x.Kind() != reflect.Array {
+		return fmt.Errorf("autorest/validation: ValidateSlice expects a slice or array, got %T", slice)
+	}
+	errs := map[int]error{}
+	for i := 0; i < x.Len(); i++ {
+		if err := Validate([]Validation{{TargetValue: getInterfaceValue(x.Index(i)), Constraints: constraints}}); err != nil {
+			errs[i] = err
+		}
+	}
+	if len(errs) > 0 {
+		return SliceError{Errors: errs}
+	}
+	return nil
+}
+
 func validateStruct(x reflect.Value, v Constraint, name ...string) error {
 	//Get field name from target name which is in format a.b.c
 	s := strings.Split(v.Target, ".")
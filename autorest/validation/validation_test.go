@@ -2417,6 +2417,29 @@ func TestValidate_StructInStruct(t *testing.T) {
 	require.Nil(t, Validate(v))
 }
 
+func TestValidateSlice(t *testing.T) {
+	products := []Product{{Name: "a"}, {}, {Name: "c"}, {}}
+	c := []Constraint{{"Name", Empty, true, nil}}
+
+	err := ValidateSlice(products, c)
+	require.IsType(t, SliceError{}, err)
+	errs := err.(SliceError).Errors
+	require.Equal(t, 2, len(errs))
+	required := createError(reflect.ValueOf(""), c[0], "value can not be null or empty; required parameter").Error()
+	require.Equal(t, required, errs[1].Error())
+	require.Equal(t, required, errs[3].Error())
+	require.Equal(t, fmt.Sprintf("element 1: %s; element 3: %s", required, required), err.Error())
+
+	require.Nil(t, ValidateSlice(products[:1], c))
+	require.Nil(t, ValidateSlice([]Product{}, c))
+}
+
+func TestValidateSliceRequiresSlice(t *testing.T) {
+	err := ValidateSlice(Product{}, []Constraint{{"Name", Empty, true, nil}})
+	require.NotNil(t, err)
+	require.True(t, strings.Contains(err.Error(), "expects a slice or array"))
+}
+
 func TestNewError(t *testing.T) {
 	p := &Product{}
 	v := []Validation{